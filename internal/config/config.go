@@ -12,7 +12,7 @@ type Config struct {
 	ServerAddr                  string
 	CostPerUnit                 float64
 	FreeSignupPoints            float64
-	FreeSignupExpiryDays        int // 免费积分过期天数，默认30天（每月刷新）
+	FreeSignupExpiryDays        int // 注册赠送免费积分的过期天数，默认30天；周期性刷新见 FreeRefreshConfigs
 	StripeSecretKey             string
 	StripeWebhookSecret         string
 	StripePriceMonthly          string
@@ -24,6 +24,17 @@ type Config struct {
 	JWTSecretKey                string
 	JWTExpiryHours              int
 	UsageAPIKey                 string
+	// 支付平台：stripe（默认）或 fake（本地模拟，不访问网络）
+	PaymentProvider    string
+	FakePaymentBaseURL string // fake 模式下结账页面使用的本服务地址
+	// 支付宝：配置 AlipayAppID 后与主支付平台并存，用于预充值
+	AlipayAppID          string
+	AlipayPrivateKey     string // 应用私钥（PEM，或去掉首尾行的 Base64）
+	AlipayPublicKey      string // 支付宝公钥，用于校验异步通知和接口响应
+	AlipayGateway        string
+	AlipayNotifyURL      string // 异步通知地址，指向 /api/webhooks/alipay
+	AlipayCheckoutMode   string // page（跳转电脑网站收银台）或 qr（当面付二维码）
+	AlipayTimeoutMinutes int    // 未支付订单的关闭时间
 	// Google OAuth 配置（支持多应用）
 	GoogleOAuthConfigs map[string]GoogleOAuthConfig
 	// 兼容旧配置
@@ -35,6 +46,29 @@ type Config struct {
 	ResendFromEmail               string                       // 兼容旧配置（单应用）
 	ResendEmailConfigs            map[string]ResendEmailConfig // 多应用配置
 	VerificationCodeExpiryMinutes int
+	// 用量扣费策略（按 system_code 区分）
+	UsagePolicies map[string]UsagePolicy
+	// 推荐奖励配置（按 system_code 区分）
+	ReferralConfigs map[string]ReferralConfig
+	// 多应用退款策略配置 (JSON 格式，key 为 system_code，"default" 为默认)
+	RefundPolicies map[string]RefundPolicy
+	// 多应用订阅换档策略配置 (JSON 格式，key 为 system_code，"default" 为默认)
+	PlanChangePolicies map[string]PlanChangePolicy
+	// 订阅积分结转策略（JSON 格式，key 为计划名称）
+	RolloverPolicies map[string]RolloverPolicy
+	// 免费积分周期刷新配置（按 system_code 区分）
+	FreeRefreshConfigs map[string]FreeRefreshConfig
+	// 余额提醒邮件配置（按 system_code 区分）
+	NotificationConfigs map[string]NotificationConfig
+	// 预充值自定义金额配置（按 system_code 区分）
+	PrepaidCustomAmounts map[string]PrepaidCustomAmountConfig
+	// 自动充值：单次充值最多扣款次数，以及连续被拒付多少次后自动关闭
+	AutoTopUpMaxAttempts int
+	AutoTopUpMaxDeclines int
+	// 后台定时任务配置，多实例部署时通过 advisory lock 选出一个实例执行
+	SchedulerEnabled             bool
+	SchedulerLockKey             int64
+	SubscriptionExpiryGraceHours int // 订阅超过 ends_at 多久后标记为过期，等待续费 Webhook
 }
 
 type GoogleOAuthConfig struct {
@@ -44,10 +78,181 @@ type GoogleOAuthConfig struct {
 	FrontendCallbackURL string `json:"frontend_callback_url"` // 前端回调地址，OAuth 成功后重定向到此地址
 }
 
+// 支付平台
+const (
+	PaymentProviderStripe = "stripe"
+	PaymentProviderFake   = "fake"
+	PaymentProviderAlipay = "alipay"
+)
+
 type ResendEmailConfig struct {
 	FromEmail string `json:"from_email"`
 }
 
+// UsagePolicy 用量扣费策略
+// 字段未配置（null）时使用默认值；配置为空数组表示不允许任何积分桶
+type UsagePolicy struct {
+	DrawOrder           []string `json:"draw_order"`           // 扣减顺序，未列出的桶类型排在最后
+	WithSubscription    []string `json:"with_subscription"`    // 有有效订阅时可扣减的桶类型，默认全部
+	WithoutSubscription []string `json:"without_subscription"` // 无有效订阅时可扣减的桶类型，默认不允许
+}
+
+// defaultDrawOrder 默认扣减顺序，结转积分先于本期订阅积分使用
+var defaultDrawOrder = []string{"rollover", "subscription", "prepaid", "free"}
+
+// SpendableBuckets 返回可扣减的桶类型（nil 表示不限制），以及是否允许扣费
+func (p UsagePolicy) SpendableBuckets(hasSubscription bool) ([]string, bool) {
+	allowed := p.WithoutSubscription
+	if hasSubscription {
+		allowed = p.WithSubscription
+	}
+	if allowed == nil {
+		return nil, hasSubscription
+	}
+	return allowed, len(allowed) > 0
+}
+
+// ReferralConfig 推荐奖励配置，被推荐人首次付款后双方各获得一次奖励
+type ReferralConfig struct {
+	ReferrerPoints    float64 `json:"referrer_points"`      // 推荐人奖励积分
+	RefereePoints     float64 `json:"referee_points"`       // 被推荐人奖励积分
+	ExpiryDays        int     `json:"expiry_days"`          // 奖励积分有效天数，0 表示永不过期
+	MaxPerIP          int     `json:"max_per_ip"`           // 同一 IP 24 小时内最多可记录的推荐数，0 表示不限制
+	MaxPerEmailDomain int     `json:"max_per_email_domain"` // 同一推荐人下同一邮箱域名最多可被推荐的用户数，0 表示不限制
+}
+
+// 退款时积分已被消耗的处理方式
+const (
+	RefundSpentForgive = "forgive" // 只收回剩余积分，已消耗部分不再追缴
+	RefundSpentDebt    = "debt"    // 已消耗部分记为欠款，由后续发放的积分偿还
+)
+
+// RefundPolicy 退款与拒付时收回积分的策略
+type RefundPolicy struct {
+	SpentPoints string `json:"spent_points"` // forgive | debt，默认 forgive
+}
+
+// 订阅换档时积分的处理方式
+const (
+	PlanChangePointsImmediate   = "immediate"    // 升档时立即补发新旧计划的积分差额
+	PlanChangePointsNextRenewal = "next_renewal" // 下次续费时按新计划发放
+)
+
+// PlanChangePolicy 订阅换档策略
+type PlanChangePolicy struct {
+	Points string `json:"points"` // immediate | next_renewal，默认 next_renewal
+}
+
+// 订阅积分结转方式
+const (
+	RolloverNone       = "none"        // 不结转，未用完的积分随周期过期
+	RolloverFull       = "full"        // 全部结转
+	RolloverCapPoints  = "cap_points"  // 最多结转 Value 积分
+	RolloverCapPercent = "cap_percent" // 最多结转本期发放积分的 Value%
+)
+
+// RolloverPolicy 订阅续费时未用完积分的结转策略，结转的积分进入 rollover 积分桶
+type RolloverPolicy struct {
+	Mode       string  `json:"mode"`         // none（默认）| full | cap_points | cap_percent
+	Value      float64 `json:"value"`        // cap_points 为积分上限，cap_percent 为百分比
+	MaxAgeDays int     `json:"max_age_days"` // 结转积分的有效天数，0 表示随新周期结束过期
+}
+
+// Amount 计算可结转的积分，remaining 为上个周期剩余积分，grantPoints 为计划每期发放积分
+func (p RolloverPolicy) Amount(remaining, grantPoints float64) float64 {
+	if remaining <= 0 {
+		return 0
+	}
+	switch p.Mode {
+	case RolloverFull:
+		return remaining
+	case RolloverCapPoints:
+		return min(remaining, max(p.Value, 0))
+	case RolloverCapPercent:
+		return min(remaining, grantPoints*max(p.Value, 0)/100)
+	default:
+		return 0
+	}
+}
+
+// 免费积分刷新周期
+const (
+	FreeRefreshCalendarMonth = "calendar_month" // 每个自然月（UTC）
+	FreeRefreshDays          = "days"           // 从注册时间起每 PeriodDays 天
+)
+
+// FreeRefreshConfig 免费积分周期刷新配置，每个周期为活跃用户发放一个新的 free 积分桶
+// 用户注册所在的周期已由注册赠送覆盖，不再重复发放
+type FreeRefreshConfig struct {
+	Points     float64 `json:"points"`      // 每个周期发放的积分，0 表示不刷新
+	Period     string  `json:"period"`      // calendar_month（默认）| days
+	PeriodDays int     `json:"period_days"` // period 为 days 时的周期天数
+	ExpiryDays int     `json:"expiry_days"` // 积分有效天数，0 表示到本周期结束
+	OnlyUnpaid bool    `json:"only_unpaid"` // 只发给没有有效订阅的用户
+}
+
+// PeriodAt 返回 now 所在周期的起止时间；配置无效或用户注册所在周期返回 false
+func (c FreeRefreshConfig) PeriodAt(createdAt, now time.Time) (time.Time, time.Time, bool) {
+	createdAt, now = createdAt.UTC(), now.UTC()
+	var start, end time.Time
+	switch c.Period {
+	case FreeRefreshDays:
+		if c.PeriodDays <= 0 {
+			return time.Time{}, time.Time{}, false
+		}
+		length := time.Duration(c.PeriodDays) * 24 * time.Hour
+		n := now.Sub(createdAt) / length
+		start = createdAt.Add(n * length)
+		end = start.Add(length)
+	case FreeRefreshCalendarMonth, "":
+		start = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		end = start.AddDate(0, 1, 0)
+	default:
+		return time.Time{}, time.Time{}, false
+	}
+	if !createdAt.Before(start) {
+		return time.Time{}, time.Time{}, false
+	}
+	return start, end, true
+}
+
+// ExpiresAt 返回本周期发放的积分的过期时间
+func (c FreeRefreshConfig) ExpiresAt(periodStart, periodEnd time.Time) time.Time {
+	if c.ExpiryDays > 0 {
+		return periodStart.AddDate(0, 0, c.ExpiryDays)
+	}
+	return periodEnd
+}
+
+// NotificationConfig 余额提醒邮件配置，用户可在通知设置中覆盖阈值
+type NotificationConfig struct {
+	LowBalancePoints float64                         `json:"low_balance_points"` // 扣费后余额低于该值时提醒，0 表示不提醒
+	ExpiringDays     int                             `json:"expiring_days"`      // 积分桶在该天数内过期时提醒，0 表示不提醒
+	Templates        map[string]NotificationTemplate `json:"templates"`          // key 为通知类型，未配置时使用内置模板
+}
+
+// PrepaidCustomAmountConfig 预充值自定义金额模式，未配置时允许任意金额，每 10 分兑换 1 积分
+type PrepaidCustomAmountConfig struct {
+	Disabled      bool    `json:"disabled"`        // 关闭后只能购买积分包
+	MinCents      int     `json:"min_cents"`       // 最低金额，0 表示不限制
+	MaxCents      int     `json:"max_cents"`       // 最高金额，0 表示不限制
+	PointsPerCent float64 `json:"points_per_cent"` // 每分兑换的积分，0 表示使用默认值 0.1
+}
+
+// defaultPrepaidPointsPerCent 预充值默认兑换比例：每 10 分 1 积分
+const defaultPrepaidPointsPerCent = 0.1
+
+// Points 按兑换比例计算金额对应的积分
+func (c PrepaidCustomAmountConfig) Points(amountCents int) float64 {
+	return float64(amountCents) * c.PointsPerCent
+}
+
+// NotificationTemplate 邮件模板，使用 html/template 语法
+type NotificationTemplate struct {
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+}
+
 func Load() Config {
 	googleConfigs := parseGoogleOAuthConfigs(env("GOOGLE_OAUTH_CONFIGS", ""))
 	legacyGoogle := GoogleOAuthConfig{
@@ -81,6 +286,15 @@ func Load() Config {
 		StripePriceMonthly:            env("STRIPE_PRICE_MONTHLY", ""),
 		StripePriceQuarterly:          env("STRIPE_PRICE_QUARTERLY", ""),
 		StripeCurrency:                env("STRIPE_CURRENCY", "usd"),
+		PaymentProvider:               env("PAYMENT_PROVIDER", PaymentProviderStripe),
+		FakePaymentBaseURL:            env("FAKE_PAYMENT_BASE_URL", "http://localhost:8080"),
+		AlipayAppID:                   env("ALIPAY_APP_ID", ""),
+		AlipayPrivateKey:              env("ALIPAY_PRIVATE_KEY", ""),
+		AlipayPublicKey:               env("ALIPAY_PUBLIC_KEY", ""),
+		AlipayGateway:                 env("ALIPAY_GATEWAY", "https://openapi.alipay.com/gateway.do"),
+		AlipayNotifyURL:               env("ALIPAY_NOTIFY_URL", ""),
+		AlipayCheckoutMode:            env("ALIPAY_CHECKOUT_MODE", "page"),
+		AlipayTimeoutMinutes:          envInt("ALIPAY_TIMEOUT_MINUTES", 30),
 		SubscriptionMonthlyPoints:     envFloat("SUBSCRIPTION_MONTHLY_POINTS", 200),
 		SubscriptionQuarterlyPoints:   envFloat("SUBSCRIPTION_QUARTERLY_POINTS", 600),
 		PrepaidExpiryDays:             envInt("PREPAID_EXPIRY_DAYS", 30),
@@ -95,6 +309,19 @@ func Load() Config {
 		ResendFromEmail:               legacyFromEmail,
 		ResendEmailConfigs:            resendEmailConfigs,
 		VerificationCodeExpiryMinutes: envInt("VERIFICATION_CODE_EXPIRY_MINUTES", 10),
+		UsagePolicies:                 parseUsagePolicies(env("USAGE_POLICY_CONFIGS", "")),
+		ReferralConfigs:               parseReferralConfigs(env("REFERRAL_CONFIGS", "")),
+		RefundPolicies:                parseRefundPolicies(env("REFUND_POLICIES", "")),
+		PlanChangePolicies:            parsePlanChangePolicies(env("PLAN_CHANGE_POLICIES", "")),
+		RolloverPolicies:              parseRolloverPolicies(env("PLAN_ROLLOVER_POLICIES", "")),
+		FreeRefreshConfigs:            parseFreeRefreshConfigs(env("FREE_REFRESH_CONFIGS", "")),
+		NotificationConfigs:           parseNotificationConfigs(env("NOTIFICATION_CONFIGS", "")),
+		PrepaidCustomAmounts:          parsePrepaidCustomAmounts(env("PREPAID_CUSTOM_AMOUNT_CONFIGS", "")),
+		AutoTopUpMaxAttempts:          envInt("AUTO_TOPUP_MAX_ATTEMPTS", 3),
+		AutoTopUpMaxDeclines:          envInt("AUTO_TOPUP_MAX_DECLINES", 3),
+		SchedulerEnabled:              envBool("SCHEDULER_ENABLED", true),
+		SchedulerLockKey:              int64(envInt("SCHEDULER_LOCK_KEY", 731001)),
+		SubscriptionExpiryGraceHours:  envInt("SUBSCRIPTION_EXPIRY_GRACE_HOURS", 24),
 	}
 }
 
@@ -123,6 +350,15 @@ func envFloat(key string, def float64) float64 {
 	return def
 }
 
+func envBool(key string, def bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if parsed, err := strconv.ParseBool(v); err == nil {
+			return parsed
+		}
+	}
+	return def
+}
+
 func parseGoogleOAuthConfigs(raw string) map[string]GoogleOAuthConfig {
 	if raw == "" {
 		return nil
@@ -145,6 +381,94 @@ func parseResendEmailConfigs(raw string) map[string]ResendEmailConfig {
 	return parsed
 }
 
+func parseUsagePolicies(raw string) map[string]UsagePolicy {
+	if raw == "" {
+		return nil
+	}
+	var parsed map[string]UsagePolicy
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		return nil
+	}
+	return parsed
+}
+
+func parseReferralConfigs(raw string) map[string]ReferralConfig {
+	if raw == "" {
+		return nil
+	}
+	var parsed map[string]ReferralConfig
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		return nil
+	}
+	return parsed
+}
+
+func parseRefundPolicies(raw string) map[string]RefundPolicy {
+	if raw == "" {
+		return nil
+	}
+	var parsed map[string]RefundPolicy
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		return nil
+	}
+	return parsed
+}
+
+func parsePlanChangePolicies(raw string) map[string]PlanChangePolicy {
+	if raw == "" {
+		return nil
+	}
+	var parsed map[string]PlanChangePolicy
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		return nil
+	}
+	return parsed
+}
+
+func parseRolloverPolicies(raw string) map[string]RolloverPolicy {
+	if raw == "" {
+		return nil
+	}
+	var parsed map[string]RolloverPolicy
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		return nil
+	}
+	return parsed
+}
+
+func parseFreeRefreshConfigs(raw string) map[string]FreeRefreshConfig {
+	if raw == "" {
+		return nil
+	}
+	var parsed map[string]FreeRefreshConfig
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		return nil
+	}
+	return parsed
+}
+
+func parseNotificationConfigs(raw string) map[string]NotificationConfig {
+	if raw == "" {
+		return nil
+	}
+	var parsed map[string]NotificationConfig
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		return nil
+	}
+	return parsed
+}
+
+func parsePrepaidCustomAmounts(raw string) map[string]PrepaidCustomAmountConfig {
+	if raw == "" {
+		return nil
+	}
+	var parsed map[string]PrepaidCustomAmountConfig
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		return nil
+	}
+	return parsed
+}
+
 func (c Config) PrepaidExpiry() time.Duration {
 	return time.Duration(c.PrepaidExpiryDays) * 24 * time.Hour
 }
@@ -153,6 +477,10 @@ func (c Config) FreeSignupExpiry() time.Duration {
 	return time.Duration(c.FreeSignupExpiryDays) * 24 * time.Hour
 }
 
+func (c Config) SubscriptionExpiryGrace() time.Duration {
+	return time.Duration(c.SubscriptionExpiryGraceHours) * time.Hour
+}
+
 func (c Config) VerificationCodeExpiry() time.Duration {
 	return time.Duration(c.VerificationCodeExpiryMinutes) * time.Minute
 }
@@ -180,3 +508,97 @@ func (c Config) ResendEmailFor(systemCode string) (ResendEmailConfig, bool) {
 	}
 	return ResendEmailConfig{}, false
 }
+
+// UsagePolicyFor 获取 system_code 对应的用量策略，未配置的字段使用默认值
+func (c Config) UsagePolicyFor(systemCode string) UsagePolicy {
+	policy, ok := c.UsagePolicies[systemCode]
+	if !ok || systemCode == "" {
+		policy = c.UsagePolicies["default"]
+	}
+	if len(policy.DrawOrder) == 0 {
+		policy.DrawOrder = defaultDrawOrder
+	}
+	return policy
+}
+
+// ReferralFor 获取 system_code 对应的推荐奖励配置，未配置时不发放奖励
+func (c Config) ReferralFor(systemCode string) (ReferralConfig, bool) {
+	if systemCode != "" {
+		if cfg, ok := c.ReferralConfigs[systemCode]; ok {
+			return cfg, true
+		}
+	}
+	if cfg, ok := c.ReferralConfigs["default"]; ok {
+		return cfg, true
+	}
+	return ReferralConfig{}, false
+}
+
+// RefundPolicyFor 获取 system_code 对应的退款策略，未配置时只收回剩余积分
+func (c Config) RefundPolicyFor(systemCode string) RefundPolicy {
+	policy, ok := c.RefundPolicies[systemCode]
+	if !ok || systemCode == "" {
+		policy = c.RefundPolicies["default"]
+	}
+	if policy.SpentPoints != RefundSpentDebt {
+		policy.SpentPoints = RefundSpentForgive
+	}
+	return policy
+}
+
+// PlanChangePolicyFor 获取 system_code 对应的换档策略，未配置时在下次续费生效
+func (c Config) PlanChangePolicyFor(systemCode string) PlanChangePolicy {
+	policy, ok := c.PlanChangePolicies[systemCode]
+	if !ok || systemCode == "" {
+		policy = c.PlanChangePolicies["default"]
+	}
+	if policy.Points != PlanChangePointsImmediate {
+		policy.Points = PlanChangePointsNextRenewal
+	}
+	return policy
+}
+
+// RolloverPolicyFor 获取计划对应的积分结转策略，未配置时不结转
+func (c Config) RolloverPolicyFor(planName string) RolloverPolicy {
+	policy, ok := c.RolloverPolicies[planName]
+	if !ok {
+		policy = c.RolloverPolicies["default"]
+	}
+	if policy.Mode == "" {
+		policy.Mode = RolloverNone
+	}
+	return policy
+}
+
+// FreeRefreshFor 获取 system_code 对应的免费积分刷新配置，未配置或积分为 0 时不刷新
+func (c Config) FreeRefreshFor(systemCode string) (FreeRefreshConfig, bool) {
+	cfg, ok := c.FreeRefreshConfigs[systemCode]
+	if !ok || systemCode == "" {
+		cfg, ok = c.FreeRefreshConfigs["default"]
+	}
+	if !ok || cfg.Points <= 0 {
+		return FreeRefreshConfig{}, false
+	}
+	return cfg, true
+}
+
+// NotificationFor 获取 system_code 对应的提醒配置，未配置时不提醒（用户可单独开启）
+func (c Config) NotificationFor(systemCode string) NotificationConfig {
+	cfg, ok := c.NotificationConfigs[systemCode]
+	if !ok || systemCode == "" {
+		cfg = c.NotificationConfigs["default"]
+	}
+	return cfg
+}
+
+// PrepaidCustomAmountFor 获取 system_code 对应的自定义金额配置，兑换比例未配置时使用默认值
+func (c Config) PrepaidCustomAmountFor(systemCode string) PrepaidCustomAmountConfig {
+	cfg, ok := c.PrepaidCustomAmounts[systemCode]
+	if !ok || systemCode == "" {
+		cfg = c.PrepaidCustomAmounts["default"]
+	}
+	if cfg.PointsPerCent <= 0 {
+		cfg.PointsPerCent = defaultPrepaidPointsPerCent
+	}
+	return cfg
+}
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUsagePolicyDefaults(t *testing.T) {
+	cfg := Config{}
+	policy := cfg.UsagePolicyFor("demo")
+	if len(policy.DrawOrder) != 4 || policy.DrawOrder[0] != "rollover" || policy.DrawOrder[1] != "subscription" {
+		t.Fatalf("unexpected default draw order: %v", policy.DrawOrder)
+	}
+	if allowed, ok := policy.SpendableBuckets(true); !ok || allowed != nil {
+		t.Fatalf("expected unrestricted usage with subscription, got %v %v", allowed, ok)
+	}
+	if _, ok := policy.SpendableBuckets(false); ok {
+		t.Fatalf("expected subscription to be required by default")
+	}
+}
+
+func TestUsagePolicyFallbackAndRestriction(t *testing.T) {
+	cfg := Config{UsagePolicies: parseUsagePolicies(`{
+		"default": {"without_subscription": ["prepaid", "free"]},
+		"appA": {"draw_order": ["prepaid", "subscription"], "without_subscription": []}
+	}`)}
+
+	policy := cfg.UsagePolicyFor("unknown")
+	allowed, ok := policy.SpendableBuckets(false)
+	if !ok || len(allowed) != 2 {
+		t.Fatalf("expected default policy to allow prepaid and free, got %v %v", allowed, ok)
+	}
+
+	policy = cfg.UsagePolicyFor("appA")
+	if policy.DrawOrder[0] != "prepaid" {
+		t.Fatalf("unexpected draw order: %v", policy.DrawOrder)
+	}
+	if _, ok := policy.SpendableBuckets(false); ok {
+		t.Fatalf("expected empty list to disallow usage without subscription")
+	}
+}
+
+func TestRefundPolicyFor(t *testing.T) {
+	cfg := Config{RefundPolicies: parseRefundPolicies(`{"default":{"spent_points":"debt"},"app_a":{"spent_points":"unknown"}}`)}
+	if got := cfg.RefundPolicyFor("app_b").SpentPoints; got != RefundSpentDebt {
+		t.Fatalf("expected default policy, got %s", got)
+	}
+	if got := cfg.RefundPolicyFor("app_a").SpentPoints; got != RefundSpentForgive {
+		t.Fatalf("expected unknown value to fall back to forgive, got %s", got)
+	}
+	if got := (Config{}).RefundPolicyFor("app_a").SpentPoints; got != RefundSpentForgive {
+		t.Fatalf("expected forgive without config, got %s", got)
+	}
+}
+
+func TestFreeRefreshPeriodAt(t *testing.T) {
+	now := time.Date(2025, 3, 15, 8, 0, 0, 0, time.UTC)
+	monthly := FreeRefreshConfig{Points: 5}
+	start, end, ok := monthly.PeriodAt(time.Date(2025, 1, 20, 0, 0, 0, 0, time.UTC), now)
+	if !ok || !start.Equal(time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)) || !end.Equal(time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected calendar period %v - %v (%v)", start, end, ok)
+	}
+	if _, _, ok := monthly.PeriodAt(time.Date(2025, 3, 2, 0, 0, 0, 0, time.UTC), now); ok {
+		t.Fatal("expected signup month to be covered by the signup bonus")
+	}
+
+	every10 := FreeRefreshConfig{Points: 5, Period: FreeRefreshDays, PeriodDays: 10, ExpiryDays: 3}
+	createdAt := time.Date(2025, 2, 20, 12, 0, 0, 0, time.UTC)
+	start, end, ok = every10.PeriodAt(createdAt, now)
+	if !ok || !start.Equal(time.Date(2025, 3, 12, 12, 0, 0, 0, time.UTC)) || !end.Equal(time.Date(2025, 3, 22, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected day period %v - %v (%v)", start, end, ok)
+	}
+	if got := every10.ExpiresAt(start, end); !got.Equal(time.Date(2025, 3, 15, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected expiry %v", got)
+	}
+	if _, _, ok := every10.PeriodAt(createdAt, createdAt.Add(48*time.Hour)); ok {
+		t.Fatal("expected first period to be covered by the signup bonus")
+	}
+}
+
+func TestRolloverPolicyAmount(t *testing.T) {
+	cfg := Config{RolloverPolicies: parseRolloverPolicies(`{"monthly":{"mode":"cap_points","value":50},"quarterly":{"mode":"cap_percent","value":25}}`)}
+	cases := []struct {
+		plan      string
+		remaining float64
+		want      float64
+	}{
+		{"monthly", 80, 50},
+		{"monthly", 30, 30},
+		{"quarterly", 400, 150},
+		{"yearly", 80, 0},
+	}
+	for _, c := range cases {
+		if got := cfg.RolloverPolicyFor(c.plan).Amount(c.remaining, 600); got != c.want {
+			t.Fatalf("%s: expected %v, got %v", c.plan, c.want, got)
+		}
+	}
+	if got := (RolloverPolicy{Mode: RolloverFull}).Amount(80, 600); got != 80 {
+		t.Fatalf("expected full rollover, got %v", got)
+	}
+}
+
+func TestPrepaidCustomAmountFor(t *testing.T) {
+	cfg := Config{}
+	custom := cfg.PrepaidCustomAmountFor("demo")
+	if custom.Disabled || custom.Points(2000) != 200 {
+		t.Fatalf("expected default custom amount at 10 cents per point, got %+v", custom)
+	}
+
+	cfg.PrepaidCustomAmounts = parsePrepaidCustomAmounts(`{
+		"default": {"min_cents": 500, "max_cents": 50000, "points_per_cent": 0.2},
+		"appA": {"disabled": true}
+	}`)
+	custom = cfg.PrepaidCustomAmountFor("unknown")
+	if custom.MinCents != 500 || custom.MaxCents != 50000 || custom.Points(1000) != 200 {
+		t.Fatalf("unexpected default config %+v", custom)
+	}
+	if custom = cfg.PrepaidCustomAmountFor("appA"); !custom.Disabled || custom.PointsPerCent != defaultPrepaidPointsPerCent {
+		t.Fatalf("unexpected appA config %+v", custom)
+	}
+}
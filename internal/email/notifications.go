@@ -0,0 +1,76 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	htmltemplate "html/template"
+	"strconv"
+	texttemplate "text/template"
+	"time"
+)
+
+var ErrUnknownNotification = errors.New("unknown notification kind")
+
+// NotificationData 通知邮件模板可用的字段
+type NotificationData struct {
+	Email      string
+	SystemCode string
+	Points     float64   // 低余额提醒为当前余额，过期提醒为即将过期的积分
+	Threshold  float64   // 低余额阈值
+	ExpiresAt  time.Time // 积分过期时间
+	BucketType string
+}
+
+var templateFuncs = map[string]any{
+	"points": func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) },
+	"date":   func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04 UTC") },
+}
+
+// 内置模板，系统未配置模板时使用
+var defaultNotificationTemplates = map[string][2]string{
+	"low_balance": {
+		"积分余额不足提醒",
+		`<p>您好，</p>
+<p>您的可用积分已降至 <strong>{{points .Points}}</strong>，低于提醒阈值 {{points .Threshold}}。</p>
+<p>为避免服务中断，请及时充值或升级订阅。</p>`,
+	},
+	"expiring_points": {
+		"积分即将过期提醒",
+		`<p>您好，</p>
+<p>您有 <strong>{{points .Points}}</strong> 积分将于 {{date .ExpiresAt}} 过期。</p>
+<p>请在过期前使用。</p>`,
+	},
+}
+
+// RenderNotification 渲染通知邮件，subjectTmpl / htmlTmpl 为空时使用内置模板
+// 主题使用 text/template，正文使用 html/template 转义数据
+func RenderNotification(kind, subjectTmpl, htmlTmpl string, data NotificationData) (string, string, error) {
+	defaults, ok := defaultNotificationTemplates[kind]
+	if !ok {
+		return "", "", ErrUnknownNotification
+	}
+	if subjectTmpl == "" {
+		subjectTmpl = defaults[0]
+	}
+	if htmlTmpl == "" {
+		htmlTmpl = defaults[1]
+	}
+
+	st, err := texttemplate.New("subject").Funcs(templateFuncs).Parse(subjectTmpl)
+	if err != nil {
+		return "", "", err
+	}
+	var subject bytes.Buffer
+	if err := st.Execute(&subject, data); err != nil {
+		return "", "", err
+	}
+	ht, err := htmltemplate.New("html").Funcs(templateFuncs).Parse(htmlTmpl)
+	if err != nil {
+		return "", "", err
+	}
+	var html bytes.Buffer
+	if err := ht.Execute(&html, data); err != nil {
+		return "", "", err
+	}
+	return subject.String(), html.String(), nil
+}
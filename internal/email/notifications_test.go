@@ -0,0 +1,40 @@
+package email
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderNotificationDefaults(t *testing.T) {
+	subject, html, err := RenderNotification("expiring_points", "", "", NotificationData{
+		Points:    12.5,
+		ExpiresAt: time.Date(2025, 3, 1, 8, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatalf("render failed: %v", err)
+	}
+	if subject != "积分即将过期提醒" || !strings.Contains(html, "12.5") || !strings.Contains(html, "2025-03-01 08:00 UTC") {
+		t.Fatalf("unexpected output: %q %q", subject, html)
+	}
+	if _, _, err := RenderNotification("unknown", "", "", NotificationData{}); err != ErrUnknownNotification {
+		t.Fatalf("expected ErrUnknownNotification, got %v", err)
+	}
+}
+
+func TestRenderNotificationEscapesCustomTemplate(t *testing.T) {
+	subject, html, err := RenderNotification("low_balance", "[{{.SystemCode}}] 余额 {{points .Points}}", "<p>{{.Email}}</p>", NotificationData{
+		SystemCode: "app_a",
+		Email:      "<script>@example.com",
+		Points:     3,
+	})
+	if err != nil {
+		t.Fatalf("render failed: %v", err)
+	}
+	if subject != "[app_a] 余额 3" {
+		t.Fatalf("unexpected subject %q", subject)
+	}
+	if strings.Contains(html, "<script>") {
+		t.Fatalf("expected escaped html, got %q", html)
+	}
+}
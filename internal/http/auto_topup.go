@@ -0,0 +1,221 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"easyusersys/internal/models"
+	"easyusersys/internal/payments"
+	"easyusersys/internal/services"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// checkoutPurposeAutoTopUp setup 模式 Checkout 的用途标记，Webhook 据此保存自动充值的支付方式
+const checkoutPurposeAutoTopUp = "auto_topup"
+
+// setupIntentLookup 查询 setup 模式结账保存的支付方式，测试中可替换为不访问网络的实现
+type setupIntentLookup interface {
+	PaymentMethodForSetupIntent(ctx context.Context, setupIntentID string) (string, error)
+}
+
+func (s *Server) handleGetAutoTopUpSettings(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	allowed, err := s.canAccessUser(r.Context(), userID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+
+	settings, err := s.svc.GetAutoTopUpSettings(r.Context(), userID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, settings)
+}
+
+type setAutoTopUpSettingsRequest struct {
+	Enabled         bool    `json:"enabled"`
+	ThresholdPoints float64 `json:"threshold_points"`
+	AmountCents     int     `json:"amount_cents"`
+}
+
+func (s *Server) handleSetAutoTopUpSettings(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	allowed, err := s.canAccessUser(r.Context(), userID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+
+	var req setAutoTopUpSettingsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	settings, err := s.svc.SetAutoTopUpSettings(r.Context(), models.AutoTopUpSettings{
+		UserID:          userID,
+		Enabled:         req.Enabled,
+		ThresholdPoints: req.ThresholdPoints,
+		AmountCents:     req.AmountCents,
+	})
+	if err != nil {
+		s.respondServiceErrorWithContext(w, r, err, "set_auto_topup_settings")
+		return
+	}
+	respondJSON(w, http.StatusOK, settings)
+}
+
+func (s *Server) handleListAutoTopUps(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	allowed, err := s.canAccessUser(r.Context(), userID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+
+	topUps, err := s.svc.ListAutoTopUps(r.Context(), userID, 50)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if topUps == nil {
+		topUps = []models.AutoTopUp{}
+	}
+	respondJSON(w, http.StatusOK, topUps)
+}
+
+type createAutoTopUpSetupRequest struct {
+	SuccessURL string `json:"success_url"`
+	CancelURL  string `json:"cancel_url"`
+}
+
+// handleCreateAutoTopUpSetup 创建 setup 模式的 Checkout 会话，用户完成后保存支付方式用于自动充值
+func (s *Server) handleCreateAutoTopUpSetup(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	allowed, err := s.canAccessUser(r.Context(), userID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+	var req createAutoTopUpSetupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.SuccessURL == "" || req.CancelURL == "" {
+		respondError(w, http.StatusBadRequest, errors.New("success_url and cancel_url are required"))
+		return
+	}
+	if !s.payments.IsConfigured() {
+		s.respondServiceError(w, services.ErrStripeNotConfigured)
+		return
+	}
+	systemCode, err := s.svc.GetUserSystemCodeByID(r.Context(), userID)
+	if err != nil {
+		s.respondServiceErrorWithContext(w, r, err, "get_user_system_code")
+		return
+	}
+
+	customerID, err := s.stripeCustomerFor(r.Context(), userID)
+	if err != nil {
+		respondErrorWithLog(w, r, http.StatusBadGateway, err, "stripe_customer")
+		return
+	}
+	sess, err := s.payments.CreateCheckout(r.Context(), payments.CheckoutParams{
+		Mode:       payments.ModeSetup,
+		CustomerID: customerID,
+		SuccessURL: req.SuccessURL,
+		CancelURL:  req.CancelURL,
+		Metadata: map[string]string{
+			"purpose":     checkoutPurposeAutoTopUp,
+			"user_id":     strconv.FormatInt(userID, 10),
+			"system_code": systemCode,
+		},
+	})
+	if err != nil {
+		respondErrorWithLog(w, r, http.StatusBadGateway, err, "stripe_setup_session")
+		return
+	}
+	respondJSON(w, http.StatusCreated, map[string]string{
+		"stripe_session": sess.ID,
+		"checkout_url":   sess.URL,
+	})
+}
+
+// processSetupSession 保存 setup 模式结账完成后得到的支付方式
+func (s *Server) processSetupSession(ctx context.Context, sess *payments.CheckoutEvent) error {
+	if sess.Metadata["purpose"] != checkoutPurposeAutoTopUp {
+		return nil
+	}
+	userID, err := strconv.ParseInt(sess.Metadata["user_id"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid user_id in setup session %s", services.ErrInvalidRequest, sess.SessionID)
+	}
+	if sess.SetupIntentID == "" {
+		return fmt.Errorf("%w: setup session %s has no setup intent", services.ErrInvalidRequest, sess.SessionID)
+	}
+	paymentMethodID, err := s.setupIntents.PaymentMethodForSetupIntent(ctx, sess.SetupIntentID)
+	if err != nil {
+		return err
+	}
+	return s.billing.SaveAutoTopUpPaymentMethod(ctx, userID, paymentMethodID)
+}
+
+// processAutoTopUpPayment 处理自动充值离线扣款的异步结果，其他支付忽略
+func (s *Server) processAutoTopUpPayment(ctx context.Context, payment *payments.PaymentEvent, succeeded bool) error {
+	raw, ok := payment.Metadata["auto_topup_id"]
+	if !ok {
+		return nil
+	}
+	topUpID, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid auto_topup_id %q", services.ErrInvalidRequest, raw)
+	}
+	if succeeded {
+		_, err := s.billing.CompleteAutoTopUp(ctx, topUpID, payment.ID)
+		return err
+	}
+	reason := payment.FailureReason
+	if reason == "" {
+		reason = "payment failed"
+	}
+	return s.billing.FailAutoTopUp(ctx, topUpID, payment.ID, reason)
+}
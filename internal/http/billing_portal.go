@@ -0,0 +1,88 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"easyusersys/internal/payments"
+	"easyusersys/internal/services"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// stripeCustomerFor 获取用户在支付平台的客户 ID，不存在时以用户邮箱创建并保存
+func (s *Server) stripeCustomerFor(ctx context.Context, userID int64) (string, error) {
+	customerID, err := s.billing.GetStripeCustomerID(ctx, userID)
+	if err == nil {
+		return customerID, nil
+	}
+	if !errors.Is(err, services.ErrNotFound) {
+		return "", err
+	}
+	user, err := s.billing.GetUserByID(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	customerID, err = s.payments.CreateCustomer(ctx, payments.Customer{
+		Email: user.Email,
+		Metadata: map[string]string{
+			"user_id":     strconv.FormatInt(user.ID, 10),
+			"system_code": user.SystemCode,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	// 并发创建时以先保存的 Customer 为准
+	return s.billing.SaveStripeCustomerID(ctx, userID, customerID)
+}
+
+type createBillingPortalRequest struct {
+	ReturnURL string `json:"return_url"`
+}
+
+// handleCreateBillingPortalSession 创建 Stripe Billing Portal 会话，用户可在其中更新支付方式、下载发票
+func (s *Server) handleCreateBillingPortalSession(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	allowed, err := s.canAccessUser(r.Context(), userID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+	var req createBillingPortalRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.ReturnURL == "" {
+		respondError(w, http.StatusBadRequest, errors.New("return_url is required"))
+		return
+	}
+	if !s.payments.IsConfigured() {
+		s.respondServiceError(w, services.ErrStripeNotConfigured)
+		return
+	}
+
+	customerID, err := s.stripeCustomerFor(r.Context(), userID)
+	if err != nil {
+		respondErrorWithLog(w, r, http.StatusBadGateway, err, "stripe_customer")
+		return
+	}
+	url, err := s.payments.CreateBillingPortal(r.Context(), customerID, req.ReturnURL)
+	if err != nil {
+		respondErrorWithLog(w, r, http.StatusBadGateway, err, "stripe_billing_portal")
+		return
+	}
+	respondJSON(w, http.StatusCreated, map[string]string{"url": url})
+}
@@ -0,0 +1,129 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"easyusersys/internal/models"
+	"easyusersys/internal/payments"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// recordingPortalProvider 记录创建的客户和打开客户自助页面时使用的客户
+type recordingPortalProvider struct {
+	*payments.FakeProvider
+	created []payments.Customer
+	portals []string
+}
+
+func (p *recordingPortalProvider) CreateCustomer(ctx context.Context, in payments.Customer) (string, error) {
+	p.created = append(p.created, in)
+	return p.FakeProvider.CreateCustomer(ctx, in)
+}
+
+func (p *recordingPortalProvider) CreateBillingPortal(ctx context.Context, customerID, returnURL string) (string, error) {
+	p.portals = append(p.portals, customerID)
+	return "https://billing.example.com/" + customerID, nil
+}
+
+func newPortalTestServer(billing *fakeBilling) (*Server, *recordingPortalProvider) {
+	provider := &recordingPortalProvider{FakeProvider: payments.NewFakeProvider("http://localhost:8080", "fake_secret")}
+	billing.users[5] = models.User{ID: 5, SystemCode: "demo", Email: "a@example.com"}
+	billing.users[6] = models.User{ID: 6, SystemCode: "demo", Email: "b@example.com"}
+	return &Server{billing: billing, payments: provider}, provider
+}
+
+// postPortal 以 requesterID 身份为 targetID 创建客户自助页面
+func postPortal(s *Server, requesterID int64, targetID string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/users/"+targetID+"/billing-portal", strings.NewReader(`{"return_url":"https://app.example.com/account"}`))
+	routeCtx := chi.NewRouteContext()
+	routeCtx.URLParams.Add("id", targetID)
+	ctx := context.WithValue(req.Context(), chi.RouteCtxKey, routeCtx)
+	ctx = context.WithValue(ctx, contextKeyUserID, requesterID)
+	ctx = context.WithValue(ctx, contextKeyRole, models.UserRoleUser)
+	rec := httptest.NewRecorder()
+	s.handleCreateBillingPortalSession(rec, req.WithContext(ctx))
+	return rec
+}
+
+func TestStripeCustomerReusedAcrossCheckouts(t *testing.T) {
+	billing := newFakeBilling()
+	s, provider := newPortalTestServer(billing)
+
+	first, err := s.stripeCustomerFor(context.Background(), 5)
+	if err != nil {
+		t.Fatalf("first lookup: %v", err)
+	}
+	second, err := s.stripeCustomerFor(context.Background(), 5)
+	if err != nil {
+		t.Fatalf("second lookup: %v", err)
+	}
+	if first == "" || first != second {
+		t.Fatalf("expected the same customer, got %q and %q", first, second)
+	}
+	if len(provider.created) != 1 || provider.created[0].Email != "a@example.com" || provider.created[0].Metadata["user_id"] != "5" {
+		t.Fatalf("expected one customer created for user 5, got %+v", provider.created)
+	}
+}
+
+func TestStripeCustomerConcurrentCreateUsesSavedCustomer(t *testing.T) {
+	billing := newFakeBilling()
+	s, provider := newPortalTestServer(billing)
+	// 另一个请求已经保存了 Customer，但本请求查询时还没有看到
+	billing.customers[5] = "cus_existing"
+	billing.customerMiss = 1
+
+	rec := postPortal(s, 5, "5")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(provider.created) != 1 {
+		t.Fatalf("expected a customer to be created after the miss, got %d", len(provider.created))
+	}
+	if len(provider.portals) != 1 || provider.portals[0] != "cus_existing" {
+		t.Fatalf("portal must use the customer saved first, got %v", provider.portals)
+	}
+	if billing.customers[5] != "cus_existing" {
+		t.Fatalf("saved customer must not be replaced, got %q", billing.customers[5])
+	}
+}
+
+func TestBillingPortalUsesOwnCustomer(t *testing.T) {
+	billing := newFakeBilling()
+	s, provider := newPortalTestServer(billing)
+	billing.customers[5] = "cus_a"
+
+	rec := postPortal(s, 5, "5")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp["url"] != "https://billing.example.com/cus_a" {
+		t.Fatalf("unexpected portal url %q", resp["url"])
+	}
+	if len(provider.created) != 0 {
+		t.Fatalf("existing customer must be reused, created %+v", provider.created)
+	}
+}
+
+func TestBillingPortalOtherUser(t *testing.T) {
+	billing := newFakeBilling()
+	s, provider := newPortalTestServer(billing)
+	billing.customers[6] = "cus_b"
+
+	rec := postPortal(s, 5, "6")
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+	if len(provider.portals) != 0 || len(provider.created) != 0 {
+		t.Fatalf("portal of another user must not be opened: %+v", provider)
+	}
+}
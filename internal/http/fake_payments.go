@@ -0,0 +1,73 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"easyusersys/internal/payments"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// fakePaymentRoutes 注册模拟支付接口，仅在 PAYMENT_PROVIDER=fake 时挂载
+// 这些接口不需要认证，只能用于本地开发和测试
+func (s *Server) fakePaymentRoutes(r chi.Router, fake *payments.FakeProvider) {
+	r.Get("/payments/fake/checkout/{id}/pay", s.handleFakeCheckout(fake.Pay))
+	r.Post("/payments/fake/checkout/{id}/pay", s.handleFakeCheckout(fake.Pay))
+	r.Post("/payments/fake/checkout/{id}/expire", s.handleFakeCheckout(fake.Expire))
+	r.Post("/payments/fake/subscriptions/{id}/renew", s.handleFakeRenew(fake))
+}
+
+// handleFakeCheckout 模拟用户完成或放弃结账，事件按 Webhook 相同的流程处理
+// 浏览器打开（GET）时处理后跳转到 success_url / cancel_url，POST 返回事件信息
+func (s *Server) handleFakeCheckout(complete func(sessionID string) (payments.Event, string, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		event, redirectURL, err := complete(chi.URLParam(r, "id"))
+		if err != nil {
+			s.respondServiceError(w, err)
+			return
+		}
+		if err := s.processFakeEvent(r.Context(), event); err != nil {
+			s.respondServiceErrorWithContext(w, r, err, "fake_checkout")
+			return
+		}
+		if r.Method == http.MethodGet && redirectURL != "" {
+			http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]string{
+			"event_id":     event.ID,
+			"event_type":   event.Type,
+			"redirect_url": redirectURL,
+		})
+	}
+}
+
+// handleFakeRenew 模拟订阅续费扣款
+func (s *Server) handleFakeRenew(fake *payments.FakeProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		event, err := fake.Renew(chi.URLParam(r, "id"))
+		if err != nil {
+			s.respondServiceError(w, err)
+			return
+		}
+		if err := s.processFakeEvent(r.Context(), event); err != nil {
+			s.respondServiceErrorWithContext(w, r, err, "fake_renew")
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]string{
+			"event_id":   event.ID,
+			"event_type": event.Type,
+		})
+	}
+}
+
+func (s *Server) processFakeEvent(ctx context.Context, event payments.Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = s.processPaymentEvent(ctx, event, payload)
+	return err
+}
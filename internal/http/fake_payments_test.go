@@ -0,0 +1,124 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"easyusersys/internal/models"
+	"easyusersys/internal/payments"
+)
+
+func newFakePaymentServer(billing *fakeBilling) (*Server, *payments.FakeProvider) {
+	fake := payments.NewFakeProvider("http://localhost:8080", "fake_secret")
+	return &Server{
+		billing:      billing,
+		payments:     fake,
+		subs:         fake,
+		setupIntents: fake,
+	}, fake
+}
+
+// fakeRequest 将模拟平台返回的地址转换为对本服务的请求
+func fakeRequest(t *testing.T, h http.Handler, method, rawURL string) *httptest.ResponseRecorder {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("parse url: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, u.Path, nil))
+	return rec
+}
+
+func TestFakeCheckoutPayMarksOrderPaid(t *testing.T) {
+	billing := newFakeBilling()
+	billing.orders[42] = models.Order{ID: 42, Status: models.OrderStatusPending, AmountCents: 1000}
+	s, fake := newFakePaymentServer(billing)
+	h := s.Routes()
+
+	sess, err := fake.CreateCheckout(context.Background(), payments.CheckoutParams{
+		Mode:              payments.ModePayment,
+		ClientReferenceID: "42",
+		AmountCents:       1000,
+		SuccessURL:        "https://app.example.com/ok?session={CHECKOUT_SESSION_ID}",
+		CancelURL:         "https://app.example.com/cancel",
+	})
+	if err != nil {
+		t.Fatalf("create checkout: %v", err)
+	}
+
+	rec := fakeRequest(t, h, http.MethodGet, sess.URL)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Location"); got != "https://app.example.com/ok?session="+sess.ID {
+		t.Fatalf("unexpected redirect %q", got)
+	}
+	order := billing.orders[42]
+	if order.Status != models.OrderStatusPaid || order.StripePaymentIntentID == nil {
+		t.Fatalf("expected order to be paid, got %+v", order)
+	}
+
+	payment, err := fake.GetPayment(context.Background(), *order.StripePaymentIntentID)
+	if err != nil || payment.AmountReceived != 1000 {
+		t.Fatalf("unexpected payment %+v, err %v", payment, err)
+	}
+	if _, err := fake.Refund(context.Background(), payments.RefundParams{PaymentID: payment.ID, AmountCents: 1001}); err == nil {
+		t.Fatal("expected refund above payment amount to fail")
+	}
+
+	// 已完成的结账不能再次支付
+	if rec := fakeRequest(t, h, http.MethodPost, sess.URL); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for completed session, got %d", rec.Code)
+	}
+}
+
+func TestFakeCheckoutSetupSavesPaymentMethod(t *testing.T) {
+	billing := newFakeBilling()
+	s, fake := newFakePaymentServer(billing)
+
+	sess, err := fake.CreateCheckout(context.Background(), payments.CheckoutParams{
+		Mode:     payments.ModeSetup,
+		Metadata: map[string]string{"purpose": checkoutPurposeAutoTopUp, "user_id": "7"},
+	})
+	if err != nil {
+		t.Fatalf("create checkout: %v", err)
+	}
+	rec := fakeRequest(t, s.Routes(), http.MethodPost, sess.URL)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if billing.savedMethods[7] == "" {
+		t.Fatalf("expected payment method to be saved, got %v", billing.savedMethods)
+	}
+}
+
+func TestFakeWebhookSignature(t *testing.T) {
+	billing := newFakeBilling()
+	billing.orders[42] = models.Order{ID: 42, Status: models.OrderStatusPending}
+	s, fake := newFakePaymentServer(billing)
+
+	payload := []byte(`{"ID":"evt_fake_1","Type":"checkout.session.expired","Checkout":{"SessionID":"cs_fake_1","ClientReferenceID":"42"}}`)
+	for _, tc := range []struct {
+		signature string
+		status    int
+	}{
+		{"bad", http.StatusBadRequest},
+		{fake.Sign(payload), http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/webhooks/stripe", bytes.NewReader(payload))
+		req.Header.Set("Fake-Signature", tc.signature)
+		rec := httptest.NewRecorder()
+		s.handleStripeWebhook(rec, req)
+		if rec.Code != tc.status {
+			t.Fatalf("signature %q: expected %d, got %d: %s", tc.signature, tc.status, rec.Code, rec.Body.String())
+		}
+	}
+	if len(billing.failedOrders) != 1 || billing.failedOrders[0] != 42 {
+		t.Fatalf("expected order 42 to be failed, got %v", billing.failedOrders)
+	}
+}
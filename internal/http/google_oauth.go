@@ -8,6 +8,8 @@ import (
 	"errors"
 	"net/http"
 
+	"easyusersys/internal/services"
+
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
@@ -23,8 +25,9 @@ type GoogleUserInfo struct {
 
 // oauthState OAuth state 参数结构，包含 CSRF token 和 system_code
 type oauthState struct {
-	CSRFToken  string `json:"csrf_token"`
-	SystemCode string `json:"system_code"`
+	CSRFToken    string `json:"csrf_token"`
+	SystemCode   string `json:"system_code"`
+	ReferralCode string `json:"referral_code,omitempty"` // 注册时携带的推荐码
 }
 
 // getGoogleOAuthConfig 获取 Google OAuth 配置
@@ -98,8 +101,9 @@ func (s *Server) handleGoogleLogin(w http.ResponseWriter, r *http.Request) {
 	// 将 CSRF token 和 system_code 一起编码到 state 参数中
 	// state 参数会被 Google 原样返回，避免了跨域 cookie 问题
 	state := oauthState{
-		CSRFToken:  csrfToken,
-		SystemCode: systemCode,
+		CSRFToken:    csrfToken,
+		SystemCode:   systemCode,
+		ReferralCode: r.URL.Query().Get("referral_code"),
 	}
 	encodedState, err := encodeOAuthState(state)
 	if err != nil {
@@ -198,7 +202,8 @@ func (s *Server) handleGoogleCallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 获取或创建用户
-	user, isNewUser, err := s.svc.GetOrCreateUserByGoogleID(r.Context(), systemCode, userInfo.ID, userInfo.Email)
+	referral := services.SignupReferral{Code: state.ReferralCode, IP: clientIP(r)}
+	user, isNewUser, err := s.svc.GetOrCreateUserByGoogleID(r.Context(), systemCode, userInfo.ID, userInfo.Email, referral)
 	if err != nil {
 		redirectWithError("create_user_failed")
 		return
@@ -0,0 +1,123 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"easyusersys/internal/services"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// parseLedgerQuery 解析流水查询参数：cursor、limit、reason、bucket_type、from、to
+// reason 和 bucket_type 支持逗号分隔多个值，from / to 为 RFC3339 时间，可以只传一个
+func parseLedgerQuery(r *http.Request) (services.LedgerQuery, error) {
+	values := r.URL.Query()
+	var q services.LedgerQuery
+	if raw := values.Get("cursor"); raw != "" {
+		cursor, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || cursor <= 0 {
+			return q, errors.New("invalid cursor")
+		}
+		q.Cursor = cursor
+	}
+	if raw := values.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			return q, errors.New("invalid limit")
+		}
+		q.Limit = limit
+	}
+	q.Reasons = splitList(values.Get("reason"))
+	q.BucketTypes = splitList(values.Get("bucket_type"))
+	if raw := values.Get("from"); raw != "" {
+		from, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return q, errors.New("invalid from")
+		}
+		q.From = &from
+	}
+	if raw := values.Get("to"); raw != "" {
+		to, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return q, errors.New("invalid to")
+		}
+		q.To = &to
+	}
+	return q, nil
+}
+
+func splitList(raw string) []string {
+	var out []string
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+func (s *Server) listLedger(w http.ResponseWriter, r *http.Request, q services.LedgerQuery) {
+	entries, next, err := s.svc.ListLedger(r.Context(), q)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{
+		"entries":     entries,
+		"next_cursor": next,
+	})
+}
+
+// handleListLedger 查询用户的积分流水，只能查看自己的，管理员可以查看同一系统的用户
+func (s *Server) handleListLedger(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	allowed, err := s.canAccessUser(r.Context(), userID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+	q, err := parseLedgerQuery(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	q.UserID = userID
+	s.listLedger(w, r, q)
+}
+
+// handleAdminListLedger 查询管理员所在系统的积分流水，可按 user_id 过滤
+func (s *Server) handleAdminListLedger(w http.ResponseWriter, r *http.Request) {
+	q, err := parseLedgerQuery(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if raw := r.URL.Query().Get("user_id"); raw != "" {
+		if q.UserID, err = parseID(raw); err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if q.SystemCode, err = s.resolveSystemCode(r.Context()); err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	// 空 system_code 在查询中表示不过滤，不能让管理员看到其他系统的流水
+	if q.SystemCode == "" {
+		respondError(w, http.StatusBadRequest, errors.New("system_code could not be resolved"))
+		return
+	}
+	s.listLedger(w, r, q)
+}
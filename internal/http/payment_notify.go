@@ -0,0 +1,95 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"easyusersys/internal/payments"
+	"easyusersys/internal/services"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// pendingPaymentMinAge 订单创建后多久开始轮询，给异步通知留出到达时间
+const pendingPaymentMinAge = time.Minute
+
+// handleAlipayNotify 处理支付宝异步通知，与 Stripe Webhook 走相同的事件处理流程
+// 支付宝要求处理成功时返回纯文本 success，其他响应会按间隔重试通知
+func (s *Server) handleAlipayNotify(provider payments.Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reqID := middleware.GetReqID(r.Context())
+		payload, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("[ERROR] [%s] Failed to read %s notify: %v", reqID, provider.Name(), err)
+			http.Error(w, "fail", http.StatusBadRequest)
+			return
+		}
+
+		event, err := provider.ParseWebhook(payload, r.Header)
+		if err != nil {
+			log.Printf("[ERROR] [%s] Invalid %s notify: %v", reqID, provider.Name(), err)
+			status := http.StatusInternalServerError
+			if errors.Is(err, payments.ErrInvalidSignature) || errors.Is(err, services.ErrInvalidRequest) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, "fail", status)
+			return
+		}
+		log.Printf("[INFO] [%s] %s notify event type: %s, event ID: %s", reqID, provider.Name(), event.Type, event.ID)
+
+		if _, err := s.processPaymentEvent(r.Context(), event, payload); err != nil {
+			log.Printf("[ERROR] [%s] Failed to process %s: %v", reqID, event.Type, err)
+			http.Error(w, "fail", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte("success"))
+	}
+}
+
+// PollPendingPayments 主动查询其他支付平台上待支付订单的状态，补偿丢失的异步通知
+// 查询结果按事件 ID 幂等处理，与异步通知重复时只处理一次；返回本次处理的事件数
+func (s *Server) PollPendingPayments(ctx context.Context) (int, error) {
+	processed := 0
+	for name, provider := range s.alternatives {
+		poller, ok := provider.(payments.Poller)
+		if !ok {
+			continue
+		}
+		orders, err := s.billing.ListPendingProviderOrders(ctx, name, pendingPaymentMinAge, 100)
+		if err != nil {
+			return processed, err
+		}
+		for _, order := range orders {
+			if order.StripeSessionID == nil {
+				continue
+			}
+			event, err := poller.QueryCheckout(ctx, *order.StripeSessionID, order.CreatedAt)
+			if err != nil {
+				log.Printf("[ERROR] Poll %s order %d failed: %v", name, order.ID, err)
+				continue
+			}
+			if event == nil {
+				continue
+			}
+			payload, err := json.Marshal(event)
+			if err != nil {
+				return processed, err
+			}
+			done, err := s.processPaymentEvent(ctx, *event, payload)
+			if err != nil {
+				log.Printf("[ERROR] Poll %s order %d: failed to process %s: %v", name, order.ID, event.Type, err)
+				continue
+			}
+			if done {
+				processed++
+			}
+		}
+	}
+	return processed, nil
+}
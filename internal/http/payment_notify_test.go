@@ -0,0 +1,183 @@
+package httpapi
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"easyusersys/internal/models"
+	"easyusersys/internal/payments"
+)
+
+const testAlipayAppID = "2021000000000001"
+
+// newAlipayTestServer 启动支付宝模拟网关，并创建一笔关联到订单 42 的扫码支付
+func newAlipayTestServer(t *testing.T, billing *fakeBilling) (*Server, *payments.AlipaySimulator, string) {
+	t.Helper()
+	appKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(&appKey.PublicKey)
+	if err != nil {
+		t.Fatalf("marshal public key: %v", err)
+	}
+	sim, err := payments.NewAlipaySimulator(testAlipayAppID, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})))
+	if err != nil {
+		t.Fatalf("new simulator: %v", err)
+	}
+	gateway := httptest.NewServer(sim)
+	t.Cleanup(gateway.Close)
+	alipay, err := payments.NewAlipayProvider(payments.AlipayConfig{
+		AppID:        testAlipayAppID,
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(appKey)})),
+		PublicKey:    sim.PublicKeyPEM(),
+		Gateway:      gateway.URL,
+		CheckoutMode: payments.AlipayCheckoutQR,
+	})
+	if err != nil {
+		t.Fatalf("new provider: %v", err)
+	}
+
+	sess, err := alipay.CreateCheckout(context.Background(), payments.CheckoutParams{
+		Mode:              payments.ModePayment,
+		ClientReferenceID: "42",
+		AmountCents:       1000,
+	})
+	if err != nil {
+		t.Fatalf("create checkout: %v", err)
+	}
+	provider := "alipay"
+	billing.orders[42] = models.Order{
+		ID:              42,
+		Status:          models.OrderStatusPending,
+		AmountCents:     1000,
+		StripeSessionID: &sess.ID,
+		PaymentProvider: &provider,
+		CreatedAt:       time.Now().UTC(),
+	}
+
+	s := newWebhookTestServer(billing)
+	s.alternatives = map[string]payments.Provider{"alipay": alipay}
+	return s, sim, sess.ID
+}
+
+func postAlipayNotify(h http.Handler, form string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/webhooks/alipay", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAlipayNotifyMarksOrderPaid(t *testing.T) {
+	billing := newFakeBilling()
+	s, sim, sessionID := newAlipayTestServer(t, billing)
+	h := s.Routes()
+
+	notify, err := sim.Pay(sessionID)
+	if err != nil {
+		t.Fatalf("pay: %v", err)
+	}
+
+	tampered := notify.Encode()
+	tampered = strings.Replace(tampered, "total_amount=10.00", "total_amount=99.00", 1)
+	if rec := postAlipayNotify(h, tampered); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected tampered notify to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if billing.orders[42].Status != models.OrderStatusPending {
+		t.Fatal("tampered notify must not mark the order paid")
+	}
+
+	rec := postAlipayNotify(h, notify.Encode())
+	if rec.Code != http.StatusOK || rec.Body.String() != "success" {
+		t.Fatalf("unexpected response %d: %q", rec.Code, rec.Body.String())
+	}
+	order := billing.orders[42]
+	if order.Status != models.OrderStatusPaid || order.StripePaymentIntentID == nil || *order.StripePaymentIntentID != notify.Get("trade_no") {
+		t.Fatalf("expected order to be paid with trade_no, got %+v", order)
+	}
+
+	// 支付宝重试相同的通知不会重复处理
+	if rec := postAlipayNotify(h, notify.Encode()); rec.Code != http.StatusOK || rec.Body.String() != "success" {
+		t.Fatalf("unexpected response for retried notify %d: %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAlipayNotifyRejectsAmountMismatch(t *testing.T) {
+	billing := newFakeBilling()
+	s, sim, sessionID := newAlipayTestServer(t, billing)
+	h := s.Routes()
+	// 交易按 10.00 元支付，而本地订单为 20.00 元
+	order := billing.orders[42]
+	order.AmountCents = 2000
+	billing.orders[42] = order
+
+	notify, err := sim.Pay(sessionID)
+	if err != nil {
+		t.Fatalf("pay: %v", err)
+	}
+	if notify.Get("total_amount") != "10.00" {
+		t.Fatalf("unexpected notify amount %q", notify.Get("total_amount"))
+	}
+	rec := postAlipayNotify(h, notify.Encode())
+	if rec.Code != http.StatusInternalServerError || rec.Body.String() == "success" {
+		t.Fatalf("signed notify with a wrong amount must be rejected, got %d: %q", rec.Code, rec.Body.String())
+	}
+	if billing.orders[42].Status != models.OrderStatusPending {
+		t.Fatalf("order must stay pending, got %+v", billing.orders[42])
+	}
+}
+
+func TestPollPendingPaymentsRecoversLostNotify(t *testing.T) {
+	billing := newFakeBilling()
+	s, sim, sessionID := newAlipayTestServer(t, billing)
+
+	n, err := s.PollPendingPayments(context.Background())
+	if err != nil || n != 0 {
+		t.Fatalf("expected nothing to process before payment, got %d, err %v", n, err)
+	}
+
+	// 用户已支付但异步通知丢失
+	if _, err := sim.Pay(sessionID); err != nil {
+		t.Fatalf("pay: %v", err)
+	}
+	n, err = s.PollPendingPayments(context.Background())
+	if err != nil || n != 1 {
+		t.Fatalf("expected one payment event, got %d, err %v", n, err)
+	}
+	if billing.orders[42].Status != models.OrderStatusPaid {
+		t.Fatalf("expected order to be paid, got %+v", billing.orders[42])
+	}
+}
+
+func TestPrepaidCheckoutRejectsAlipayWhenPricesAreNotCNY(t *testing.T) {
+	billing := newFakeBilling()
+	s, _, _ := newAlipayTestServer(t, billing)
+	s.cfg.StripeCurrency = "usd"
+
+	req := httptest.NewRequest(http.MethodPost, "/api/checkout/prepaid", strings.NewReader(
+		`{"user_id":5,"amount_cents":1000,"success_url":"https://app.example.com/ok","cancel_url":"https://app.example.com/cancel","provider":"alipay"}`))
+	ctx := context.WithValue(req.Context(), contextKeyUserID, int64(5))
+	ctx = context.WithValue(ctx, contextKeyRole, models.UserRoleUser)
+	rec := httptest.NewRecorder()
+	s.handleCreatePrepaidCheckout(rec, req.WithContext(ctx))
+
+	// 美元价格不能按人民币分收款，必须在创建订单前拒绝
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "alipay charges in cny but prices are in usd") {
+		t.Fatalf("unexpected error body: %s", rec.Body.String())
+	}
+	if len(billing.orders) != 1 {
+		t.Fatalf("no order must be created, got %+v", billing.orders)
+	}
+}
@@ -0,0 +1,192 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"easyusersys/internal/config"
+	"easyusersys/internal/models"
+	"easyusersys/internal/payments"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// newPlanChangeFixture 用户 5 在模拟平台上有一个 monthly 订阅（本地订阅 ID 1）
+func newPlanChangeFixture(t *testing.T) (*Server, *fakeBilling, *payments.FakeProvider) {
+	t.Helper()
+	fake := payments.NewFakeProvider("http://localhost:8080", "fake_secret")
+	sess, err := fake.CreateCheckout(context.Background(), payments.CheckoutParams{
+		Mode:    payments.ModeSubscription,
+		PriceID: "price_monthly",
+	})
+	if err != nil {
+		t.Fatalf("create checkout: %v", err)
+	}
+	event, _, err := fake.Pay(sess.ID)
+	if err != nil {
+		t.Fatalf("pay: %v", err)
+	}
+	stripeSubID := event.Checkout.SubscriptionID
+
+	billing := newFakeBilling()
+	billing.plans[1] = models.Plan{ID: 1, Name: "monthly", GrantPoints: 1000, Active: true}
+	billing.plans[2] = models.Plan{ID: 2, Name: "quarterly", GrantPoints: 3200, Active: true}
+	billing.plans[3] = models.Plan{ID: 3, Name: "legacy", GrantPoints: 500, Active: false}
+	billing.subscriptions[1] = models.Subscription{ID: 1, UserID: 5, PlanID: 1, Status: models.SubscriptionActive, StripeSubscriptionID: &stripeSubID}
+	s := &Server{
+		billing:  billing,
+		payments: fake,
+		subs:     fake,
+		cfg:      config.Config{StripePriceMonthly: "price_monthly", StripePriceQuarterly: "price_quarterly"},
+	}
+	return s, billing, fake
+}
+
+func planChangeRequest(method, subID, body string, userID int64) *http.Request {
+	req := httptest.NewRequest(method, "/api/subscriptions/"+subID+"/plan", strings.NewReader(body))
+	routeCtx := chi.NewRouteContext()
+	routeCtx.URLParams.Add("id", subID)
+	ctx := context.WithValue(req.Context(), chi.RouteCtxKey, routeCtx)
+	ctx = context.WithValue(ctx, contextKeyUserID, userID)
+	ctx = context.WithValue(ctx, contextKeyRole, models.UserRoleUser)
+	return req.WithContext(ctx)
+}
+
+func postPlanChange(s *Server, userID int64, subID string, planID int64) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.handleChangeSubscriptionPlan(rec, planChangeRequest(http.MethodPost, subID, `{"plan_id":`+strconv.FormatInt(planID, 10)+`}`, userID))
+	return rec
+}
+
+type planChangeResponse struct {
+	Subscription models.Subscription `json:"subscription"`
+	PlanChange   models.PlanChange   `json:"plan_change"`
+}
+
+func decodePlanChange(t *testing.T, rec *httptest.ResponseRecorder) planChangeResponse {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp planChangeResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	return resp
+}
+
+func TestChangePlanUpgradeImmediateGrantsDifference(t *testing.T) {
+	s, billing, _ := newPlanChangeFixture(t)
+	billing.planPolicy = config.PlanChangePointsImmediate
+
+	resp := decodePlanChange(t, postPlanChange(s, 5, "1", 2))
+	if resp.Subscription.PlanID != 2 || resp.Subscription.EndsAt.IsZero() {
+		t.Fatalf("expected subscription on plan 2 with the provider period end, got %+v", resp.Subscription)
+	}
+	if resp.PlanChange.FromPlanID != 1 || resp.PlanChange.ToPlanID != 2 || resp.PlanChange.ChangedBy != 5 {
+		t.Fatalf("unexpected plan change %+v", resp.PlanChange)
+	}
+	if resp.PlanChange.PointsGranted != 2200 {
+		t.Fatalf("expected 2200 prorated points, got %v", resp.PlanChange.PointsGranted)
+	}
+}
+
+func TestChangePlanDowngradeImmediateGrantsNothing(t *testing.T) {
+	s, billing, _ := newPlanChangeFixture(t)
+	billing.planPolicy = config.PlanChangePointsImmediate
+	sub := billing.subscriptions[1]
+	sub.PlanID = 2
+	billing.subscriptions[1] = sub
+
+	resp := decodePlanChange(t, postPlanChange(s, 5, "1", 1))
+	if resp.Subscription.PlanID != 1 || resp.PlanChange.PointsGranted != 0 {
+		t.Fatalf("downgrade must not grant points: %+v", resp)
+	}
+}
+
+func TestChangePlanNextRenewalGrantsNothing(t *testing.T) {
+	s, _, _ := newPlanChangeFixture(t)
+
+	resp := decodePlanChange(t, postPlanChange(s, 5, "1", 2))
+	if resp.PlanChange.PointsPolicy != config.PlanChangePointsNextRenewal || resp.PlanChange.PointsGranted != 0 {
+		t.Fatalf("next_renewal policy must not grant points now: %+v", resp.PlanChange)
+	}
+}
+
+func TestChangePlanProviderFailureKeepsLocalState(t *testing.T) {
+	s, billing, fake := newPlanChangeFixture(t)
+	if err := fake.CancelNow(context.Background(), *billing.subscriptions[1].StripeSubscriptionID, false); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+
+	rec := postPlanChange(s, 5, "1", 2)
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", rec.Code)
+	}
+	if billing.subscriptions[1].PlanID != 1 || len(billing.planChanges) != 0 {
+		t.Fatalf("local subscription must not change when the provider fails")
+	}
+}
+
+func TestChangePlanRejectsInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name   string
+		userID int64
+		planID int64
+		status string
+		want   int
+	}{
+		{name: "other user", userID: 6, planID: 2, want: http.StatusForbidden},
+		{name: "same plan", userID: 5, planID: 1, want: http.StatusBadRequest},
+		{name: "inactive plan", userID: 5, planID: 3, want: http.StatusBadRequest},
+		{name: "unknown plan", userID: 5, planID: 9, want: http.StatusNotFound},
+		{name: "subscription not active", userID: 5, planID: 2, status: models.SubscriptionCanceled, want: http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, billing, _ := newPlanChangeFixture(t)
+			if tt.status != "" {
+				sub := billing.subscriptions[1]
+				sub.Status = tt.status
+				billing.subscriptions[1] = sub
+			}
+			rec := postPlanChange(s, tt.userID, "1", tt.planID)
+			if rec.Code != tt.want {
+				t.Fatalf("expected %d, got %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+			if len(billing.planChanges) != 0 {
+				t.Fatalf("rejected request must not change the plan")
+			}
+		})
+	}
+}
+
+func TestListPlanChanges(t *testing.T) {
+	s, _, _ := newPlanChangeFixture(t)
+	decodePlanChange(t, postPlanChange(s, 5, "1", 2))
+	decodePlanChange(t, postPlanChange(s, 5, "1", 1))
+
+	rec := httptest.NewRecorder()
+	s.handleListPlanChanges(rec, planChangeRequest(http.MethodGet, "1", "", 5))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	var changes []models.PlanChange
+	if err := json.Unmarshal(rec.Body.Bytes(), &changes); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if len(changes) != 2 || changes[0].ToPlanID != 1 || changes[1].ToPlanID != 2 {
+		t.Fatalf("expected newest change first, got %+v", changes)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleListPlanChanges(rec, planChangeRequest(http.MethodGet, "1", "", 6))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for another user, got %d", rec.Code)
+	}
+}
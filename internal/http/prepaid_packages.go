@@ -0,0 +1,193 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"easyusersys/internal/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// handleListPrepaidPackages 列出当前用户所在系统可购买的积分包，以及自定义金额的限制
+func (s *Server) handleListPrepaidPackages(w http.ResponseWriter, r *http.Request) {
+	systemCode, err := s.resolveSystemCode(r.Context())
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if systemCode == "" {
+		respondError(w, http.StatusBadRequest, errors.New("system_code could not be resolved"))
+		return
+	}
+	packages, err := s.svc.ListPrepaidPackages(r.Context(), systemCode, true)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	custom := s.cfg.PrepaidCustomAmountFor(systemCode)
+	respondJSON(w, http.StatusOK, map[string]any{
+		"packages": packages,
+		"custom_amount": map[string]any{
+			"enabled":         !custom.Disabled,
+			"min_cents":       custom.MinCents,
+			"max_cents":       custom.MaxCents,
+			"points_per_cent": custom.PointsPerCent,
+		},
+	})
+}
+
+type adminCreatePrepaidPackageRequest struct {
+	Name           string     `json:"name"`
+	PriceCents     int        `json:"price_cents"`
+	Points         float64    `json:"points"`
+	BonusPoints    float64    `json:"bonus_points"`
+	ExpiryDays     int        `json:"expiry_days"` // 0 表示使用 PREPAID_EXPIRY_DAYS
+	AvailableFrom  *time.Time `json:"available_from"`
+	AvailableUntil *time.Time `json:"available_until"`
+	Active         *bool      `json:"active"` // 默认上架
+	SortOrder      int        `json:"sort_order"`
+}
+
+func (s *Server) handleAdminCreatePrepaidPackage(w http.ResponseWriter, r *http.Request) {
+	systemCode, err := s.resolveSystemCode(r.Context())
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if systemCode == "" {
+		respondError(w, http.StatusBadRequest, errors.New("system_code could not be resolved"))
+		return
+	}
+
+	var req adminCreatePrepaidPackageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == "" || req.PriceCents <= 0 || req.Points <= 0 {
+		respondError(w, http.StatusBadRequest, errors.New("name, price_cents and points are required"))
+		return
+	}
+
+	active := true
+	if req.Active != nil {
+		active = *req.Active
+	}
+	created, err := s.svc.CreatePrepaidPackage(r.Context(), models.PrepaidPackage{
+		SystemCode:     systemCode,
+		Name:           req.Name,
+		PriceCents:     req.PriceCents,
+		Points:         req.Points,
+		BonusPoints:    req.BonusPoints,
+		ExpiryDays:     req.ExpiryDays,
+		AvailableFrom:  req.AvailableFrom,
+		AvailableUntil: req.AvailableUntil,
+		Active:         active,
+		SortOrder:      req.SortOrder,
+	})
+	if err != nil {
+		s.respondServiceErrorWithContext(w, r, err, "create_prepaid_package")
+		return
+	}
+	respondJSON(w, http.StatusCreated, created)
+}
+
+// handleAdminListPrepaidPackages 列出系统内全部积分包，包括已下架和不在销售时间内的
+func (s *Server) handleAdminListPrepaidPackages(w http.ResponseWriter, r *http.Request) {
+	systemCode, err := s.resolveSystemCode(r.Context())
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	packages, err := s.svc.ListPrepaidPackages(r.Context(), systemCode, false)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, packages)
+}
+
+// adminUpdatePrepaidPackageRequest 只更新传入的字段
+// clear_available_from / clear_available_until 用于取消销售时间限制
+type adminUpdatePrepaidPackageRequest struct {
+	Name                *string    `json:"name"`
+	PriceCents          *int       `json:"price_cents"`
+	Points              *float64   `json:"points"`
+	BonusPoints         *float64   `json:"bonus_points"`
+	ExpiryDays          *int       `json:"expiry_days"`
+	AvailableFrom       *time.Time `json:"available_from"`
+	AvailableUntil      *time.Time `json:"available_until"`
+	ClearAvailableFrom  bool       `json:"clear_available_from"`
+	ClearAvailableUntil bool       `json:"clear_available_until"`
+	Active              *bool      `json:"active"`
+	SortOrder           *int       `json:"sort_order"`
+}
+
+func (s *Server) handleAdminUpdatePrepaidPackage(w http.ResponseWriter, r *http.Request) {
+	packageID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	pkg, err := s.svc.GetPrepaidPackage(r.Context(), packageID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	systemCode, err := s.resolveSystemCode(r.Context())
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if systemCode != "" && systemCode != pkg.SystemCode {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+
+	var req adminUpdatePrepaidPackageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name != nil {
+		pkg.Name = *req.Name
+	}
+	if req.PriceCents != nil {
+		pkg.PriceCents = *req.PriceCents
+	}
+	if req.Points != nil {
+		pkg.Points = *req.Points
+	}
+	if req.BonusPoints != nil {
+		pkg.BonusPoints = *req.BonusPoints
+	}
+	if req.ExpiryDays != nil {
+		pkg.ExpiryDays = *req.ExpiryDays
+	}
+	if req.AvailableFrom != nil {
+		pkg.AvailableFrom = req.AvailableFrom
+	} else if req.ClearAvailableFrom {
+		pkg.AvailableFrom = nil
+	}
+	if req.AvailableUntil != nil {
+		pkg.AvailableUntil = req.AvailableUntil
+	} else if req.ClearAvailableUntil {
+		pkg.AvailableUntil = nil
+	}
+	if req.Active != nil {
+		pkg.Active = *req.Active
+	}
+	if req.SortOrder != nil {
+		pkg.SortOrder = *req.SortOrder
+	}
+
+	updated, err := s.svc.UpdatePrepaidPackage(r.Context(), pkg)
+	if err != nil {
+		s.respondServiceErrorWithContext(w, r, err, "update_prepaid_package")
+		return
+	}
+	respondJSON(w, http.StatusOK, updated)
+}
@@ -0,0 +1,37 @@
+package httpapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"easyusersys/internal/models"
+	"easyusersys/internal/payments"
+)
+
+func TestPrepaidCheckoutRequiresExactlyOneOfPackageOrAmount(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields string
+	}{
+		{name: "neither", fields: `"user_id":5`},
+		{name: "both", fields: `"user_id":5,"package_id":3,"amount_cents":1000`},
+		{name: "non-positive amount", fields: `"user_id":5,"amount_cents":-100`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{billing: newFakeBilling(), payments: payments.NewFakeProvider("http://localhost:8080", "fake_secret")}
+			body := `{` + tt.fields + `,"success_url":"https://app.example.com/ok","cancel_url":"https://app.example.com/cancel"}`
+			req := httptest.NewRequest(http.MethodPost, "/api/checkout/prepaid", strings.NewReader(body))
+			ctx := context.WithValue(req.Context(), contextKeyUserID, int64(5))
+			ctx = context.WithValue(ctx, contextKeyRole, models.UserRoleUser)
+			rec := httptest.NewRecorder()
+			s.handleCreatePrepaidCheckout(rec, req.WithContext(ctx))
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "exactly one of package_id or amount_cents is required") {
+				t.Fatalf("expected 400 for package_id/amount_cents, got %d: %s", rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+
+	"easyusersys/internal/services"
+)
+
+// handleAdminReconcile 核对管理员所在系统的积分流水与积分桶，只报告不修复
+func (s *Server) handleAdminReconcile(w http.ResponseWriter, r *http.Request) {
+	s.adminReconcile(w, r, false)
+}
+
+// handleAdminRepairReconciliation 修复管理员所在系统可自动修复的问题，返回修复后的报告
+func (s *Server) handleAdminRepairReconciliation(w http.ResponseWriter, r *http.Request) {
+	s.adminReconcile(w, r, true)
+}
+
+func (s *Server) adminReconcile(w http.ResponseWriter, r *http.Request, repair bool) {
+	systemCode, err := s.resolveSystemCode(r.Context())
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	// 跨系统对账只能通过 reconcile 命令执行
+	if systemCode == "" {
+		respondError(w, http.StatusBadRequest, errors.New("system_code could not be resolved"))
+		return
+	}
+	report, err := s.svc.Reconcile(r.Context(), services.ReconcileOptions{SystemCode: systemCode, Repair: repair})
+	if err != nil {
+		s.respondServiceErrorWithContext(w, r, err, "reconcile")
+		return
+	}
+	respondJSON(w, http.StatusOK, report)
+}
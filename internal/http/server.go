@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"runtime/debug"
 	"strconv"
@@ -16,24 +17,68 @@ import (
 	"easyusersys/internal/config"
 	"easyusersys/internal/email"
 	"easyusersys/internal/models"
+	"easyusersys/internal/payments"
 	"easyusersys/internal/services"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/stripe/stripe-go/v84"
-	"github.com/stripe/stripe-go/v84/checkout/session"
-	"github.com/stripe/stripe-go/v84/webhook"
 )
 
 type Server struct {
-	svc         *services.Service
-	cfg         config.Config
-	emailClient *email.ResendClient
+	svc          *services.Service
+	billing      stripeBilling
+	payments     payments.Provider            // 主支付平台
+	alternatives map[string]payments.Provider // 与主支付平台并存的其他平台（如支付宝），按名称索引
+	subs         subscriptionManager
+	setupIntents setupIntentLookup
+	cfg          config.Config
+	emailClient  *email.ResendClient
 }
 
-func NewServer(svc *services.Service, cfg config.Config) *Server {
+// stripeBilling 支付平台 Webhook 处理所需的服务方法，测试中可替换为内存实现
+type stripeBilling interface {
+	GetOrder(ctx context.Context, orderID int64) (models.Order, error)
+	GetOrderByStripeSessionID(ctx context.Context, sessionID string) (models.Order, error)
+	MarkOrderPaid(ctx context.Context, orderID int64, sessionID, paymentIntentID, stripeSubscriptionID string) (models.Order, error)
+	FailPendingOrder(ctx context.Context, orderID int64) error
+	GetSubscriptionByID(ctx context.Context, subscriptionID int64) (models.Subscription, error)
+	GetSubscriptionByStripeID(ctx context.Context, stripeSubscriptionID string) (models.Subscription, error)
+	GetPlanByID(ctx context.Context, planID int64) (models.Plan, error)
+	ActivateSubscription(ctx context.Context, subscriptionID int64, stripeSubscriptionID string, grantPoints float64, periodDays int) error
+	SyncStripeSubscription(ctx context.Context, stripeSubscriptionID string, update services.StripeSubscriptionUpdate) error
+	MarkSubscriptionPaymentFailed(ctx context.Context, stripeSubscriptionID string) error
+	GetOrderByPaymentIntentID(ctx context.Context, paymentIntentID string) (models.Order, error)
+	RecordOrderRefund(ctx context.Context, in services.OrderReversal) (models.Order, error)
+	RecordOrderDispute(ctx context.Context, in services.OrderReversal) (models.Order, error)
+	ProcessStripeEvent(ctx context.Context, eventID, eventType string, payload []byte, handle func(ctx context.Context) error) (bool, error)
+	CancelSubscription(ctx context.Context, subscriptionID int64, atPeriodEnd bool) (models.Subscription, error)
+	ChangeSubscriptionPlan(ctx context.Context, in services.ChangePlanInput) (models.Subscription, models.PlanChange, error)
+	ListPlanChanges(ctx context.Context, subscriptionID int64) ([]models.PlanChange, error)
+	GetUserByID(ctx context.Context, userID int64) (models.User, error)
+	GetStripeCustomerID(ctx context.Context, userID int64) (string, error)
+	SaveStripeCustomerID(ctx context.Context, userID int64, customerID string) (string, error)
+	SaveAutoTopUpPaymentMethod(ctx context.Context, userID int64, paymentMethodID string) error
+	CompleteAutoTopUp(ctx context.Context, topUpID int64, paymentIntentID string) (models.Order, error)
+	FailAutoTopUp(ctx context.Context, topUpID int64, paymentIntentID, reason string) error
+	ListPendingProviderOrders(ctx context.Context, provider string, minAge time.Duration, limit int) ([]models.Order, error)
+}
+
+func NewServer(svc *services.Service, cfg config.Config, provider payments.Provider, alternatives ...payments.Provider) *Server {
 	emailClient := email.NewResendClient(cfg.ResendAPIKey)
-	return &Server{svc: svc, cfg: cfg, emailClient: emailClient}
+	byName := map[string]payments.Provider{}
+	for _, p := range alternatives {
+		byName[p.Name()] = p
+	}
+	return &Server{
+		svc:          svc,
+		billing:      svc,
+		payments:     provider,
+		alternatives: byName,
+		subs:         provider,
+		setupIntents: provider,
+		cfg:          cfg,
+		emailClient:  emailClient,
+	}
 }
 
 // loggingRecoverer 自定义的 panic 恢复中间件，记录详细的错误信息
@@ -92,9 +137,18 @@ func (s *Server) Routes() http.Handler {
 		r.Get("/users/by-email", s.handleGetUserByEmail)
 		r.Get("/plans", s.handleListPlans)
 		r.Post("/webhooks/stripe", s.handleStripeWebhook)
+		if fake, ok := s.payments.(*payments.FakeProvider); ok {
+			s.fakePaymentRoutes(r, fake)
+		}
+		if alipay, ok := s.alternatives[config.PaymentProviderAlipay]; ok {
+			r.Post("/webhooks/alipay", s.handleAlipayNotify(alipay))
+		}
 
 		// 服务间接口（使用 API Key 验证）
 		r.Post("/usage", s.handleReportUsage)
+		r.With(s.internalAPIKeyMiddleware).Post("/usage/batch", s.handleReportUsageBatch)
+		r.With(s.internalAPIKeyMiddleware).Post("/usage/reversals", s.handleReverseUsage)
+		r.With(s.internalAPIKeyMiddleware).Get("/usage/reversals", s.handleListUsageReversals)
 
 		// 需要认证的用户接口
 		r.Group(func(r chi.Router) {
@@ -103,15 +157,31 @@ func (s *Server) Routes() http.Handler {
 			r.Get("/users/{id}", s.handleGetUser)
 			r.Patch("/users/{id}/status", s.handleUpdateUserStatus)
 			r.Get("/users/{id}/balances", s.handleListBalances)
+			r.Get("/users/{id}/ledger", s.handleListLedger)
 			r.Post("/users/{id}/api-keys", s.handleCreateAPIKey)
 			r.Get("/users/{id}/api-keys", s.handleListAPIKeys)
 			r.Post("/api-keys/{id}/revoke", s.handleRevokeAPIKey)
+			r.Put("/api-keys/{id}/limits", s.handleSetAPIKeyLimits)
 
 			r.Post("/subscriptions/checkout", s.handleCreateSubscriptionCheckout)
 			r.Post("/subscriptions/{id}/cancel", s.handleCancelSubscription)
+			r.Post("/subscriptions/{id}/change-plan", s.handleChangeSubscriptionPlan)
+			r.Get("/subscriptions/{id}/plan-changes", s.handleListPlanChanges)
+			r.Post("/users/{id}/billing-portal", s.handleCreateBillingPortalSession)
 			r.Get("/subscriptions/{id}", s.handleGetSubscription)
 
+			r.Get("/prepaid/packages", s.handleListPrepaidPackages)
 			r.Post("/prepaid/checkout", s.handleCreatePrepaidCheckout)
+			r.Post("/coupons/redeem", s.handleRedeemCoupon)
+			r.Get("/users/{id}/referrals", s.handleGetUserReferrals)
+			r.Post("/users/{id}/transfers", s.handleCreateTransfer)
+			r.Get("/users/{id}/transfers", s.handleListTransfers)
+			r.Get("/users/{id}/notification-settings", s.handleGetNotificationSettings)
+			r.Put("/users/{id}/notification-settings", s.handleSetNotificationSettings)
+			r.Get("/users/{id}/auto-topup", s.handleGetAutoTopUpSettings)
+			r.Put("/users/{id}/auto-topup", s.handleSetAutoTopUpSettings)
+			r.Post("/users/{id}/auto-topup/setup", s.handleCreateAutoTopUpSetup)
+			r.Get("/users/{id}/auto-topups", s.handleListAutoTopUps)
 
 			r.Get("/usage", s.handleListUsage)
 
@@ -128,7 +198,29 @@ func (s *Server) Routes() http.Handler {
 			r.Get("/users/{id}/usage", s.handleAdminGetUserUsage)
 			r.Get("/users/{id}/subscriptions", s.handleAdminGetUserSubscriptions)
 			r.Get("/users/{id}/balances", s.handleAdminGetUserBalances)
+			r.Get("/users/{id}/credit", s.handleAdminGetUserCredit)
+			r.Get("/ledger", s.handleAdminListLedger)
+			r.Put("/users/{id}/credit-limit", s.handleAdminSetUserCreditLimit)
+			r.Put("/credit-limit", s.handleAdminSetSystemCreditLimit)
+			r.Post("/users/{id}/grants", s.handleAdminGrantPoints)
+			r.Post("/buckets/{id}/adjust", s.handleAdminAdjustBucket)
+			r.Post("/buckets/{id}/expire", s.handleAdminExpireBucket)
+			r.Post("/buckets/{id}/void", s.handleAdminVoidBucket)
+			r.Post("/orders/{id}/refund", s.handleAdminRefundOrder)
+			r.Post("/coupons", s.handleAdminCreateCoupon)
+			r.Get("/coupons", s.handleAdminListCoupons)
+			r.Patch("/coupons/{id}", s.handleAdminUpdateCoupon)
+			r.Post("/prepaid-packages", s.handleAdminCreatePrepaidPackage)
+			r.Get("/prepaid-packages", s.handleAdminListPrepaidPackages)
+			r.Patch("/prepaid-packages/{id}", s.handleAdminUpdatePrepaidPackage)
+			r.Get("/referrals", s.handleAdminListReferrals)
+			r.Get("/stripe-events", s.handleAdminListStripeEvents)
+			r.Post("/stripe-events/{id}/replay", s.handleAdminReplayStripeEvent)
+			r.Get("/transfer-settings", s.handleAdminGetTransferSettings)
+			r.Put("/transfer-settings", s.handleAdminSetTransferSettings)
 			r.Get("/stats", s.handleAdminGetStats)
+			r.Get("/reconciliation", s.handleAdminReconcile)
+			r.Post("/reconciliation/repair", s.handleAdminRepairReconciliation)
 		})
 
 		// 内部服务接口（使用 X-API-Key 验证）
@@ -206,9 +298,10 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 }
 
 type createUserRequest struct {
-	SystemCode string `json:"system_code"`
-	Email      string `json:"email"`
-	Password   string `json:"password"`
+	SystemCode   string `json:"system_code"`
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	ReferralCode string `json:"referral_code"` // 可选，推荐人的推荐码
 }
 
 func (s *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
@@ -221,7 +314,8 @@ func (s *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, errors.New("system_code, email and password are required"))
 		return
 	}
-	user, err := s.svc.CreateUser(r.Context(), req.SystemCode, req.Email, req.Password)
+	referral := services.SignupReferral{Code: req.ReferralCode, IP: clientIP(r)}
+	user, err := s.svc.CreateUser(r.Context(), req.SystemCode, req.Email, req.Password, referral)
 	if err != nil {
 		s.respondServiceError(w, err)
 		return
@@ -348,7 +442,13 @@ func (s *Server) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusForbidden, errors.New("access denied"))
 		return
 	}
-	raw, key, err := s.svc.CreateAPIKey(r.Context(), userID)
+	// 请求体可选，用于在创建时设置限额
+	var limits services.APIKeyLimits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil && !errors.Is(err, io.EOF) {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	raw, key, err := s.svc.CreateAPIKey(r.Context(), userID, limits)
 	if err != nil {
 		s.respondServiceError(w, err)
 		return
@@ -411,6 +511,41 @@ func (s *Server) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
 
+// handleSetAPIKeyLimits 设置 API Key 的限额，未传的字段表示不限制
+func (s *Server) handleSetAPIKeyLimits(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	apiKey, err := s.svc.GetAPIKeyByID(r.Context(), id)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	allowed, err := s.canAccessUser(r.Context(), apiKey.UserID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+
+	var limits services.APIKeyLimits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	updated, err := s.svc.SetAPIKeyLimits(r.Context(), id, limits)
+	if err != nil {
+		s.respondServiceErrorWithContext(w, r, err, "set_api_key_limits")
+		return
+	}
+	respondJSON(w, http.StatusOK, updated)
+}
+
 func (s *Server) handleListPlans(w http.ResponseWriter, r *http.Request) {
 	plans, err := s.svc.ListPlans(r.Context())
 	if err != nil {
@@ -425,14 +560,15 @@ type createSubscriptionCheckoutRequest struct {
 	PlanID     int64  `json:"plan_id"`
 	SuccessURL string `json:"success_url"`
 	CancelURL  string `json:"cancel_url"`
+	CouponCode string `json:"coupon_code"` // 可选，使用 Stripe 折扣的优惠码
 }
 
 func (s *Server) handleCreateSubscriptionCheckout(w http.ResponseWriter, r *http.Request) {
 	reqID := middleware.GetReqID(r.Context())
 	log.Printf("[INFO] [%s] Starting subscription checkout", reqID)
 
-	if s.cfg.StripeSecretKey == "" {
-		log.Printf("[ERROR] [%s] Stripe not configured", reqID)
+	if !s.payments.IsConfigured() {
+		log.Printf("[ERROR] [%s] Payment provider not configured", reqID)
 		s.respondServiceErrorWithContext(w, r, services.ErrStripeNotConfigured, "stripe_not_configured")
 		return
 	}
@@ -475,6 +611,21 @@ func (s *Server) handleCreateSubscriptionCheckout(w http.ResponseWriter, r *http
 	}
 	log.Printf("[INFO] [%s] Stripe price ID: %s", reqID, priceID)
 
+	// 创建订单和预留优惠码之前先查询 system_code 和 Customer，之后的失败都要放弃订单以释放优惠码
+	systemCode, err := s.svc.GetUserSystemCodeByID(r.Context(), req.UserID)
+	if err != nil {
+		log.Printf("[ERROR] [%s] Failed to get user system_code: %v", reqID, err)
+		s.respondServiceErrorWithContext(w, r, err, "get_user_system_code")
+		return
+	}
+
+	customerID, err := s.stripeCustomerFor(r.Context(), req.UserID)
+	if err != nil {
+		log.Printf("[ERROR] [%s] Failed to get stripe customer: %v", reqID, err)
+		respondErrorWithLog(w, r, http.StatusBadGateway, err, "stripe_customer")
+		return
+	}
+
 	sub, err := s.svc.CreatePendingSubscription(r.Context(), req.UserID, plan.ID, plan.PeriodDays)
 	if err != nil {
 		log.Printf("[ERROR] [%s] Failed to create pending subscription: %v", reqID, err)
@@ -491,11 +642,16 @@ func (s *Server) handleCreateSubscriptionCheckout(w http.ResponseWriter, r *http
 	}
 	log.Printf("[INFO] [%s] Created order: id=%d", reqID, order.ID)
 
-	systemCode, err := s.svc.GetUserSystemCodeByID(r.Context(), req.UserID)
-	if err != nil {
-		log.Printf("[ERROR] [%s] Failed to get user system_code: %v", reqID, err)
-		s.respondServiceErrorWithContext(w, r, err, "get_user_system_code")
-		return
+	var coupon *models.Coupon
+	if req.CouponCode != "" {
+		c, err := s.svc.ReserveCheckoutCoupon(r.Context(), req.UserID, order.ID, req.CouponCode, plan.Name)
+		if err != nil {
+			log.Printf("[ERROR] [%s] Coupon %s rejected: %v", reqID, req.CouponCode, err)
+			s.abandonCheckoutOrder(r, order.ID)
+			s.respondServiceErrorWithContext(w, r, err, "validate_coupon")
+			return
+		}
+		coupon = &c
 	}
 
 	// 替换 URL 中的占位符
@@ -503,18 +659,14 @@ func (s *Server) handleCreateSubscriptionCheckout(w http.ResponseWriter, r *http
 	successURL := strings.Replace(req.SuccessURL, "{order_id}", orderIDStr, -1)
 	cancelURL := strings.Replace(req.CancelURL, "{order_id}", orderIDStr, -1)
 
-	stripe.Key = s.cfg.StripeSecretKey
-	params := &stripe.CheckoutSessionParams{
-		Mode:              stripe.String(string(stripe.CheckoutSessionModeSubscription)),
-		SuccessURL:        stripe.String(successURL),
-		CancelURL:         stripe.String(cancelURL),
-		ClientReferenceID: stripe.String(strconv.FormatInt(order.ID, 10)),
-		LineItems: []*stripe.CheckoutSessionLineItemParams{
-			{
-				Price:    stripe.String(priceID),
-				Quantity: stripe.Int64(1),
-			},
-		},
+	params := payments.CheckoutParams{
+		Mode:              payments.ModeSubscription,
+		CustomerID:        customerID,
+		SuccessURL:        successURL,
+		CancelURL:         cancelURL,
+		ClientReferenceID: strconv.FormatInt(order.ID, 10),
+		PriceID:           priceID,
+		AmountCents:       plan.PriceCents,
 		Metadata: map[string]string{
 			"order_id":        strconv.FormatInt(order.ID, 10),
 			"subscription_id": strconv.FormatInt(sub.ID, 10),
@@ -523,27 +675,22 @@ func (s *Server) handleCreateSubscriptionCheckout(w http.ResponseWriter, r *http
 			"system_code":     systemCode,
 		},
 	}
+	if coupon != nil {
+		params.CouponID = *coupon.StripeCouponID
+	}
 
-	log.Printf("[INFO] [%s] Creating Stripe checkout session...", reqID)
-	sess, err := session.New(params)
+	log.Printf("[INFO] [%s] Creating %s checkout session...", reqID, s.payments.Name())
+	sess, err := s.payments.CreateCheckout(r.Context(), params)
 	if err != nil {
-		// 详细记录 Stripe 错误
-		var stripeErr *stripe.Error
-		if errors.As(err, &stripeErr) {
-			log.Printf("[ERROR] [%s] Stripe API error: type=%s, code=%s, message=%s, param=%s",
-				reqID, stripeErr.Type, stripeErr.Code, stripeErr.Msg, stripeErr.Param)
-			respondErrorWithLog(w, r, http.StatusBadRequest,
-				fmt.Errorf("stripe error: %s - %s", stripeErr.Code, stripeErr.Msg), "stripe_api")
-		} else {
-			log.Printf("[ERROR] [%s] Failed to create Stripe session: %v", reqID, err)
-			respondErrorWithLog(w, r, http.StatusInternalServerError, err, "stripe_session_create")
-		}
+		s.abandonCheckoutOrder(r, order.ID)
+		respondCheckoutError(w, r, err)
 		return
 	}
-	log.Printf("[INFO] [%s] Stripe session created: id=%s", reqID, sess.ID)
+	log.Printf("[INFO] [%s] Checkout session created: id=%s", reqID, sess.ID)
 
-	if err := s.svc.LinkOrderSession(r.Context(), order.ID, sess.ID); err != nil {
+	if err := s.svc.LinkOrderSession(r.Context(), order.ID, sess.ID, ""); err != nil {
 		log.Printf("[ERROR] [%s] Failed to link order session: %v", reqID, err)
+		s.abandonCheckoutOrder(r, order.ID)
 		s.respondServiceErrorWithContext(w, r, err, "link_order_session")
 		return
 	}
@@ -557,13 +704,23 @@ func (s *Server) handleCreateSubscriptionCheckout(w http.ResponseWriter, r *http
 	})
 }
 
+type cancelSubscriptionRequest struct {
+	Immediately bool `json:"immediately"` // 立即取消，默认到期取消
+	Prorate     bool `json:"prorate"`     // 立即取消时按剩余时间生成抵扣
+}
+
 func (s *Server) handleCancelSubscription(w http.ResponseWriter, r *http.Request) {
 	subscriptionID, err := parseID(chi.URLParam(r, "id"))
 	if err != nil {
 		respondError(w, http.StatusBadRequest, err)
 		return
 	}
-	sub, err := s.svc.GetSubscriptionByID(r.Context(), subscriptionID)
+	var req cancelSubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	sub, err := s.billing.GetSubscriptionByID(r.Context(), subscriptionID)
 	if err != nil {
 		s.respondServiceError(w, err)
 		return
@@ -578,11 +735,149 @@ func (s *Server) handleCancelSubscription(w http.ResponseWriter, r *http.Request
 		respondError(w, http.StatusForbidden, errors.New("access denied"))
 		return
 	}
-	if err := s.svc.CancelSubscription(r.Context(), sub.UserID); err != nil {
+	if sub.Status != models.SubscriptionActive && sub.Status != models.SubscriptionPastDue {
+		s.respondServiceError(w, services.ErrSubscriptionNotActive)
+		return
+	}
+
+	// 先通知 Stripe 停止扣费，成功后再修改本地状态
+	if sub.StripeSubscriptionID != nil && *sub.StripeSubscriptionID != "" {
+		if !s.payments.IsConfigured() {
+			s.respondServiceError(w, services.ErrStripeNotConfigured)
+			return
+		}
+		if req.Immediately {
+			err = s.subs.CancelNow(r.Context(), *sub.StripeSubscriptionID, req.Prorate)
+		} else {
+			err = s.subs.CancelAtPeriodEnd(r.Context(), *sub.StripeSubscriptionID)
+		}
+		if err != nil {
+			respondErrorWithLog(w, r, http.StatusBadGateway, err, "stripe_cancel_subscription")
+			return
+		}
+	}
+	sub, err = s.billing.CancelSubscription(r.Context(), sub.ID, !req.Immediately)
+	if err != nil {
+		s.respondServiceErrorWithContext(w, r, err, "cancel_subscription")
+		return
+	}
+	respondJSON(w, http.StatusOK, sub)
+}
+
+type changePlanRequest struct {
+	PlanID int64 `json:"plan_id"`
+}
+
+func (s *Server) handleChangeSubscriptionPlan(w http.ResponseWriter, r *http.Request) {
+	subscriptionID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	var req changePlanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.PlanID == 0 {
+		respondError(w, http.StatusBadRequest, errors.New("plan_id is required"))
+		return
+	}
+	sub, err := s.billing.GetSubscriptionByID(r.Context(), subscriptionID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	// 权限验证：只能修改自己的订阅，管理员可以修改任何人的
+	allowed, err := s.canAccessUser(r.Context(), sub.UserID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+	if sub.Status != models.SubscriptionActive && sub.Status != models.SubscriptionPastDue {
+		s.respondServiceError(w, services.ErrSubscriptionNotActive)
+		return
+	}
+	if sub.PlanID == req.PlanID {
+		respondError(w, http.StatusBadRequest, errors.New("subscription is already on this plan"))
+		return
+	}
+	plan, err := s.billing.GetPlanByID(r.Context(), req.PlanID)
+	if err != nil {
 		s.respondServiceError(w, err)
 		return
 	}
-	respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	if !plan.Active {
+		respondError(w, http.StatusBadRequest, errors.New("plan is not available"))
+		return
+	}
+
+	// 有 Stripe 订阅时先在 Stripe 侧换价，按比例结算差价
+	var periodEnd *time.Time
+	if sub.StripeSubscriptionID != nil && *sub.StripeSubscriptionID != "" {
+		if !s.payments.IsConfigured() {
+			s.respondServiceError(w, services.ErrStripeNotConfigured)
+			return
+		}
+		priceID, err := s.stripePriceForPlan(plan.Name)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		end, err := s.subs.ChangePrice(r.Context(), *sub.StripeSubscriptionID, priceID)
+		if err != nil {
+			respondErrorWithLog(w, r, http.StatusBadGateway, err, "stripe_change_plan")
+			return
+		}
+		periodEnd = &end
+	}
+
+	sub, change, err := s.billing.ChangeSubscriptionPlan(r.Context(), services.ChangePlanInput{
+		SubscriptionID: sub.ID,
+		PlanID:         plan.ID,
+		ChangedBy:      getUserIDFromContext(r.Context()),
+		PeriodEnd:      periodEnd,
+	})
+	if err != nil {
+		s.respondServiceErrorWithContext(w, r, err, "change_subscription_plan")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{
+		"subscription": sub,
+		"plan_change":  change,
+	})
+}
+
+func (s *Server) handleListPlanChanges(w http.ResponseWriter, r *http.Request) {
+	subscriptionID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	sub, err := s.billing.GetSubscriptionByID(r.Context(), subscriptionID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	allowed, err := s.canAccessUser(r.Context(), sub.UserID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+	changes, err := s.billing.ListPlanChanges(r.Context(), subscriptionID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, changes)
 }
 
 func (s *Server) handleGetSubscription(w http.ResponseWriter, r *http.Request) {
@@ -610,31 +905,48 @@ func (s *Server) handleGetSubscription(w http.ResponseWriter, r *http.Request) {
 }
 
 type createPrepaidCheckoutRequest struct {
-	UserID     int64  `json:"user_id"`
-	AmountCents int   `json:"amount_cents"`
-	SuccessURL string `json:"success_url"`
-	CancelURL  string `json:"cancel_url"`
+	UserID      int64  `json:"user_id"`
+	PackageID   int64  `json:"package_id"`   // 积分包 ID，与 amount_cents 二选一
+	AmountCents int    `json:"amount_cents"` // 自定义金额，受 PREPAID_CUSTOM_AMOUNT_CONFIGS 限制
+	SuccessURL  string `json:"success_url"`
+	CancelURL   string `json:"cancel_url"`
+	CouponCode  string `json:"coupon_code"` // 可选，使用 Stripe 折扣的优惠码
+	Provider    string `json:"provider"`    // 可选，支付平台名称（如 alipay），默认使用主支付平台
 }
 
 func (s *Server) handleCreatePrepaidCheckout(w http.ResponseWriter, r *http.Request) {
 	reqID := middleware.GetReqID(r.Context())
 	log.Printf("[INFO] [%s] Starting prepaid checkout", reqID)
 
-	if s.cfg.StripeSecretKey == "" {
-		log.Printf("[ERROR] [%s] Stripe not configured", reqID)
-		s.respondServiceErrorWithContext(w, r, services.ErrStripeNotConfigured, "stripe_not_configured")
-		return
-	}
 	var req createPrepaidCheckoutRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		log.Printf("[ERROR] [%s] Failed to decode request: %v", reqID, err)
 		respondErrorWithLog(w, r, http.StatusBadRequest, err, "decode_request")
 		return
 	}
-	log.Printf("[INFO] [%s] Prepaid request: user_id=%d, amount=%d cents", reqID, req.UserID, req.AmountCents)
+	provider, err := s.providerFor(req.Provider)
+	if err != nil {
+		respondErrorWithLog(w, r, http.StatusBadRequest, err, "payment_provider")
+		return
+	}
+	if !provider.IsConfigured() {
+		log.Printf("[ERROR] [%s] Payment provider not configured", reqID)
+		s.respondServiceErrorWithContext(w, r, services.ErrStripeNotConfigured, "stripe_not_configured")
+		return
+	}
+	// 积分包和自定义金额按 STRIPE_CURRENCY 定价，收款币种不同的支付平台不能直接按分收款
+	if currency := provider.Currency(); currency != "" && !strings.EqualFold(currency, s.cfg.StripeCurrency) {
+		respondErrorWithLog(w, r, http.StatusBadRequest, fmt.Errorf("%s charges in %s but prices are in %s", provider.Name(), currency, s.cfg.StripeCurrency), "payment_provider")
+		return
+	}
+	log.Printf("[INFO] [%s] Prepaid request: user_id=%d, package_id=%d, amount=%d cents", reqID, req.UserID, req.PackageID, req.AmountCents)
 
-	if req.UserID == 0 || req.AmountCents <= 0 || req.SuccessURL == "" || req.CancelURL == "" {
-		respondErrorWithLog(w, r, http.StatusBadRequest, errors.New("user_id, amount_cents, success_url, cancel_url are required"), "validation")
+	if req.UserID == 0 || req.SuccessURL == "" || req.CancelURL == "" {
+		respondErrorWithLog(w, r, http.StatusBadRequest, errors.New("user_id, success_url, cancel_url are required"), "validation")
+		return
+	}
+	if (req.PackageID == 0) == (req.AmountCents <= 0) {
+		respondErrorWithLog(w, r, http.StatusBadRequest, errors.New("exactly one of package_id or amount_cents is required"), "validation")
 		return
 	}
 	// 权限验证：只能为自己充值，管理员可以为任何人充值
@@ -648,14 +960,13 @@ func (s *Server) handleCreatePrepaidCheckout(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	order, err := s.svc.CreatePrepaidOrder(r.Context(), req.UserID, req.AmountCents)
-	if err != nil {
-		log.Printf("[ERROR] [%s] Failed to create prepaid order: %v", reqID, err)
-		s.respondServiceErrorWithContext(w, r, err, "create_prepaid_order")
+	// 优惠码依赖主支付平台的折扣券
+	if req.CouponCode != "" && provider != s.payments {
+		respondErrorWithLog(w, r, http.StatusBadRequest, fmt.Errorf("coupons are not supported by %s", provider.Name()), "validate_coupon")
 		return
 	}
-	log.Printf("[INFO] [%s] Created prepaid order: id=%d", reqID, order.ID)
 
+	// 创建订单和预留优惠码之前先查询 system_code 和 Customer，之后的失败都要放弃订单以释放优惠码
 	systemCode, err := s.svc.GetUserSystemCodeByID(r.Context(), req.UserID)
 	if err != nil {
 		log.Printf("[ERROR] [%s] Failed to get user system_code: %v", reqID, err)
@@ -663,71 +974,129 @@ func (s *Server) handleCreatePrepaidCheckout(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	// 其他支付平台没有客户对象，只有主支付平台关联 Customer
+	var customerID, providerName string
+	if provider == s.payments {
+		customerID, err = s.stripeCustomerFor(r.Context(), req.UserID)
+		if err != nil {
+			log.Printf("[ERROR] [%s] Failed to get stripe customer: %v", reqID, err)
+			respondErrorWithLog(w, r, http.StatusBadGateway, err, "stripe_customer")
+			return
+		}
+	} else {
+		providerName = provider.Name()
+	}
+
+	productName := "Prepaid Points"
+	var order models.Order
+	if req.PackageID != 0 {
+		var pkg models.PrepaidPackage
+		order, pkg, err = s.svc.CreatePackageOrder(r.Context(), req.UserID, req.PackageID)
+		productName = pkg.Name
+	} else {
+		order, err = s.svc.CreateCustomPrepaidOrder(r.Context(), req.UserID, req.AmountCents)
+	}
+	if err != nil {
+		log.Printf("[ERROR] [%s] Failed to create prepaid order: %v", reqID, err)
+		s.respondServiceErrorWithContext(w, r, err, "create_prepaid_order")
+		return
+	}
+	log.Printf("[INFO] [%s] Created prepaid order: id=%d", reqID, order.ID)
+
+	var coupon *models.Coupon
+	if req.CouponCode != "" {
+		c, err := s.svc.ReserveCheckoutCoupon(r.Context(), req.UserID, order.ID, req.CouponCode, services.CouponTargetPrepaid)
+		if err != nil {
+			log.Printf("[ERROR] [%s] Coupon %s rejected: %v", reqID, req.CouponCode, err)
+			s.abandonCheckoutOrder(r, order.ID)
+			s.respondServiceErrorWithContext(w, r, err, "validate_coupon")
+			return
+		}
+		coupon = &c
+	}
+
 	// 替换 URL 中的占位符
 	orderIDStr := strconv.FormatInt(order.ID, 10)
 	successURL := strings.Replace(req.SuccessURL, "{order_id}", orderIDStr, -1)
 	cancelURL := strings.Replace(req.CancelURL, "{order_id}", orderIDStr, -1)
 
-	stripe.Key = s.cfg.StripeSecretKey
-	params := &stripe.CheckoutSessionParams{
-		Mode:              stripe.String(string(stripe.CheckoutSessionModePayment)),
-		SuccessURL:        stripe.String(successURL),
-		CancelURL:         stripe.String(cancelURL),
-		ClientReferenceID: stripe.String(strconv.FormatInt(order.ID, 10)),
-		LineItems: []*stripe.CheckoutSessionLineItemParams{
-			{
-				PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
-					Currency:   stripe.String(s.cfg.StripeCurrency),
-					UnitAmount: stripe.Int64(int64(req.AmountCents)),
-					ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
-						Name: stripe.String("Prepaid Points"),
-					},
-				},
-				Quantity: stripe.Int64(1),
-			},
-		},
+	params := payments.CheckoutParams{
+		Mode:              payments.ModePayment,
+		CustomerID:        customerID,
+		SuccessURL:        successURL,
+		CancelURL:         cancelURL,
+		ClientReferenceID: strconv.FormatInt(order.ID, 10),
+		AmountCents:       order.AmountCents,
+		ProductName:       productName,
 		Metadata: map[string]string{
 			"order_id":    strconv.FormatInt(order.ID, 10),
 			"user_id":     strconv.FormatInt(req.UserID, 10),
 			"system_code": systemCode,
 		},
 	}
+	if coupon != nil {
+		params.CouponID = *coupon.StripeCouponID
+	}
 
-	log.Printf("[INFO] [%s] Creating Stripe checkout session...", reqID)
-	sess, err := session.New(params)
+	log.Printf("[INFO] [%s] Creating %s checkout session...", reqID, provider.Name())
+	sess, err := provider.CreateCheckout(r.Context(), params)
 	if err != nil {
-		// 详细记录 Stripe 错误
-		var stripeErr *stripe.Error
-		if errors.As(err, &stripeErr) {
-			log.Printf("[ERROR] [%s] Stripe API error: type=%s, code=%s, message=%s, param=%s",
-				reqID, stripeErr.Type, stripeErr.Code, stripeErr.Msg, stripeErr.Param)
-			respondErrorWithLog(w, r, http.StatusBadRequest,
-				fmt.Errorf("stripe error: %s - %s", stripeErr.Code, stripeErr.Msg), "stripe_api")
-		} else {
-			log.Printf("[ERROR] [%s] Failed to create Stripe session: %v", reqID, err)
-			respondErrorWithLog(w, r, http.StatusInternalServerError, err, "stripe_session_create")
-		}
+		s.abandonCheckoutOrder(r, order.ID)
+		respondCheckoutError(w, r, err)
 		return
 	}
-	log.Printf("[INFO] [%s] Stripe session created: id=%s", reqID, sess.ID)
+	log.Printf("[INFO] [%s] Checkout session created: id=%s", reqID, sess.ID)
 
-	if err := s.svc.LinkOrderSession(r.Context(), order.ID, sess.ID); err != nil {
+	if err := s.svc.LinkOrderSession(r.Context(), order.ID, sess.ID, providerName); err != nil {
 		log.Printf("[ERROR] [%s] Failed to link order session: %v", reqID, err)
+		s.abandonCheckoutOrder(r, order.ID)
 		s.respondServiceErrorWithContext(w, r, err, "link_order_session")
 		return
 	}
 	log.Printf("[INFO] [%s] Prepaid checkout completed successfully", reqID)
-	respondJSON(w, http.StatusCreated, map[string]any{
+	resp := map[string]any{
 		"order_id":       order.ID,
+		"provider":       provider.Name(),
 		"stripe_session": sess.ID,
 		"checkout_url":   sess.URL,
-	})
+	}
+	if sess.QRCode != "" {
+		resp["qr_code"] = sess.QRCode
+	}
+	respondJSON(w, http.StatusCreated, resp)
+}
+
+// abandonCheckoutOrder 未能创建结账会话时将订单标记为失败，释放预留的优惠码
+func (s *Server) abandonCheckoutOrder(r *http.Request, orderID int64) {
+	if err := s.svc.FailPendingOrder(r.Context(), orderID); err != nil {
+		log.Printf("[ERROR] [%s] Failed to abandon order %d: %v", middleware.GetReqID(r.Context()), orderID, err)
+	}
+}
+
+// providerFor 按名称选择支付平台，空字符串或主支付平台名称返回主支付平台
+func (s *Server) providerFor(name string) (payments.Provider, error) {
+	if name == "" || name == s.payments.Name() {
+		return s.payments, nil
+	}
+	if p, ok := s.alternatives[name]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("payment provider %q is not available", name)
+}
+
+// orderProvider 返回订单使用的支付平台
+func (s *Server) orderProvider(order models.Order) (payments.Provider, error) {
+	if order.PaymentProvider == nil {
+		return s.payments, nil
+	}
+	return s.providerFor(*order.PaymentProvider)
 }
 
 type reportUsageRequest struct {
 	UserID    int64  `json:"user_id"`
 	Units     int    `json:"units"`
 	RequestID string `json:"request_id"`
+	APIKey    string `json:"api_key"` // 可选，用户调用时使用的原始 API Key，按其限额检查
 }
 
 func (s *Server) handleReportUsage(w http.ResponseWriter, r *http.Request) {
@@ -751,7 +1120,7 @@ func (s *Server) handleReportUsage(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, err)
 		return
 	}
-	usage, err := s.svc.ReportUsage(r.Context(), req.UserID, req.Units, req.RequestID)
+	usage, err := s.svc.ReportUsage(r.Context(), req.UserID, req.Units, req.RequestID, req.APIKey)
 	if err != nil {
 		s.respondServiceError(w, err)
 		return
@@ -759,42 +1128,132 @@ func (s *Server) handleReportUsage(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusCreated, usage)
 }
 
-func (s *Server) handleListUsage(w http.ResponseWriter, r *http.Request) {
-	userID, err := parseID(r.URL.Query().Get("user_id"))
-	if err != nil {
+const maxUsageBatchSize = 1000
+
+type reportUsageBatchRequest struct {
+	Events []services.UsageEvent `json:"events"`
+}
+
+func (s *Server) handleReportUsageBatch(w http.ResponseWriter, r *http.Request) {
+	var req reportUsageBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		respondError(w, http.StatusBadRequest, err)
 		return
 	}
-	// 权限验证：只能查看自己的用量，管理员可以查看任何人
-	allowed, err := s.canAccessUser(r.Context(), userID)
-	if err != nil {
-		s.respondServiceError(w, err)
+	if len(req.Events) == 0 {
+		respondError(w, http.StatusBadRequest, errors.New("events is required"))
 		return
 	}
-	if !allowed {
-		respondError(w, http.StatusForbidden, errors.New("access denied"))
+	if len(req.Events) > maxUsageBatchSize {
+		respondError(w, http.StatusBadRequest, fmt.Errorf("too many events, max %d per batch", maxUsageBatchSize))
 		return
 	}
-	from, to, err := parseRange(r)
-	if err != nil {
+	results := s.svc.ReportUsageBatch(r.Context(), req.Events)
+	summary := map[string]int{}
+	for _, res := range results {
+		summary[res.Status]++
+	}
+	respondJSON(w, http.StatusOK, map[string]any{
+		"results": results,
+		"summary": summary,
+	})
+}
+
+type reverseUsageRequest struct {
+	UserID     int64   `json:"user_id"`
+	RequestID  string  `json:"request_id"`
+	ReversalID string  `json:"reversal_id"`
+	Points     float64 `json:"points"`
+	Reason     string  `json:"reason"`
+}
+
+func (s *Server) handleReverseUsage(w http.ResponseWriter, r *http.Request) {
+	var req reverseUsageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		respondError(w, http.StatusBadRequest, err)
 		return
 	}
-	records, err := s.svc.ListUsage(r.Context(), userID, from, to)
+	if req.UserID == 0 || req.RequestID == "" || req.ReversalID == "" {
+		respondError(w, http.StatusBadRequest, errors.New("user_id, request_id and reversal_id are required"))
+		return
+	}
+	if req.Points < 0 {
+		respondError(w, http.StatusBadRequest, errors.New("points must not be negative"))
+		return
+	}
+	reversal, replayed, err := s.svc.ReverseUsage(r.Context(), services.ReverseUsageInput{
+		UserID:      req.UserID,
+		RequestID:   req.RequestID,
+		ReversalKey: req.ReversalID,
+		Points:      req.Points,
+		Reason:      req.Reason,
+	})
 	if err != nil {
-		s.respondServiceError(w, err)
+		s.respondServiceErrorWithContext(w, r, err, "reverse_usage")
 		return
 	}
-	respondJSON(w, http.StatusOK, records)
+	status := http.StatusCreated
+	if replayed {
+		status = http.StatusOK
+	}
+	respondJSON(w, status, reversal)
 }
 
-func (s *Server) handleGetOrder(w http.ResponseWriter, r *http.Request) {
-	orderID, err := parseID(chi.URLParam(r, "id"))
+func (s *Server) handleListUsageReversals(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseID(r.URL.Query().Get("user_id"))
 	if err != nil {
 		respondError(w, http.StatusBadRequest, err)
 		return
 	}
-	order, err := s.svc.GetOrder(r.Context(), orderID)
+	requestID := r.URL.Query().Get("request_id")
+	if requestID == "" {
+		respondError(w, http.StatusBadRequest, errors.New("request_id is required"))
+		return
+	}
+	reversals, err := s.svc.ListUsageReversals(r.Context(), userID, requestID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, reversals)
+}
+
+func (s *Server) handleListUsage(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseID(r.URL.Query().Get("user_id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	// 权限验证：只能查看自己的用量，管理员可以查看任何人
+	allowed, err := s.canAccessUser(r.Context(), userID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+	from, to, err := parseRange(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	records, err := s.svc.ListUsage(r.Context(), userID, from, to)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, records)
+}
+
+func (s *Server) handleGetOrder(w http.ResponseWriter, r *http.Request) {
+	orderID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	order, err := s.svc.GetOrder(r.Context(), orderID)
 	if err != nil {
 		s.respondServiceError(w, err)
 		return
@@ -814,13 +1273,8 @@ func (s *Server) handleGetOrder(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleStripeWebhook(w http.ResponseWriter, r *http.Request) {
 	reqID := middleware.GetReqID(r.Context())
-	log.Printf("[INFO] [%s] Received Stripe webhook", reqID)
+	log.Printf("[INFO] [%s] Received %s webhook", reqID, s.payments.Name())
 
-	if s.cfg.StripeWebhookSecret == "" {
-		log.Printf("[ERROR] [%s] Stripe webhook secret not configured", reqID)
-		s.respondServiceError(w, services.ErrStripeNotConfigured)
-		return
-	}
 	payload, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Printf("[ERROR] [%s] Failed to read webhook payload: %v", reqID, err)
@@ -829,126 +1283,277 @@ func (s *Server) handleStripeWebhook(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("[INFO] [%s] Webhook payload size: %d bytes", reqID, len(payload))
 
-	sigHeader := r.Header.Get("Stripe-Signature")
-	if sigHeader == "" {
-		log.Printf("[ERROR] [%s] Missing Stripe-Signature header", reqID)
-		respondError(w, http.StatusBadRequest, errors.New("missing Stripe-Signature header"))
+	event, err := s.payments.ParseWebhook(payload, r.Header)
+	if err != nil {
+		if errors.Is(err, payments.ErrInvalidSignature) {
+			log.Printf("[ERROR] [%s] Webhook signature verification failed: %v", reqID, err)
+			respondError(w, http.StatusBadRequest, fmt.Errorf("webhook signature verification failed: %w", err))
+			return
+		}
+		log.Printf("[ERROR] [%s] Failed to parse webhook: %v", reqID, err)
+		s.respondServiceError(w, err)
 		return
 	}
+	log.Printf("[INFO] [%s] Webhook event type: %s, event ID: %s", reqID, event.Type, event.ID)
 
-	event, err := webhook.ConstructEvent(payload, sigHeader, s.cfg.StripeWebhookSecret)
+	processed, err := s.processPaymentEvent(r.Context(), event, payload)
 	if err != nil {
-		log.Printf("[ERROR] [%s] Webhook signature verification failed: %v", reqID, err)
-		respondError(w, http.StatusBadRequest, fmt.Errorf("webhook signature verification failed: %w", err))
+		log.Printf("[ERROR] [%s] Failed to process %s: %v", reqID, event.Type, err)
+		s.respondServiceError(w, err)
 		return
 	}
-	log.Printf("[INFO] [%s] Webhook event type: %s, event ID: %s", reqID, event.Type, event.ID)
+	if !processed {
+		log.Printf("[INFO] [%s] Event %s already processed, skipping", reqID, event.ID)
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// processPaymentEvent 按事件 ID 幂等处理支付平台事件，payload 为保存用于重放的原始内容
+func (s *Server) processPaymentEvent(ctx context.Context, event payments.Event, payload []byte) (bool, error) {
+	return s.billing.ProcessStripeEvent(ctx, event.ID, event.Type, payload, func(ctx context.Context) error {
+		return s.dispatchPaymentEvent(ctx, event)
+	})
+}
 
+// dispatchPaymentEvent 按事件类型处理支付平台事件，ctx 携带事件事务
+func (s *Server) dispatchPaymentEvent(ctx context.Context, event payments.Event) error {
+	reqID := middleware.GetReqID(ctx)
 	switch event.Type {
-	case "checkout.session.completed":
-		log.Printf("[INFO] [%s] Processing checkout.session.completed", reqID)
-		var sess stripe.CheckoutSession
-		if err := json.Unmarshal(event.Data.Raw, &sess); err != nil {
-			log.Printf("[ERROR] [%s] Failed to unmarshal checkout session: %v", reqID, err)
-			respondError(w, http.StatusBadRequest, err)
-			return
+	case payments.EventCheckoutCompleted:
+		if event.Checkout == nil {
+			return fmt.Errorf("%w: event %s has no checkout session", services.ErrInvalidRequest, event.ID)
 		}
-		log.Printf("[INFO] [%s] Checkout session ID: %s, ClientReferenceID: %s", reqID, sess.ID, sess.ClientReferenceID)
-		if err := s.processCheckoutSession(r.Context(), &sess); err != nil {
-			log.Printf("[ERROR] [%s] Failed to process checkout session: %v", reqID, err)
-			s.respondServiceError(w, err)
-			return
+		log.Printf("[INFO] [%s] Checkout session ID: %s, ClientReferenceID: %s", reqID, event.Checkout.SessionID, event.Checkout.ClientReferenceID)
+		return s.processCheckoutSession(ctx, event.Checkout)
+	case payments.EventCheckoutExpired:
+		if event.Checkout == nil {
+			return fmt.Errorf("%w: event %s has no checkout session", services.ErrInvalidRequest, event.ID)
 		}
-		log.Printf("[INFO] [%s] Successfully processed checkout.session.completed", reqID)
-	case "invoice.paid":
-		log.Printf("[INFO] [%s] Processing invoice.paid", reqID)
-		var inv stripe.Invoice
-		if err := json.Unmarshal(event.Data.Raw, &inv); err != nil {
-			log.Printf("[ERROR] [%s] Failed to unmarshal invoice: %v", reqID, err)
-			respondError(w, http.StatusBadRequest, err)
-			return
+		return s.processCheckoutSessionExpired(ctx, event.Checkout)
+	case payments.EventInvoicePaid:
+		if event.Invoice == nil {
+			return fmt.Errorf("%w: event %s has no invoice", services.ErrInvalidRequest, event.ID)
 		}
-		if err := s.processInvoicePaid(r.Context(), &inv); err != nil {
-			log.Printf("[ERROR] [%s] Failed to process invoice.paid: %v", reqID, err)
-			s.respondServiceError(w, err)
-			return
+		return s.processInvoicePaid(ctx, event.Invoice)
+	case payments.EventInvoicePaymentFailed:
+		if event.Invoice == nil {
+			return fmt.Errorf("%w: event %s has no invoice", services.ErrInvalidRequest, event.ID)
+		}
+		return s.processInvoicePaymentFailed(ctx, event.Invoice)
+	case payments.EventSubscriptionUpdated, payments.EventSubscriptionDeleted:
+		if event.Subscription == nil {
+			return fmt.Errorf("%w: event %s has no subscription", services.ErrInvalidRequest, event.ID)
+		}
+		return s.processSubscriptionChange(ctx, event.Subscription, event.Type == payments.EventSubscriptionDeleted)
+	case payments.EventChargeRefunded:
+		if event.Refund == nil {
+			return fmt.Errorf("%w: event %s has no charge", services.ErrInvalidRequest, event.ID)
 		}
-		log.Printf("[INFO] [%s] Successfully processed invoice.paid", reqID)
+		return s.processChargeRefunded(ctx, event.Refund)
+	case payments.EventDisputeCreated:
+		if event.Dispute == nil {
+			return fmt.Errorf("%w: event %s has no dispute", services.ErrInvalidRequest, event.ID)
+		}
+		return s.processDisputeCreated(ctx, event.Dispute)
+	case payments.EventPaymentSucceeded, payments.EventPaymentFailed:
+		if event.Payment == nil {
+			return fmt.Errorf("%w: event %s has no payment", services.ErrInvalidRequest, event.ID)
+		}
+		return s.processAutoTopUpPayment(ctx, event.Payment, event.Type == payments.EventPaymentSucceeded)
 	default:
 		log.Printf("[INFO] [%s] Ignoring unhandled event type: %s", reqID, event.Type)
+		return nil
 	}
-	respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
 
-func (s *Server) processCheckoutSession(ctx context.Context, sess *stripe.CheckoutSession) error {
+// orderForCheckoutSession 根据 ClientReferenceID 或会话 ID 查找结账会话对应的订单
+func (s *Server) orderForCheckoutSession(ctx context.Context, sess *payments.CheckoutEvent) (models.Order, error) {
 	var order models.Order
 	var err error
 
 	if sess.ClientReferenceID != "" {
 		if orderID, parseErr := strconv.ParseInt(sess.ClientReferenceID, 10, 64); parseErr == nil {
-			order, err = s.svc.GetOrder(ctx, orderID)
+			order, err = s.billing.GetOrder(ctx, orderID)
 		}
 	}
 	if err != nil || order.ID == 0 {
-		order, err = s.svc.GetOrderByStripeSessionID(ctx, sess.ID)
+		order, err = s.billing.GetOrderByStripeSessionID(ctx, sess.SessionID)
 	}
+	return order, err
+}
+
+func (s *Server) processCheckoutSession(ctx context.Context, sess *payments.CheckoutEvent) error {
+	if sess.Mode == payments.ModeSetup {
+		return s.processSetupSession(ctx, sess)
+	}
+	order, err := s.orderForCheckoutSession(ctx, sess)
 	if err != nil {
 		return err
 	}
-
-	stripeSubID := ""
-	if sess.Subscription != nil {
-		stripeSubID = sess.Subscription.ID
+	// 按支付宝等平台的要求核对实付金额，金额不一致时不标记为已支付
+	if sess.AmountPaid > 0 && sess.AmountPaid != order.AmountCents {
+		return fmt.Errorf("%w: order %d paid %d cents, expected %d", services.ErrInvalidRequest, order.ID, sess.AmountPaid, order.AmountCents)
 	}
-	stripePaymentID := ""
-	if sess.PaymentIntent != nil {
-		stripePaymentID = sess.PaymentIntent.ID
+
+	// 旧版结账创建的匿名 Customer 在首次回调时关联到用户
+	if sess.CustomerID != "" {
+		if _, err := s.billing.SaveStripeCustomerID(ctx, order.UserID, sess.CustomerID); err != nil && !errors.Is(err, services.ErrNotFound) {
+			return err
+		}
 	}
-	paidOrder, err := s.svc.MarkOrderPaid(ctx, order.ID, sess.ID, stripePaymentID, stripeSubID)
+	paidOrder, err := s.billing.MarkOrderPaid(ctx, order.ID, sess.SessionID, sess.PaymentID, sess.SubscriptionID)
 	if err != nil {
 		return err
 	}
 	if paidOrder.OrderType != models.OrderTypeSubscription || paidOrder.SubscriptionID == nil {
 		return nil
 	}
-	sub, err := s.svc.GetSubscriptionByID(ctx, *paidOrder.SubscriptionID)
+	sub, err := s.billing.GetSubscriptionByID(ctx, *paidOrder.SubscriptionID)
 	if err != nil {
 		return err
 	}
 	if sub.Status == models.SubscriptionActive && sub.EndsAt.After(time.Now().UTC()) {
 		return nil
 	}
-	plan, err := s.svc.GetPlanByID(ctx, sub.PlanID)
+	plan, err := s.billing.GetPlanByID(ctx, sub.PlanID)
 	if err != nil {
 		return err
 	}
-	return s.svc.ActivateSubscription(ctx, sub.ID, stripeSubID, plan.GrantPoints, plan.PeriodDays)
+	return s.billing.ActivateSubscription(ctx, sub.ID, sess.SubscriptionID, plan.GrantPoints, plan.PeriodDays)
 }
 
-func (s *Server) processInvoicePaid(ctx context.Context, inv *stripe.Invoice) error {
-	// v84 API: Subscription 现在在 Parent.SubscriptionDetails.Subscription 中
-	if inv.Parent == nil || inv.Parent.SubscriptionDetails == nil || inv.Parent.SubscriptionDetails.Subscription == nil {
+func (s *Server) processInvoicePaid(ctx context.Context, inv *payments.InvoiceEvent) error {
+	if inv.SubscriptionID == "" {
 		return nil
 	}
-	stripeSub := inv.Parent.SubscriptionDetails.Subscription
-	if stripeSub.ID == "" {
+	// 首期由 checkout.session.completed 激活，改价等其他账单不开启新周期
+	if !inv.Renewal {
 		return nil
 	}
-	sub, err := s.svc.GetSubscriptionByStripeID(ctx, stripeSub.ID)
+	sub, err := s.billing.GetSubscriptionByStripeID(ctx, inv.SubscriptionID)
+	if err != nil {
+		if errors.Is(err, services.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	plan, err := s.billing.GetPlanByID(ctx, sub.PlanID)
+	if err != nil {
+		return err
+	}
+	return s.billing.ActivateSubscription(ctx, sub.ID, inv.SubscriptionID, plan.GrantPoints, plan.PeriodDays)
+}
+
+// processCheckoutSessionExpired 结账会话过期未支付，将对应的待支付订单标记为失败
+func (s *Server) processCheckoutSessionExpired(ctx context.Context, sess *payments.CheckoutEvent) error {
+	order, err := s.orderForCheckoutSession(ctx, sess)
 	if err != nil {
 		if errors.Is(err, services.ErrNotFound) {
 			return nil
 		}
 		return err
 	}
-	if sub.EndsAt.After(time.Now().UTC().Add(1 * time.Hour)) {
+	return s.billing.FailPendingOrder(ctx, order.ID)
+}
+
+// processSubscriptionChange 同步支付平台订阅的状态和价格变更，deleted 表示订阅已被删除
+func (s *Server) processSubscriptionChange(ctx context.Context, sub *payments.SubscriptionEvent, deleted bool) error {
+	if sub.ID == "" {
+		return nil
+	}
+	status := sub.Status
+	cancelAtPeriodEnd := sub.CancelAtPeriodEnd
+	if deleted {
+		status = models.SubscriptionCanceled
+		cancelAtPeriodEnd = false
+	}
+	update := services.StripeSubscriptionUpdate{
+		Status:            status,
+		CancelAtPeriodEnd: &cancelAtPeriodEnd,
+		EndedAt:           sub.EndedAt,
+	}
+	for _, priceID := range sub.PriceIDs {
+		if name := s.planNameForStripePrice(priceID); name != "" {
+			update.PlanName = name
+			break
+		}
+	}
+	err := s.billing.SyncStripeSubscription(ctx, sub.ID, update)
+	if errors.Is(err, services.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) processInvoicePaymentFailed(ctx context.Context, inv *payments.InvoiceEvent) error {
+	if inv.SubscriptionID == "" {
+		return nil
+	}
+	err := s.billing.MarkSubscriptionPaymentFailed(ctx, inv.SubscriptionID)
+	if errors.Is(err, services.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// processChargeRefunded 按支付平台累计退款金额收回订单发放的积分，未关联订单的扣款忽略
+func (s *Server) processChargeRefunded(ctx context.Context, charge *payments.RefundEvent) error {
+	if charge.PaymentID == "" || charge.AmountRefunded <= 0 {
+		return nil
+	}
+	order, err := s.billing.GetOrderByPaymentIntentID(ctx, charge.PaymentID)
+	if errors.Is(err, services.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	providerName := s.payments.Name()
+	if order.PaymentProvider != nil {
+		providerName = *order.PaymentProvider
+	}
+	_, err = s.billing.RecordOrderRefund(ctx, services.OrderReversal{
+		OrderID:       order.ID,
+		RefundedCents: charge.AmountRefunded,
+		ChargedCents:  charge.Amount,
+		Note:          providerName + " refund " + charge.ChargeID,
+	})
+	return err
+}
+
+// processDisputeCreated 客户发起拒付时按争议金额收回订单发放的积分
+func (s *Server) processDisputeCreated(ctx context.Context, dispute *payments.DisputeEvent) error {
+	if dispute.PaymentID == "" {
+		return nil
+	}
+	order, err := s.billing.GetOrderByPaymentIntentID(ctx, dispute.PaymentID)
+	if errors.Is(err, services.ErrNotFound) {
 		return nil
 	}
-	plan, err := s.svc.GetPlanByID(ctx, sub.PlanID)
 	if err != nil {
 		return err
 	}
-	return s.svc.ActivateSubscription(ctx, sub.ID, stripeSub.ID, plan.GrantPoints, plan.PeriodDays)
+	_, err = s.billing.RecordOrderDispute(ctx, services.OrderReversal{
+		OrderID:       order.ID,
+		DisputedCents: dispute.Amount,
+		ChargedCents:  dispute.Charged,
+		Note:          s.payments.Name() + " dispute " + dispute.ID,
+	})
+	return err
+}
+
+// respondCheckoutError 支付平台拒绝的结账请求（价格、折扣券无效等）返回 400，其他错误返回 500
+func respondCheckoutError(w http.ResponseWriter, r *http.Request, err error) {
+	reqID := middleware.GetReqID(r.Context())
+	var providerErr *payments.Error
+	if errors.As(err, &providerErr) {
+		log.Printf("[ERROR] [%s] Payment provider error: provider=%s, code=%s, message=%s",
+			reqID, providerErr.Provider, providerErr.Code, providerErr.Message)
+		respondErrorWithLog(w, r, http.StatusBadRequest, providerErr, "stripe_api")
+		return
+	}
+	log.Printf("[ERROR] [%s] Failed to create checkout session: %v", reqID, err)
+	respondErrorWithLog(w, r, http.StatusInternalServerError, err, "stripe_session_create")
 }
 
 func (s *Server) respondServiceError(w http.ResponseWriter, err error) {
@@ -965,8 +1570,32 @@ func (s *Server) respondServiceErrorWithContext(w http.ResponseWriter, r *http.R
 		respondError(w, http.StatusConflict, err)
 	case errors.Is(err, services.ErrInsufficientPoints):
 		respondError(w, http.StatusConflict, err)
+	case errors.Is(err, services.ErrReversalExceedsUsage):
+		respondError(w, http.StatusConflict, err)
+	case errors.Is(err, services.ErrCouponInvalid):
+		respondError(w, http.StatusBadRequest, err)
+	case errors.Is(err, services.ErrCouponExhausted):
+		respondError(w, http.StatusConflict, err)
+	case errors.Is(err, services.ErrPackageUnavailable):
+		respondError(w, http.StatusBadRequest, err)
+	case errors.Is(err, services.ErrAPIKeyInvalid):
+		respondError(w, http.StatusForbidden, err)
+	case errors.Is(err, services.ErrAPIKeyExpired):
+		respondError(w, http.StatusForbidden, err)
+	case errors.Is(err, services.ErrAPIKeyLimitExceeded):
+		respondError(w, http.StatusTooManyRequests, err)
+	case errors.Is(err, services.ErrTransferDisabled):
+		respondError(w, http.StatusForbidden, err)
+	case errors.Is(err, services.ErrTransferLimitExceeded):
+		respondError(w, http.StatusConflict, err)
+	case errors.Is(err, services.ErrSubscriptionNotActive):
+		respondError(w, http.StatusConflict, err)
 	case errors.Is(err, services.ErrSubscriptionRequired):
 		respondError(w, http.StatusForbidden, err)
+	case errors.Is(err, services.ErrPaymentMethodRequired):
+		respondError(w, http.StatusBadRequest, err)
+	case errors.Is(err, services.ErrPaymentIntentMismatch):
+		respondError(w, http.StatusConflict, err)
 	case errors.Is(err, services.ErrStripeNotConfigured):
 		respondError(w, http.StatusServiceUnavailable, err)
 	case errors.Is(err, services.ErrInvalidCode):
@@ -1009,6 +1638,28 @@ func (s *Server) stripePriceForPlan(name string) (string, error) {
 	}
 }
 
+// planNameForStripePrice 根据 Stripe 价格 ID 反查计划名称，未配置的价格返回空字符串
+func (s *Server) planNameForStripePrice(priceID string) string {
+	switch {
+	case priceID == "":
+		return ""
+	case priceID == s.cfg.StripePriceMonthly:
+		return "monthly"
+	case priceID == s.cfg.StripePriceQuarterly:
+		return "quarterly"
+	default:
+		return ""
+	}
+}
+
+// clientIP 获取请求来源 IP（RealIP 中间件已处理代理头）
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
 func parseID(raw string) (int64, error) {
 	if raw == "" {
 		return 0, errors.New("id is required")
@@ -1230,6 +1881,800 @@ func (s *Server) handleAdminGetUserBalances(w http.ResponseWriter, r *http.Reque
 	respondJSON(w, http.StatusOK, balances)
 }
 
+func (s *Server) handleAdminGetUserCredit(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	allowed, err := s.canAccessUser(r.Context(), userID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+
+	status, err := s.svc.GetCreditStatus(r.Context(), userID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, status)
+}
+
+type setCreditLimitRequest struct {
+	LimitPoints float64 `json:"limit_points"`
+}
+
+func (s *Server) handleAdminSetUserCreditLimit(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	allowed, err := s.canAccessUser(r.Context(), userID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+
+	var req setCreditLimitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.LimitPoints < 0 {
+		respondError(w, http.StatusBadRequest, errors.New("limit_points must not be negative"))
+		return
+	}
+
+	if err := s.svc.SetUserCreditLimit(r.Context(), userID, req.LimitPoints); err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleAdminSetSystemCreditLimit(w http.ResponseWriter, r *http.Request) {
+	systemCode, err := s.resolveSystemCode(r.Context())
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if systemCode == "" {
+		respondError(w, http.StatusBadRequest, errors.New("system_code could not be resolved"))
+		return
+	}
+
+	var req setCreditLimitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.LimitPoints < 0 {
+		respondError(w, http.StatusBadRequest, errors.New("limit_points must not be negative"))
+		return
+	}
+
+	if err := s.svc.SetSystemCreditLimit(r.Context(), systemCode, req.LimitPoints); err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+type adminGrantPointsRequest struct {
+	BucketType string     `json:"bucket_type"`
+	Points     float64    `json:"points"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	ExpiryDays int        `json:"expiry_days"`
+	Reason     string     `json:"reason"`
+}
+
+func (s *Server) handleAdminGrantPoints(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	allowed, err := s.canAccessUser(r.Context(), userID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+
+	var req adminGrantPointsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.BucketType == "" || req.Points <= 0 || strings.TrimSpace(req.Reason) == "" {
+		respondError(w, http.StatusBadRequest, errors.New("bucket_type, points and reason are required"))
+		return
+	}
+	expiresAt := req.ExpiresAt
+	if expiresAt == nil && req.ExpiryDays > 0 {
+		t := time.Now().UTC().Add(time.Duration(req.ExpiryDays) * 24 * time.Hour)
+		expiresAt = &t
+	}
+
+	bucket, err := s.svc.AdminGrantPoints(r.Context(), services.AdminGrantInput{
+		UserID:     userID,
+		AdminID:    getUserIDFromContext(r.Context()),
+		BucketType: req.BucketType,
+		Points:     req.Points,
+		ExpiresAt:  expiresAt,
+		Note:       req.Reason,
+	})
+	if err != nil {
+		s.respondServiceErrorWithContext(w, r, err, "admin_grant_points")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, bucket)
+}
+
+// authorizeBucket 检查当前管理员是否可以操作指定积分桶
+func (s *Server) authorizeBucket(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	bucketID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return 0, false
+	}
+	bucket, err := s.svc.GetBucket(r.Context(), bucketID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return 0, false
+	}
+	allowed, err := s.canAccessUser(r.Context(), bucket.UserID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return 0, false
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return 0, false
+	}
+	return bucketID, true
+}
+
+type adminAdjustBucketRequest struct {
+	DeltaPoints float64 `json:"delta_points"`
+	Reason      string  `json:"reason"`
+}
+
+func (s *Server) handleAdminAdjustBucket(w http.ResponseWriter, r *http.Request) {
+	bucketID, ok := s.authorizeBucket(w, r)
+	if !ok {
+		return
+	}
+
+	var req adminAdjustBucketRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.DeltaPoints == 0 || strings.TrimSpace(req.Reason) == "" {
+		respondError(w, http.StatusBadRequest, errors.New("delta_points and reason are required"))
+		return
+	}
+
+	bucket, err := s.svc.AdminAdjustBucket(r.Context(), bucketID, getUserIDFromContext(r.Context()), req.DeltaPoints, req.Reason)
+	if err != nil {
+		s.respondServiceErrorWithContext(w, r, err, "admin_adjust_bucket")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, bucket)
+}
+
+type adminCloseBucketRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (s *Server) handleAdminExpireBucket(w http.ResponseWriter, r *http.Request) {
+	s.handleAdminCloseBucket(w, r, false)
+}
+
+func (s *Server) handleAdminVoidBucket(w http.ResponseWriter, r *http.Request) {
+	s.handleAdminCloseBucket(w, r, true)
+}
+
+func (s *Server) handleAdminCloseBucket(w http.ResponseWriter, r *http.Request, void bool) {
+	bucketID, ok := s.authorizeBucket(w, r)
+	if !ok {
+		return
+	}
+
+	var req adminCloseBucketRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		respondError(w, http.StatusBadRequest, errors.New("reason is required"))
+		return
+	}
+
+	bucket, err := s.svc.AdminCloseBucket(r.Context(), bucketID, getUserIDFromContext(r.Context()), void, req.Reason)
+	if err != nil {
+		s.respondServiceErrorWithContext(w, r, err, "admin_close_bucket")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, bucket)
+}
+
+type adminRefundOrderRequest struct {
+	AmountCents int    `json:"amount_cents"` // 为 0 表示退还剩余全部金额
+	Reason      string `json:"reason"`
+}
+
+func (s *Server) handleAdminRefundOrder(w http.ResponseWriter, r *http.Request) {
+	orderID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	var req adminRefundOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.AmountCents < 0 || strings.TrimSpace(req.Reason) == "" {
+		respondError(w, http.StatusBadRequest, errors.New("reason is required and amount_cents must not be negative"))
+		return
+	}
+
+	order, err := s.svc.GetOrder(r.Context(), orderID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	allowed, err := s.canAccessUser(r.Context(), order.UserID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+	if order.Status != models.OrderStatusPaid && order.Status != models.OrderStatusRefunded {
+		respondError(w, http.StatusConflict, errors.New("only paid orders can be refunded"))
+		return
+	}
+	if order.StripePaymentIntentID == nil || *order.StripePaymentIntentID == "" {
+		respondError(w, http.StatusBadRequest, errors.New("order has no stripe payment to refund"))
+		return
+	}
+	provider, err := s.orderProvider(order)
+	if err != nil {
+		respondError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if !provider.IsConfigured() {
+		s.respondServiceError(w, services.ErrStripeNotConfigured)
+		return
+	}
+
+	payment, err := provider.GetPayment(r.Context(), *order.StripePaymentIntentID)
+	if err != nil {
+		respondErrorWithLog(w, r, http.StatusBadGateway, err, "stripe_get_payment_intent")
+		return
+	}
+	refundable := payment.AmountReceived - order.RefundedCents
+	amount := req.AmountCents
+	if amount == 0 {
+		amount = refundable
+	}
+	if amount <= 0 || amount > refundable {
+		respondError(w, http.StatusBadRequest, fmt.Errorf("amount_cents must be between 1 and %d", refundable))
+		return
+	}
+	_, err = provider.Refund(r.Context(), payments.RefundParams{
+		PaymentID:   *order.StripePaymentIntentID,
+		AmountCents: amount,
+		Metadata: map[string]string{
+			"order_id": strconv.FormatInt(order.ID, 10),
+			"reason":   req.Reason,
+		},
+	})
+	if err != nil {
+		respondErrorWithLog(w, r, http.StatusBadGateway, err, "stripe_create_refund")
+		return
+	}
+
+	// 后续 charge.refunded Webhook 携带相同的累计金额，不会重复收回积分
+	order, err = s.svc.RecordOrderRefund(r.Context(), services.OrderReversal{
+		OrderID:       order.ID,
+		RefundedCents: order.RefundedCents + amount,
+		ChargedCents:  payment.AmountReceived,
+		Note:          req.Reason,
+	})
+	if err != nil {
+		s.respondServiceErrorWithContext(w, r, err, "admin_refund_order")
+		return
+	}
+	respondJSON(w, http.StatusOK, order)
+}
+
+type redeemCouponRequest struct {
+	UserID int64  `json:"user_id"`
+	Code   string `json:"code"`
+}
+
+func (s *Server) handleRedeemCoupon(w http.ResponseWriter, r *http.Request) {
+	var req redeemCouponRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.UserID == 0 || strings.TrimSpace(req.Code) == "" {
+		respondError(w, http.StatusBadRequest, errors.New("user_id and code are required"))
+		return
+	}
+	// 权限验证：只能为自己兑换，管理员可以为同系统用户兑换
+	allowed, err := s.canAccessUser(r.Context(), req.UserID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+
+	redemption, bucket, err := s.svc.RedeemCoupon(r.Context(), req.UserID, req.Code)
+	if err != nil {
+		s.respondServiceErrorWithContext(w, r, err, "redeem_coupon")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, map[string]any{
+		"redemption": redemption,
+		"bucket":     bucket,
+	})
+}
+
+type adminCreateCouponRequest struct {
+	Code             string     `json:"code"`
+	Points           float64    `json:"points"`
+	PointsExpiryDays int        `json:"points_expiry_days"`
+	StripeCouponID   string     `json:"stripe_coupon_id"`
+	MaxRedemptions   *int       `json:"max_redemptions"`
+	PerUserLimit     int        `json:"per_user_limit"`
+	ValidFrom        *time.Time `json:"valid_from"`
+	ValidUntil       *time.Time `json:"valid_until"`
+	AppliesTo        []string   `json:"applies_to"`
+}
+
+func (s *Server) handleAdminCreateCoupon(w http.ResponseWriter, r *http.Request) {
+	systemCode, err := s.resolveSystemCode(r.Context())
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if systemCode == "" {
+		respondError(w, http.StatusBadRequest, errors.New("system_code could not be resolved"))
+		return
+	}
+
+	var req adminCreateCouponRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if strings.TrimSpace(req.Code) == "" || (req.Points <= 0 && req.StripeCouponID == "") {
+		respondError(w, http.StatusBadRequest, errors.New("code and points or stripe_coupon_id are required"))
+		return
+	}
+
+	coupon := models.Coupon{
+		SystemCode:       systemCode,
+		Code:             req.Code,
+		Points:           req.Points,
+		PointsExpiryDays: req.PointsExpiryDays,
+		MaxRedemptions:   req.MaxRedemptions,
+		PerUserLimit:     req.PerUserLimit,
+		ValidFrom:        req.ValidFrom,
+		ValidUntil:       req.ValidUntil,
+		AppliesTo:        req.AppliesTo,
+	}
+	if req.StripeCouponID != "" {
+		coupon.StripeCouponID = &req.StripeCouponID
+	}
+	created, err := s.svc.CreateCoupon(r.Context(), coupon)
+	if err != nil {
+		s.respondServiceErrorWithContext(w, r, err, "create_coupon")
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, created)
+}
+
+func (s *Server) handleAdminListCoupons(w http.ResponseWriter, r *http.Request) {
+	systemCode, err := s.resolveSystemCode(r.Context())
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	coupons, err := s.svc.ListCoupons(r.Context(), systemCode)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, coupons)
+}
+
+type adminUpdateCouponRequest struct {
+	Active *bool `json:"active"`
+}
+
+func (s *Server) handleAdminUpdateCoupon(w http.ResponseWriter, r *http.Request) {
+	couponID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	coupon, err := s.svc.GetCoupon(r.Context(), couponID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	systemCode, err := s.resolveSystemCode(r.Context())
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if systemCode != "" && systemCode != coupon.SystemCode {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+
+	var req adminUpdateCouponRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Active == nil {
+		respondError(w, http.StatusBadRequest, errors.New("active is required"))
+		return
+	}
+
+	if err := s.svc.SetCouponActive(r.Context(), couponID, *req.Active); err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	coupon.Active = *req.Active
+
+	respondJSON(w, http.StatusOK, coupon)
+}
+
+func (s *Server) handleGetUserReferrals(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	// 权限验证：只能查看自己的推荐记录，管理员可以查看同系统用户的
+	allowed, err := s.canAccessUser(r.Context(), userID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+
+	summary, err := s.svc.GetReferralSummary(r.Context(), userID)
+	if err != nil {
+		s.respondServiceErrorWithContext(w, r, err, "get_referral_summary")
+		return
+	}
+	respondJSON(w, http.StatusOK, summary)
+}
+
+func (s *Server) handleAdminListReferrals(w http.ResponseWriter, r *http.Request) {
+	page, pageSize := parsePagination(r)
+	status := r.URL.Query().Get("status")
+	systemCode, err := s.resolveSystemCode(r.Context())
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+
+	referrals, total, err := s.svc.ListSystemReferrals(r.Context(), systemCode, status, page, pageSize)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]any{
+		"referrals": referrals,
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+	})
+}
+
+type createTransferRequest struct {
+	RecipientID    int64   `json:"recipient_id"`
+	RecipientEmail string  `json:"recipient_email"`
+	Points         float64 `json:"points"`
+	TransferKey    string  `json:"transfer_key"`
+	Note           string  `json:"note"`
+}
+
+func (s *Server) handleCreateTransfer(w http.ResponseWriter, r *http.Request) {
+	senderID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	// 权限验证：只能转出自己的积分，管理员可以代同系统用户转出
+	allowed, err := s.canAccessUser(r.Context(), senderID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+
+	var req createTransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if (req.RecipientID == 0 && req.RecipientEmail == "") || req.Points <= 0 || req.TransferKey == "" {
+		respondError(w, http.StatusBadRequest, errors.New("recipient_id or recipient_email, points and transfer_key are required"))
+		return
+	}
+
+	result, replayed, err := s.svc.TransferPoints(r.Context(), services.TransferInput{
+		SenderID:       senderID,
+		RecipientID:    req.RecipientID,
+		RecipientEmail: req.RecipientEmail,
+		Points:         req.Points,
+		TransferKey:    req.TransferKey,
+		Note:           req.Note,
+	})
+	if err != nil {
+		s.respondServiceErrorWithContext(w, r, err, "transfer_points")
+		return
+	}
+
+	status := http.StatusCreated
+	if replayed {
+		status = http.StatusOK
+	}
+	respondJSON(w, status, result)
+}
+
+func (s *Server) handleListTransfers(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	allowed, err := s.canAccessUser(r.Context(), userID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+
+	transfers, err := s.svc.ListTransfers(r.Context(), userID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, transfers)
+}
+
+func (s *Server) handleGetNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	allowed, err := s.canAccessUser(r.Context(), userID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+
+	settings, err := s.svc.GetNotificationSettings(r.Context(), userID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, settings)
+}
+
+type setNotificationSettingsRequest struct {
+	Enabled          bool     `json:"enabled"`
+	LowBalancePoints *float64 `json:"low_balance_points"`
+	ExpiringDays     *int     `json:"expiring_days"`
+}
+
+func (s *Server) handleSetNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	userID, err := parseID(chi.URLParam(r, "id"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	allowed, err := s.canAccessUser(r.Context(), userID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if !allowed {
+		respondError(w, http.StatusForbidden, errors.New("access denied"))
+		return
+	}
+
+	var req setNotificationSettingsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	settings, err := s.svc.SetNotificationSettings(r.Context(), models.NotificationSettings{
+		UserID:           userID,
+		Enabled:          req.Enabled,
+		LowBalancePoints: req.LowBalancePoints,
+		ExpiringDays:     req.ExpiringDays,
+	})
+	if err != nil {
+		s.respondServiceErrorWithContext(w, r, err, "set_notification_settings")
+		return
+	}
+	respondJSON(w, http.StatusOK, settings)
+}
+
+func (s *Server) handleAdminGetTransferSettings(w http.ResponseWriter, r *http.Request) {
+	systemCode, err := s.resolveSystemCode(r.Context())
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if systemCode == "" {
+		respondError(w, http.StatusBadRequest, errors.New("system_code could not be resolved"))
+		return
+	}
+	settings, err := s.svc.GetTransferSettings(r.Context(), systemCode)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, settings)
+}
+
+type setTransferSettingsRequest struct {
+	Enabled              bool     `json:"enabled"`
+	MinPoints            float64  `json:"min_points"`
+	MaxPointsPerTransfer float64  `json:"max_points_per_transfer"`
+	DailyLimitPoints     float64  `json:"daily_limit_points"`
+	BucketTypes          []string `json:"bucket_types"`
+}
+
+func (s *Server) handleAdminSetTransferSettings(w http.ResponseWriter, r *http.Request) {
+	systemCode, err := s.resolveSystemCode(r.Context())
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if systemCode == "" {
+		respondError(w, http.StatusBadRequest, errors.New("system_code could not be resolved"))
+		return
+	}
+
+	var req setTransferSettingsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	settings, err := s.svc.SetTransferSettings(r.Context(), models.TransferSettings{
+		SystemCode:           systemCode,
+		Enabled:              req.Enabled,
+		MinPoints:            req.MinPoints,
+		MaxPointsPerTransfer: req.MaxPointsPerTransfer,
+		DailyLimitPoints:     req.DailyLimitPoints,
+		BucketTypes:          req.BucketTypes,
+	})
+	if err != nil {
+		s.respondServiceErrorWithContext(w, r, err, "set_transfer_settings")
+		return
+	}
+	respondJSON(w, http.StatusOK, settings)
+}
+
+// handleAdminListStripeEvents 列出 Stripe Webhook 事件日志，默认只列出处理失败的事件
+// Stripe 账户由所有系统共用，事件不按 system_code 区分
+func (s *Server) handleAdminListStripeEvents(w http.ResponseWriter, r *http.Request) {
+	page, pageSize := parsePagination(r)
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = models.StripeEventFailed
+	} else if status == "all" {
+		status = ""
+	}
+
+	events, total, err := s.svc.ListStripeEvents(r.Context(), status, page, pageSize)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]any{
+		"events":    events,
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+	})
+}
+
+// handleAdminReplayStripeEvent 使用已保存的事件内容重新处理未成功的 Stripe 事件
+func (s *Server) handleAdminReplayStripeEvent(w http.ResponseWriter, r *http.Request) {
+	eventID := chi.URLParam(r, "id")
+	stored, err := s.svc.GetStripeEvent(r.Context(), eventID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if stored.Status == models.StripeEventProcessed {
+		respondError(w, http.StatusConflict, errors.New("event already processed"))
+		return
+	}
+	// 其他支付平台的事件 ID 带有平台前缀，按前缀选择解析方式
+	provider, err := s.providerFor(payments.EventProvider(eventID))
+	if err != nil {
+		respondError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	event, err := provider.ParseEvent(stored.Payload)
+	if err != nil {
+		respondErrorWithLog(w, r, http.StatusInternalServerError, err, "unmarshal_stored_stripe_event")
+		return
+	}
+
+	_, processErr := s.processPaymentEvent(r.Context(), event, stored.Payload)
+	stored, err = s.svc.GetStripeEvent(r.Context(), eventID)
+	if err != nil {
+		s.respondServiceError(w, err)
+		return
+	}
+	if processErr != nil {
+		log.Printf("[ERROR] Replay of stripe event %s failed: %v", eventID, processErr)
+	}
+	respondJSON(w, http.StatusOK, stored)
+}
+
 // ========== 内部服务接口 Handlers ==========
 
 // internalAPIKeyMiddleware 内部服务 API Key 验证中间件
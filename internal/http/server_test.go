@@ -1,10 +1,16 @@
 package httpapi
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 	"time"
+
+	"easyusersys/internal/models"
+	"easyusersys/internal/services"
 )
 
 func TestParseID(t *testing.T) {
@@ -49,3 +55,67 @@ func TestParseRangeCustom(t *testing.T) {
 		t.Fatalf("range mismatch")
 	}
 }
+
+func TestParseLedgerQuery(t *testing.T) {
+	q := url.Values{}
+	q.Set("cursor", "42")
+	q.Set("limit", "10")
+	q.Set("reason", "usage, prepaid_grant,")
+	q.Set("bucket_type", "prepaid")
+	q.Set("from", "2025-01-01T00:00:00Z")
+	req := &http.Request{URL: &url.URL{RawQuery: q.Encode()}}
+	got, err := parseLedgerQuery(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Cursor != 42 || got.Limit != 10 {
+		t.Fatalf("unexpected cursor/limit: %d/%d", got.Cursor, got.Limit)
+	}
+	if len(got.Reasons) != 2 || got.Reasons[1] != "prepaid_grant" {
+		t.Fatalf("unexpected reasons: %v", got.Reasons)
+	}
+	if len(got.BucketTypes) != 1 || got.From == nil || got.To != nil {
+		t.Fatalf("unexpected filters: %+v", got)
+	}
+
+	q.Set("cursor", "abc")
+	req = &http.Request{URL: &url.URL{RawQuery: q.Encode()}}
+	if _, err := parseLedgerQuery(req); err == nil {
+		t.Fatalf("expected error for invalid cursor")
+	}
+}
+
+func TestRespondServiceErrorAPIKeyStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "invalid key", err: services.ErrAPIKeyInvalid, want: http.StatusForbidden},
+		{name: "expired key", err: services.ErrAPIKeyExpired, want: http.StatusForbidden},
+		{name: "per request limit", err: fmt.Errorf("%w: request costs 12 points, max 10 per request", services.ErrAPIKeyLimitExceeded), want: http.StatusTooManyRequests},
+		{name: "daily limit", err: fmt.Errorf("%w: daily limit 100 points", services.ErrAPIKeyLimitExceeded), want: http.StatusTooManyRequests},
+		{name: "invalid limits", err: fmt.Errorf("%w: limit_window must be calendar or rolling", services.ErrInvalidRequest), want: http.StatusBadRequest},
+	}
+	s := &Server{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.respondServiceError(rec, tt.err)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminListLedgerRequiresSystemCode(t *testing.T) {
+	// 无法确定管理员所属系统时不能按空 system_code（即全部系统）查询
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/ledger", nil)
+	ctx := context.WithValue(req.Context(), contextKeyRole, models.UserRoleAdmin)
+	rec := httptest.NewRecorder()
+	(&Server{}).handleAdminListLedger(rec, req.WithContext(ctx))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,16 @@
+package httpapi
+
+import (
+	"context"
+	"time"
+)
+
+// subscriptionManager 在支付平台侧修改订阅，由 payments.Provider 实现，测试中可替换为不访问网络的实现
+type subscriptionManager interface {
+	// CancelAtPeriodEnd 当前周期结束后不再续费
+	CancelAtPeriodEnd(ctx context.Context, stripeSubscriptionID string) error
+	// CancelNow 立即取消订阅，prorate 为 true 时按剩余时间生成抵扣
+	CancelNow(ctx context.Context, stripeSubscriptionID string, prorate bool) error
+	// ChangePrice 将订阅切换到新价格并按比例计费，返回切换后当前周期的结束时间
+	ChangePrice(ctx context.Context, stripeSubscriptionID, priceID string) (time.Time, error)
+}
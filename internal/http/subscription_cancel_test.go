@@ -0,0 +1,131 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"easyusersys/internal/models"
+	"easyusersys/internal/payments"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// fakeCanceler 记录对 Stripe 的取消请求
+type fakeCanceler struct {
+	atPeriodEnd []string
+	now         []string
+	prorated    bool
+	err         error
+}
+
+func (f *fakeCanceler) CancelAtPeriodEnd(ctx context.Context, stripeSubscriptionID string) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.atPeriodEnd = append(f.atPeriodEnd, stripeSubscriptionID)
+	return nil
+}
+
+func (f *fakeCanceler) CancelNow(ctx context.Context, stripeSubscriptionID string, prorate bool) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.now = append(f.now, stripeSubscriptionID)
+	f.prorated = prorate
+	return nil
+}
+
+func (f *fakeCanceler) ChangePrice(ctx context.Context, stripeSubscriptionID, priceID string) (time.Time, error) {
+	return time.Time{}, errors.New("not implemented")
+}
+
+func newCancelTestServer(billing *fakeBilling, canceler *fakeCanceler) *Server {
+	return &Server{
+		billing:  billing,
+		payments: payments.NewStripeProvider("sk_test", "", "usd"),
+		subs:     canceler,
+	}
+}
+
+// postCancel 以 userID 身份调用取消订阅接口
+func postCancel(s *Server, userID int64, subID, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/subscriptions/"+subID+"/cancel", strings.NewReader(body))
+	routeCtx := chi.NewRouteContext()
+	routeCtx.URLParams.Add("id", subID)
+	ctx := context.WithValue(req.Context(), chi.RouteCtxKey, routeCtx)
+	ctx = context.WithValue(ctx, contextKeyUserID, userID)
+	ctx = context.WithValue(ctx, contextKeyRole, models.UserRoleUser)
+	rec := httptest.NewRecorder()
+	s.handleCancelSubscription(rec, req.WithContext(ctx))
+	return rec
+}
+
+func newCancelFixture() *fakeBilling {
+	billing := newFakeBilling()
+	stripeA, stripeB := "sub_a", "sub_b"
+	billing.subscriptions[1] = models.Subscription{ID: 1, UserID: 5, Status: models.SubscriptionActive, StripeSubscriptionID: &stripeA}
+	billing.subscriptions[2] = models.Subscription{ID: 2, UserID: 5, Status: models.SubscriptionActive, StripeSubscriptionID: &stripeB}
+	return billing
+}
+
+func TestCancelSubscriptionDefaultsToPeriodEnd(t *testing.T) {
+	billing := newCancelFixture()
+	canceler := &fakeCanceler{}
+	rec := postCancel(newCancelTestServer(billing, canceler), 5, "1", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(canceler.atPeriodEnd) != 1 || canceler.atPeriodEnd[0] != "sub_a" || len(canceler.now) != 0 {
+		t.Fatalf("unexpected stripe calls: %+v", canceler)
+	}
+	if atPeriodEnd, ok := billing.canceled[1]; !ok || !atPeriodEnd {
+		t.Fatalf("expected subscription 1 to be canceled at period end")
+	}
+	if _, ok := billing.canceled[2]; ok {
+		t.Fatalf("other subscriptions must not be canceled")
+	}
+}
+
+func TestCancelSubscriptionImmediately(t *testing.T) {
+	billing := newCancelFixture()
+	canceler := &fakeCanceler{}
+	rec := postCancel(newCancelTestServer(billing, canceler), 5, "2", `{"immediately":true,"prorate":true}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(canceler.now) != 1 || canceler.now[0] != "sub_b" || !canceler.prorated {
+		t.Fatalf("unexpected stripe calls: %+v", canceler)
+	}
+	if atPeriodEnd, ok := billing.canceled[2]; !ok || atPeriodEnd {
+		t.Fatalf("expected subscription 2 to be canceled immediately")
+	}
+}
+
+func TestCancelSubscriptionStripeFailureKeepsLocalState(t *testing.T) {
+	billing := newCancelFixture()
+	canceler := &fakeCanceler{err: errors.New("stripe unavailable")}
+	rec := postCancel(newCancelTestServer(billing, canceler), 5, "1", "")
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", rec.Code)
+	}
+	if len(billing.canceled) != 0 {
+		t.Fatalf("local subscription must not change when stripe fails")
+	}
+}
+
+func TestCancelSubscriptionOtherUser(t *testing.T) {
+	billing := newCancelFixture()
+	canceler := &fakeCanceler{}
+	rec := postCancel(newCancelTestServer(billing, canceler), 6, "1", "")
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+	if len(canceler.atPeriodEnd) != 0 || len(billing.canceled) != 0 {
+		t.Fatalf("subscription of another user must not be canceled")
+	}
+}
@@ -0,0 +1,474 @@
+package httpapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"easyusersys/internal/config"
+	"easyusersys/internal/models"
+	"easyusersys/internal/payments"
+	"easyusersys/internal/services"
+
+	"github.com/stripe/stripe-go/v84/webhook"
+)
+
+const testWebhookSecret = "whsec_test_secret"
+
+// fakeBilling 记录 Webhook 处理过程中对服务层的调用
+type fakeBilling struct {
+	orders        map[int64]models.Order
+	failedOrders  []int64
+	syncs         map[string]services.StripeSubscriptionUpdate
+	paymentFailed []string
+	refunds       []services.OrderReversal
+	disputes      []services.OrderReversal
+	events        map[string]string // 事件 ID -> 处理状态
+	subscriptions map[int64]models.Subscription
+	canceled      map[int64]bool   // 订阅 ID -> 是否到期取消
+	savedMethods  map[int64]string // 用户 ID -> 自动充值支付方式
+	topUpsDone    map[int64]string // 自动充值 ID -> PaymentIntent ID
+	topUpsFailed  map[int64]string // 自动充值 ID -> 失败原因
+	users         map[int64]models.User
+	customers     map[int64]string // 用户 ID -> Stripe Customer ID
+	customerMiss  int              // 查询 Customer 时模拟尚未看到并发请求保存的记录的次数
+	plans         map[int64]models.Plan
+	planPolicy    string // 换档积分策略
+	planChanges   []models.PlanChange
+}
+
+func newFakeBilling() *fakeBilling {
+	return &fakeBilling{
+		orders:        map[int64]models.Order{},
+		syncs:         map[string]services.StripeSubscriptionUpdate{},
+		events:        map[string]string{},
+		subscriptions: map[int64]models.Subscription{},
+		canceled:      map[int64]bool{},
+		savedMethods:  map[int64]string{},
+		topUpsDone:    map[int64]string{},
+		topUpsFailed:  map[int64]string{},
+		users:         map[int64]models.User{},
+		customers:     map[int64]string{},
+		plans:         map[int64]models.Plan{},
+		planPolicy:    config.PlanChangePointsNextRenewal,
+	}
+}
+
+func (f *fakeBilling) GetOrder(ctx context.Context, orderID int64) (models.Order, error) {
+	order, ok := f.orders[orderID]
+	if !ok {
+		return models.Order{}, services.ErrNotFound
+	}
+	return order, nil
+}
+
+func (f *fakeBilling) GetOrderByStripeSessionID(ctx context.Context, sessionID string) (models.Order, error) {
+	for _, order := range f.orders {
+		if order.StripeSessionID != nil && *order.StripeSessionID == sessionID {
+			return order, nil
+		}
+	}
+	return models.Order{}, services.ErrNotFound
+}
+
+func (f *fakeBilling) MarkOrderPaid(ctx context.Context, orderID int64, sessionID, paymentIntentID, stripeSubscriptionID string) (models.Order, error) {
+	order, ok := f.orders[orderID]
+	if !ok {
+		return models.Order{}, services.ErrNotFound
+	}
+	order.Status = models.OrderStatusPaid
+	order.StripeSessionID = &sessionID
+	order.StripePaymentIntentID = &paymentIntentID
+	f.orders[orderID] = order
+	return order, nil
+}
+
+func (f *fakeBilling) FailPendingOrder(ctx context.Context, orderID int64) error {
+	f.failedOrders = append(f.failedOrders, orderID)
+	return nil
+}
+
+func (f *fakeBilling) GetSubscriptionByID(ctx context.Context, subscriptionID int64) (models.Subscription, error) {
+	sub, ok := f.subscriptions[subscriptionID]
+	if !ok {
+		return models.Subscription{}, services.ErrNotFound
+	}
+	return sub, nil
+}
+
+func (f *fakeBilling) GetSubscriptionByStripeID(ctx context.Context, stripeSubscriptionID string) (models.Subscription, error) {
+	return models.Subscription{}, services.ErrNotFound
+}
+
+func (f *fakeBilling) GetPlanByID(ctx context.Context, planID int64) (models.Plan, error) {
+	plan, ok := f.plans[planID]
+	if !ok {
+		return models.Plan{}, services.ErrNotFound
+	}
+	return plan, nil
+}
+
+func (f *fakeBilling) ActivateSubscription(ctx context.Context, subscriptionID int64, stripeSubscriptionID string, grantPoints float64, periodDays int) error {
+	return nil
+}
+
+func (f *fakeBilling) SyncStripeSubscription(ctx context.Context, stripeSubscriptionID string, update services.StripeSubscriptionUpdate) error {
+	f.syncs[stripeSubscriptionID] = update
+	return nil
+}
+
+func (f *fakeBilling) MarkSubscriptionPaymentFailed(ctx context.Context, stripeSubscriptionID string) error {
+	f.paymentFailed = append(f.paymentFailed, stripeSubscriptionID)
+	return nil
+}
+
+func (f *fakeBilling) GetOrderByPaymentIntentID(ctx context.Context, paymentIntentID string) (models.Order, error) {
+	for _, order := range f.orders {
+		if order.StripePaymentIntentID != nil && *order.StripePaymentIntentID == paymentIntentID {
+			return order, nil
+		}
+	}
+	return models.Order{}, services.ErrNotFound
+}
+
+func (f *fakeBilling) RecordOrderRefund(ctx context.Context, in services.OrderReversal) (models.Order, error) {
+	f.refunds = append(f.refunds, in)
+	return f.orders[in.OrderID], nil
+}
+
+func (f *fakeBilling) RecordOrderDispute(ctx context.Context, in services.OrderReversal) (models.Order, error) {
+	f.disputes = append(f.disputes, in)
+	return f.orders[in.OrderID], nil
+}
+
+func (f *fakeBilling) ProcessStripeEvent(ctx context.Context, eventID, eventType string, payload []byte, handle func(ctx context.Context) error) (bool, error) {
+	if f.events[eventID] == models.StripeEventProcessed {
+		return false, nil
+	}
+	if err := handle(ctx); err != nil {
+		f.events[eventID] = models.StripeEventFailed
+		return false, err
+	}
+	f.events[eventID] = models.StripeEventProcessed
+	return true, nil
+}
+
+func (f *fakeBilling) CancelSubscription(ctx context.Context, subscriptionID int64, atPeriodEnd bool) (models.Subscription, error) {
+	sub, ok := f.subscriptions[subscriptionID]
+	if !ok {
+		return models.Subscription{}, services.ErrNotFound
+	}
+	f.canceled[subscriptionID] = atPeriodEnd
+	sub.CancelAtPeriodEnd = atPeriodEnd
+	if !atPeriodEnd {
+		sub.Status = models.SubscriptionCanceled
+	}
+	return sub, nil
+}
+
+func (f *fakeBilling) GetUserByID(ctx context.Context, userID int64) (models.User, error) {
+	user, ok := f.users[userID]
+	if !ok {
+		return models.User{}, services.ErrNotFound
+	}
+	return user, nil
+}
+
+func (f *fakeBilling) GetStripeCustomerID(ctx context.Context, userID int64) (string, error) {
+	if f.customerMiss > 0 {
+		f.customerMiss--
+		return "", services.ErrNotFound
+	}
+	customerID, ok := f.customers[userID]
+	if !ok {
+		return "", services.ErrNotFound
+	}
+	return customerID, nil
+}
+
+func (f *fakeBilling) ChangeSubscriptionPlan(ctx context.Context, in services.ChangePlanInput) (models.Subscription, models.PlanChange, error) {
+	sub, ok := f.subscriptions[in.SubscriptionID]
+	if !ok {
+		return models.Subscription{}, models.PlanChange{}, services.ErrNotFound
+	}
+	change := models.PlanChange{
+		ID:             int64(len(f.planChanges) + 1),
+		SubscriptionID: sub.ID,
+		UserID:         sub.UserID,
+		FromPlanID:     sub.PlanID,
+		ToPlanID:       in.PlanID,
+		PointsPolicy:   f.planPolicy,
+		PointsGranted:  services.PlanChangeGrant(f.planPolicy, f.plans[sub.PlanID], f.plans[in.PlanID]),
+		ChangedBy:      in.ChangedBy,
+	}
+	sub.PlanID = in.PlanID
+	if in.PeriodEnd != nil {
+		sub.EndsAt = *in.PeriodEnd
+	}
+	f.subscriptions[sub.ID] = sub
+	f.planChanges = append(f.planChanges, change)
+	return sub, change, nil
+}
+
+func (f *fakeBilling) ListPlanChanges(ctx context.Context, subscriptionID int64) ([]models.PlanChange, error) {
+	changes := []models.PlanChange{}
+	for i := len(f.planChanges) - 1; i >= 0; i-- {
+		if f.planChanges[i].SubscriptionID == subscriptionID {
+			changes = append(changes, f.planChanges[i])
+		}
+	}
+	return changes, nil
+}
+
+// SaveStripeCustomerID 与数据库实现一致：用户已有关联时保留原值并返回已有的 Customer ID
+func (f *fakeBilling) SaveStripeCustomerID(ctx context.Context, userID int64, customerID string) (string, error) {
+	if existing, ok := f.customers[userID]; ok {
+		return existing, nil
+	}
+	f.customers[userID] = customerID
+	return customerID, nil
+}
+
+func (f *fakeBilling) SaveAutoTopUpPaymentMethod(ctx context.Context, userID int64, paymentMethodID string) error {
+	f.savedMethods[userID] = paymentMethodID
+	return nil
+}
+
+func (f *fakeBilling) CompleteAutoTopUp(ctx context.Context, topUpID int64, paymentIntentID string) (models.Order, error) {
+	f.topUpsDone[topUpID] = paymentIntentID
+	return models.Order{}, nil
+}
+
+func (f *fakeBilling) ListPendingProviderOrders(ctx context.Context, provider string, minAge time.Duration, limit int) ([]models.Order, error) {
+	var orders []models.Order
+	for _, order := range f.orders {
+		if order.Status == models.OrderStatusPending && order.PaymentProvider != nil && *order.PaymentProvider == provider {
+			orders = append(orders, order)
+		}
+	}
+	return orders, nil
+}
+
+func (f *fakeBilling) FailAutoTopUp(ctx context.Context, topUpID int64, paymentIntentID, reason string) error {
+	f.topUpsFailed[topUpID] = reason
+	return nil
+}
+
+// fakeSetupIntents 按 SetupIntent ID 返回固定的支付方式
+type fakeSetupIntents map[string]string
+
+func (f fakeSetupIntents) PaymentMethodForSetupIntent(ctx context.Context, setupIntentID string) (string, error) {
+	pm, ok := f[setupIntentID]
+	if !ok {
+		return "", services.ErrNotFound
+	}
+	return pm, nil
+}
+
+func newWebhookTestServer(billing *fakeBilling) *Server {
+	return &Server{
+		billing:      billing,
+		payments:     payments.NewStripeProvider("", testWebhookSecret, "usd"),
+		setupIntents: fakeSetupIntents{"seti_test_123": "pm_test_card"},
+		cfg: config.Config{
+			StripeWebhookSecret:  testWebhookSecret,
+			StripePriceMonthly:   "price_monthly",
+			StripePriceQuarterly: "price_quarterly",
+		},
+	}
+}
+
+// postFixture 读取 testdata/stripe 下的事件并签名后发送到 Webhook 接口
+func postFixture(t *testing.T, s *Server, name, secret string) *httptest.ResponseRecorder {
+	t.Helper()
+	payload, err := os.ReadFile(filepath.Join("testdata", "stripe", name))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload:   payload,
+		Secret:    secret,
+		Timestamp: time.Now(),
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/webhooks/stripe", strings.NewReader(string(payload)))
+	req.Header.Set("Stripe-Signature", signed.Header)
+	rec := httptest.NewRecorder()
+	s.handleStripeWebhook(rec, req)
+	return rec
+}
+
+func TestWebhookCheckoutSessionExpired(t *testing.T) {
+	billing := newFakeBilling()
+	billing.orders[42] = models.Order{ID: 42, Status: models.OrderStatusPending}
+	rec := postFixture(t, newWebhookTestServer(billing), "checkout_session_expired.json", testWebhookSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(billing.failedOrders) != 1 || billing.failedOrders[0] != 42 {
+		t.Fatalf("expected order 42 to be failed, got %v", billing.failedOrders)
+	}
+}
+
+func TestWebhookCheckoutSessionExpiredUnknownOrder(t *testing.T) {
+	billing := newFakeBilling()
+	rec := postFixture(t, newWebhookTestServer(billing), "checkout_session_expired.json", testWebhookSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(billing.failedOrders) != 0 {
+		t.Fatalf("expected no failed orders, got %v", billing.failedOrders)
+	}
+}
+
+func TestWebhookSubscriptionUpdated(t *testing.T) {
+	billing := newFakeBilling()
+	rec := postFixture(t, newWebhookTestServer(billing), "customer_subscription_updated.json", testWebhookSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	update, ok := billing.syncs["sub_test_123"]
+	if !ok {
+		t.Fatalf("expected subscription to be synced")
+	}
+	if update.Status != models.SubscriptionPastDue {
+		t.Fatalf("unexpected status: %s", update.Status)
+	}
+	if update.PlanName != "quarterly" {
+		t.Fatalf("unexpected plan: %s", update.PlanName)
+	}
+	if update.EndedAt != nil {
+		t.Fatalf("expected no ended_at")
+	}
+}
+
+func TestWebhookSubscriptionDeleted(t *testing.T) {
+	billing := newFakeBilling()
+	rec := postFixture(t, newWebhookTestServer(billing), "customer_subscription_deleted.json", testWebhookSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	update := billing.syncs["sub_test_123"]
+	if update.Status != models.SubscriptionCanceled {
+		t.Fatalf("unexpected status: %s", update.Status)
+	}
+	if update.EndedAt == nil || !update.EndedAt.Equal(time.Unix(1767225600, 0)) {
+		t.Fatalf("unexpected ended_at: %v", update.EndedAt)
+	}
+}
+
+func TestWebhookInvoicePaymentFailed(t *testing.T) {
+	billing := newFakeBilling()
+	rec := postFixture(t, newWebhookTestServer(billing), "invoice_payment_failed.json", testWebhookSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(billing.paymentFailed) != 1 || billing.paymentFailed[0] != "sub_test_123" {
+		t.Fatalf("unexpected payment failures: %v", billing.paymentFailed)
+	}
+}
+
+func TestWebhookChargeRefunded(t *testing.T) {
+	billing := newFakeBilling()
+	paymentIntentID := "pi_test_refund"
+	billing.orders[7] = models.Order{ID: 7, Status: models.OrderStatusPaid, StripePaymentIntentID: &paymentIntentID}
+	rec := postFixture(t, newWebhookTestServer(billing), "charge_refunded.json", testWebhookSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(billing.refunds) != 1 {
+		t.Fatalf("expected one refund, got %d", len(billing.refunds))
+	}
+	got := billing.refunds[0]
+	if got.OrderID != 7 || got.RefundedCents != 500 || got.ChargedCents != 2000 {
+		t.Fatalf("unexpected refund: %+v", got)
+	}
+}
+
+func TestWebhookChargeRefundedUnknownPayment(t *testing.T) {
+	billing := newFakeBilling()
+	rec := postFixture(t, newWebhookTestServer(billing), "charge_refunded.json", testWebhookSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(billing.refunds) != 0 {
+		t.Fatalf("expected no refunds, got %d", len(billing.refunds))
+	}
+}
+
+func TestWebhookDisputeCreated(t *testing.T) {
+	billing := newFakeBilling()
+	paymentIntentID := "pi_test_dispute"
+	billing.orders[8] = models.Order{ID: 8, Status: models.OrderStatusPaid, StripePaymentIntentID: &paymentIntentID}
+	rec := postFixture(t, newWebhookTestServer(billing), "charge_dispute_created.json", testWebhookSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(billing.disputes) != 1 {
+		t.Fatalf("expected one dispute, got %d", len(billing.disputes))
+	}
+	got := billing.disputes[0]
+	if got.OrderID != 8 || got.DisputedCents != 2000 {
+		t.Fatalf("unexpected dispute: %+v", got)
+	}
+}
+
+func TestWebhookDuplicateEventProcessedOnce(t *testing.T) {
+	billing := newFakeBilling()
+	s := newWebhookTestServer(billing)
+	for i := 0; i < 2; i++ {
+		rec := postFixture(t, s, "invoice_payment_failed.json", testWebhookSecret)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+	if len(billing.paymentFailed) != 1 {
+		t.Fatalf("expected event to be processed once, got %d", len(billing.paymentFailed))
+	}
+	if billing.events["evt_invoice_failed"] != models.StripeEventProcessed {
+		t.Fatalf("expected event to be recorded as processed")
+	}
+}
+
+func TestWebhookRejectsBadSignature(t *testing.T) {
+	billing := newFakeBilling()
+	rec := postFixture(t, newWebhookTestServer(billing), "invoice_payment_failed.json", "whsec_wrong")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	if len(billing.paymentFailed) != 0 {
+		t.Fatalf("handler should not run for bad signature")
+	}
+}
+
+func TestWebhookSetupSessionSavesPaymentMethod(t *testing.T) {
+	billing := newFakeBilling()
+	rec := postFixture(t, newWebhookTestServer(billing), "checkout_session_setup_completed.json", testWebhookSecret)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	if billing.savedMethods[5] != "pm_test_card" {
+		t.Fatalf("unexpected saved payment methods: %v", billing.savedMethods)
+	}
+}
+
+func TestWebhookAutoTopUpPaymentIntents(t *testing.T) {
+	billing := newFakeBilling()
+	s := newWebhookTestServer(billing)
+	for _, name := range []string{"payment_intent_succeeded.json", "payment_intent_payment_failed.json"} {
+		rec := postFixture(t, s, name, testWebhookSecret)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d: %s", name, rec.Code, rec.Body.String())
+		}
+	}
+	if billing.topUpsDone[11] != "pi_test_topup_ok" {
+		t.Fatalf("unexpected completed top-ups: %v", billing.topUpsDone)
+	}
+	if !strings.Contains(billing.topUpsFailed[12], "card_declined") {
+		t.Fatalf("unexpected failed top-ups: %v", billing.topUpsFailed)
+	}
+}
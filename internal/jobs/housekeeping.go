@@ -0,0 +1,104 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"easyusersys/internal/config"
+	"easyusersys/internal/email"
+	"easyusersys/internal/payments"
+	"easyusersys/internal/services"
+)
+
+// RegisterHousekeeping 注册过期处理、免费积分刷新、余额提醒、自动充值与清理任务
+func RegisterHousekeeping(s *Scheduler, svc *services.Service, cfg config.Config, provider payments.Provider) {
+	s.Register(Job{
+		Name:     "expire_subscriptions",
+		Interval: 5 * time.Minute,
+		Run: func(ctx context.Context) error {
+			n, err := svc.ExpireSubscriptions(ctx, cfg.SubscriptionExpiryGrace())
+			if n > 0 {
+				log.Printf("[INFO] job expire_subscriptions: %d subscriptions ended", n)
+			}
+			return err
+		},
+	})
+	s.Register(Job{
+		Name:     "expire_buckets",
+		Interval: 5 * time.Minute,
+		Run: func(ctx context.Context) error {
+			n, err := svc.ExpireBuckets(ctx, cfg.SubscriptionExpiryGrace())
+			if n > 0 {
+				log.Printf("[INFO] job expire_buckets: %d buckets expired", n)
+			}
+			return err
+		},
+	})
+	s.Register(Job{
+		Name:     "refresh_free_points",
+		Interval: time.Hour,
+		Run: func(ctx context.Context) error {
+			n, err := svc.RefreshFreePoints(ctx, time.Now().UTC())
+			if n > 0 {
+				log.Printf("[INFO] job refresh_free_points: %d users refreshed", n)
+			}
+			return err
+		},
+	})
+	s.Register(Job{
+		Name:     "queue_expiring_points_notifications",
+		Interval: time.Hour,
+		Run: func(ctx context.Context) error {
+			_, err := svc.QueueExpiringPointsNotifications(ctx)
+			return err
+		},
+	})
+	// 邮件服务未配置时通知保留为 pending，配置后再发送
+	if sender := email.NewResendClient(cfg.ResendAPIKey); sender.IsConfigured() {
+		s.Register(Job{
+			Name:     "send_notifications",
+			Interval: time.Minute,
+			Run: func(ctx context.Context) error {
+				n, err := svc.SendPendingNotifications(ctx, sender, 100)
+				if n > 0 {
+					log.Printf("[INFO] job send_notifications: %d notifications sent", n)
+				}
+				return err
+			},
+		})
+	}
+	if provider.IsConfigured() {
+		s.Register(Job{
+			Name:     "process_auto_topups",
+			Interval: time.Minute,
+			Run: func(ctx context.Context) error {
+				n, err := svc.ProcessAutoTopUps(ctx, provider, 50)
+				if n > 0 {
+					log.Printf("[INFO] job process_auto_topups: %d top-ups charged", n)
+				}
+				return err
+			},
+		})
+	}
+	s.Register(Job{
+		Name:     "cleanup_verification_codes",
+		Interval: time.Hour,
+		Run:      svc.CleanupExpiredCodes,
+	})
+}
+
+// RegisterPaymentPolling 注册支付状态轮询任务，poll 返回本次确认的事件数
+func RegisterPaymentPolling(s *Scheduler, poll func(ctx context.Context) (int, error)) {
+	s.Register(Job{
+		Name:     "poll_pending_payments",
+		Interval: time.Minute,
+		Run: func(ctx context.Context) error {
+			n, err := poll(ctx)
+			if n > 0 {
+				log.Printf("[INFO] job poll_pending_payments: %d payment events processed", n)
+			}
+			return err
+		},
+	})
+}
@@ -0,0 +1,76 @@
+package jobs
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// AdvisoryLockLeader 基于 Postgres 会话级 advisory lock 的主节点选举
+// 锁绑定在一个独占的连接上，连接断开时锁自动释放，其他实例可接管
+type AdvisoryLockLeader struct {
+	pool *pgxpool.Pool
+	key  int64
+
+	mu   sync.Mutex
+	conn *pgxpool.Conn
+}
+
+// NewAdvisoryLockLeader 创建选举器，同一组实例需使用相同的 key
+func NewAdvisoryLockLeader(pool *pgxpool.Pool, key int64) *AdvisoryLockLeader {
+	return &AdvisoryLockLeader{pool: pool, key: key}
+}
+
+func (l *AdvisoryLockLeader) TryAcquire(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn != nil {
+		return true, nil
+	}
+	conn, err := l.pool.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	var locked bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, l.key).Scan(&locked); err != nil {
+		conn.Release()
+		return false, err
+	}
+	if !locked {
+		conn.Release()
+		return false, nil
+	}
+	l.conn = conn
+	return true, nil
+}
+
+func (l *AdvisoryLockLeader) Check(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return errNotLeader
+	}
+	if err := l.conn.Ping(ctx); err != nil {
+		// 连接已不可用，锁随会话一起释放，丢弃该连接
+		l.conn.Conn().Close(context.Background())
+		l.conn.Release()
+		l.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (l *AdvisoryLockLeader) Release(ctx context.Context) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn == nil {
+		return
+	}
+	if _, err := l.conn.Exec(ctx, `SELECT pg_advisory_unlock($1)`, l.key); err != nil {
+		// 解锁失败时关闭连接，确保锁随会话释放而不是留在连接池中
+		l.conn.Conn().Close(context.Background())
+	}
+	l.conn.Release()
+	l.conn = nil
+}
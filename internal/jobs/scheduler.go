@@ -0,0 +1,151 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var errNotLeader = errors.New("not leader")
+
+// Job 定时任务，由调度器按 Interval 周期执行
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error
+}
+
+// Leader 多实例部署时的主节点选举，只有主节点执行定时任务
+type Leader interface {
+	// TryAcquire 尝试成为主节点，已是主节点时直接返回 true
+	TryAcquire(ctx context.Context) (bool, error)
+	// Check 确认仍持有主节点身份，返回错误表示已失去
+	Check(ctx context.Context) error
+	// Release 放弃主节点身份
+	Release(ctx context.Context)
+}
+
+// Scheduler 进程内任务调度器
+type Scheduler struct {
+	leader       Leader
+	pollInterval time.Duration // 选举重试与主节点身份检查的间隔
+	jobs         []Job
+}
+
+// NewScheduler 创建调度器，leader 为空时视为单实例部署，始终执行任务
+func NewScheduler(leader Leader, pollInterval time.Duration) *Scheduler {
+	if pollInterval <= 0 {
+		pollInterval = 30 * time.Second
+	}
+	return &Scheduler{leader: leader, pollInterval: pollInterval}
+}
+
+// Register 注册任务，需在 Run 之前调用
+func (s *Scheduler) Register(job Job) {
+	s.jobs = append(s.jobs, job)
+}
+
+// Run 阻塞运行直到 ctx 取消；返回前等待正在执行的任务结束并释放主节点身份
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	for {
+		if s.acquire(ctx) {
+			s.lead(ctx)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scheduler) acquire(ctx context.Context) bool {
+	if s.leader == nil {
+		return true
+	}
+	ok, err := s.leader.TryAcquire(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("[WARN] scheduler leader election failed: %v", err)
+		}
+		return false
+	}
+	return ok
+}
+
+// lead 作为主节点运行所有任务，直到 ctx 取消或失去主节点身份
+func (s *Scheduler) lead(ctx context.Context) {
+	leadCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for _, job := range s.jobs {
+		wg.Add(1)
+		go func(job Job) {
+			defer wg.Done()
+			runLoop(leadCtx, job)
+		}(job)
+	}
+	log.Printf("[INFO] scheduler became leader, running %d jobs", len(s.jobs))
+
+	if s.leader != nil {
+		ticker := time.NewTicker(s.pollInterval)
+	watch:
+		for {
+			select {
+			case <-ctx.Done():
+				break watch
+			case <-ticker.C:
+				if err := s.leader.Check(ctx); err != nil {
+					if ctx.Err() == nil {
+						log.Printf("[WARN] scheduler lost leadership: %v", err)
+					}
+					break watch
+				}
+			}
+		}
+		ticker.Stop()
+	} else {
+		<-ctx.Done()
+	}
+
+	cancel()
+	wg.Wait()
+	if s.leader != nil {
+		// ctx 可能已取消，释放时使用独立的超时
+		releaseCtx, releaseCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		s.leader.Release(releaseCtx)
+		releaseCancel()
+	}
+}
+
+// runLoop 立即执行一次任务，之后按间隔执行；单个任务失败只记录日志
+func runLoop(ctx context.Context, job Job) {
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+	for {
+		runOnce(ctx, job)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func runOnce(ctx context.Context, job Job) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Printf("[ERROR] job %s panicked: %v", job.Name, rec)
+		}
+	}()
+	start := time.Now()
+	if err := job.Run(ctx); err != nil && ctx.Err() == nil {
+		log.Printf("[ERROR] job %s failed after %s: %v", job.Name, time.Since(start), err)
+	}
+}
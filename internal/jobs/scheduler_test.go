@@ -0,0 +1,118 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeLeader struct {
+	mu       sync.Mutex
+	granted  bool
+	checkErr error
+	released int
+}
+
+func (f *fakeLeader) TryAcquire(ctx context.Context) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.granted, nil
+}
+
+func (f *fakeLeader) Check(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.checkErr
+}
+
+func (f *fakeLeader) Release(ctx context.Context) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.released++
+}
+
+func (f *fakeLeader) set(granted bool, checkErr error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.granted = granted
+	f.checkErr = checkErr
+}
+
+func (f *fakeLeader) releases() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.released
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func startScheduler(leader Leader, runs *atomic.Int32) (context.CancelFunc, chan struct{}) {
+	s := NewScheduler(leader, 10*time.Millisecond)
+	s.Register(Job{
+		Name:     "count",
+		Interval: 10 * time.Millisecond,
+		Run: func(ctx context.Context) error {
+			runs.Add(1)
+			return errors.New("failures are only logged")
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+	return cancel, done
+}
+
+func TestSchedulerRunsJobsOnlyAsLeader(t *testing.T) {
+	leader := &fakeLeader{}
+	var runs atomic.Int32
+	cancel, done := startScheduler(leader, &runs)
+
+	time.Sleep(50 * time.Millisecond)
+	if runs.Load() != 0 {
+		t.Fatalf("expected no runs before leadership, got %d", runs.Load())
+	}
+
+	leader.set(true, nil)
+	waitFor(t, func() bool { return runs.Load() >= 2 })
+
+	cancel()
+	<-done
+	if leader.releases() != 1 {
+		t.Fatalf("expected leadership released on shutdown, got %d", leader.releases())
+	}
+}
+
+func TestSchedulerStopsJobsWhenLeadershipLost(t *testing.T) {
+	leader := &fakeLeader{granted: true}
+	var runs atomic.Int32
+	cancel, done := startScheduler(leader, &runs)
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor(t, func() bool { return runs.Load() >= 1 })
+	leader.set(false, errNotLeader)
+	waitFor(t, func() bool { return leader.releases() == 1 })
+
+	stopped := runs.Load()
+	time.Sleep(50 * time.Millisecond)
+	if runs.Load() != stopped {
+		t.Fatalf("expected jobs to stop after losing leadership, runs %d -> %d", stopped, runs.Load())
+	}
+}
@@ -1,6 +1,9 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type User struct {
 	ID           int64
@@ -22,6 +25,15 @@ type APIKey struct {
 	Status    string
 	CreatedAt time.Time
 	RevokedAt *time.Time
+	// 限额，为空表示不限制
+	DailyPointsLimit   *float64
+	MonthlyPointsLimit *float64
+	MaxCostPerRequest  *float64
+	ExpiresAt          *time.Time
+	LimitWindow        string // calendar 或 rolling
+	// 当前统计窗口内的消耗（扣除冲正），仅列表接口返回
+	DailySpent   float64
+	MonthlySpent float64
 }
 
 type Plan struct {
@@ -41,6 +53,7 @@ type Subscription struct {
 	StartedAt            time.Time
 	EndsAt               time.Time
 	StripeSubscriptionID *string // 可能为 NULL（pending 状态时）
+	CancelAtPeriodEnd    bool    // 已申请到期取消，ends_at 之后不再续费
 	CreatedAt            time.Time
 	UpdatedAt            time.Time
 }
@@ -62,9 +75,20 @@ type UsageRecord struct {
 	Units      int
 	CostPoints float64
 	RequestID  string
+	APIKeyID   *int64 // 上报时使用的 API Key，为空表示未关联
 	RecordedAt time.Time
 }
 
+type UsageReversal struct {
+	ID            int64
+	UserID        int64
+	UsageRecordID int64
+	ReversalKey   string
+	Points        float64
+	Reason        string
+	CreatedAt     time.Time
+}
+
 type BillingLedger struct {
 	ID            int64
 	UserID        int64
@@ -73,6 +97,7 @@ type BillingLedger struct {
 	Reason        string
 	ReferenceType string
 	ReferenceID   *int64
+	Note          string
 	CreatedAt     time.Time
 }
 
@@ -87,6 +112,10 @@ type Order struct {
 	StripeSessionID        *string // 可能为 NULL（创建后才关联）
 	StripePaymentIntentID  *string // 可能为 NULL（支付完成后才有）
 	StripeSubscriptionID   *string // 可能为 NULL（订阅类型才有）
+	PaymentProvider        *string // 支付平台，NULL 表示主支付平台
+	PackageID              *int64  // 购买的积分包，自定义金额为 NULL
+	RefundedCents          int     // 累计退款金额（分）
+	DisputedCents          int     // 争议（拒付）金额（分）
 	CreatedAt              time.Time
 	UpdatedAt              time.Time
 }
@@ -107,10 +136,19 @@ const (
 	APIKeyStatusRevoked = "revoked"
 )
 
+// API Key 限额的统计窗口
+const (
+	APIKeyWindowCalendar = "calendar" // UTC 自然日 / 自然月
+	APIKeyWindowRolling  = "rolling"  // 最近 24 小时 / 30 天
+)
+
 const (
 	BucketFree        = "free"
 	BucketSubscription = "subscription"
 	BucketPrepaid     = "prepaid"
+	BucketDebt        = "debt" // 透支欠款，remaining_points 为负数
+	BucketPromo       = "promo"
+	BucketRollover    = "rollover" // 订阅续费时结转的未用完积分
 )
 
 const (
@@ -118,6 +156,7 @@ const (
 	SubscriptionCanceled = "canceled"
 	SubscriptionExpired  = "expired"
 	SubscriptionPending  = "pending"
+	SubscriptionPastDue  = "past_due" // 续费扣款失败，等待 Stripe 重试
 )
 
 const (
@@ -126,9 +165,220 @@ const (
 )
 
 const (
-	OrderStatusPending = "pending"
-	OrderStatusPaid    = "paid"
-	OrderStatusFailed  = "failed"
+	OrderStatusPending  = "pending"
+	OrderStatusPaid     = "paid"
+	OrderStatusFailed   = "failed"
+	OrderStatusRefunded = "refunded" // 已全部或部分退款
+	OrderStatusDisputed = "disputed" // 发生拒付争议
+)
+
+// CreditLimit 信用额度，UserID 为空表示系统级默认额度
+type CreditLimit struct {
+	ID          int64
+	SystemCode  string
+	UserID      *int64
+	LimitPoints float64
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Coupon 优惠码，可兑换积分或作为 Stripe Checkout 折扣
+type Coupon struct {
+	ID               int64
+	SystemCode       string
+	Code             string
+	Points           float64 // 兑换积分，0 表示不可兑换积分
+	PointsExpiryDays int     // 兑换积分的有效天数，0 表示永不过期
+	StripeCouponID   *string // Stripe 折扣券 ID，为空表示不可用于 Checkout
+	MaxRedemptions   *int    // 总兑换次数上限，为空表示不限制
+	PerUserLimit     int
+	ValidFrom        *time.Time
+	ValidUntil       *time.Time
+	AppliesTo        []string // 计划名称或 prepaid，为空表示全部
+	Active           bool
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
+
+// PrepaidPackage 预充值积分包
+type PrepaidPackage struct {
+	ID             int64
+	SystemCode     string
+	Name           string
+	PriceCents     int
+	Points         float64
+	BonusPoints    float64 // 赠送积分
+	ExpiryDays     int     // 积分有效天数，0 表示使用 PREPAID_EXPIRY_DAYS
+	AvailableFrom  *time.Time
+	AvailableUntil *time.Time
+	Active         bool
+	SortOrder      int
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+type CouponRedemption struct {
+	ID        int64
+	CouponID  int64
+	UserID    int64
+	BucketID  *int64
+	OrderID   *int64
+	Status    string
+	CreatedAt time.Time
+}
+
+// 优惠码兑换状态，预留的兑换同样占用兑换次数
+const (
+	CouponRedemptionPending  = "pending"  // Checkout 已创建，等待支付
+	CouponRedemptionRedeemed = "redeemed" // 已兑换
+)
+
+// Referral 推荐关系，被推荐人注册时记录
+type Referral struct {
+	ID             int64
+	SystemCode     string
+	ReferrerID     int64
+	RefereeID      int64
+	ReferralCode   string
+	SignupIP       *string
+	EmailDomain    string
+	Status         string  // pending | rewarded | rejected
+	RejectReason   *string // 触发的防刷规则
+	OrderID        *int64  // 触发奖励的首个付费订单
+	ReferrerPoints float64
+	RefereePoints  float64
+	RewardedAt     *time.Time
+	CreatedAt      time.Time
+}
+
+const (
+	ReferralPending  = "pending"
+	ReferralRewarded = "rewarded"
+	ReferralRejected = "rejected"
+)
+
+// PointTransfer 用户之间的积分转赠记录
+type PointTransfer struct {
+	ID          int64
+	SystemCode  string
+	SenderID    int64
+	RecipientID int64
+	Points      float64
+	TransferKey string
+	Note        *string
+	CreatedAt   time.Time
+}
+
+// TransferSettings 系统级积分转赠设置，额度为 0 表示不限制
+type TransferSettings struct {
+	SystemCode           string
+	Enabled              bool
+	MinPoints            float64
+	MaxPointsPerTransfer float64
+	DailyLimitPoints     float64
+	BucketTypes          []string // 可转出的积分桶类型
+	UpdatedAt            time.Time
+}
+
+// PlanChange 订阅换档记录
+type PlanChange struct {
+	ID             int64
+	SubscriptionID int64
+	UserID         int64
+	FromPlanID     int64
+	ToPlanID       int64
+	PointsPolicy   string  // immediate | next_renewal
+	PointsGranted  float64 // 换档时立即补发的积分
+	ChangedBy      int64   // 发起换档的用户 ID（本人或管理员）
+	CreatedAt      time.Time
+}
+
+// NotificationSettings 用户级通知设置，阈值为空时使用系统配置
+type NotificationSettings struct {
+	UserID           int64
+	Enabled          bool
+	LowBalancePoints *float64 // 余额低于该值时提醒，0 表示不提醒
+	ExpiringDays     *int     // 积分桶在该天数内过期时提醒，0 表示不提醒
+	UpdatedAt        time.Time
+}
+
+// Notification 待发送或已发送的邮件通知
+type Notification struct {
+	ID         int64
+	SystemCode string
+	UserID     int64
+	Kind       string
+	DedupKey   string
+	Data       json.RawMessage
+	Status     string // pending | sent | failed
+	Attempts   int
+	LastError  *string
+	SentAt     *time.Time
+	CreatedAt  time.Time
+}
+
+const (
+	NotificationLowBalance     = "low_balance"
+	NotificationExpiringPoints = "expiring_points"
+)
+
+const (
+	NotificationPending = "pending"
+	NotificationSent    = "sent"
+	NotificationFailed  = "failed"
+)
+
+// AutoTopUpSettings 自动充值设置
+type AutoTopUpSettings struct {
+	UserID              int64
+	Enabled             bool
+	ThresholdPoints     float64 // 扣费后余额低于该值时充值
+	AmountCents         int     // 每次充值金额（分）
+	PaymentMethodID     *string // 通过 setup 模式 Checkout 保存的支付方式
+	ConsecutiveDeclines int
+	DisabledReason      *string // 连续被拒付后自动关闭的原因
+	UpdatedAt           time.Time
+}
+
+// AutoTopUp 一次自动充值
+type AutoTopUp struct {
+	ID              int64
+	UserID          int64
+	AmountCents     int
+	Status          string // pending | processing | succeeded | failed
+	Attempts        int
+	NextAttemptAt   time.Time
+	PaymentIntentID *string
+	OrderID         *int64
+	LastError       *string
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+const (
+	AutoTopUpPending    = "pending"
+	AutoTopUpProcessing = "processing"
+	AutoTopUpSucceeded  = "succeeded"
+	AutoTopUpFailed     = "failed"
+)
+
+// StripeEvent Stripe Webhook 事件日志，按事件 ID 保证只处理一次
+type StripeEvent struct {
+	ID          string
+	EventType   string
+	Payload     json.RawMessage
+	Status      string // pending | processed | failed
+	Attempts    int
+	LastError   *string
+	ProcessedAt *time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+const (
+	StripeEventPending   = "pending"
+	StripeEventProcessed = "processed"
+	StripeEventFailed    = "failed"
 )
 
 // VerificationCode 验证码模型
@@ -0,0 +1,584 @@
+package payments
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"easyusersys/internal/services"
+)
+
+// 支付宝结账方式
+const (
+	AlipayCheckoutPage = "page" // 电脑网站支付，跳转到支付宝收银台
+	AlipayCheckoutQR   = "qr"   // 当面付，返回二维码内容由前端展示
+)
+
+// alipayCloseGrace 订单超过关闭时间后再等待多久，仍查不到交易时视为放弃支付
+const alipayCloseGrace = 10 * time.Minute
+
+// alipayLocation 支付宝接口的 timestamp 使用北京时间
+var alipayLocation = time.FixedZone("CST", 8*3600)
+
+// AlipayConfig 支付宝开放平台配置
+type AlipayConfig struct {
+	AppID        string
+	PrivateKey   string // 应用私钥，PKCS1 或 PKCS8
+	PublicKey    string // 支付宝公钥
+	Gateway      string
+	NotifyURL    string
+	CheckoutMode string // page | qr
+	Timeout      time.Duration
+}
+
+// AlipayProvider 支付宝支付，只支持一次性支付（预充值）、退款和交易查询
+// 请求与异步通知均使用 RSA2（SHA256WithRSA）签名
+type AlipayProvider struct {
+	cfg        AlipayConfig
+	privateKey *rsa.PrivateKey
+	publicKey  *rsa.PublicKey
+	httpClient *http.Client
+}
+
+func NewAlipayProvider(cfg AlipayConfig) (*AlipayProvider, error) {
+	privateKey, err := parseRSAPrivateKey(cfg.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("alipay private key: %w", err)
+	}
+	publicKey, err := parseRSAPublicKey(cfg.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("alipay public key: %w", err)
+	}
+	switch cfg.CheckoutMode {
+	case "":
+		cfg.CheckoutMode = AlipayCheckoutPage
+	case AlipayCheckoutPage, AlipayCheckoutQR:
+	default:
+		return nil, fmt.Errorf("unknown alipay checkout mode %q", cfg.CheckoutMode)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Minute
+	}
+	return &AlipayProvider{
+		cfg:        cfg,
+		privateKey: privateKey,
+		publicKey:  publicKey,
+		httpClient: &http.Client{Timeout: 15 * time.Second},
+	}, nil
+}
+
+func (p *AlipayProvider) Name() string { return "alipay" }
+
+func (p *AlipayProvider) IsConfigured() bool { return true }
+
+// Currency 支付宝只以人民币收款，AmountCents 按分处理
+func (p *AlipayProvider) Currency() string { return "cny" }
+
+func alipayUnsupported(op string) error {
+	return &Error{Provider: "alipay", Code: "unsupported", Message: op + " is not supported by alipay"}
+}
+
+func (p *AlipayProvider) CreateCustomer(ctx context.Context, in Customer) (string, error) {
+	return "", alipayUnsupported("customer")
+}
+
+func (p *AlipayProvider) CreateBillingPortal(ctx context.Context, customerID, returnURL string) (string, error) {
+	return "", alipayUnsupported("billing portal")
+}
+
+func (p *AlipayProvider) PaymentMethodForSetupIntent(ctx context.Context, setupIntentID string) (string, error) {
+	return "", alipayUnsupported("saved payment method")
+}
+
+func (p *AlipayProvider) CancelAtPeriodEnd(ctx context.Context, subscriptionID string) error {
+	return alipayUnsupported("subscription")
+}
+
+func (p *AlipayProvider) CancelNow(ctx context.Context, subscriptionID string, prorate bool) error {
+	return alipayUnsupported("subscription")
+}
+
+func (p *AlipayProvider) ChangePrice(ctx context.Context, subscriptionID, priceID string) (time.Time, error) {
+	return time.Time{}, alipayUnsupported("subscription")
+}
+
+func (p *AlipayProvider) ChargeOffSession(ctx context.Context, charge services.OffSessionCharge) (services.OffSessionResult, error) {
+	return services.OffSessionResult{}, alipayUnsupported("off-session charge")
+}
+
+// CreateCheckout 创建支付宝交易，会话 ID 为商户订单号（out_trade_no）
+// page 模式返回收银台跳转地址；qr 模式调用预下单接口，URL 与 QRCode 为二维码内容
+func (p *AlipayProvider) CreateCheckout(ctx context.Context, in CheckoutParams) (CheckoutSession, error) {
+	if in.Mode != ModePayment {
+		return CheckoutSession{}, alipayUnsupported(in.Mode + " checkout")
+	}
+	if in.CouponID != "" {
+		return CheckoutSession{}, alipayUnsupported("coupon")
+	}
+	if in.AmountCents <= 0 {
+		return CheckoutSession{}, &Error{Provider: "alipay", Code: "parameter_missing", Message: "amount is required"}
+	}
+	subject := in.ProductName
+	if subject == "" {
+		subject = "Points"
+	}
+	outTradeNo := newAlipayTradeNo(in.ClientReferenceID)
+	biz := map[string]string{
+		"out_trade_no":    outTradeNo,
+		"total_amount":    formatYuan(in.AmountCents),
+		"subject":         subject,
+		"timeout_express": fmt.Sprintf("%dm", int(p.cfg.Timeout/time.Minute)),
+		"passback_params": url.QueryEscape(in.ClientReferenceID),
+	}
+
+	if p.cfg.CheckoutMode == AlipayCheckoutQR {
+		var resp struct {
+			QRCode string `json:"qr_code"`
+		}
+		if err := p.call(ctx, "alipay.trade.precreate", biz, &resp); err != nil {
+			return CheckoutSession{}, err
+		}
+		return CheckoutSession{ID: outTradeNo, URL: resp.QRCode, QRCode: resp.QRCode}, nil
+	}
+
+	biz["product_code"] = "FAST_INSTANT_TRADE_PAY"
+	params, err := p.requestParams("alipay.trade.page.pay", biz)
+	if err != nil {
+		return CheckoutSession{}, err
+	}
+	if in.SuccessURL != "" {
+		params.Set("return_url", in.SuccessURL)
+	}
+	if err := p.sign(params); err != nil {
+		return CheckoutSession{}, err
+	}
+	return CheckoutSession{ID: outTradeNo, URL: p.cfg.Gateway + "?" + params.Encode()}, nil
+}
+
+// GetPayment paymentID 为支付宝交易号（trade_no）
+func (p *AlipayProvider) GetPayment(ctx context.Context, paymentID string) (Payment, error) {
+	var trade alipayTrade
+	if err := p.call(ctx, "alipay.trade.query", map[string]string{"trade_no": paymentID}, &trade); err != nil {
+		return Payment{}, err
+	}
+	amount, err := parseYuan(trade.TotalAmount)
+	if err != nil {
+		return Payment{}, err
+	}
+	return Payment{ID: trade.TradeNo, AmountReceived: amount}, nil
+}
+
+// Refund 部分退款，退款请求号每次不同，返回退款请求号
+func (p *AlipayProvider) Refund(ctx context.Context, in RefundParams) (string, error) {
+	requestNo := fmt.Sprintf("%s_%d", in.PaymentID, time.Now().UnixNano())
+	biz := map[string]string{
+		"trade_no":       in.PaymentID,
+		"refund_amount":  formatYuan(in.AmountCents),
+		"out_request_no": requestNo,
+	}
+	if reason := in.Metadata["reason"]; reason != "" {
+		biz["refund_reason"] = reason
+	}
+	if err := p.call(ctx, "alipay.trade.refund", biz, nil); err != nil {
+		return "", err
+	}
+	return requestNo, nil
+}
+
+// QueryCheckout 查询交易状态，补偿丢失的异步通知；交易仍待支付时返回 nil
+// 扫码前交易不存在，超过关闭时间仍查不到时视为放弃支付
+func (p *AlipayProvider) QueryCheckout(ctx context.Context, sessionID string, createdAt time.Time) (*Event, error) {
+	var trade alipayTrade
+	err := p.call(ctx, "alipay.trade.query", map[string]string{"out_trade_no": sessionID}, &trade)
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.Code == "ACQ.TRADE_NOT_EXIST" {
+		if time.Since(createdAt) < p.cfg.Timeout+alipayCloseGrace {
+			return nil, nil
+		}
+		return &Event{
+			ID:       alipayEventID(sessionID, "closed"),
+			Type:     EventCheckoutExpired,
+			Checkout: &CheckoutEvent{SessionID: sessionID, Mode: ModePayment},
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return trade.event()
+}
+
+// ParseWebhook 校验支付宝异步通知（表单格式）的签名并转换为统一事件
+func (p *AlipayProvider) ParseWebhook(payload []byte, header http.Header) (Event, error) {
+	values, err := url.ParseQuery(string(payload))
+	if err != nil {
+		return Event{}, fmt.Errorf("%w: invalid notify payload: %v", services.ErrInvalidRequest, err)
+	}
+	if err := p.verify(alipaySignContent(values, "sign", "sign_type"), values.Get("sign")); err != nil {
+		return Event{}, err
+	}
+	if values.Get("app_id") != p.cfg.AppID {
+		return Event{}, fmt.Errorf("%w: notify for app %s", services.ErrInvalidRequest, values.Get("app_id"))
+	}
+	return notifyEvent(values)
+}
+
+// ParseEvent 解析已保存的异步通知；轮询得到的事件保存为 JSON
+func (p *AlipayProvider) ParseEvent(payload []byte) (Event, error) {
+	if strings.HasPrefix(strings.TrimSpace(string(payload)), "{") {
+		var event Event
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return Event{}, err
+		}
+		return event, nil
+	}
+	values, err := url.ParseQuery(string(payload))
+	if err != nil {
+		return Event{}, err
+	}
+	return notifyEvent(values)
+}
+
+// alipayTrade 交易查询响应与异步通知共用的字段
+type alipayTrade struct {
+	OutTradeNo     string `json:"out_trade_no"`
+	TradeNo        string `json:"trade_no"`
+	TradeStatus    string `json:"trade_status"`
+	TotalAmount    string `json:"total_amount"`
+	RefundFee      string `json:"refund_fee"`
+	PassbackParams string `json:"passback_params"`
+}
+
+// event 按交易状态转换为统一事件，退款通知优先；等待付款返回 nil
+// 事件 ID 由订单号和状态组成，同一状态的异步通知与轮询结果只处理一次
+func (t alipayTrade) event() (*Event, error) {
+	if t.RefundFee != "" {
+		refunded, err := parseYuan(t.RefundFee)
+		if err != nil {
+			return nil, err
+		}
+		if refunded > 0 {
+			total, err := parseYuan(t.TotalAmount)
+			if err != nil {
+				return nil, err
+			}
+			return &Event{
+				ID:   alipayEventID(t.OutTradeNo, "refund:"+strconv.Itoa(refunded)),
+				Type: EventChargeRefunded,
+				Refund: &RefundEvent{
+					ChargeID:       t.TradeNo,
+					PaymentID:      t.TradeNo,
+					AmountRefunded: refunded,
+					Amount:         total,
+				},
+			}, nil
+		}
+	}
+	switch t.TradeStatus {
+	case "TRADE_SUCCESS", "TRADE_FINISHED":
+		reference, _ := url.QueryUnescape(t.PassbackParams)
+		paid, err := parseYuan(t.TotalAmount)
+		if err != nil {
+			return nil, err
+		}
+		return &Event{
+			ID:   alipayEventID(t.OutTradeNo, "paid"),
+			Type: EventCheckoutCompleted,
+			Checkout: &CheckoutEvent{
+				SessionID:         t.OutTradeNo,
+				Mode:              ModePayment,
+				ClientReferenceID: reference,
+				PaymentID:         t.TradeNo,
+				AmountPaid:        paid,
+			},
+		}, nil
+	case "TRADE_CLOSED":
+		return &Event{
+			ID:       alipayEventID(t.OutTradeNo, "closed"),
+			Type:     EventCheckoutExpired,
+			Checkout: &CheckoutEvent{SessionID: t.OutTradeNo, Mode: ModePayment},
+		}, nil
+	default:
+		return nil, nil
+	}
+}
+
+func notifyEvent(values url.Values) (Event, error) {
+	trade := alipayTrade{
+		OutTradeNo:     values.Get("out_trade_no"),
+		TradeNo:        values.Get("trade_no"),
+		TradeStatus:    values.Get("trade_status"),
+		TotalAmount:    values.Get("total_amount"),
+		RefundFee:      values.Get("refund_fee"),
+		PassbackParams: values.Get("passback_params"),
+	}
+	if trade.OutTradeNo == "" {
+		return Event{}, fmt.Errorf("%w: notify has no out_trade_no", services.ErrInvalidRequest)
+	}
+	event, err := trade.event()
+	if err != nil {
+		return Event{}, fmt.Errorf("%w: %v", services.ErrInvalidRequest, err)
+	}
+	if event == nil {
+		// 其他状态只记录，不做处理
+		status := strings.ToLower(trade.TradeStatus)
+		return Event{ID: alipayEventID(trade.OutTradeNo, status), Type: "alipay.trade." + status}, nil
+	}
+	return *event, nil
+}
+
+func alipayEventID(outTradeNo, kind string) string {
+	return "alipay:" + outTradeNo + ":" + kind
+}
+
+// newAlipayTradeNo 商户订单号：本地订单 ID 加随机后缀，重新结账时不会与已关闭的交易冲突
+func newAlipayTradeNo(reference string) string {
+	suffix := make([]byte, 6)
+	_, _ = rand.Read(suffix)
+	return "eus" + reference + "_" + hex.EncodeToString(suffix)
+}
+
+// requestParams 构造公共请求参数，调用方补充参数后调用 sign
+func (p *AlipayProvider) requestParams(method string, biz map[string]string) (url.Values, error) {
+	content, err := json.Marshal(biz)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("app_id", p.cfg.AppID)
+	params.Set("method", method)
+	params.Set("format", "JSON")
+	params.Set("charset", "utf-8")
+	params.Set("sign_type", "RSA2")
+	params.Set("timestamp", time.Now().In(alipayLocation).Format("2006-01-02 15:04:05"))
+	params.Set("version", "1.0")
+	params.Set("biz_content", string(content))
+	if p.cfg.NotifyURL != "" {
+		params.Set("notify_url", p.cfg.NotifyURL)
+	}
+	return params, nil
+}
+
+func (p *AlipayProvider) sign(params url.Values) error {
+	sig, err := rsaSign(p.privateKey, alipaySignContent(params, "sign"))
+	if err != nil {
+		return err
+	}
+	params.Set("sign", sig)
+	return nil
+}
+
+func (p *AlipayProvider) verify(content, sig string) error {
+	if err := rsaVerify(p.publicKey, content, sig); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	return nil
+}
+
+// call 调用支付宝接口并校验响应签名，业务失败时返回 *Error（Code 为 sub_code）
+func (p *AlipayProvider) call(ctx context.Context, method string, biz map[string]string, out any) error {
+	params, err := p.requestParams(method, biz)
+	if err != nil {
+		return err
+	}
+	if err := p.sign(params); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.Gateway, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=utf-8")
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return fmt.Errorf("alipay %s: invalid response: %w", method, err)
+	}
+	raw, ok := envelope[strings.ReplaceAll(method, ".", "_")+"_response"]
+	if !ok {
+		raw, ok = envelope["error_response"]
+	}
+	if !ok {
+		return fmt.Errorf("alipay %s: response has no result", method)
+	}
+	var result struct {
+		Code    string `json:"code"`
+		Msg     string `json:"msg"`
+		SubCode string `json:"sub_code"`
+		SubMsg  string `json:"sub_msg"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return fmt.Errorf("alipay %s: invalid response: %w", method, err)
+	}
+	// 网关级错误（如应用 ID 无效）不带签名，成功响应必须校验签名
+	var sig string
+	if rawSig, ok := envelope["sign"]; ok {
+		if err := json.Unmarshal(rawSig, &sig); err != nil {
+			return fmt.Errorf("alipay %s: invalid sign: %w", method, err)
+		}
+	}
+	if sig != "" || result.Code == "10000" {
+		if err := p.verify(string(raw), sig); err != nil {
+			return fmt.Errorf("alipay %s: %w", method, err)
+		}
+	}
+	if result.Code != "10000" {
+		code, msg := result.SubCode, result.SubMsg
+		if code == "" {
+			code, msg = result.Code, result.Msg
+		}
+		return &Error{Provider: "alipay", Code: code, Message: msg}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// alipaySignContent 待签名字符串：排除指定参数和空值后按参数名排序，以 key=value 用 & 连接，值不做 URL 编码
+func alipaySignContent(values url.Values, exclude ...string) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		skip := values.Get(k) == ""
+		for _, e := range exclude {
+			if k == e {
+				skip = true
+			}
+		}
+		if !skip {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(values.Get(k))
+	}
+	return b.String()
+}
+
+func rsaSign(key *rsa.PrivateKey, content string) (string, error) {
+	digest := sha256.Sum256([]byte(content))
+	sig, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+func rsaVerify(key *rsa.PublicKey, content, sig string) error {
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(content))
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], raw)
+}
+
+// keyDER 接受 PEM 或去掉首尾行的 Base64 密钥
+func keyDER(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, errors.New("key is empty")
+	}
+	if strings.HasPrefix(s, "-----BEGIN") {
+		block, _ := pem.Decode([]byte(s))
+		if block == nil {
+			return nil, errors.New("invalid PEM")
+		}
+		return block.Bytes, nil
+	}
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+func parseRSAPrivateKey(s string) (*rsa.PrivateKey, error) {
+	der, err := keyDER(s)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return key, nil
+}
+
+func parseRSAPublicKey(s string) (*rsa.PublicKey, error) {
+	der, err := keyDER(s)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS1PublicKey(der); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return key, nil
+}
+
+// formatYuan 分转换为支付宝金额（元，两位小数）
+func formatYuan(cents int) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+// parseYuan 支付宝金额转换为分，避免浮点误差
+func parseYuan(s string) (int, error) {
+	whole, frac, _ := strings.Cut(strings.TrimSpace(s), ".")
+	if len(frac) > 2 {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	yuan, err := strconv.Atoi(whole)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	cents := 0
+	if frac != "" {
+		cents, err = strconv.Atoi(frac + strings.Repeat("0", 2-len(frac)))
+		if err != nil {
+			return 0, fmt.Errorf("invalid amount %q", s)
+		}
+	}
+	return yuan*100 + cents, nil
+}
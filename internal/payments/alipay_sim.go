@@ -0,0 +1,228 @@
+package payments
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AlipaySimulator 本地模拟的支付宝网关，签名算法与支付宝一致，用于测试和联调
+// 使用自己的密钥对签名响应和异步通知，使用应用公钥校验请求
+type AlipaySimulator struct {
+	mu         sync.Mutex
+	appID      string
+	privateKey *rsa.PrivateKey
+	appKey     *rsa.PublicKey
+	seq        int64
+	trades     map[string]*simTrade // out_trade_no -> 交易
+}
+
+type simTrade struct {
+	outTradeNo string
+	tradeNo    string
+	passback   string
+	total      int
+	refunded   int
+	status     string // 空字符串表示用户尚未扫码，查询返回交易不存在
+}
+
+// NewAlipaySimulator appPublicKey 为应用公钥（PEM 或 Base64），用于校验请求签名
+func NewAlipaySimulator(appID, appPublicKey string) (*AlipaySimulator, error) {
+	appKey, err := parseRSAPublicKey(appPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &AlipaySimulator{
+		appID:      appID,
+		privateKey: privateKey,
+		appKey:     appKey,
+		trades:     map[string]*simTrade{},
+	}, nil
+}
+
+// PublicKeyPEM 模拟网关的公钥，配置为 ALIPAY_PUBLIC_KEY
+func (s *AlipaySimulator) PublicKeyPEM() string {
+	der, _ := x509.MarshalPKIXPublicKey(&s.privateKey.PublicKey)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// ServeHTTP 处理 alipay.trade.page.pay / precreate / query / refund 请求
+func (s *AlipaySimulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	method := r.Form.Get("method")
+	if err := rsaVerify(s.appKey, alipaySignContent(r.Form, "sign"), r.Form.Get("sign")); err != nil || r.Form.Get("app_id") != s.appID {
+		s.respond(w, method, map[string]string{"code": "40002", "msg": "Invalid Arguments", "sub_code": "isv.invalid-signature", "sub_msg": "invalid signature"})
+		return
+	}
+	var biz map[string]string
+	if err := json.Unmarshal([]byte(r.Form.Get("biz_content")), &biz); err != nil {
+		s.respond(w, method, map[string]string{"code": "40002", "msg": "Invalid Arguments", "sub_code": "isv.invalid-parameter", "sub_msg": err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch method {
+	case "alipay.trade.page.pay", "alipay.trade.precreate":
+		total, err := parseYuan(biz["total_amount"])
+		if err != nil || total <= 0 {
+			s.respond(w, method, map[string]string{"code": "40002", "msg": "Invalid Arguments", "sub_code": "isv.invalid-parameter", "sub_msg": "invalid total_amount"})
+			return
+		}
+		outTradeNo := biz["out_trade_no"]
+		s.trades[outTradeNo] = &simTrade{outTradeNo: outTradeNo, passback: biz["passback_params"], total: total}
+		if method == "alipay.trade.page.pay" {
+			fmt.Fprintf(w, "alipay simulator cashier: out_trade_no=%s total_amount=%s\n", outTradeNo, biz["total_amount"])
+			return
+		}
+		s.respond(w, method, map[string]string{
+			"code":         "10000",
+			"msg":          "Success",
+			"out_trade_no": outTradeNo,
+			"qr_code":      "https://qr.alipay.com/sim_" + outTradeNo,
+		})
+	case "alipay.trade.query":
+		trade := s.find(biz)
+		if trade == nil || trade.status == "" {
+			s.respond(w, method, map[string]string{"code": "40004", "msg": "Business Failed", "sub_code": "ACQ.TRADE_NOT_EXIST", "sub_msg": "交易不存在"})
+			return
+		}
+		s.respond(w, method, map[string]string{
+			"code":         "10000",
+			"msg":          "Success",
+			"out_trade_no": trade.outTradeNo,
+			"trade_no":     trade.tradeNo,
+			"trade_status": trade.status,
+			"total_amount": formatYuan(trade.total),
+		})
+	case "alipay.trade.refund":
+		trade := s.find(biz)
+		if trade == nil || trade.tradeNo == "" {
+			s.respond(w, method, map[string]string{"code": "40004", "msg": "Business Failed", "sub_code": "ACQ.TRADE_NOT_EXIST", "sub_msg": "交易不存在"})
+			return
+		}
+		amount, err := parseYuan(biz["refund_amount"])
+		if err != nil || amount <= 0 || trade.refunded+amount > trade.total {
+			s.respond(w, method, map[string]string{"code": "40004", "msg": "Business Failed", "sub_code": "ACQ.REFUND_AMT_NOT_EQUAL_TOTAL", "sub_msg": "退款金额超限"})
+			return
+		}
+		trade.refunded += amount
+		if trade.refunded == trade.total {
+			trade.status = "TRADE_CLOSED"
+		}
+		s.respond(w, method, map[string]string{
+			"code":         "10000",
+			"msg":          "Success",
+			"out_trade_no": trade.outTradeNo,
+			"trade_no":     trade.tradeNo,
+			"fund_change":  "Y",
+			"refund_fee":   formatYuan(trade.refunded),
+		})
+	default:
+		s.respond(w, method, map[string]string{"code": "40004", "msg": "Business Failed", "sub_code": "isv.invalid-method", "sub_msg": "unsupported method"})
+	}
+}
+
+// find 按 out_trade_no 或 trade_no 查找交易，调用方需持有锁
+func (s *AlipaySimulator) find(biz map[string]string) *simTrade {
+	if trade, ok := s.trades[biz["out_trade_no"]]; ok {
+		return trade
+	}
+	for _, trade := range s.trades {
+		if trade.tradeNo != "" && trade.tradeNo == biz["trade_no"] {
+			return trade
+		}
+	}
+	return nil
+}
+
+// respond 按支付宝格式返回响应，签名内容为 xxx_response 节点的原始 JSON
+func (s *AlipaySimulator) respond(w http.ResponseWriter, method string, result map[string]string) {
+	raw, _ := json.Marshal(result)
+	sig, err := rsaSign(s.privateKey, string(raw))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	fmt.Fprintf(w, `{"%s_response":%s,"sign":"%s"}`, strings.ReplaceAll(method, ".", "_"), raw, sig)
+}
+
+// Pay 模拟用户扫码或在收银台完成支付，返回已签名的异步通知表单
+func (s *AlipaySimulator) Pay(outTradeNo string) (url.Values, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	trade, ok := s.trades[outTradeNo]
+	if !ok {
+		return nil, fmt.Errorf("unknown trade %s", outTradeNo)
+	}
+	if trade.status != "" {
+		return nil, fmt.Errorf("trade %s is %s", outTradeNo, trade.status)
+	}
+	s.seq++
+	trade.tradeNo = fmt.Sprintf("%s%010d", time.Now().In(alipayLocation).Format("20060102"), s.seq)
+	trade.status = "TRADE_SUCCESS"
+	return s.notify(trade)
+}
+
+// RefundNotify 返回当前累计退款金额的异步通知表单
+func (s *AlipaySimulator) RefundNotify(outTradeNo string) (url.Values, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	trade, ok := s.trades[outTradeNo]
+	if !ok || trade.refunded == 0 {
+		return nil, fmt.Errorf("trade %s has no refund", outTradeNo)
+	}
+	values, err := s.notify(trade)
+	if err != nil {
+		return nil, err
+	}
+	values.Set("refund_fee", formatYuan(trade.refunded))
+	values.Set("gmt_refund", time.Now().In(alipayLocation).Format("2006-01-02 15:04:05"))
+	return values, s.signNotify(values)
+}
+
+// notify 构造异步通知，调用方需持有锁
+func (s *AlipaySimulator) notify(trade *simTrade) (url.Values, error) {
+	s.seq++
+	values := url.Values{}
+	values.Set("notify_time", time.Now().In(alipayLocation).Format("2006-01-02 15:04:05"))
+	values.Set("notify_type", "trade_status_sync")
+	values.Set("notify_id", fmt.Sprintf("sim%d", s.seq))
+	values.Set("app_id", s.appID)
+	values.Set("charset", "utf-8")
+	values.Set("version", "1.0")
+	values.Set("out_trade_no", trade.outTradeNo)
+	values.Set("trade_no", trade.tradeNo)
+	values.Set("trade_status", trade.status)
+	values.Set("total_amount", formatYuan(trade.total))
+	if trade.passback != "" {
+		values.Set("passback_params", trade.passback)
+	}
+	return values, s.signNotify(values)
+}
+
+func (s *AlipaySimulator) signNotify(values url.Values) error {
+	values.Set("sign_type", "RSA2")
+	sig, err := rsaSign(s.privateKey, alipaySignContent(values, "sign", "sign_type"))
+	if err != nil {
+		return err
+	}
+	values.Set("sign", sig)
+	return nil
+}
@@ -0,0 +1,169 @@
+package payments
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newAlipayTestProvider 启动模拟网关并返回指向它的支付宝平台
+func newAlipayTestProvider(t *testing.T, mode string) (*AlipayProvider, *AlipaySimulator) {
+	t.Helper()
+	appKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(appKey)
+	if err != nil {
+		t.Fatalf("marshal private key: %v", err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(&appKey.PublicKey)
+	if err != nil {
+		t.Fatalf("marshal public key: %v", err)
+	}
+	sim, err := NewAlipaySimulator("2021000000000001", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})))
+	if err != nil {
+		t.Fatalf("new simulator: %v", err)
+	}
+	gateway := httptest.NewServer(sim)
+	t.Cleanup(gateway.Close)
+
+	provider, err := NewAlipayProvider(AlipayConfig{
+		AppID:        "2021000000000001",
+		PrivateKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})),
+		PublicKey:    sim.PublicKeyPEM(),
+		Gateway:      gateway.URL,
+		NotifyURL:    "https://example.com/api/webhooks/alipay",
+		CheckoutMode: mode,
+	})
+	if err != nil {
+		t.Fatalf("new provider: %v", err)
+	}
+	return provider, sim
+}
+
+func TestAlipayQRCheckoutPayAndRefund(t *testing.T) {
+	ctx := context.Background()
+	provider, sim := newAlipayTestProvider(t, AlipayCheckoutQR)
+
+	sess, err := provider.CreateCheckout(ctx, CheckoutParams{Mode: ModePayment, ClientReferenceID: "42", AmountCents: 1250})
+	if err != nil {
+		t.Fatalf("create checkout: %v", err)
+	}
+	if sess.QRCode == "" || sess.URL != sess.QRCode {
+		t.Fatalf("expected qr code, got %+v", sess)
+	}
+
+	// 扫码前查询不到交易，未超过关闭时间时继续等待
+	event, err := provider.QueryCheckout(ctx, sess.ID, time.Now())
+	if err != nil || event != nil {
+		t.Fatalf("expected pending checkout, got %+v, err %v", event, err)
+	}
+
+	notify, err := sim.Pay(sess.ID)
+	if err != nil {
+		t.Fatalf("pay: %v", err)
+	}
+	paid, err := provider.ParseWebhook([]byte(notify.Encode()), http.Header{})
+	if err != nil {
+		t.Fatalf("parse notify: %v", err)
+	}
+	if paid.Type != EventCheckoutCompleted || paid.Checkout.ClientReferenceID != "42" || paid.Checkout.PaymentID == "" || paid.Checkout.AmountPaid != 1250 {
+		t.Fatalf("unexpected event %+v %+v", paid, paid.Checkout)
+	}
+
+	// 轮询结果与异步通知的事件 ID 相同，只会处理一次
+	polled, err := provider.QueryCheckout(ctx, sess.ID, time.Now())
+	if err != nil || polled == nil || polled.ID != paid.ID || polled.Checkout.AmountPaid != 1250 {
+		t.Fatalf("expected polled event %s, got %+v, err %v", paid.ID, polled, err)
+	}
+
+	payment, err := provider.GetPayment(ctx, paid.Checkout.PaymentID)
+	if err != nil || payment.AmountReceived != 1250 {
+		t.Fatalf("unexpected payment %+v, err %v", payment, err)
+	}
+	if _, err := provider.Refund(ctx, RefundParams{PaymentID: payment.ID, AmountCents: 500}); err != nil {
+		t.Fatalf("refund: %v", err)
+	}
+	var apiErr *Error
+	if _, err := provider.Refund(ctx, RefundParams{PaymentID: payment.ID, AmountCents: 800}); !errors.As(err, &apiErr) {
+		t.Fatalf("expected refund above remaining amount to be rejected, got %v", err)
+	}
+
+	notify, err = sim.RefundNotify(sess.ID)
+	if err != nil {
+		t.Fatalf("refund notify: %v", err)
+	}
+	refunded, err := provider.ParseWebhook([]byte(notify.Encode()), http.Header{})
+	if err != nil {
+		t.Fatalf("parse refund notify: %v", err)
+	}
+	if refunded.Type != EventChargeRefunded || refunded.Refund.AmountRefunded != 500 || refunded.Refund.Amount != 1250 {
+		t.Fatalf("unexpected refund event %+v %+v", refunded, refunded.Refund)
+	}
+}
+
+func TestAlipayPageCheckoutURLIsSigned(t *testing.T) {
+	provider, _ := newAlipayTestProvider(t, AlipayCheckoutPage)
+	sess, err := provider.CreateCheckout(context.Background(), CheckoutParams{
+		Mode:              ModePayment,
+		ClientReferenceID: "7",
+		AmountCents:       100,
+		SuccessURL:        "https://app.example.com/ok",
+	})
+	if err != nil {
+		t.Fatalf("create checkout: %v", err)
+	}
+	resp, err := http.Get(sess.URL)
+	if err != nil {
+		t.Fatalf("open cashier: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read cashier: %v", err)
+	}
+	if !strings.Contains(string(body), "out_trade_no="+sess.ID) {
+		t.Fatalf("simulator rejected checkout url: %s", body)
+	}
+}
+
+func TestAlipayNotifyRejectsTampering(t *testing.T) {
+	provider, sim := newAlipayTestProvider(t, AlipayCheckoutQR)
+	sess, err := provider.CreateCheckout(context.Background(), CheckoutParams{Mode: ModePayment, ClientReferenceID: "1", AmountCents: 100})
+	if err != nil {
+		t.Fatalf("create checkout: %v", err)
+	}
+	notify, err := sim.Pay(sess.ID)
+	if err != nil {
+		t.Fatalf("pay: %v", err)
+	}
+	notify.Set("total_amount", "1000.00")
+	if _, err := provider.ParseWebhook([]byte(notify.Encode()), http.Header{}); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected ErrInvalidSignature, got %v", err)
+	}
+}
+
+func TestParseYuan(t *testing.T) {
+	for in, want := range map[string]int{"12.34": 1234, "0.5": 50, "7": 700, "0.01": 1} {
+		got, err := parseYuan(in)
+		if err != nil || got != want {
+			t.Fatalf("parseYuan(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	if _, err := parseYuan("1.234"); err == nil {
+		t.Fatal("expected error for three decimals")
+	}
+	if formatYuan(1205) != "12.05" {
+		t.Fatalf("unexpected formatYuan result %s", formatYuan(1205))
+	}
+}
@@ -0,0 +1,311 @@
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"easyusersys/internal/models"
+	"easyusersys/internal/services"
+)
+
+// FakeDeclinedPaymentMethod 离线扣款时总是被拒付的支付方式，用于测试自动充值失败
+const FakeDeclinedPaymentMethod = "pm_fake_declined"
+
+// fakeSubscriptionPeriod 模拟订阅的计费周期
+const fakeSubscriptionPeriod = 30 * 24 * time.Hour
+
+// FakeProvider 不访问网络的支付平台，数据只保存在内存中，用于本地开发和端到端测试
+// 结账页面指向本服务的模拟支付接口，调用 Pay / Expire 后生成与真实平台相同类型的事件
+type FakeProvider struct {
+	mu            sync.Mutex
+	baseURL       string
+	secret        []byte
+	seq           int64
+	sessions      map[string]*fakeSession
+	payments      map[string]*fakePayment
+	subscriptions map[string]*fakeSubscription
+	setupIntents  map[string]string                    // SetupIntent ID -> 支付方式
+	charges       map[string]services.OffSessionResult // 幂等键 -> 离线扣款结果
+}
+
+type fakeSession struct {
+	params CheckoutParams
+	status string // open | complete | expired
+}
+
+type fakePayment struct {
+	amount   int
+	refunded int
+}
+
+type fakeSubscription struct {
+	priceID     string
+	amount      int
+	periodEnd   time.Time
+	canceled    bool
+	cancelAtEnd bool
+}
+
+// NewFakeProvider baseURL 为本服务的对外地址，webhookSecret 为空时随机生成
+func NewFakeProvider(baseURL, webhookSecret string) *FakeProvider {
+	secret := []byte(webhookSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		_, _ = rand.Read(secret)
+	}
+	return &FakeProvider{
+		baseURL:       strings.TrimRight(baseURL, "/"),
+		secret:        secret,
+		sessions:      map[string]*fakeSession{},
+		payments:      map[string]*fakePayment{},
+		subscriptions: map[string]*fakeSubscription{},
+		setupIntents:  map[string]string{},
+		charges:       map[string]services.OffSessionResult{},
+	}
+}
+
+func (p *FakeProvider) Name() string { return "fake" }
+
+func (p *FakeProvider) IsConfigured() bool { return true }
+
+// Currency 模拟平台不区分币种
+func (p *FakeProvider) Currency() string { return "" }
+
+// nextID 生成带前缀的递增 ID，调用方需持有锁
+func (p *FakeProvider) nextID(prefix string) string {
+	p.seq++
+	return fmt.Sprintf("%s_fake_%d", prefix, p.seq)
+}
+
+func (p *FakeProvider) CreateCustomer(ctx context.Context, in Customer) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.nextID("cus"), nil
+}
+
+func (p *FakeProvider) CreateCheckout(ctx context.Context, in CheckoutParams) (CheckoutSession, error) {
+	if in.Mode == ModeSubscription && in.PriceID == "" {
+		return CheckoutSession{}, &Error{Provider: "fake", Code: "parameter_missing", Message: "price is required"}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := p.nextID("cs")
+	p.sessions[id] = &fakeSession{params: in, status: "open"}
+	return CheckoutSession{ID: id, URL: p.baseURL + "/api/payments/fake/checkout/" + id + "/pay"}, nil
+}
+
+// CreateBillingPortal 模拟平台没有自助管理页面，直接返回 returnURL
+func (p *FakeProvider) CreateBillingPortal(ctx context.Context, customerID, returnURL string) (string, error) {
+	return returnURL, nil
+}
+
+func (p *FakeProvider) PaymentMethodForSetupIntent(ctx context.Context, setupIntentID string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pm, ok := p.setupIntents[setupIntentID]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown setup intent %s", services.ErrInvalidRequest, setupIntentID)
+	}
+	return pm, nil
+}
+
+func (p *FakeProvider) CancelAtPeriodEnd(ctx context.Context, subscriptionID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sub, ok := p.subscriptions[subscriptionID]
+	if !ok {
+		return fmt.Errorf("fake subscription %s not found", subscriptionID)
+	}
+	sub.cancelAtEnd = true
+	return nil
+}
+
+func (p *FakeProvider) CancelNow(ctx context.Context, subscriptionID string, prorate bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sub, ok := p.subscriptions[subscriptionID]
+	if !ok {
+		return fmt.Errorf("fake subscription %s not found", subscriptionID)
+	}
+	sub.canceled = true
+	return nil
+}
+
+func (p *FakeProvider) ChangePrice(ctx context.Context, subscriptionID, priceID string) (time.Time, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sub, ok := p.subscriptions[subscriptionID]
+	if !ok || sub.canceled {
+		return time.Time{}, fmt.Errorf("fake subscription %s not found", subscriptionID)
+	}
+	sub.priceID = priceID
+	return sub.periodEnd, nil
+}
+
+func (p *FakeProvider) GetPayment(ctx context.Context, paymentID string) (Payment, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pay, ok := p.payments[paymentID]
+	if !ok {
+		return Payment{}, fmt.Errorf("fake payment %s not found", paymentID)
+	}
+	return Payment{ID: paymentID, AmountReceived: pay.amount}, nil
+}
+
+func (p *FakeProvider) Refund(ctx context.Context, in RefundParams) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pay, ok := p.payments[in.PaymentID]
+	if !ok {
+		return "", fmt.Errorf("fake payment %s not found", in.PaymentID)
+	}
+	if in.AmountCents <= 0 || pay.refunded+in.AmountCents > pay.amount {
+		return "", &Error{Provider: "fake", Code: "amount_too_large", Message: "refund exceeds payment amount"}
+	}
+	pay.refunded += in.AmountCents
+	return p.nextID("re"), nil
+}
+
+// ChargeOffSession 除 FakeDeclinedPaymentMethod 外总是立即成功，相同幂等键返回相同结果
+func (p *FakeProvider) ChargeOffSession(ctx context.Context, charge services.OffSessionCharge) (services.OffSessionResult, error) {
+	if charge.PaymentMethodID == FakeDeclinedPaymentMethod {
+		return services.OffSessionResult{}, fmt.Errorf("%w: card_declined", services.ErrPaymentDeclined)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if result, ok := p.charges[charge.IdempotencyKey]; ok {
+		return result, nil
+	}
+	id := p.nextID("pi")
+	p.payments[id] = &fakePayment{amount: charge.AmountCents}
+	result := services.OffSessionResult{PaymentIntentID: id, Succeeded: true}
+	p.charges[charge.IdempotencyKey] = result
+	return result, nil
+}
+
+// Pay 模拟用户完成结账，返回 checkout.session.completed 事件和应跳转的 success_url
+func (p *FakeProvider) Pay(sessionID string) (Event, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sess, ok := p.sessions[sessionID]
+	if !ok {
+		return Event{}, "", fmt.Errorf("%w: unknown checkout session %s", services.ErrNotFound, sessionID)
+	}
+	if sess.status != "open" {
+		return Event{}, "", fmt.Errorf("%w: checkout session %s is %s", services.ErrInvalidRequest, sessionID, sess.status)
+	}
+	sess.status = "complete"
+
+	c := &CheckoutEvent{
+		SessionID:         sessionID,
+		Mode:              sess.params.Mode,
+		ClientReferenceID: sess.params.ClientReferenceID,
+		CustomerID:        sess.params.CustomerID,
+		Metadata:          sess.params.Metadata,
+	}
+	switch sess.params.Mode {
+	case ModePayment:
+		c.PaymentID = p.nextID("pi")
+		p.payments[c.PaymentID] = &fakePayment{amount: sess.params.AmountCents}
+	case ModeSubscription:
+		c.SubscriptionID = p.nextID("sub")
+		p.subscriptions[c.SubscriptionID] = &fakeSubscription{
+			priceID:   sess.params.PriceID,
+			amount:    sess.params.AmountCents,
+			periodEnd: time.Now().UTC().Add(fakeSubscriptionPeriod),
+		}
+	case ModeSetup:
+		c.SetupIntentID = p.nextID("seti")
+		p.setupIntents[c.SetupIntentID] = p.nextID("pm")
+	}
+	successURL := strings.ReplaceAll(sess.params.SuccessURL, "{CHECKOUT_SESSION_ID}", sessionID)
+	return Event{ID: p.nextID("evt"), Type: EventCheckoutCompleted, Checkout: c}, successURL, nil
+}
+
+// Expire 模拟结账页面过期，返回 checkout.session.expired 事件和应跳转的 cancel_url
+func (p *FakeProvider) Expire(sessionID string) (Event, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sess, ok := p.sessions[sessionID]
+	if !ok {
+		return Event{}, "", fmt.Errorf("%w: unknown checkout session %s", services.ErrNotFound, sessionID)
+	}
+	if sess.status != "open" {
+		return Event{}, "", fmt.Errorf("%w: checkout session %s is %s", services.ErrInvalidRequest, sessionID, sess.status)
+	}
+	sess.status = "expired"
+	return Event{ID: p.nextID("evt"), Type: EventCheckoutExpired, Checkout: &CheckoutEvent{
+		SessionID:         sessionID,
+		Mode:              sess.params.Mode,
+		ClientReferenceID: sess.params.ClientReferenceID,
+		CustomerID:        sess.params.CustomerID,
+		Metadata:          sess.params.Metadata,
+	}}, sess.params.CancelURL, nil
+}
+
+// Renew 模拟订阅续费扣款，返回 invoice.paid 事件；订阅已取消或到期取消时返回 customer.subscription.deleted 事件
+func (p *FakeProvider) Renew(subscriptionID string) (Event, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sub, ok := p.subscriptions[subscriptionID]
+	if !ok {
+		return Event{}, fmt.Errorf("%w: unknown subscription %s", services.ErrNotFound, subscriptionID)
+	}
+	if sub.canceled || sub.cancelAtEnd {
+		sub.canceled = true
+		endedAt := time.Now().UTC()
+		return Event{ID: p.nextID("evt"), Type: EventSubscriptionDeleted, Subscription: &SubscriptionEvent{
+			ID:       subscriptionID,
+			Status:   models.SubscriptionCanceled,
+			EndedAt:  &endedAt,
+			PriceIDs: []string{sub.priceID},
+		}}, nil
+	}
+	sub.periodEnd = sub.periodEnd.Add(fakeSubscriptionPeriod)
+	p.payments[p.nextID("pi")] = &fakePayment{amount: sub.amount}
+	return Event{ID: p.nextID("evt"), Type: EventInvoicePaid, Invoice: &InvoiceEvent{
+		ID:             p.nextID("in"),
+		SubscriptionID: subscriptionID,
+		Renewal:        true,
+	}}, nil
+}
+
+// Sign 计算事件内容的签名，放在 Fake-Signature 请求头中
+func (p *FakeProvider) Sign(payload []byte) string {
+	return hex.EncodeToString(p.signature(payload))
+}
+
+func (p *FakeProvider) signature(payload []byte) []byte {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (p *FakeProvider) ParseWebhook(payload []byte, header http.Header) (Event, error) {
+	sig, err := hex.DecodeString(header.Get("Fake-Signature"))
+	if err != nil || !hmac.Equal(sig, p.signature(payload)) {
+		return Event{}, ErrInvalidSignature
+	}
+	return p.ParseEvent(payload)
+}
+
+func (p *FakeProvider) ParseEvent(payload []byte) (Event, error) {
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return Event{}, err
+	}
+	if event.ID == "" || event.Type == "" {
+		return Event{}, errors.New("fake event requires ID and Type")
+	}
+	return event, nil
+}
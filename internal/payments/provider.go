@@ -0,0 +1,239 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"easyusersys/internal/config"
+	"easyusersys/internal/services"
+)
+
+// ErrInvalidSignature Webhook 签名校验失败
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Checkout 模式
+const (
+	ModePayment      = "payment"      // 一次性支付（预充值）
+	ModeSubscription = "subscription" // 订阅
+	ModeSetup        = "setup"        // 只保存支付方式（自动充值）
+)
+
+// 支付平台事件类型，沿用 Stripe 的事件名，其他平台的通知转换为同名事件
+const (
+	EventCheckoutCompleted    = "checkout.session.completed"
+	EventCheckoutExpired      = "checkout.session.expired"
+	EventInvoicePaid          = "invoice.paid"
+	EventInvoicePaymentFailed = "invoice.payment_failed"
+	EventSubscriptionUpdated  = "customer.subscription.updated"
+	EventSubscriptionDeleted  = "customer.subscription.deleted"
+	EventChargeRefunded       = "charge.refunded"
+	EventDisputeCreated       = "charge.dispute.created"
+	EventPaymentSucceeded     = "payment_intent.succeeded"
+	EventPaymentFailed        = "payment_intent.payment_failed"
+)
+
+// Provider 支付平台接口：结账、订阅管理、退款、离线扣款与 Webhook 校验
+type Provider interface {
+	services.OffSessionCharger
+
+	// Name 平台名称，用于日志和配置
+	Name() string
+	// IsConfigured 是否已配置可用
+	IsConfigured() bool
+	// Currency 收款币种（ISO 4217 小写），为空表示按调用方给出的金额和币种收款
+	Currency() string
+
+	// CreateCustomer 创建平台客户，返回客户 ID
+	CreateCustomer(ctx context.Context, in Customer) (string, error)
+	// CreateCheckout 创建托管结账页面
+	CreateCheckout(ctx context.Context, in CheckoutParams) (CheckoutSession, error)
+	// CreateBillingPortal 创建客户自助管理页面，返回页面地址
+	CreateBillingPortal(ctx context.Context, customerID, returnURL string) (string, error)
+	// PaymentMethodForSetupIntent 查询 setup 模式结账保存的支付方式
+	PaymentMethodForSetupIntent(ctx context.Context, setupIntentID string) (string, error)
+
+	// CancelAtPeriodEnd 当前周期结束后不再续费
+	CancelAtPeriodEnd(ctx context.Context, subscriptionID string) error
+	// CancelNow 立即取消订阅，prorate 为 true 时按剩余时间生成抵扣
+	CancelNow(ctx context.Context, subscriptionID string, prorate bool) error
+	// ChangePrice 将订阅切换到新价格并按比例计费，返回切换后当前周期的结束时间
+	ChangePrice(ctx context.Context, subscriptionID, priceID string) (time.Time, error)
+
+	// GetPayment 查询一笔支付
+	GetPayment(ctx context.Context, paymentID string) (Payment, error)
+	// Refund 对一笔支付退款，返回退款 ID
+	Refund(ctx context.Context, in RefundParams) (string, error)
+
+	// ParseWebhook 校验签名并解析 Webhook 请求，签名错误时返回 ErrInvalidSignature
+	ParseWebhook(payload []byte, header http.Header) (Event, error)
+	// ParseEvent 解析已校验并保存的事件内容，用于重放
+	ParseEvent(payload []byte) (Event, error)
+}
+
+// Customer 创建客户的参数
+type Customer struct {
+	Email    string
+	Metadata map[string]string
+}
+
+// CheckoutParams 创建结账页面的参数
+type CheckoutParams struct {
+	Mode              string // payment | subscription | setup
+	CustomerID        string
+	SuccessURL        string
+	CancelURL         string
+	ClientReferenceID string
+	PriceID           string // subscription 模式使用的平台价格 ID
+	AmountCents       int    // payment 模式的支付金额；subscription 模式为计划价格，供没有价格 ID 的平台使用
+	ProductName       string
+	CouponID          string // 平台折扣券 ID，可选
+	Metadata          map[string]string
+}
+
+// CheckoutSession 创建的结账页面
+type CheckoutSession struct {
+	ID     string
+	URL    string
+	QRCode string // 扫码支付的二维码内容，由前端渲染；跳转支付为空
+}
+
+// Poller 支持主动查询结账状态的平台，用于补偿丢失的异步通知
+type Poller interface {
+	// QueryCheckout 返回结账会话的最终状态事件，仍在等待支付时返回 nil
+	QueryCheckout(ctx context.Context, sessionID string, createdAt time.Time) (*Event, error)
+}
+
+// Payment 一笔支付
+type Payment struct {
+	ID             string
+	AmountReceived int // 实收金额（分）
+}
+
+// RefundParams 退款参数
+type RefundParams struct {
+	PaymentID   string
+	AmountCents int
+	Metadata    map[string]string
+}
+
+// Error 支付平台拒绝请求（参数错误、折扣券无效等），不可重试
+type Error struct {
+	Provider string
+	Code     string
+	Message  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s error: %s - %s", e.Provider, e.Code, e.Message)
+}
+
+// Event 转换为统一结构的支付平台事件，按 Type 填充对应字段
+type Event struct {
+	ID           string
+	Type         string
+	Checkout     *CheckoutEvent     `json:",omitempty"`
+	Invoice      *InvoiceEvent      `json:",omitempty"`
+	Subscription *SubscriptionEvent `json:",omitempty"`
+	Refund       *RefundEvent       `json:",omitempty"`
+	Dispute      *DisputeEvent      `json:",omitempty"`
+	Payment      *PaymentEvent      `json:",omitempty"`
+}
+
+// CheckoutEvent 结账完成或过期
+type CheckoutEvent struct {
+	SessionID         string
+	Mode              string
+	ClientReferenceID string
+	CustomerID        string
+	SubscriptionID    string
+	PaymentID         string
+	SetupIntentID     string
+	Metadata          map[string]string
+	// AmountPaid 实付金额（分），为 0 表示不核对；Stripe 结账可能使用折扣券，不提供该金额
+	AmountPaid int
+}
+
+// InvoiceEvent 订阅账单支付结果
+type InvoiceEvent struct {
+	ID             string
+	SubscriptionID string
+	Renewal        bool // 续费周期账单；首期、改价等其他账单为 false
+}
+
+// SubscriptionEvent 订阅变更
+type SubscriptionEvent struct {
+	ID                string
+	Status            string // 映射后的本地订阅状态，空字符串表示不需要同步
+	CancelAtPeriodEnd bool
+	EndedAt           *time.Time
+	PriceIDs          []string
+}
+
+// RefundEvent 扣款退款，金额为累计值
+type RefundEvent struct {
+	ChargeID       string
+	PaymentID      string
+	AmountRefunded int
+	Amount         int
+}
+
+// DisputeEvent 客户发起拒付
+type DisputeEvent struct {
+	ID        string
+	PaymentID string
+	Amount    int // 争议金额
+	Charged   int // 原扣款金额
+}
+
+// PaymentEvent 离线扣款的异步结果
+type PaymentEvent struct {
+	ID            string
+	Metadata      map[string]string
+	FailureReason string
+}
+
+// EventProvider 返回事件 ID 中标记的支付平台名称（如 alipay:...），主支付平台的事件返回空字符串
+func EventProvider(eventID string) string {
+	name, _, ok := strings.Cut(eventID, ":")
+	if !ok {
+		return ""
+	}
+	return name
+}
+
+// New 按 PAYMENT_PROVIDER 创建支付平台
+func New(cfg config.Config) (Provider, error) {
+	switch cfg.PaymentProvider {
+	case "", config.PaymentProviderStripe:
+		return NewStripeProvider(cfg.StripeSecretKey, cfg.StripeWebhookSecret, cfg.StripeCurrency), nil
+	case config.PaymentProviderFake:
+		return NewFakeProvider(cfg.FakePaymentBaseURL, cfg.StripeWebhookSecret), nil
+	default:
+		return nil, fmt.Errorf("unknown payment provider %q", cfg.PaymentProvider)
+	}
+}
+
+// NewAlternatives 创建与主支付平台并存的其他支付平台（目前为支付宝），未配置时返回空
+func NewAlternatives(cfg config.Config) ([]Provider, error) {
+	var providers []Provider
+	if cfg.AlipayAppID != "" {
+		alipay, err := NewAlipayProvider(AlipayConfig{
+			AppID:        cfg.AlipayAppID,
+			PrivateKey:   cfg.AlipayPrivateKey,
+			PublicKey:    cfg.AlipayPublicKey,
+			Gateway:      cfg.AlipayGateway,
+			NotifyURL:    cfg.AlipayNotifyURL,
+			CheckoutMode: cfg.AlipayCheckoutMode,
+			Timeout:      time.Duration(cfg.AlipayTimeoutMinutes) * time.Minute,
+		})
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, alipay)
+	}
+	return providers, nil
+}
@@ -0,0 +1,353 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"easyusersys/internal/models"
+	"easyusersys/internal/services"
+
+	"github.com/stripe/stripe-go/v84"
+	"github.com/stripe/stripe-go/v84/webhook"
+)
+
+// StripeProvider 通过 Stripe API 实现 Provider，每个实例使用独立的 API 客户端，不修改全局 stripe.Key
+type StripeProvider struct {
+	client        *stripe.Client
+	configured    bool
+	webhookSecret string
+	currency      string
+}
+
+func NewStripeProvider(secretKey, webhookSecret, currency string) *StripeProvider {
+	return &StripeProvider{
+		client:        stripe.NewClient(secretKey),
+		configured:    secretKey != "",
+		webhookSecret: webhookSecret,
+		currency:      currency,
+	}
+}
+
+func (p *StripeProvider) Name() string { return "stripe" }
+
+func (p *StripeProvider) IsConfigured() bool { return p.configured }
+
+func (p *StripeProvider) Currency() string { return p.currency }
+
+func (p *StripeProvider) CreateCustomer(ctx context.Context, in Customer) (string, error) {
+	c, err := p.client.V1Customers.Create(ctx, &stripe.CustomerCreateParams{
+		Email:    stripe.String(in.Email),
+		Metadata: in.Metadata,
+	})
+	if err != nil {
+		return "", stripeError(err)
+	}
+	return c.ID, nil
+}
+
+func (p *StripeProvider) CreateCheckout(ctx context.Context, in CheckoutParams) (CheckoutSession, error) {
+	params := &stripe.CheckoutSessionCreateParams{
+		Mode:       stripe.String(in.Mode),
+		Customer:   stripe.String(in.CustomerID),
+		SuccessURL: stripe.String(in.SuccessURL),
+		CancelURL:  stripe.String(in.CancelURL),
+		Metadata:   in.Metadata,
+	}
+	if in.ClientReferenceID != "" {
+		params.ClientReferenceID = stripe.String(in.ClientReferenceID)
+	}
+	switch in.Mode {
+	case ModeSubscription:
+		params.LineItems = []*stripe.CheckoutSessionCreateLineItemParams{
+			{Price: stripe.String(in.PriceID), Quantity: stripe.Int64(1)},
+		}
+	case ModePayment:
+		params.LineItems = []*stripe.CheckoutSessionCreateLineItemParams{
+			{
+				PriceData: &stripe.CheckoutSessionCreateLineItemPriceDataParams{
+					Currency:   stripe.String(p.currency),
+					UnitAmount: stripe.Int64(int64(in.AmountCents)),
+					ProductData: &stripe.CheckoutSessionCreateLineItemPriceDataProductDataParams{
+						Name: stripe.String(in.ProductName),
+					},
+				},
+				Quantity: stripe.Int64(1),
+			},
+		}
+	case ModeSetup:
+		params.PaymentMethodTypes = stripe.StringSlice([]string{"card"})
+		params.SetupIntentData = &stripe.CheckoutSessionCreateSetupIntentDataParams{Metadata: in.Metadata}
+	}
+	if in.CouponID != "" {
+		params.Discounts = []*stripe.CheckoutSessionCreateDiscountParams{{Coupon: stripe.String(in.CouponID)}}
+	}
+	sess, err := p.client.V1CheckoutSessions.Create(ctx, params)
+	if err != nil {
+		return CheckoutSession{}, stripeError(err)
+	}
+	return CheckoutSession{ID: sess.ID, URL: sess.URL}, nil
+}
+
+func (p *StripeProvider) CreateBillingPortal(ctx context.Context, customerID, returnURL string) (string, error) {
+	sess, err := p.client.V1BillingPortalSessions.Create(ctx, &stripe.BillingPortalSessionCreateParams{
+		Customer:  stripe.String(customerID),
+		ReturnURL: stripe.String(returnURL),
+	})
+	if err != nil {
+		return "", stripeError(err)
+	}
+	return sess.URL, nil
+}
+
+func (p *StripeProvider) PaymentMethodForSetupIntent(ctx context.Context, setupIntentID string) (string, error) {
+	si, err := p.client.V1SetupIntents.Retrieve(ctx, setupIntentID, nil)
+	if err != nil {
+		return "", err
+	}
+	if si.PaymentMethod == nil || si.PaymentMethod.ID == "" {
+		return "", fmt.Errorf("%w: setup intent %s has no payment method", services.ErrInvalidRequest, setupIntentID)
+	}
+	return si.PaymentMethod.ID, nil
+}
+
+func (p *StripeProvider) CancelAtPeriodEnd(ctx context.Context, subscriptionID string) error {
+	_, err := p.client.V1Subscriptions.Update(ctx, subscriptionID, &stripe.SubscriptionUpdateParams{
+		CancelAtPeriodEnd: stripe.Bool(true),
+	})
+	return err
+}
+
+func (p *StripeProvider) CancelNow(ctx context.Context, subscriptionID string, prorate bool) error {
+	params := &stripe.SubscriptionCancelParams{Prorate: stripe.Bool(prorate)}
+	if prorate {
+		// 立即开出账单，使抵扣金额计入客户余额
+		params.InvoiceNow = stripe.Bool(true)
+	}
+	_, err := p.client.V1Subscriptions.Cancel(ctx, subscriptionID, params)
+	return err
+}
+
+func (p *StripeProvider) ChangePrice(ctx context.Context, subscriptionID, priceID string) (time.Time, error) {
+	current, err := p.client.V1Subscriptions.Retrieve(ctx, subscriptionID, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if current.Items == nil || len(current.Items.Data) == 0 {
+		return time.Time{}, errors.New("stripe subscription has no items")
+	}
+	updated, err := p.client.V1Subscriptions.Update(ctx, subscriptionID, &stripe.SubscriptionUpdateParams{
+		Items: []*stripe.SubscriptionUpdateItemParams{
+			{ID: stripe.String(current.Items.Data[0].ID), Price: stripe.String(priceID)},
+		},
+		ProrationBehavior: stripe.String("create_prorations"),
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if updated.Items == nil || len(updated.Items.Data) == 0 {
+		return time.Time{}, errors.New("stripe subscription has no items")
+	}
+	return time.Unix(updated.Items.Data[0].CurrentPeriodEnd, 0).UTC(), nil
+}
+
+func (p *StripeProvider) GetPayment(ctx context.Context, paymentID string) (Payment, error) {
+	pi, err := p.client.V1PaymentIntents.Retrieve(ctx, paymentID, nil)
+	if err != nil {
+		return Payment{}, err
+	}
+	return Payment{ID: pi.ID, AmountReceived: int(pi.AmountReceived)}, nil
+}
+
+func (p *StripeProvider) Refund(ctx context.Context, in RefundParams) (string, error) {
+	r, err := p.client.V1Refunds.Create(ctx, &stripe.RefundCreateParams{
+		PaymentIntent: stripe.String(in.PaymentID),
+		Amount:        stripe.Int64(int64(in.AmountCents)),
+		Metadata:      in.Metadata,
+	})
+	if err != nil {
+		return "", stripeError(err)
+	}
+	return r.ID, nil
+}
+
+// ChargeOffSession 创建并确认一笔 off_session 的 PaymentIntent
+// 卡被拒或需要用户验证时返回 services.ErrPaymentDeclined，其他错误可重试
+func (p *StripeProvider) ChargeOffSession(ctx context.Context, charge services.OffSessionCharge) (services.OffSessionResult, error) {
+	params := &stripe.PaymentIntentCreateParams{
+		Amount:        stripe.Int64(int64(charge.AmountCents)),
+		Currency:      stripe.String(p.currency),
+		Customer:      stripe.String(charge.CustomerID),
+		PaymentMethod: stripe.String(charge.PaymentMethodID),
+		Confirm:       stripe.Bool(true),
+		OffSession:    stripe.Bool(true),
+		Metadata:      charge.Metadata,
+	}
+	params.SetIdempotencyKey(charge.IdempotencyKey)
+	pi, err := p.client.V1PaymentIntents.Create(ctx, params)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeCard {
+			return services.OffSessionResult{}, fmt.Errorf("%w: %s %s", services.ErrPaymentDeclined, stripeErr.Code, stripeErr.Msg)
+		}
+		return services.OffSessionResult{}, err
+	}
+	return services.OffSessionResult{
+		PaymentIntentID: pi.ID,
+		Succeeded:       pi.Status == stripe.PaymentIntentStatusSucceeded,
+	}, nil
+}
+
+func (p *StripeProvider) ParseWebhook(payload []byte, header http.Header) (Event, error) {
+	if p.webhookSecret == "" {
+		return Event{}, services.ErrStripeNotConfigured
+	}
+	sigHeader := header.Get("Stripe-Signature")
+	if sigHeader == "" {
+		return Event{}, fmt.Errorf("%w: missing Stripe-Signature header", ErrInvalidSignature)
+	}
+	event, err := webhook.ConstructEvent(payload, sigHeader, p.webhookSecret)
+	if err != nil {
+		return Event{}, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	return convertStripeEvent(event)
+}
+
+func (p *StripeProvider) ParseEvent(payload []byte) (Event, error) {
+	var event stripe.Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return Event{}, err
+	}
+	return convertStripeEvent(event)
+}
+
+// stripeError 将 Stripe 返回的错误转换为 *Error，网络等其他错误原样返回
+func stripeError(err error) error {
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) {
+		return &Error{Provider: "stripe", Code: string(stripeErr.Code), Message: stripeErr.Msg}
+	}
+	return err
+}
+
+// convertStripeEvent 将 Stripe 事件转换为统一结构，未处理的事件类型只保留 ID 和类型
+func convertStripeEvent(event stripe.Event) (Event, error) {
+	out := Event{ID: event.ID, Type: string(event.Type)}
+	if event.Data == nil {
+		return out, nil
+	}
+	raw := event.Data.Raw
+	switch out.Type {
+	case EventCheckoutCompleted, EventCheckoutExpired:
+		var sess stripe.CheckoutSession
+		if err := json.Unmarshal(raw, &sess); err != nil {
+			return Event{}, fmt.Errorf("%w: unmarshal checkout session: %v", services.ErrInvalidRequest, err)
+		}
+		c := &CheckoutEvent{
+			SessionID:         sess.ID,
+			Mode:              string(sess.Mode),
+			ClientReferenceID: sess.ClientReferenceID,
+			Metadata:          sess.Metadata,
+		}
+		if sess.Customer != nil {
+			c.CustomerID = sess.Customer.ID
+		}
+		if sess.Subscription != nil {
+			c.SubscriptionID = sess.Subscription.ID
+		}
+		if sess.PaymentIntent != nil {
+			c.PaymentID = sess.PaymentIntent.ID
+		}
+		if sess.SetupIntent != nil {
+			c.SetupIntentID = sess.SetupIntent.ID
+		}
+		out.Checkout = c
+	case EventInvoicePaid, EventInvoicePaymentFailed:
+		var inv stripe.Invoice
+		if err := json.Unmarshal(raw, &inv); err != nil {
+			return Event{}, fmt.Errorf("%w: unmarshal invoice: %v", services.ErrInvalidRequest, err)
+		}
+		i := &InvoiceEvent{ID: inv.ID, Renewal: inv.BillingReason == stripe.InvoiceBillingReasonSubscriptionCycle}
+		// v84 API: Subscription 现在在 Parent.SubscriptionDetails.Subscription 中
+		if inv.Parent != nil && inv.Parent.SubscriptionDetails != nil && inv.Parent.SubscriptionDetails.Subscription != nil {
+			i.SubscriptionID = inv.Parent.SubscriptionDetails.Subscription.ID
+		}
+		out.Invoice = i
+	case EventSubscriptionUpdated, EventSubscriptionDeleted:
+		var sub stripe.Subscription
+		if err := json.Unmarshal(raw, &sub); err != nil {
+			return Event{}, fmt.Errorf("%w: unmarshal subscription: %v", services.ErrInvalidRequest, err)
+		}
+		s := &SubscriptionEvent{
+			ID:                sub.ID,
+			Status:            subscriptionStatusFromStripe(sub.Status),
+			CancelAtPeriodEnd: sub.CancelAtPeriodEnd,
+		}
+		if sub.EndedAt > 0 {
+			endedAt := time.Unix(sub.EndedAt, 0).UTC()
+			s.EndedAt = &endedAt
+		}
+		if sub.Items != nil {
+			for _, item := range sub.Items.Data {
+				if item.Price != nil {
+					s.PriceIDs = append(s.PriceIDs, item.Price.ID)
+				}
+			}
+		}
+		out.Subscription = s
+	case EventChargeRefunded:
+		var charge stripe.Charge
+		if err := json.Unmarshal(raw, &charge); err != nil {
+			return Event{}, fmt.Errorf("%w: unmarshal charge: %v", services.ErrInvalidRequest, err)
+		}
+		r := &RefundEvent{ChargeID: charge.ID, AmountRefunded: int(charge.AmountRefunded), Amount: int(charge.Amount)}
+		if charge.PaymentIntent != nil {
+			r.PaymentID = charge.PaymentIntent.ID
+		}
+		out.Refund = r
+	case EventDisputeCreated:
+		var dispute stripe.Dispute
+		if err := json.Unmarshal(raw, &dispute); err != nil {
+			return Event{}, fmt.Errorf("%w: unmarshal dispute: %v", services.ErrInvalidRequest, err)
+		}
+		d := &DisputeEvent{ID: dispute.ID, Amount: int(dispute.Amount)}
+		if dispute.PaymentIntent != nil {
+			d.PaymentID = dispute.PaymentIntent.ID
+		}
+		if dispute.Charge != nil {
+			d.Charged = int(dispute.Charge.Amount)
+		}
+		out.Dispute = d
+	case EventPaymentSucceeded, EventPaymentFailed:
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(raw, &pi); err != nil {
+			return Event{}, fmt.Errorf("%w: unmarshal payment intent: %v", services.ErrInvalidRequest, err)
+		}
+		pe := &PaymentEvent{ID: pi.ID, Metadata: pi.Metadata}
+		if pi.LastPaymentError != nil {
+			pe.FailureReason = fmt.Sprintf("%s %s", pi.LastPaymentError.Code, pi.LastPaymentError.Msg)
+		}
+		out.Payment = pe
+	}
+	return out, nil
+}
+
+// subscriptionStatusFromStripe 将 Stripe 订阅状态映射为本地状态，返回空字符串表示不需要同步
+// incomplete 订阅仍在等待首次支付，由 checkout.session 事件处理
+func subscriptionStatusFromStripe(status stripe.SubscriptionStatus) string {
+	switch status {
+	case stripe.SubscriptionStatusActive, stripe.SubscriptionStatusTrialing:
+		return models.SubscriptionActive
+	case stripe.SubscriptionStatusPastDue, stripe.SubscriptionStatusUnpaid:
+		return models.SubscriptionPastDue
+	case stripe.SubscriptionStatusCanceled:
+		return models.SubscriptionCanceled
+	case stripe.SubscriptionStatusIncompleteExpired:
+		return models.SubscriptionExpired
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,202 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"easyusersys/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// grantableBucketTypes 管理员可以发放的积分桶类型
+var grantableBucketTypes = map[string]bool{
+	models.BucketFree:         true,
+	models.BucketSubscription: true,
+	models.BucketPrepaid:      true,
+	models.BucketPromo:        true,
+}
+
+// AdminGrantInput 管理员发放积分参数
+type AdminGrantInput struct {
+	UserID     int64
+	AdminID    int64
+	BucketType string
+	Points     float64
+	ExpiresAt  *time.Time // 为空表示永不过期
+	Note       string     // 必填，写入流水备注
+}
+
+// GetBucket 根据 ID 获取积分桶
+func (s *Service) GetBucket(ctx context.Context, bucketID int64) (models.BalanceBucket, error) {
+	var b models.BalanceBucket
+	err := s.pool.QueryRow(ctx, `
+		SELECT id, user_id, bucket_type, total_points, remaining_points, expires_at, created_at, updated_at
+		FROM balance_buckets WHERE id = $1`, bucketID,
+	).Scan(&b.ID, &b.UserID, &b.BucketType, &b.TotalPoints, &b.RemainingPoints, &b.ExpiresAt, &b.CreatedAt, &b.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.BalanceBucket{}, ErrNotFound
+	}
+	return b, err
+}
+
+// AdminGrantPoints 管理员向用户发放积分，新建积分桶并优先偿还欠款
+func (s *Service) AdminGrantPoints(ctx context.Context, in AdminGrantInput) (models.BalanceBucket, error) {
+	if in.UserID == 0 || in.AdminID == 0 || in.Points <= 0 || !grantableBucketTypes[in.BucketType] || strings.TrimSpace(in.Note) == "" {
+		return models.BalanceBucket{}, ErrInvalidRequest
+	}
+	if in.ExpiresAt != nil && !in.ExpiresAt.After(time.Now()) {
+		return models.BalanceBucket{}, ErrInvalidRequest
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return models.BalanceBucket{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	var bucketID int64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO balance_buckets (user_id, system_code, bucket_type, total_points, remaining_points, expires_at)
+		SELECT id, system_code, $2, $3, $3, $4 FROM users WHERE id = $1
+		RETURNING id`, in.UserID, in.BucketType, in.Points, in.ExpiresAt).Scan(&bucketID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.BalanceBucket{}, ErrNotFound
+	}
+	if err != nil {
+		return models.BalanceBucket{}, err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id, note)
+		SELECT id, system_code, $2, $3, $4, $5, $6, $7 FROM users WHERE id = $1`,
+		in.UserID, bucketID, in.Points, "admin_grant", "admin", in.AdminID, in.Note)
+	if err != nil {
+		return models.BalanceBucket{}, err
+	}
+	if err := s.settleDebt(ctx, tx, bucketID); err != nil {
+		return models.BalanceBucket{}, err
+	}
+	bucket, err := scanBucket(tx.QueryRow(ctx, `
+		SELECT id, user_id, bucket_type, total_points, remaining_points, expires_at, created_at, updated_at
+		FROM balance_buckets WHERE id = $1`, bucketID))
+	if err != nil {
+		return models.BalanceBucket{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return models.BalanceBucket{}, err
+	}
+	return bucket, nil
+}
+
+// AdminAdjustBucket 管理员调整指定积分桶的剩余积分，delta 为正表示补发，为负表示扣减
+// 普通积分桶调整后剩余积分不能为负，欠款桶调整后不能为正
+func (s *Service) AdminAdjustBucket(ctx context.Context, bucketID, adminID int64, delta float64, note string) (models.BalanceBucket, error) {
+	if bucketID == 0 || adminID == 0 || delta == 0 || strings.TrimSpace(note) == "" {
+		return models.BalanceBucket{}, ErrInvalidRequest
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return models.BalanceBucket{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	bucket, err := scanBucket(tx.QueryRow(ctx, `
+		SELECT id, user_id, bucket_type, total_points, remaining_points, expires_at, created_at, updated_at
+		FROM balance_buckets WHERE id = $1 FOR UPDATE`, bucketID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.BalanceBucket{}, ErrNotFound
+	}
+	if err != nil {
+		return models.BalanceBucket{}, err
+	}
+	newRemaining := bucket.RemainingPoints + delta
+	if bucket.BucketType == models.BucketDebt {
+		if newRemaining > 0 {
+			return models.BalanceBucket{}, ErrInvalidRequest
+		}
+	} else if newRemaining < 0 {
+		return models.BalanceBucket{}, ErrInsufficientPoints
+	}
+	// 补发积分同时计入总额，使总额反映累计入账积分
+	totalDelta := 0.0
+	if delta > 0 && bucket.BucketType != models.BucketDebt {
+		totalDelta = delta
+	}
+	bucket, err = scanBucket(tx.QueryRow(ctx, `
+		UPDATE balance_buckets
+		SET remaining_points = $1, total_points = total_points + $2, updated_at = NOW()
+		WHERE id = $3
+		RETURNING id, user_id, bucket_type, total_points, remaining_points, expires_at, created_at, updated_at`,
+		newRemaining, totalDelta, bucketID))
+	if err != nil {
+		return models.BalanceBucket{}, err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id, note)
+		SELECT user_id, system_code, id, $2, $3, $4, $5, $6 FROM balance_buckets WHERE id = $1`,
+		bucketID, delta, "admin_adjustment", "admin", adminID, note)
+	if err != nil {
+		return models.BalanceBucket{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return models.BalanceBucket{}, err
+	}
+	return bucket, nil
+}
+
+// AdminCloseBucket 管理员让积分桶立即失效，清空剩余积分并写入流水
+// void 为 true 时记为作废（admin_void），否则记为过期（admin_expire）
+func (s *Service) AdminCloseBucket(ctx context.Context, bucketID, adminID int64, void bool, note string) (models.BalanceBucket, error) {
+	if bucketID == 0 || adminID == 0 || strings.TrimSpace(note) == "" {
+		return models.BalanceBucket{}, ErrInvalidRequest
+	}
+	reason := "admin_expire"
+	if void {
+		reason = "admin_void"
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return models.BalanceBucket{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	bucket, err := scanBucket(tx.QueryRow(ctx, `
+		SELECT id, user_id, bucket_type, total_points, remaining_points, expires_at, created_at, updated_at
+		FROM balance_buckets WHERE id = $1 FOR UPDATE`, bucketID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.BalanceBucket{}, ErrNotFound
+	}
+	if err != nil {
+		return models.BalanceBucket{}, err
+	}
+	if bucket.BucketType == models.BucketDebt {
+		return models.BalanceBucket{}, ErrInvalidRequest
+	}
+	removed := bucket.RemainingPoints
+	bucket, err = scanBucket(tx.QueryRow(ctx, `
+		UPDATE balance_buckets
+		SET remaining_points = 0, expires_at = LEAST(COALESCE(expires_at, NOW()), NOW()), updated_at = NOW()
+		WHERE id = $1
+		RETURNING id, user_id, bucket_type, total_points, remaining_points, expires_at, created_at, updated_at`, bucketID))
+	if err != nil {
+		return models.BalanceBucket{}, err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id, note)
+		SELECT user_id, system_code, id, $2, $3, $4, $5, $6 FROM balance_buckets WHERE id = $1`,
+		bucketID, -removed, reason, "admin", adminID, note)
+	if err != nil {
+		return models.BalanceBucket{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return models.BalanceBucket{}, err
+	}
+	return bucket, nil
+}
+
+func scanBucket(row pgx.Row) (models.BalanceBucket, error) {
+	var b models.BalanceBucket
+	err := row.Scan(&b.ID, &b.UserID, &b.BucketType, &b.TotalPoints, &b.RemainingPoints, &b.ExpiresAt, &b.CreatedAt, &b.UpdatedAt)
+	return b, err
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"easyusersys/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrAPIKeyInvalid       = errors.New("invalid or revoked api key")
+	ErrAPIKeyExpired       = errors.New("api key expired")
+	ErrAPIKeyLimitExceeded = errors.New("api key spending limit exceeded")
+)
+
+const apiKeyColumns = `id, user_id, key_hash, key_prefix, status, created_at, revoked_at,
+	daily_points_limit, monthly_points_limit, max_cost_per_request, expires_at, limit_window`
+
+func scanAPIKey(row pgx.Row, extra ...any) (models.APIKey, error) {
+	var k models.APIKey
+	dest := []any{&k.ID, &k.UserID, &k.KeyHash, &k.KeyPrefix, &k.Status, &k.CreatedAt, &k.RevokedAt,
+		&k.DailyPointsLimit, &k.MonthlyPointsLimit, &k.MaxCostPerRequest, &k.ExpiresAt, &k.LimitWindow}
+	err := row.Scan(append(dest, extra...)...)
+	return k, err
+}
+
+// APIKeyLimits API Key 的限额设置，字段为空表示不限制
+type APIKeyLimits struct {
+	DailyPointsLimit   *float64   `json:"daily_points_limit"`
+	MonthlyPointsLimit *float64   `json:"monthly_points_limit"`
+	MaxCostPerRequest  *float64   `json:"max_cost_per_request"`
+	ExpiresAt          *time.Time `json:"expires_at"`
+	LimitWindow        string     `json:"limit_window"` // calendar（默认）或 rolling
+}
+
+func (l *APIKeyLimits) validate() error {
+	if l.LimitWindow == "" {
+		l.LimitWindow = models.APIKeyWindowCalendar
+	}
+	if l.LimitWindow != models.APIKeyWindowCalendar && l.LimitWindow != models.APIKeyWindowRolling {
+		return fmt.Errorf("%w: limit_window must be calendar or rolling", ErrInvalidRequest)
+	}
+	for _, v := range []*float64{l.DailyPointsLimit, l.MonthlyPointsLimit, l.MaxCostPerRequest} {
+		if v != nil && *v <= 0 {
+			return fmt.Errorf("%w: limits must be positive", ErrInvalidRequest)
+		}
+	}
+	return nil
+}
+
+// SetAPIKeyLimits 更新 API Key 的限额，覆盖原有设置
+func (s *Service) SetAPIKeyLimits(ctx context.Context, keyID int64, limits APIKeyLimits) (models.APIKey, error) {
+	if err := limits.validate(); err != nil {
+		return models.APIKey{}, err
+	}
+	key, err := scanAPIKey(s.pool.QueryRow(ctx, `
+		UPDATE api_keys
+		SET daily_points_limit = $1, monthly_points_limit = $2, max_cost_per_request = $3, expires_at = $4, limit_window = $5
+		WHERE id = $6
+		RETURNING `+apiKeyColumns,
+		limits.DailyPointsLimit, limits.MonthlyPointsLimit, limits.MaxCostPerRequest, limits.ExpiresAt, limits.LimitWindow, keyID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.APIKey{}, ErrNotFound
+	}
+	return key, err
+}
+
+// apiKeyWindowStarts 返回按天和按月限额的统计起点
+func apiKeyWindowStarts(window string, now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	if window == models.APIKeyWindowRolling {
+		return now.Add(-24 * time.Hour), now.AddDate(0, 0, -30)
+	}
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return day, time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// apiKeySpendQuery 统计 API Key 在当前窗口内的消耗，已冲正的积分不计入
+// $1 为 API Key ID，$2 / $3 为按天 / 按月的统计起点，$4 为排除的用量记录 ID
+const apiKeySpendQuery = `
+	SELECT
+		COALESCE(SUM(u.cost_points - COALESCE(r.points, 0)) FILTER (WHERE u.recorded_at >= $2), 0),
+		COALESCE(SUM(u.cost_points - COALESCE(r.points, 0)), 0)
+	FROM usage_records u
+	LEFT JOIN LATERAL (
+		SELECT SUM(points) AS points FROM usage_reversals WHERE usage_record_id = u.id
+	) r ON TRUE
+	WHERE u.api_key_id = $1 AND u.recorded_at >= $3 AND u.id <> $4`
+
+// apiKeyListQuery 列出用户的 API Key 及各自窗口内的消耗，一次查询按 Key 分组统计
+// $1 为用户 ID，$2 为 rolling 窗口名，$3 / $4 为自然日 / 自然月起点，$5 / $6 为最近 24 小时 / 30 天起点
+const apiKeyListQuery = `
+	WITH windows AS (
+		SELECT id,
+			CASE WHEN limit_window = $2 THEN $5::timestamptz ELSE $3::timestamptz END AS day_start,
+			CASE WHEN limit_window = $2 THEN $6::timestamptz ELSE $4::timestamptz END AS month_start
+		FROM api_keys WHERE user_id = $1
+	), spend AS (
+		SELECT u.api_key_id,
+			SUM(u.cost_points - COALESCE(r.points, 0)) FILTER (WHERE u.recorded_at >= w.day_start) AS daily,
+			SUM(u.cost_points - COALESCE(r.points, 0)) AS monthly
+		FROM usage_records u
+		JOIN windows w ON w.id = u.api_key_id
+		LEFT JOIN LATERAL (
+			SELECT SUM(points) AS points FROM usage_reversals WHERE usage_record_id = u.id
+		) r ON TRUE
+		WHERE u.recorded_at >= w.month_start
+		GROUP BY u.api_key_id
+	)
+	SELECT ` + apiKeyColumns + `, COALESCE(spend.daily, 0), COALESCE(spend.monthly, 0)
+	FROM api_keys
+	LEFT JOIN spend ON spend.api_key_id = api_keys.id
+	WHERE api_keys.user_id = $1
+	ORDER BY api_keys.id DESC`
+
+// lockUsageAPIKey 根据上报的原始 Key 锁定 API Key，同一个 Key 的并发扣费串行执行
+// rawKey 为空时返回 nil，表示本次用量不关联 API Key
+func (s *Service) lockUsageAPIKey(ctx context.Context, tx pgx.Tx, userID int64, rawKey string) (*models.APIKey, error) {
+	if rawKey == "" {
+		return nil, nil
+	}
+	sum := sha256.Sum256([]byte(rawKey))
+	key, err := scanAPIKey(tx.QueryRow(ctx, `
+		SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = $1 FOR UPDATE`, hex.EncodeToString(sum[:])))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.UserID != userID || key.Status != models.APIKeyStatusActive {
+		return nil, ErrAPIKeyInvalid
+	}
+	if key.ExpiresAt != nil && !key.ExpiresAt.After(time.Now()) {
+		return nil, ErrAPIKeyExpired
+	}
+	return &key, nil
+}
+
+// checkAPIKeyLimits 在扣费事务内检查本次用量是否超出 API Key 的限额
+// usageID 为本次用量记录，统计已有消耗时排除
+func (s *Service) checkAPIKeyLimits(ctx context.Context, tx pgx.Tx, key models.APIKey, usageID int64, costPoints float64) error {
+	if key.MaxCostPerRequest != nil && costPoints > *key.MaxCostPerRequest {
+		return fmt.Errorf("%w: request costs %g points, max %g per request", ErrAPIKeyLimitExceeded, costPoints, *key.MaxCostPerRequest)
+	}
+	if key.DailyPointsLimit == nil && key.MonthlyPointsLimit == nil {
+		return nil
+	}
+	dayStart, monthStart := apiKeyWindowStarts(key.LimitWindow, time.Now())
+	var daily, monthly float64
+	if err := tx.QueryRow(ctx, apiKeySpendQuery, key.ID, dayStart, monthStart, usageID).Scan(&daily, &monthly); err != nil {
+		return err
+	}
+	if key.DailyPointsLimit != nil && daily+costPoints > *key.DailyPointsLimit {
+		return fmt.Errorf("%w: daily limit %g points", ErrAPIKeyLimitExceeded, *key.DailyPointsLimit)
+	}
+	if key.MonthlyPointsLimit != nil && monthly+costPoints > *key.MonthlyPointsLimit {
+		return fmt.Errorf("%w: monthly limit %g points", ErrAPIKeyLimitExceeded, *key.MonthlyPointsLimit)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"easyusersys/internal/models"
+)
+
+func TestAPIKeyWindowStarts(t *testing.T) {
+	tests := []struct {
+		name      string
+		window    string
+		now       time.Time
+		wantDay   time.Time
+		wantMonth time.Time
+	}{
+		{
+			name:      "calendar",
+			window:    models.APIKeyWindowCalendar,
+			now:       time.Date(2025, 3, 15, 13, 45, 0, 0, time.UTC),
+			wantDay:   time.Date(2025, 3, 15, 0, 0, 0, 0, time.UTC),
+			wantMonth: time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "calendar uses UTC day",
+			window:    models.APIKeyWindowCalendar,
+			now:       time.Date(2025, 4, 1, 6, 30, 0, 0, time.FixedZone("UTC+8", 8*3600)),
+			wantDay:   time.Date(2025, 3, 31, 0, 0, 0, 0, time.UTC),
+			wantMonth: time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "empty window is calendar",
+			window:    "",
+			now:       time.Date(2025, 3, 15, 13, 45, 0, 0, time.UTC),
+			wantDay:   time.Date(2025, 3, 15, 0, 0, 0, 0, time.UTC),
+			wantMonth: time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "rolling",
+			window:    models.APIKeyWindowRolling,
+			now:       time.Date(2025, 3, 15, 13, 45, 0, 0, time.UTC),
+			wantDay:   time.Date(2025, 3, 14, 13, 45, 0, 0, time.UTC),
+			wantMonth: time.Date(2025, 2, 13, 13, 45, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			day, month := apiKeyWindowStarts(tt.window, tt.now)
+			if !day.Equal(tt.wantDay) || !month.Equal(tt.wantMonth) {
+				t.Fatalf("apiKeyWindowStarts() = %v, %v, want %v, %v", day, month, tt.wantDay, tt.wantMonth)
+			}
+		})
+	}
+}
+
+func TestAPIKeyLimitsValidate(t *testing.T) {
+	positive, zero, negative := 10.0, 0.0, -1.0
+	tests := []struct {
+		name       string
+		limits     APIKeyLimits
+		ok         bool
+		wantWindow string
+	}{
+		{name: "no limits defaults to calendar", limits: APIKeyLimits{}, ok: true, wantWindow: models.APIKeyWindowCalendar},
+		{name: "rolling", limits: APIKeyLimits{LimitWindow: models.APIKeyWindowRolling, DailyPointsLimit: &positive}, ok: true, wantWindow: models.APIKeyWindowRolling},
+		{name: "all limits", limits: APIKeyLimits{DailyPointsLimit: &positive, MonthlyPointsLimit: &positive, MaxCostPerRequest: &positive}, ok: true, wantWindow: models.APIKeyWindowCalendar},
+		{name: "unknown window", limits: APIKeyLimits{LimitWindow: "weekly"}},
+		{name: "zero daily limit", limits: APIKeyLimits{DailyPointsLimit: &zero}},
+		{name: "negative monthly limit", limits: APIKeyLimits{MonthlyPointsLimit: &negative}},
+		{name: "zero max cost", limits: APIKeyLimits{MaxCostPerRequest: &zero}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limits.validate()
+			if !tt.ok {
+				if !errors.Is(err, ErrInvalidRequest) {
+					t.Fatalf("expected ErrInvalidRequest, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.limits.LimitWindow != tt.wantWindow {
+				t.Fatalf("LimitWindow = %q, want %q", tt.limits.LimitWindow, tt.wantWindow)
+			}
+		})
+	}
+}
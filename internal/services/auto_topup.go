@@ -0,0 +1,502 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"easyusersys/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrPaymentDeclined 支付方式被拒付（卡被拒、需要用户验证等），重试前需要用户处理
+var ErrPaymentDeclined = errors.New("payment declined")
+
+// ErrPaymentMethodRequired 开启自动充值前需要先保存支付方式
+var ErrPaymentMethodRequired = errors.New("payment method required")
+
+// ErrPaymentIntentMismatch 扣款成功通知中的 PaymentIntent 与自动充值记录的不一致，可能重复扣款，需要人工核对
+var ErrPaymentIntentMismatch = errors.New("payment intent does not match auto top-up")
+
+// minAutoTopUpCents 单次自动充值的最低金额，与 Stripe 的最低扣款金额一致
+const minAutoTopUpCents = 50
+
+// staleAutoTopUpAfter 发起扣款后超过该时间仍未得到结果的自动充值会被重新处理（使用相同的幂等键）
+const staleAutoTopUpAfter = time.Hour
+
+// autoTopUpUnknownAfter 扣款结果一直未知时放弃重试的时间，不超过 Stripe 幂等键的保留时间
+const autoTopUpUnknownAfter = 24 * time.Hour
+
+// OffSessionCharger 支付平台接口：使用保存的支付方式在用户不在场时扣款
+type OffSessionCharger interface {
+	ChargeOffSession(ctx context.Context, charge OffSessionCharge) (OffSessionResult, error)
+}
+
+// OffSessionCharge 离线扣款参数
+type OffSessionCharge struct {
+	CustomerID      string
+	PaymentMethodID string
+	AmountCents     int
+	IdempotencyKey  string
+	Metadata        map[string]string
+}
+
+// OffSessionResult 离线扣款结果，Succeeded 为 false 表示仍在处理中，结果通过 Webhook 通知
+type OffSessionResult struct {
+	PaymentIntentID string
+	Succeeded       bool
+}
+
+// autoTopUpClaim 被当前任务认领的自动充值及其扣款信息
+type autoTopUpClaim struct {
+	topUp           models.AutoTopUp
+	systemCode      string
+	enabled         bool
+	paymentMethodID *string
+	customerID      *string
+}
+
+// GetAutoTopUpSettings 获取用户的自动充值设置，未设置时返回关闭状态
+func (s *Service) GetAutoTopUpSettings(ctx context.Context, userID int64) (models.AutoTopUpSettings, error) {
+	settings, err := scanAutoTopUpSettings(s.pool.QueryRow(ctx, `
+		SELECT user_id, enabled, threshold_points, amount_cents, payment_method_id, consecutive_declines, disabled_reason, updated_at
+		FROM auto_topup_settings WHERE user_id = $1`, userID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.AutoTopUpSettings{UserID: userID}, nil
+	}
+	return settings, err
+}
+
+// SetAutoTopUpSettings 更新自动充值阈值与金额，开启时要求已保存支付方式；重新开启会清零连续拒付次数
+func (s *Service) SetAutoTopUpSettings(ctx context.Context, in models.AutoTopUpSettings) (models.AutoTopUpSettings, error) {
+	if in.UserID == 0 || in.ThresholdPoints < 0 || in.AmountCents < 0 {
+		return models.AutoTopUpSettings{}, ErrInvalidRequest
+	}
+	if in.Enabled && (in.ThresholdPoints <= 0 || in.AmountCents < minAutoTopUpCents) {
+		return models.AutoTopUpSettings{}, ErrInvalidRequest
+	}
+	if in.Enabled {
+		systemCode, err := s.GetUserSystemCodeByID(ctx, in.UserID)
+		if err != nil {
+			return models.AutoTopUpSettings{}, err
+		}
+		if err := validateCustomAmount(s.config.PrepaidCustomAmountFor(systemCode), in.AmountCents); err != nil {
+			return models.AutoTopUpSettings{}, err
+		}
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return models.AutoTopUpSettings{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	settings, err := scanAutoTopUpSettings(tx.QueryRow(ctx, `
+		INSERT INTO auto_topup_settings (user_id, system_code, enabled, threshold_points, amount_cents)
+		SELECT id, system_code, $2, $3, $4 FROM users WHERE id = $1
+		ON CONFLICT (user_id) DO UPDATE SET
+			enabled = EXCLUDED.enabled,
+			threshold_points = EXCLUDED.threshold_points,
+			amount_cents = EXCLUDED.amount_cents,
+			consecutive_declines = CASE WHEN EXCLUDED.enabled THEN 0 ELSE auto_topup_settings.consecutive_declines END,
+			disabled_reason = CASE WHEN EXCLUDED.enabled THEN NULL ELSE auto_topup_settings.disabled_reason END,
+			updated_at = NOW()
+		RETURNING user_id, enabled, threshold_points, amount_cents, payment_method_id, consecutive_declines, disabled_reason, updated_at`,
+		in.UserID, in.Enabled, in.ThresholdPoints, in.AmountCents))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.AutoTopUpSettings{}, ErrNotFound
+	}
+	if err != nil {
+		return models.AutoTopUpSettings{}, err
+	}
+	if settings.Enabled && settings.PaymentMethodID == nil {
+		return models.AutoTopUpSettings{}, ErrPaymentMethodRequired
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return models.AutoTopUpSettings{}, err
+	}
+	return settings, nil
+}
+
+// SaveAutoTopUpPaymentMethod 保存 setup 模式 Checkout 完成后得到的支付方式，不改变开关状态
+func (s *Service) SaveAutoTopUpPaymentMethod(ctx context.Context, userID int64, paymentMethodID string) error {
+	if userID == 0 || paymentMethodID == "" {
+		return ErrInvalidRequest
+	}
+	ct, err := s.db(ctx).Exec(ctx, `
+		INSERT INTO auto_topup_settings (user_id, system_code, payment_method_id)
+		SELECT id, system_code, $2 FROM users WHERE id = $1
+		ON CONFLICT (user_id) DO UPDATE SET
+			payment_method_id = EXCLUDED.payment_method_id,
+			consecutive_declines = 0,
+			disabled_reason = NULL,
+			updated_at = NOW()`, userID, paymentMethodID)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListAutoTopUps 列出用户最近的自动充值记录
+func (s *Service) ListAutoTopUps(ctx context.Context, userID int64, limit int) ([]models.AutoTopUp, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT id, user_id, amount_cents, status, attempts, next_attempt_at, payment_intent_id, order_id, last_error, created_at, updated_at
+		FROM auto_topups WHERE user_id = $1
+		ORDER BY id DESC
+		LIMIT $2`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var topUps []models.AutoTopUp
+	for rows.Next() {
+		t, err := scanAutoTopUp(rows)
+		if err != nil {
+			return nil, err
+		}
+		topUps = append(topUps, t)
+	}
+	return topUps, rows.Err()
+}
+
+// queueAutoTopUp 扣费后余额低于阈值时写入一次自动充值，balance 由 autoTopUpBalance 计算
+// 已有进行中的自动充值，或最近一小时内有充值失败时不重复写入
+func (s *Service) queueAutoTopUp(ctx context.Context, q querier, userID int64, balance float64) error {
+	_, err := q.Exec(ctx, `
+		INSERT INTO auto_topups (system_code, user_id, amount_cents)
+		SELECT system_code, user_id, amount_cents FROM auto_topup_settings
+		WHERE user_id = $1 AND enabled AND payment_method_id IS NOT NULL AND threshold_points > $2
+			AND NOT EXISTS (
+				SELECT 1 FROM auto_topups f
+				WHERE f.user_id = $1 AND f.status = $3 AND f.updated_at > NOW() - INTERVAL '1 hour'
+			)
+		ON CONFLICT (user_id) WHERE status IN ('pending', 'processing') DO NOTHING`,
+		userID, balance, models.AutoTopUpFailed)
+	return err
+}
+
+// autoTopUpBalance 与自动充值阈值比较的余额
+// 有请求因积分不足失败时按扣除未满足积分后的余额（负数）比较，余额仍不低于阈值但不够支付单次请求时同样会充值
+func autoTopUpBalance(balance, shortfall float64) float64 {
+	if shortfall > 0 {
+		return min(balance, 0) - shortfall
+	}
+	return balance
+}
+
+// ProcessAutoTopUps 处理到期的自动充值，返回成功充值的数量
+// 每条记录先标记为 processing 再调用支付平台，扣款使用按尝试次数生成的幂等键，重新处理不会重复扣款
+func (s *Service) ProcessAutoTopUps(ctx context.Context, charger OffSessionCharger, limit int) (int, error) {
+	succeeded := 0
+	var lastID int64
+	for i := 0; i < limit; i++ {
+		claim, ok, err := s.claimAutoTopUp(ctx, lastID)
+		if err != nil || !ok {
+			return succeeded, err
+		}
+		lastID = claim.topUp.ID
+		done, err := s.chargeAutoTopUp(ctx, charger, claim)
+		if err != nil {
+			return succeeded, err
+		}
+		if done {
+			succeeded++
+		}
+	}
+	return succeeded, nil
+}
+
+// claimAutoTopUp 认领下一条到期的自动充值：pending 记录增加尝试次数，超时未决的 processing 记录保持原尝试次数
+func (s *Service) claimAutoTopUp(ctx context.Context, afterID int64) (autoTopUpClaim, bool, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return autoTopUpClaim{}, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var c autoTopUpClaim
+	err = tx.QueryRow(ctx, `
+		SELECT t.id, t.user_id, t.system_code, t.amount_cents, t.status, t.attempts, t.next_attempt_at,
+			COALESCE(ats.enabled, FALSE), ats.payment_method_id, sc.customer_id
+		FROM auto_topups t
+		LEFT JOIN auto_topup_settings ats ON ats.user_id = t.user_id
+		LEFT JOIN stripe_customers sc ON sc.user_id = t.user_id
+		WHERE t.id > $1 AND (
+			(t.status = $2 AND t.next_attempt_at <= NOW())
+			OR (t.status = $3 AND t.updated_at < $4)
+		)
+		ORDER BY t.id
+		LIMIT 1
+		FOR UPDATE OF t SKIP LOCKED`,
+		afterID, models.AutoTopUpPending, models.AutoTopUpProcessing, time.Now().UTC().Add(-staleAutoTopUpAfter),
+	).Scan(&c.topUp.ID, &c.topUp.UserID, &c.systemCode, &c.topUp.AmountCents, &c.topUp.Status, &c.topUp.Attempts, &c.topUp.NextAttemptAt,
+		&c.enabled, &c.paymentMethodID, &c.customerID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return autoTopUpClaim{}, false, nil
+	}
+	if err != nil {
+		return autoTopUpClaim{}, false, err
+	}
+	// 新的一次尝试使用新的幂等键，清除上一次被拒付的 PaymentIntent
+	newAttempt := c.topUp.Status == models.AutoTopUpPending
+	c.topUp.Attempts = claimedAttempts(c.topUp.Status, c.topUp.Attempts)
+	_, err = tx.Exec(ctx, `
+		UPDATE auto_topups
+		SET status = $1, attempts = $2, updated_at = NOW(),
+			payment_intent_id = CASE WHEN $4 THEN NULL ELSE payment_intent_id END
+		WHERE id = $3`, models.AutoTopUpProcessing, c.topUp.Attempts, c.topUp.ID, newAttempt)
+	if err != nil {
+		return autoTopUpClaim{}, false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return autoTopUpClaim{}, false, err
+	}
+	return c, true, nil
+}
+
+// claimedAttempts 认领后的尝试次数：pending 记录开始新的一次尝试，超时未决的 processing 记录沿用原次数（和幂等键）
+func claimedAttempts(status string, attempts int) int {
+	if status == models.AutoTopUpPending {
+		return attempts + 1
+	}
+	return attempts
+}
+
+// chargeable 自动充值仍开启且已保存支付方式和客户时才能扣款
+func (c autoTopUpClaim) chargeable() bool {
+	return c.enabled && c.paymentMethodID != nil && c.customerID != nil
+}
+
+// chargeAutoTopUp 对认领的自动充值发起扣款，扣款成功时返回 true
+func (s *Service) chargeAutoTopUp(ctx context.Context, charger OffSessionCharger, c autoTopUpClaim) (bool, error) {
+	if !c.chargeable() {
+		return false, s.finishAutoTopUp(ctx, c.topUp.ID, models.AutoTopUpFailed, "auto top-up disabled or payment method missing")
+	}
+	// 设置保存后自定义金额配置可能已调整，扣款前按当前配置重新检查
+	if err := validateCustomAmount(s.config.PrepaidCustomAmountFor(c.systemCode), c.topUp.AmountCents); err != nil {
+		return false, s.finishAutoTopUp(ctx, c.topUp.ID, models.AutoTopUpFailed, err.Error())
+	}
+	result, err := charger.ChargeOffSession(ctx, OffSessionCharge{
+		CustomerID:      *c.customerID,
+		PaymentMethodID: *c.paymentMethodID,
+		AmountCents:     c.topUp.AmountCents,
+		IdempotencyKey:  fmt.Sprintf("auto_topup_%d_%d", c.topUp.ID, c.topUp.Attempts),
+		Metadata: map[string]string{
+			"auto_topup_id": strconv.FormatInt(c.topUp.ID, 10),
+			"user_id":       strconv.FormatInt(c.topUp.UserID, 10),
+			"system_code":   c.systemCode,
+		},
+	})
+	if errors.Is(err, ErrPaymentDeclined) {
+		return false, s.recordAutoTopUpFailure(ctx, c.topUp.ID, "", err)
+	}
+	if err != nil {
+		return false, s.recordAutoTopUpUnknown(ctx, c, err)
+	}
+	// 先记录 PaymentIntent，CompleteAutoTopUp 和 Webhook 只接受这一笔
+	_, err = s.pool.Exec(ctx, `
+		UPDATE auto_topups SET payment_intent_id = $1, updated_at = NOW() WHERE id = $2`,
+		result.PaymentIntentID, c.topUp.ID)
+	if err != nil || !result.Succeeded {
+		// 扣款仍在处理中，等待 payment_intent Webhook
+		return false, err
+	}
+	if _, err := s.CompleteAutoTopUp(ctx, c.topUp.ID, result.PaymentIntentID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// recordAutoTopUpUnknown 扣款请求出错但不是明确的拒付（网络超时、支付平台 5xx 等）时，
+// PaymentIntent 可能已经创建，不能换新的幂等键重试：保持 processing，由认领流程在
+// staleAutoTopUpAfter 后用相同的幂等键重试；超过 autoTopUpUnknownAfter 仍无结果时结束本次充值
+func (s *Service) recordAutoTopUpUnknown(ctx context.Context, c autoTopUpClaim, cause error) error {
+	if autoTopUpGiveUp(c.topUp.NextAttemptAt, time.Now()) {
+		return s.finishAutoTopUp(ctx, c.topUp.ID, models.AutoTopUpFailed, fmt.Sprintf("payment outcome unknown: %v", cause))
+	}
+	_, err := s.pool.Exec(ctx, `
+		UPDATE auto_topups SET last_error = $1, updated_at = NOW()
+		WHERE id = $2 AND status = $3`, cause.Error(), c.topUp.ID, models.AutoTopUpProcessing)
+	return err
+}
+
+// autoTopUpGiveUp 本次尝试从 startedAt 开始一直得不到结果时是否放弃
+func autoTopUpGiveUp(startedAt, now time.Time) bool {
+	return now.Sub(startedAt) > autoTopUpUnknownAfter
+}
+
+// autoTopUpIntentMatches 扣款成功的 PaymentIntent 是否属于该自动充值
+// 尚未记录 PaymentIntent（扣款请求结果未知）时接受，之后只接受记录的那一笔
+func autoTopUpIntentMatches(recorded *string, received string) bool {
+	return recorded == nil || *recorded == received
+}
+
+// CompleteAutoTopUp 扣款成功后创建已支付的预充值订单并发放积分，重复调用返回已有的订单
+// PaymentIntent 与记录的不一致时返回 ErrPaymentIntentMismatch，不发放积分
+func (s *Service) CompleteAutoTopUp(ctx context.Context, topUpID int64, paymentIntentID string) (models.Order, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return models.Order{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	var topUp models.AutoTopUp
+	var systemCode string
+	err = tx.QueryRow(ctx, `
+		SELECT id, user_id, system_code, amount_cents, status, payment_intent_id, order_id
+		FROM auto_topups WHERE id = $1 FOR UPDATE`, topUpID,
+	).Scan(&topUp.ID, &topUp.UserID, &systemCode, &topUp.AmountCents, &topUp.Status, &topUp.PaymentIntentID, &topUp.OrderID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.Order{}, ErrNotFound
+	}
+	if err != nil {
+		return models.Order{}, err
+	}
+	if !autoTopUpIntentMatches(topUp.PaymentIntentID, paymentIntentID) {
+		return models.Order{}, fmt.Errorf("%w: auto top-up %d expects %s, got %s", ErrPaymentIntentMismatch, topUp.ID, *topUp.PaymentIntentID, paymentIntentID)
+	}
+	txCtx := withTx(ctx, tx)
+	if topUp.Status == models.AutoTopUpSucceeded && topUp.OrderID != nil {
+		return s.GetOrder(txCtx, *topUp.OrderID)
+	}
+
+	// 金额在扣款前已按自定义金额配置检查过，款项到账后不再拒绝，直接按当前兑换比例发放
+	points := s.config.PrepaidCustomAmountFor(systemCode).Points(topUp.AmountCents)
+	order, err := s.insertPrepaidOrder(txCtx, topUp.UserID, topUp.AmountCents, points, nil, nil)
+	if err != nil {
+		return models.Order{}, err
+	}
+	order, err = s.MarkOrderPaid(txCtx, order.ID, "", paymentIntentID, "")
+	if err != nil {
+		return models.Order{}, err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE auto_topups
+		SET status = $1, payment_intent_id = $2, order_id = $3, last_error = NULL, updated_at = NOW()
+		WHERE id = $4`, models.AutoTopUpSucceeded, paymentIntentID, order.ID, topUp.ID)
+	if err != nil {
+		return models.Order{}, err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE auto_topup_settings SET consecutive_declines = 0, updated_at = NOW()
+		WHERE user_id = $1`, topUp.UserID)
+	if err != nil {
+		return models.Order{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return models.Order{}, err
+	}
+	return order, nil
+}
+
+// FailAutoTopUp 处理支付平台异步通知的扣款失败，按拒付计入连续失败次数
+// 只处理仍在等待该 PaymentIntent 结果的自动充值，同步返回过的失败不会重复计数
+func (s *Service) FailAutoTopUp(ctx context.Context, topUpID int64, paymentIntentID, reason string) error {
+	if paymentIntentID == "" {
+		return ErrInvalidRequest
+	}
+	return s.recordAutoTopUpFailure(ctx, topUpID, paymentIntentID, fmt.Errorf("%w: %s", ErrPaymentDeclined, reason))
+}
+
+// recordAutoTopUpFailure 记录扣款失败：未超过最大尝试次数时按指数退避重试；
+// 拒付计入连续拒付次数，达到上限后关闭自动充值并结束本次充值。
+// paymentIntentID 非空时只处理 processing 状态且 PaymentIntent 一致的记录
+func (s *Service) recordAutoTopUpFailure(ctx context.Context, topUpID int64, paymentIntentID string, cause error) error {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var userID int64
+	var status string
+	var attempts int
+	var currentIntentID *string
+	err = tx.QueryRow(ctx, `
+		SELECT user_id, status, attempts, payment_intent_id FROM auto_topups WHERE id = $1 FOR UPDATE`, topUpID,
+	).Scan(&userID, &status, &attempts, &currentIntentID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if status == models.AutoTopUpSucceeded || status == models.AutoTopUpFailed {
+		return nil
+	}
+	if paymentIntentID != "" && (status != models.AutoTopUpProcessing || currentIntentID == nil || *currentIntentID != paymentIntentID) {
+		return nil
+	}
+
+	declined := errors.Is(cause, ErrPaymentDeclined)
+	var declines int
+	if declined {
+		err = tx.QueryRow(ctx, `
+			UPDATE auto_topup_settings SET consecutive_declines = consecutive_declines + 1, updated_at = NOW()
+			WHERE user_id = $1
+			RETURNING consecutive_declines`, userID).Scan(&declines)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+	}
+	disable, final := autoTopUpFailureOutcome(attempts, declines, declined, s.config.AutoTopUpMaxAttempts, s.config.AutoTopUpMaxDeclines)
+	if disable {
+		_, err = tx.Exec(ctx, `
+			UPDATE auto_topup_settings SET enabled = FALSE, disabled_reason = $1, updated_at = NOW()
+			WHERE user_id = $2`, fmt.Sprintf("disabled after %d consecutive declines: %v", declines, cause), userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if final {
+		_, err = tx.Exec(ctx, `
+			UPDATE auto_topups SET status = $1, last_error = $2, updated_at = NOW()
+			WHERE id = $3`, models.AutoTopUpFailed, cause.Error(), topUpID)
+	} else {
+		_, err = tx.Exec(ctx, `
+			UPDATE auto_topups SET status = $1, last_error = $2, next_attempt_at = $3, updated_at = NOW()
+			WHERE id = $4`, models.AutoTopUpPending, cause.Error(), time.Now().UTC().Add(autoTopUpBackoff(attempts)), topUpID)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// autoTopUpFailureOutcome 扣款失败后的处理：拒付次数达到上限时关闭自动充值（disable），
+// 关闭或尝试次数用完时结束本次充值（final），否则按 autoTopUpBackoff 重试
+func autoTopUpFailureOutcome(attempts, declines int, declined bool, maxAttempts, maxDeclines int) (disable, final bool) {
+	disable = declined && declines >= maxDeclines
+	return disable, disable || attempts >= maxAttempts
+}
+
+// autoTopUpBackoff 第 attempts 次尝试失败后的重试间隔：15 分钟起每次翻倍
+func autoTopUpBackoff(attempts int) time.Duration {
+	return time.Duration(1<<max(attempts-1, 0)) * 15 * time.Minute
+}
+
+// finishAutoTopUp 直接结束一次自动充值
+func (s *Service) finishAutoTopUp(ctx context.Context, topUpID int64, status, reason string) error {
+	_, err := s.pool.Exec(ctx, `
+		UPDATE auto_topups SET status = $1, last_error = $2, updated_at = NOW()
+		WHERE id = $3`, status, reason, topUpID)
+	return err
+}
+
+func scanAutoTopUpSettings(row pgx.Row) (models.AutoTopUpSettings, error) {
+	var a models.AutoTopUpSettings
+	err := row.Scan(&a.UserID, &a.Enabled, &a.ThresholdPoints, &a.AmountCents, &a.PaymentMethodID, &a.ConsecutiveDeclines, &a.DisabledReason, &a.UpdatedAt)
+	return a, err
+}
+
+func scanAutoTopUp(row pgx.Row) (models.AutoTopUp, error) {
+	var t models.AutoTopUp
+	err := row.Scan(&t.ID, &t.UserID, &t.AmountCents, &t.Status, &t.Attempts, &t.NextAttemptAt, &t.PaymentIntentID, &t.OrderID, &t.LastError, &t.CreatedAt, &t.UpdatedAt)
+	return t, err
+}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"easyusersys/internal/models"
+)
+
+func TestAutoTopUpBalanceQueuesOnShortfall(t *testing.T) {
+	const threshold = 100.0
+	tests := []struct {
+		name      string
+		balance   float64
+		shortfall float64
+		want      float64
+		queued    bool
+	}{
+		{name: "above threshold without shortfall", balance: 150, want: 150, queued: false},
+		{name: "below threshold", balance: 40, want: 40, queued: true},
+		{name: "above threshold but request too expensive", balance: 150, shortfall: 50, want: -50, queued: true},
+		{name: "already in debt", balance: -20, shortfall: 10, want: -30, queued: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := autoTopUpBalance(tt.balance, tt.shortfall)
+			if got != tt.want {
+				t.Fatalf("autoTopUpBalance() = %v, want %v", got, tt.want)
+			}
+			// queueAutoTopUp 按 threshold_points > balance 写入
+			if queued := threshold > got; queued != tt.queued {
+				t.Fatalf("queued = %v, want %v", queued, tt.queued)
+			}
+		})
+	}
+}
+
+func TestClaimedAttempts(t *testing.T) {
+	if got := claimedAttempts(models.AutoTopUpPending, 0); got != 1 {
+		t.Fatalf("pending top-up must start a new attempt, got %d", got)
+	}
+	if got := claimedAttempts(models.AutoTopUpPending, 2); got != 3 {
+		t.Fatalf("retried top-up must start attempt 3, got %d", got)
+	}
+	if got := claimedAttempts(models.AutoTopUpProcessing, 2); got != 2 {
+		t.Fatalf("stale processing top-up must reuse its attempt (and idempotency key), got %d", got)
+	}
+}
+
+func TestAutoTopUpClaimChargeable(t *testing.T) {
+	pm, cus := "pm_1", "cus_1"
+	tests := []struct {
+		name  string
+		claim autoTopUpClaim
+		want  bool
+	}{
+		{name: "ready", claim: autoTopUpClaim{enabled: true, paymentMethodID: &pm, customerID: &cus}, want: true},
+		{name: "disabled", claim: autoTopUpClaim{enabled: false, paymentMethodID: &pm, customerID: &cus}},
+		{name: "no payment method", claim: autoTopUpClaim{enabled: true, customerID: &cus}},
+		{name: "no customer", claim: autoTopUpClaim{enabled: true, paymentMethodID: &pm}},
+	}
+	for _, tt := range tests {
+		if got := tt.claim.chargeable(); got != tt.want {
+			t.Fatalf("%s: chargeable() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAutoTopUpFailureOutcome(t *testing.T) {
+	const maxAttempts, maxDeclines = 3, 2
+	tests := []struct {
+		name        string
+		attempts    int
+		declines    int
+		declined    bool
+		wantDisable bool
+		wantFinal   bool
+	}{
+		{name: "network error retries", attempts: 1, wantFinal: false},
+		{name: "first decline retries", attempts: 1, declines: 1, declined: true},
+		{name: "declines reach limit disables", attempts: 2, declines: 2, declined: true, wantDisable: true, wantFinal: true},
+		{name: "attempts exhausted", attempts: 3, wantFinal: true},
+		{name: "non decline ignores decline count", attempts: 1, declines: 5, wantFinal: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			disable, final := autoTopUpFailureOutcome(tt.attempts, tt.declines, tt.declined, maxAttempts, maxDeclines)
+			if disable != tt.wantDisable || final != tt.wantFinal {
+				t.Fatalf("got disable=%v final=%v, want disable=%v final=%v", disable, final, tt.wantDisable, tt.wantFinal)
+			}
+		})
+	}
+}
+
+func TestAutoTopUpBackoff(t *testing.T) {
+	want := []time.Duration{15 * time.Minute, 15 * time.Minute, 30 * time.Minute, time.Hour}
+	for attempts, d := range want {
+		if got := autoTopUpBackoff(attempts); got != d {
+			t.Fatalf("autoTopUpBackoff(%d) = %v, want %v", attempts, got, d)
+		}
+	}
+}
+
+func TestAutoTopUpIntentMatches(t *testing.T) {
+	recorded := "pi_first"
+	if !autoTopUpIntentMatches(nil, "pi_first") {
+		t.Fatal("a charge with unknown outcome must accept the PaymentIntent that succeeded")
+	}
+	if !autoTopUpIntentMatches(&recorded, "pi_first") {
+		t.Fatal("the recorded PaymentIntent must be accepted")
+	}
+	if autoTopUpIntentMatches(&recorded, "pi_second") {
+		t.Fatal("another PaymentIntent must not complete the top-up")
+	}
+}
+
+func TestAutoTopUpGiveUp(t *testing.T) {
+	started := time.Date(2025, 1, 21, 10, 0, 0, 0, time.UTC)
+	if autoTopUpGiveUp(started, started.Add(staleAutoTopUpAfter)) {
+		t.Fatal("unknown outcome must be retried with the same key after the stale period")
+	}
+	if autoTopUpGiveUp(started, started.Add(autoTopUpUnknownAfter)) {
+		t.Fatal("must keep retrying until the idempotency key window ends")
+	}
+	if !autoTopUpGiveUp(started, started.Add(autoTopUpUnknownAfter+time.Minute)) {
+		t.Fatal("must give up once the idempotency key may have expired")
+	}
+}
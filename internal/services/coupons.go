@@ -0,0 +1,301 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"easyusersys/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CouponTargetPrepaid 预充值 Checkout 在优惠码适用范围中的名称
+const CouponTargetPrepaid = "prepaid"
+
+// CouponWithUsage 包含兑换次数的优惠码
+type CouponWithUsage struct {
+	models.Coupon
+	RedemptionCount int64 `json:"redemption_count"`
+}
+
+const couponColumns = `id, system_code, code, points, points_expiry_days, stripe_coupon_id, max_redemptions,
+	per_user_limit, valid_from, valid_until, applies_to, active, created_at, updated_at`
+
+func scanCoupon(row pgx.Row) (models.Coupon, error) {
+	var c models.Coupon
+	err := row.Scan(&c.ID, &c.SystemCode, &c.Code, &c.Points, &c.PointsExpiryDays, &c.StripeCouponID, &c.MaxRedemptions,
+		&c.PerUserLimit, &c.ValidFrom, &c.ValidUntil, &c.AppliesTo, &c.Active, &c.CreatedAt, &c.UpdatedAt)
+	return c, err
+}
+
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// CreateCoupon 创建优惠码，优惠码在同一 system_code 内唯一（不区分大小写）
+func (s *Service) CreateCoupon(ctx context.Context, c models.Coupon) (models.Coupon, error) {
+	c.Code = normalizeCouponCode(c.Code)
+	if c.SystemCode == "" || c.Code == "" || c.Points < 0 || c.PointsExpiryDays < 0 {
+		return models.Coupon{}, ErrInvalidRequest
+	}
+	if c.Points == 0 && (c.StripeCouponID == nil || *c.StripeCouponID == "") {
+		return models.Coupon{}, ErrInvalidRequest
+	}
+	if c.MaxRedemptions != nil && *c.MaxRedemptions <= 0 {
+		return models.Coupon{}, ErrInvalidRequest
+	}
+	if c.PerUserLimit <= 0 {
+		c.PerUserLimit = 1
+	}
+	if c.ValidFrom != nil && c.ValidUntil != nil && !c.ValidUntil.After(*c.ValidFrom) {
+		return models.Coupon{}, ErrInvalidRequest
+	}
+	if c.AppliesTo == nil {
+		c.AppliesTo = []string{}
+	}
+	created, err := scanCoupon(s.pool.QueryRow(ctx, `
+		INSERT INTO coupons (system_code, code, points, points_expiry_days, stripe_coupon_id, max_redemptions,
+			per_user_limit, valid_from, valid_until, applies_to, active)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, true)
+		RETURNING `+couponColumns,
+		c.SystemCode, c.Code, c.Points, c.PointsExpiryDays, c.StripeCouponID, c.MaxRedemptions,
+		c.PerUserLimit, c.ValidFrom, c.ValidUntil, c.AppliesTo))
+	if err != nil {
+		if isUniqueViolation(err) {
+			return models.Coupon{}, ErrDuplicateRequest
+		}
+		return models.Coupon{}, err
+	}
+	return created, nil
+}
+
+// ListCoupons 列出系统内的优惠码及兑换次数
+func (s *Service) ListCoupons(ctx context.Context, systemCode string) ([]CouponWithUsage, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT c.id, c.system_code, c.code, c.points, c.points_expiry_days, c.stripe_coupon_id, c.max_redemptions,
+			c.per_user_limit, c.valid_from, c.valid_until, c.applies_to, c.active, c.created_at, c.updated_at,
+			(SELECT COUNT(*) FROM coupon_redemptions cr WHERE cr.coupon_id = c.id AND cr.status = $2)
+		FROM coupons c
+		WHERE c.system_code = $1
+		ORDER BY c.id DESC`, systemCode, models.CouponRedemptionRedeemed)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var coupons []CouponWithUsage
+	for rows.Next() {
+		var c CouponWithUsage
+		if err := rows.Scan(&c.ID, &c.SystemCode, &c.Code, &c.Points, &c.PointsExpiryDays, &c.StripeCouponID, &c.MaxRedemptions,
+			&c.PerUserLimit, &c.ValidFrom, &c.ValidUntil, &c.AppliesTo, &c.Active, &c.CreatedAt, &c.UpdatedAt, &c.RedemptionCount); err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, c)
+	}
+	return coupons, rows.Err()
+}
+
+// GetCoupon 根据 ID 获取优惠码
+func (s *Service) GetCoupon(ctx context.Context, couponID int64) (models.Coupon, error) {
+	c, err := scanCoupon(s.pool.QueryRow(ctx, `SELECT `+couponColumns+` FROM coupons WHERE id = $1`, couponID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.Coupon{}, ErrNotFound
+	}
+	return c, err
+}
+
+// SetCouponActive 启用或停用优惠码
+func (s *Service) SetCouponActive(ctx context.Context, couponID int64, active bool) error {
+	ct, err := s.pool.Exec(ctx, `
+		UPDATE coupons SET active = $1, updated_at = NOW()
+		WHERE id = $2`, active, couponID)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// checkCouponUsable 检查优惠码状态、有效期和兑换次数，预留中的兑换同样计入次数
+func checkCouponUsable(ctx context.Context, tx pgx.Tx, c models.Coupon, userID int64) error {
+	now := time.Now().UTC()
+	if !c.Active || (c.ValidFrom != nil && now.Before(*c.ValidFrom)) || (c.ValidUntil != nil && !now.Before(*c.ValidUntil)) {
+		return ErrCouponInvalid
+	}
+	var total, byUser int
+	err := tx.QueryRow(ctx, `
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE user_id = $2)
+		FROM coupon_redemptions WHERE coupon_id = $1`, c.ID, userID).Scan(&total, &byUser)
+	if err != nil {
+		return err
+	}
+	if c.MaxRedemptions != nil && total >= *c.MaxRedemptions {
+		return ErrCouponExhausted
+	}
+	if byUser >= c.PerUserLimit {
+		return ErrCouponExhausted
+	}
+	return nil
+}
+
+// RedeemCoupon 兑换积分优惠码，新建 promo 积分桶并写入流水
+func (s *Service) RedeemCoupon(ctx context.Context, userID int64, code string) (models.CouponRedemption, models.BalanceBucket, error) {
+	code = normalizeCouponCode(code)
+	if userID == 0 || code == "" {
+		return models.CouponRedemption{}, models.BalanceBucket{}, ErrInvalidRequest
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return models.CouponRedemption{}, models.BalanceBucket{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	coupon, err := scanCoupon(tx.QueryRow(ctx, `
+		SELECT `+couponColumns+` FROM coupons
+		WHERE system_code = (SELECT system_code FROM users WHERE id = $1) AND code = $2
+		FOR UPDATE`, userID, code))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.CouponRedemption{}, models.BalanceBucket{}, ErrCouponInvalid
+	}
+	if err != nil {
+		return models.CouponRedemption{}, models.BalanceBucket{}, err
+	}
+	if coupon.Points <= 0 {
+		return models.CouponRedemption{}, models.BalanceBucket{}, ErrCouponInvalid
+	}
+	if err := checkCouponUsable(ctx, tx, coupon, userID); err != nil {
+		return models.CouponRedemption{}, models.BalanceBucket{}, err
+	}
+
+	var expiresAt *time.Time
+	if coupon.PointsExpiryDays > 0 {
+		t := time.Now().UTC().Add(time.Duration(coupon.PointsExpiryDays) * 24 * time.Hour)
+		expiresAt = &t
+	}
+	var bucketID int64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO balance_buckets (user_id, system_code, bucket_type, total_points, remaining_points, expires_at)
+		SELECT id, system_code, $2, $3, $3, $4 FROM users WHERE id = $1
+		RETURNING id`, userID, models.BucketPromo, coupon.Points, expiresAt).Scan(&bucketID)
+	if err != nil {
+		return models.CouponRedemption{}, models.BalanceBucket{}, err
+	}
+	var redemption models.CouponRedemption
+	err = tx.QueryRow(ctx, `
+		INSERT INTO coupon_redemptions (coupon_id, user_id, system_code, bucket_id)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, coupon_id, user_id, bucket_id, order_id, status, created_at`,
+		coupon.ID, userID, coupon.SystemCode, bucketID,
+	).Scan(&redemption.ID, &redemption.CouponID, &redemption.UserID, &redemption.BucketID, &redemption.OrderID, &redemption.Status, &redemption.CreatedAt)
+	if err != nil {
+		return models.CouponRedemption{}, models.BalanceBucket{}, err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id, note)
+		SELECT id, system_code, $2, $3, $4, $5, $6, $7 FROM users WHERE id = $1`,
+		userID, bucketID, coupon.Points, "promo_grant", "coupon_redemption", redemption.ID, coupon.Code)
+	if err != nil {
+		return models.CouponRedemption{}, models.BalanceBucket{}, err
+	}
+	if err := s.settleDebt(ctx, tx, bucketID); err != nil {
+		return models.CouponRedemption{}, models.BalanceBucket{}, err
+	}
+	bucket, err := scanBucket(tx.QueryRow(ctx, `
+		SELECT id, user_id, bucket_type, total_points, remaining_points, expires_at, created_at, updated_at
+		FROM balance_buckets WHERE id = $1`, bucketID))
+	if err != nil {
+		return models.CouponRedemption{}, models.BalanceBucket{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return models.CouponRedemption{}, models.BalanceBucket{}, err
+	}
+	return redemption, bucket, nil
+}
+
+// ReserveCheckoutCoupon 校验优惠码能否用于指定 Checkout（计划名称或 prepaid），并为待支付订单预留一次兑换
+// 预留与校验在同一事务内完成并锁定优惠码，并发 Checkout 不会超过兑换次数；订单支付成功后预留转为已兑换，
+// 订单失败（会话过期、支付失败）时释放预留。返回带 Stripe 折扣的优惠码
+func (s *Service) ReserveCheckoutCoupon(ctx context.Context, userID, orderID int64, code, target string) (models.Coupon, error) {
+	code = normalizeCouponCode(code)
+	if userID == 0 || orderID == 0 || code == "" {
+		return models.Coupon{}, ErrInvalidRequest
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return models.Coupon{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	coupon, err := scanCoupon(tx.QueryRow(ctx, `
+		SELECT `+couponColumns+` FROM coupons
+		WHERE system_code = (SELECT system_code FROM users WHERE id = $1) AND code = $2
+		FOR UPDATE`, userID, code))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.Coupon{}, ErrCouponInvalid
+	}
+	if err != nil {
+		return models.Coupon{}, err
+	}
+	if coupon.StripeCouponID == nil || *coupon.StripeCouponID == "" {
+		return models.Coupon{}, ErrCouponInvalid
+	}
+	if len(coupon.AppliesTo) > 0 {
+		applies := false
+		for _, t := range coupon.AppliesTo {
+			if t == target {
+				applies = true
+				break
+			}
+		}
+		if !applies {
+			return models.Coupon{}, ErrCouponInvalid
+		}
+	}
+	if err := checkCouponUsable(ctx, tx, coupon, userID); err != nil {
+		return models.Coupon{}, err
+	}
+	ct, err := tx.Exec(ctx, `
+		UPDATE orders SET coupon_id = $1, updated_at = NOW()
+		WHERE id = $2 AND user_id = $3 AND status = $4`, coupon.ID, orderID, userID, models.OrderStatusPending)
+	if err != nil {
+		return models.Coupon{}, err
+	}
+	if ct.RowsAffected() == 0 {
+		return models.Coupon{}, ErrNotFound
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO coupon_redemptions (coupon_id, user_id, system_code, order_id, status)
+		VALUES ($1, $2, $3, $4, $5)`, coupon.ID, userID, coupon.SystemCode, orderID, models.CouponRedemptionPending)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return models.Coupon{}, ErrDuplicateRequest
+		}
+		return models.Coupon{}, err
+	}
+	return coupon, tx.Commit(ctx)
+}
+
+// recordOrderCouponRedemption 订单支付成功后将预留的兑换转为已兑换，没有预留时补写兑换记录，重复调用不会重复记录
+func (s *Service) recordOrderCouponRedemption(ctx context.Context, tx pgx.Tx, orderID int64) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO coupon_redemptions (coupon_id, user_id, system_code, order_id, status)
+		SELECT coupon_id, user_id, system_code, id, $2 FROM orders
+		WHERE id = $1 AND coupon_id IS NOT NULL
+		ON CONFLICT (order_id) WHERE order_id IS NOT NULL DO UPDATE SET status = EXCLUDED.status`,
+		orderID, models.CouponRedemptionRedeemed)
+	return err
+}
+
+// releaseOrderCoupons 释放失败订单预留的优惠码兑换，已兑换的记录不受影响
+func releaseOrderCoupons(ctx context.Context, tx pgx.Tx, orderIDs []int64) error {
+	if len(orderIDs) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(ctx, `
+		DELETE FROM coupon_redemptions
+		WHERE order_id = ANY($1) AND status = $2`, orderIDs, models.CouponRedemptionPending)
+	return err
+}
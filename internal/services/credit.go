@@ -0,0 +1,233 @@
+package services
+
+import (
+	"context"
+	"errors"
+
+	"easyusersys/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CreditStatus 用户的信用额度与欠款情况
+type CreditStatus struct {
+	LimitPoints float64 `json:"limit_points"`
+	Source      string  `json:"source"` // user | system | none
+	DebtPoints  float64 `json:"debt_points"`
+}
+
+// creditLimitFor 获取用户的信用额度，用户级额度优先于系统级额度
+func (s *Service) creditLimitFor(ctx context.Context, tx pgx.Tx, userID int64) (float64, string, error) {
+	var limit float64
+	var userScoped bool
+	err := tx.QueryRow(ctx, `
+		SELECT cl.limit_points, cl.user_id IS NOT NULL
+		FROM credit_limits cl
+		JOIN users u ON u.system_code = cl.system_code
+		WHERE u.id = $1 AND (cl.user_id = u.id OR cl.user_id IS NULL)
+		ORDER BY cl.user_id NULLS LAST
+		LIMIT 1`, userID).Scan(&limit, &userScoped)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, "none", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if userScoped {
+		return limit, "user", nil
+	}
+	return limit, "system", nil
+}
+
+// lockDebtBucket 锁定用户的欠款桶，不存在时创建
+func (s *Service) lockDebtBucket(ctx context.Context, tx pgx.Tx, userID int64) (models.BalanceBucket, error) {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO balance_buckets (user_id, system_code, bucket_type, total_points, remaining_points)
+		SELECT id, system_code, $2, 0, 0 FROM users WHERE id = $1
+		ON CONFLICT (user_id) WHERE bucket_type = 'debt' DO NOTHING`, userID, models.BucketDebt)
+	if err != nil {
+		return models.BalanceBucket{}, err
+	}
+	var b models.BalanceBucket
+	err = tx.QueryRow(ctx, `
+		SELECT id, user_id, bucket_type, total_points, remaining_points, expires_at, created_at, updated_at
+		FROM balance_buckets
+		WHERE user_id = $1 AND bucket_type = $2
+		FOR UPDATE`, userID, models.BucketDebt,
+	).Scan(&b.ID, &b.UserID, &b.BucketType, &b.TotalPoints, &b.RemainingPoints, &b.ExpiresAt, &b.CreatedAt, &b.UpdatedAt)
+	return b, err
+}
+
+// debtHeadroom 返回用户在信用额度内还可透支的积分
+func (s *Service) debtHeadroom(ctx context.Context, tx pgx.Tx, userID int64) (float64, error) {
+	limit, _, err := s.creditLimitFor(ctx, tx, userID)
+	if err != nil {
+		return 0, err
+	}
+	if limit <= 0 {
+		return 0, nil
+	}
+	var debt float64
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE(-SUM(remaining_points), 0)
+		FROM balance_buckets
+		WHERE user_id = $1 AND bucket_type = $2`, userID, models.BucketDebt).Scan(&debt)
+	if err != nil {
+		return 0, err
+	}
+	if debt >= limit {
+		return 0, nil
+	}
+	return limit - debt, nil
+}
+
+// chargeDebt 将积分桶不足以覆盖的部分记为欠款，超出信用额度时返回 ErrInsufficientPoints
+func (s *Service) chargeDebt(ctx context.Context, tx pgx.Tx, userID, usageID int64, points float64) error {
+	if points <= 0 {
+		return nil
+	}
+	limit, _, err := s.creditLimitFor(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	if limit <= 0 {
+		return ErrInsufficientPoints
+	}
+	debt, err := s.lockDebtBucket(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	if -debt.RemainingPoints+points > limit {
+		return ErrInsufficientPoints
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE balance_buckets
+		SET remaining_points = remaining_points - $1, updated_at = NOW()
+		WHERE id = $2`, points, debt.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id)
+		SELECT id, system_code, $1, $2, $3, $4, $5 FROM users WHERE id = $6`,
+		debt.ID, -points, "credit_debt", "usage", usageID, userID)
+	return err
+}
+
+// settleDebt 用新发放的积分桶优先偿还欠款，应在写入发放流水后于同一事务中调用
+func (s *Service) settleDebt(ctx context.Context, tx pgx.Tx, grantBucketID int64) error {
+	var userID int64
+	var available float64
+	err := tx.QueryRow(ctx, `
+		SELECT user_id, remaining_points FROM balance_buckets
+		WHERE id = $1 FOR UPDATE`, grantBucketID).Scan(&userID, &available)
+	if err != nil {
+		return err
+	}
+	if available <= 0 {
+		return nil
+	}
+	var debtID int64
+	var debtRemaining float64
+	err = tx.QueryRow(ctx, `
+		SELECT id, remaining_points FROM balance_buckets
+		WHERE user_id = $1 AND bucket_type = $2
+		FOR UPDATE`, userID, models.BucketDebt).Scan(&debtID, &debtRemaining)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if debtRemaining >= 0 {
+		return nil
+	}
+	settle := minFloat(available, -debtRemaining)
+
+	_, err = tx.Exec(ctx, `
+		UPDATE balance_buckets SET remaining_points = remaining_points - $1, updated_at = NOW()
+		WHERE id = $2`, settle, grantBucketID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE balance_buckets SET remaining_points = remaining_points + $1, updated_at = NOW()
+		WHERE id = $2`, settle, debtID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id)
+		SELECT id, system_code, $1, $2, $3, $4, $5 FROM users WHERE id = $6`,
+		grantBucketID, -settle, "debt_settlement", "bucket", debtID, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id)
+		SELECT id, system_code, $1, $2, $3, $4, $5 FROM users WHERE id = $6`,
+		debtID, settle, "debt_settlement", "bucket", grantBucketID, userID)
+	return err
+}
+
+// GetCreditStatus 查询用户的信用额度与当前欠款
+func (s *Service) GetCreditStatus(ctx context.Context, userID int64) (CreditStatus, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return CreditStatus{}, err
+	}
+	defer tx.Rollback(ctx)
+	limit, source, err := s.creditLimitFor(ctx, tx, userID)
+	if err != nil {
+		return CreditStatus{}, err
+	}
+	status := CreditStatus{LimitPoints: limit, Source: source}
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE(-SUM(remaining_points), 0)
+		FROM balance_buckets
+		WHERE user_id = $1 AND bucket_type = $2`, userID, models.BucketDebt).Scan(&status.DebtPoints)
+	if err != nil {
+		return CreditStatus{}, err
+	}
+	return status, tx.Commit(ctx)
+}
+
+// SetUserCreditLimit 设置用户级信用额度，limitPoints 为 0 时删除该额度
+func (s *Service) SetUserCreditLimit(ctx context.Context, userID int64, limitPoints float64) error {
+	if userID == 0 || limitPoints < 0 {
+		return ErrInvalidRequest
+	}
+	if limitPoints == 0 {
+		_, err := s.pool.Exec(ctx, `DELETE FROM credit_limits WHERE user_id = $1`, userID)
+		return err
+	}
+	ct, err := s.pool.Exec(ctx, `
+		INSERT INTO credit_limits (system_code, user_id, limit_points)
+		SELECT system_code, id, $2 FROM users WHERE id = $1
+		ON CONFLICT (user_id) WHERE user_id IS NOT NULL
+		DO UPDATE SET limit_points = EXCLUDED.limit_points, updated_at = NOW()`, userID, limitPoints)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetSystemCreditLimit 设置系统级默认信用额度，limitPoints 为 0 时删除该额度
+func (s *Service) SetSystemCreditLimit(ctx context.Context, systemCode string, limitPoints float64) error {
+	if systemCode == "" || limitPoints < 0 {
+		return ErrInvalidRequest
+	}
+	if limitPoints == 0 {
+		_, err := s.pool.Exec(ctx, `DELETE FROM credit_limits WHERE system_code = $1 AND user_id IS NULL`, systemCode)
+		return err
+	}
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO credit_limits (system_code, limit_points)
+		VALUES ($1, $2)
+		ON CONFLICT (system_code) WHERE user_id IS NULL
+		DO UPDATE SET limit_points = EXCLUDED.limit_points, updated_at = NOW()`, systemCode, limitPoints)
+	return err
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"easyusersys/internal/models"
+)
+
+// expiryBatchSize 每个事务处理的积分桶数量，避免长事务锁住大量行
+const expiryBatchSize = 500
+
+// ExpireSubscriptions 将超过 ends_at 的订阅改为终止状态，返回处理的订阅数
+// 已申请到期取消的改为 canceled，其余（含 past_due）改为 expired；
+// grace 为宽限时间，给 Stripe 续费 Webhook 留出到达的时间，续费成功后会重新激活
+func (s *Service) ExpireSubscriptions(ctx context.Context, grace time.Duration) (int64, error) {
+	ct, err := s.pool.Exec(ctx, `
+		UPDATE subscriptions
+		SET status = CASE WHEN cancel_at_period_end THEN $1 ELSE $2 END, updated_at = NOW()
+		WHERE status IN ($3, $4) AND ends_at < $5`,
+		models.SubscriptionCanceled, models.SubscriptionExpired,
+		models.SubscriptionActive, models.SubscriptionPastDue, time.Now().UTC().Add(-grace))
+	if err != nil {
+		return 0, err
+	}
+	return ct.RowsAffected(), nil
+}
+
+// ExpireBuckets 清空已过期积分桶的剩余积分并写入 expiry 流水，返回处理的积分桶数
+// 欠款桶不会过期；subscription 积分桶在过期后再保留 subscriptionGrace，供续费时结转剩余积分；
+// 使用 SKIP LOCKED 跳过正在被扣费的积分桶，留到下一轮处理
+func (s *Service) ExpireBuckets(ctx context.Context, subscriptionGrace time.Duration) (int64, error) {
+	var total int64
+	for {
+		n, err := s.expireBucketBatch(ctx, time.Now().UTC().Add(-subscriptionGrace))
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < expiryBatchSize {
+			return total, nil
+		}
+	}
+}
+
+func (s *Service) expireBucketBatch(ctx context.Context, subscriptionCutoff time.Time) (int64, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	ct, err := tx.Exec(ctx, `
+		WITH expired AS (
+			SELECT id, user_id, system_code, remaining_points FROM balance_buckets
+			WHERE expires_at <= NOW() AND remaining_points > 0 AND bucket_type <> $1
+				AND (bucket_type <> $3 OR expires_at <= $4)
+			ORDER BY id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		), cleared AS (
+			UPDATE balance_buckets b SET remaining_points = 0, updated_at = NOW()
+			FROM expired e WHERE b.id = e.id
+		)
+		INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id)
+		SELECT user_id, system_code, id, -remaining_points, 'expiry', 'bucket', id FROM expired`,
+		models.BucketDebt, expiryBatchSize, models.BucketSubscription, subscriptionCutoff)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return ct.RowsAffected(), nil
+}
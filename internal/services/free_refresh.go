@@ -0,0 +1,177 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"easyusersys/internal/config"
+	"easyusersys/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// freeRefreshBatchSize 每次查询的候选用户数
+const freeRefreshBatchSize = 200
+
+type freeRefreshCandidate struct {
+	userID    int64
+	createdAt time.Time
+}
+
+// RefreshFreePoints 为配置了免费积分刷新的系统中符合条件的活跃用户发放本周期的 free 积分桶，返回发放人数
+// 每个用户每个周期只发放一次，重复执行不会重复发放
+func (s *Service) RefreshFreePoints(ctx context.Context, now time.Time) (int64, error) {
+	rows, err := s.pool.Query(ctx, `SELECT DISTINCT system_code FROM users`)
+	if err != nil {
+		return 0, err
+	}
+	var systemCodes []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		systemCodes = append(systemCodes, code)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, code := range systemCodes {
+		cfg, ok := s.config.FreeRefreshFor(code)
+		if !ok {
+			continue
+		}
+		n, err := s.refreshFreePointsForSystem(ctx, code, cfg, now)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (s *Service) refreshFreePointsForSystem(ctx context.Context, systemCode string, cfg config.FreeRefreshConfig, now time.Time) (int64, error) {
+	var granted, lastID int64
+	for {
+		candidates, err := s.freeRefreshCandidates(ctx, systemCode, cfg, now, lastID)
+		if err != nil {
+			return granted, err
+		}
+		for _, c := range candidates {
+			lastID = c.userID
+			start, end, ok := cfg.PeriodAt(c.createdAt, now)
+			if !ok {
+				continue
+			}
+			expiresAt := cfg.ExpiresAt(start, end)
+			if !expiresAt.After(now) {
+				continue
+			}
+			ok, err := s.grantFreeRefresh(ctx, c.userID, systemCode, cfg.Points, start, expiresAt)
+			if err != nil {
+				return granted, err
+			}
+			if ok {
+				granted++
+			}
+		}
+		if len(candidates) < freeRefreshBatchSize {
+			return granted, nil
+		}
+	}
+}
+
+// freeRefreshCandidates 粗略筛选本周期可能需要发放的用户：注册已满一个周期且最近一个周期内没有发放记录
+// 精确的周期由 FreeRefreshConfig.PeriodAt 计算
+func (s *Service) freeRefreshCandidates(ctx context.Context, systemCode string, cfg config.FreeRefreshConfig, now time.Time, afterID int64) ([]freeRefreshCandidate, error) {
+	var createdBefore, refreshedAfter time.Time
+	if cfg.Period == config.FreeRefreshDays {
+		length := time.Duration(cfg.PeriodDays) * 24 * time.Hour
+		createdBefore = now.Add(-length)
+		refreshedAfter = now.Add(-length)
+	} else {
+		createdBefore = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		refreshedAfter = createdBefore.AddDate(0, -1, 0)
+	}
+	rows, err := s.pool.Query(ctx, `
+		SELECT u.id, u.created_at FROM users u
+		WHERE u.system_code = $1 AND u.status = $2 AND u.id > $3 AND u.created_at < $4
+			AND NOT EXISTS (
+				SELECT 1 FROM free_refreshes f
+				WHERE f.user_id = u.id AND f.period_start > $5
+			)
+			AND (NOT $6::boolean OR NOT EXISTS (
+				SELECT 1 FROM subscriptions sub
+				WHERE sub.user_id = u.id AND sub.status = $7 AND sub.ends_at > NOW()
+			))
+		ORDER BY u.id
+		LIMIT $8`,
+		systemCode, models.UserStatusActive, afterID, createdBefore, refreshedAfter,
+		cfg.OnlyUnpaid, models.SubscriptionActive, freeRefreshBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var candidates []freeRefreshCandidate
+	for rows.Next() {
+		var c freeRefreshCandidate
+		if err := rows.Scan(&c.userID, &c.createdAt); err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, rows.Err()
+}
+
+// grantFreeRefresh 发放一个周期的免费积分，该周期已发放过时返回 false
+func (s *Service) grantFreeRefresh(ctx context.Context, userID int64, systemCode string, points float64, periodStart, expiresAt time.Time) (bool, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var refreshID int64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO free_refreshes (system_code, user_id, period_start, points)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, period_start) DO NOTHING
+		RETURNING id`, systemCode, userID, periodStart, points).Scan(&refreshID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var bucketID int64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO balance_buckets (user_id, system_code, bucket_type, total_points, remaining_points, expires_at)
+		VALUES ($1, $2, $3, $4, $4, $5)
+		RETURNING id`, userID, systemCode, models.BucketFree, points, expiresAt).Scan(&bucketID)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(ctx, `UPDATE free_refreshes SET bucket_id = $1 WHERE id = $2`, bucketID, refreshID)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		userID, systemCode, bucketID, points, "free_refresh", "free_refresh", refreshID)
+	if err != nil {
+		return false, err
+	}
+	if err := s.settleDebt(ctx, tx, bucketID); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
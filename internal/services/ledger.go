@@ -0,0 +1,150 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultLedgerPageSize = 50
+	maxLedgerPageSize     = 200
+)
+
+// LedgerQuery 积分流水查询条件，按流水 ID 倒序游标分页
+type LedgerQuery struct {
+	UserID      int64  // 0 表示不限用户（仅管理员接口）
+	SystemCode  string // 非空时只返回该系统的流水
+	Reasons     []string
+	BucketTypes []string
+	From        *time.Time
+	To          *time.Time
+	Cursor      int64 // 上一页返回的 next_cursor，0 表示从最新一条开始
+	Limit       int
+}
+
+// LedgerOrder 流水关联的订单摘要
+type LedgerOrder struct {
+	ID          int64  `json:"id"`
+	OrderType   string `json:"order_type"`
+	Status      string `json:"status"`
+	AmountCents int    `json:"amount_cents"`
+}
+
+// LedgerSubscription 流水关联的订阅摘要
+type LedgerSubscription struct {
+	ID     int64  `json:"id"`
+	Plan   string `json:"plan"`
+	Status string `json:"status"`
+}
+
+// LedgerEntry 积分流水，附带引用的订单、订阅或用量请求 ID
+type LedgerEntry struct {
+	ID            int64               `json:"id"`
+	UserID        int64               `json:"user_id"`
+	SystemCode    string              `json:"system_code"`
+	BucketID      *int64              `json:"bucket_id"`
+	BucketType    *string             `json:"bucket_type"`
+	DeltaPoints   float64             `json:"delta_points"`
+	Reason        string              `json:"reason"`
+	ReferenceType string              `json:"reference_type"`
+	ReferenceID   *int64              `json:"reference_id"`
+	Note          string              `json:"note"`
+	CreatedAt     time.Time           `json:"created_at"`
+	Order         *LedgerOrder        `json:"order,omitempty"`
+	Subscription  *LedgerSubscription `json:"subscription,omitempty"`
+	RequestID     *string             `json:"request_id,omitempty"` // 用量扣费或冲正对应的请求 ID
+}
+
+// ListLedger 查询积分流水，返回本页流水和下一页游标（没有更多时为 nil）
+func (s *Service) ListLedger(ctx context.Context, q LedgerQuery) ([]LedgerEntry, *int64, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultLedgerPageSize
+	}
+	if q.Limit > maxLedgerPageSize {
+		q.Limit = maxLedgerPageSize
+	}
+	if q.Cursor < 0 {
+		return nil, nil, fmt.Errorf("%w: cursor must be positive", ErrInvalidRequest)
+	}
+	if q.From != nil && q.To != nil && q.From.After(*q.To) {
+		return nil, nil, fmt.Errorf("%w: from must be before to", ErrInvalidRequest)
+	}
+	if len(q.Reasons) == 0 {
+		q.Reasons = nil
+	}
+	if len(q.BucketTypes) == 0 {
+		q.BucketTypes = nil
+	}
+
+	// 订阅可以直接引用，也可以经由订单或换档记录关联
+	rows, err := s.pool.Query(ctx, `
+		SELECT l.id, l.user_id, l.system_code, l.bucket_id, b.bucket_type, l.delta_points, l.reason,
+			l.reference_type, l.reference_id, l.note, l.created_at,
+			o.id, o.order_type, o.status, o.amount_cents,
+			sub.id, p.name, sub.status,
+			COALESCE(u.request_id, ru.request_id)
+		FROM billing_ledger l
+		LEFT JOIN balance_buckets b ON b.id = l.bucket_id
+		LEFT JOIN orders o ON l.reference_type = 'order' AND o.id = l.reference_id
+		LEFT JOIN plan_changes pc ON l.reference_type = 'plan_change' AND pc.id = l.reference_id
+		LEFT JOIN subscriptions sub ON sub.id = CASE l.reference_type
+			WHEN 'subscription' THEN l.reference_id
+			WHEN 'plan_change' THEN pc.subscription_id
+			WHEN 'order' THEN o.subscription_id
+		END
+		LEFT JOIN plans p ON p.id = sub.plan_id
+		LEFT JOIN usage_records u ON l.reference_type = 'usage' AND u.id = l.reference_id
+		LEFT JOIN usage_reversals ur ON l.reference_type = 'usage_reversal' AND ur.id = l.reference_id
+		LEFT JOIN usage_records ru ON ru.id = ur.usage_record_id
+		WHERE ($1::bigint = 0 OR l.user_id = $1)
+			AND ($2::text = '' OR l.system_code = $2)
+			AND ($3::text[] IS NULL OR l.reason = ANY($3))
+			AND ($4::text[] IS NULL OR b.bucket_type = ANY($4))
+			AND ($5::timestamptz IS NULL OR l.created_at >= $5)
+			AND ($6::timestamptz IS NULL OR l.created_at < $6)
+			AND ($7::bigint = 0 OR l.id < $7)
+		ORDER BY l.id DESC
+		LIMIT $8`,
+		q.UserID, q.SystemCode, q.Reasons, q.BucketTypes, q.From, q.To, q.Cursor, q.Limit+1)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	entries := []LedgerEntry{}
+	for rows.Next() {
+		var e LedgerEntry
+		var orderID, subID *int64
+		var orderType, orderStatus, planName, subStatus *string
+		var amountCents *int
+		if err := rows.Scan(&e.ID, &e.UserID, &e.SystemCode, &e.BucketID, &e.BucketType, &e.DeltaPoints, &e.Reason,
+			&e.ReferenceType, &e.ReferenceID, &e.Note, &e.CreatedAt,
+			&orderID, &orderType, &orderStatus, &amountCents,
+			&subID, &planName, &subStatus,
+			&e.RequestID); err != nil {
+			return nil, nil, err
+		}
+		if orderID != nil {
+			e.Order = &LedgerOrder{ID: *orderID, OrderType: *orderType, Status: *orderStatus, AmountCents: *amountCents}
+		}
+		if subID != nil {
+			e.Subscription = &LedgerSubscription{ID: *subID, Status: *subStatus}
+			if planName != nil {
+				e.Subscription.Plan = *planName
+			}
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var next *int64
+	if len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+		last := entries[len(entries)-1].ID
+		next = &last
+	}
+	return entries, next, nil
+}
@@ -0,0 +1,243 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"easyusersys/internal/email"
+	"easyusersys/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// maxNotificationAttempts 发送失败的最大重试次数，超过后标记为 failed
+const maxNotificationAttempts = 3
+
+// NotificationSender 发送通知邮件，由 email.ResendClient 实现
+type NotificationSender interface {
+	SendEmail(fromEmail, to, subject, htmlContent string) error
+}
+
+// notificationPayload 通知的模板数据，保存在 notifications.data 中
+type notificationPayload struct {
+	Points     float64    `json:"points"`
+	Threshold  float64    `json:"threshold,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	BucketType string     `json:"bucket_type,omitempty"`
+}
+
+// GetNotificationSettings 获取用户的通知设置，未设置时返回默认值（开启，阈值使用系统配置）
+func (s *Service) GetNotificationSettings(ctx context.Context, userID int64) (models.NotificationSettings, error) {
+	settings := models.NotificationSettings{UserID: userID, Enabled: true}
+	err := s.pool.QueryRow(ctx, `
+		SELECT user_id, enabled, low_balance_points, expiring_days, updated_at
+		FROM notification_settings WHERE user_id = $1`, userID,
+	).Scan(&settings.UserID, &settings.Enabled, &settings.LowBalancePoints, &settings.ExpiringDays, &settings.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return settings, nil
+	}
+	return settings, err
+}
+
+// SetNotificationSettings 更新用户的通知设置
+func (s *Service) SetNotificationSettings(ctx context.Context, in models.NotificationSettings) (models.NotificationSettings, error) {
+	if in.UserID == 0 || (in.LowBalancePoints != nil && *in.LowBalancePoints < 0) || (in.ExpiringDays != nil && *in.ExpiringDays < 0) {
+		return models.NotificationSettings{}, ErrInvalidRequest
+	}
+	var settings models.NotificationSettings
+	err := s.pool.QueryRow(ctx, `
+		INSERT INTO notification_settings (user_id, system_code, enabled, low_balance_points, expiring_days)
+		SELECT id, system_code, $2, $3, $4 FROM users WHERE id = $1
+		ON CONFLICT (user_id) DO UPDATE SET
+			enabled = EXCLUDED.enabled,
+			low_balance_points = EXCLUDED.low_balance_points,
+			expiring_days = EXCLUDED.expiring_days,
+			updated_at = NOW()
+		RETURNING user_id, enabled, low_balance_points, expiring_days, updated_at`,
+		in.UserID, in.Enabled, in.LowBalancePoints, in.ExpiringDays,
+	).Scan(&settings.UserID, &settings.Enabled, &settings.LowBalancePoints, &settings.ExpiringDays, &settings.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.NotificationSettings{}, ErrNotFound
+	}
+	return settings, err
+}
+
+// queueLowBalanceNotification 扣费使余额从阈值以上降到阈值以下时写入低余额通知
+// 每个用户每天最多一条，余额在阈值附近反复波动时不会重复提醒
+func (s *Service) queueLowBalanceNotification(ctx context.Context, tx pgx.Tx, userID int64, before, after float64) error {
+	if after >= before {
+		return nil
+	}
+	var systemCode string
+	var enabled bool
+	var userThreshold *float64
+	err := tx.QueryRow(ctx, `
+		SELECT u.system_code, COALESCE(ns.enabled, TRUE), ns.low_balance_points
+		FROM users u LEFT JOIN notification_settings ns ON ns.user_id = u.id
+		WHERE u.id = $1`, userID).Scan(&systemCode, &enabled, &userThreshold)
+	if err != nil {
+		return err
+	}
+	threshold := s.config.NotificationFor(systemCode).LowBalancePoints
+	if userThreshold != nil {
+		threshold = *userThreshold
+	}
+	if !enabled || threshold <= 0 || before < threshold || after >= threshold {
+		return nil
+	}
+	data, err := json.Marshal(notificationPayload{Points: after, Threshold: threshold})
+	if err != nil {
+		return err
+	}
+	dedupKey := fmt.Sprintf("%s:%d:%s", models.NotificationLowBalance, userID, time.Now().UTC().Format("2006-01-02"))
+	_, err = tx.Exec(ctx, `
+		INSERT INTO notifications (system_code, user_id, kind, dedup_key, data)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (dedup_key) DO NOTHING`,
+		systemCode, userID, models.NotificationLowBalance, dedupKey, data)
+	return err
+}
+
+// QueueExpiringPointsNotifications 为即将过期的积分桶写入过期提醒，每个积分桶只提醒一次，返回新写入的通知数
+func (s *Service) QueueExpiringPointsNotifications(ctx context.Context) (int64, error) {
+	rows, err := s.pool.Query(ctx, `SELECT DISTINCT system_code FROM users`)
+	if err != nil {
+		return 0, err
+	}
+	var systemCodes []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		systemCodes = append(systemCodes, code)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, code := range systemCodes {
+		days := s.config.NotificationFor(code).ExpiringDays
+		ct, err := s.pool.Exec(ctx, `
+			INSERT INTO notifications (system_code, user_id, kind, dedup_key, data)
+			SELECT b.system_code, b.user_id, $2, $2 || ':' || b.id,
+				jsonb_build_object('points', b.remaining_points, 'expires_at', b.expires_at, 'bucket_type', b.bucket_type)
+			FROM balance_buckets b
+			JOIN users u ON u.id = b.user_id
+			LEFT JOIN notification_settings ns ON ns.user_id = b.user_id
+			WHERE b.system_code = $1 AND u.status = $4
+				AND b.bucket_type <> $5 AND b.remaining_points > 0
+				AND b.expires_at > NOW()
+				AND COALESCE(ns.enabled, TRUE)
+				AND COALESCE(ns.expiring_days, $3) > 0
+				AND b.expires_at <= NOW() + make_interval(days => COALESCE(ns.expiring_days, $3))
+			ON CONFLICT (dedup_key) DO NOTHING`,
+			code, models.NotificationExpiringPoints, days, models.UserStatusActive, models.BucketDebt)
+		if err != nil {
+			return total, err
+		}
+		total += ct.RowsAffected()
+	}
+	return total, nil
+}
+
+// SendPendingNotifications 发送待发送的通知，返回成功发送的数量
+// 每条通知单独加锁发送，多实例同时执行时互不重复；失败的通知在之后的轮次重试
+func (s *Service) SendPendingNotifications(ctx context.Context, sender NotificationSender, limit int) (int, error) {
+	sent := 0
+	var lastID int64
+	for i := 0; i < limit; i++ {
+		id, ok, err := s.sendNextNotification(ctx, sender, lastID)
+		if err != nil || !ok {
+			return sent, err
+		}
+		lastID = id
+		sent++
+	}
+	return sent, nil
+}
+
+// sendNextNotification 发送 id 大于 afterID 的下一条待发送通知，没有待发送通知时返回 false
+// 发送失败不返回错误，只记录到通知上
+func (s *Service) sendNextNotification(ctx context.Context, sender NotificationSender, afterID int64) (int64, bool, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var n models.Notification
+	var to string
+	err = tx.QueryRow(ctx, `
+		SELECT n.id, n.system_code, n.kind, n.data, n.attempts, u.email
+		FROM notifications n JOIN users u ON u.id = n.user_id
+		WHERE n.status = $1 AND n.id > $2
+		ORDER BY n.id
+		LIMIT 1
+		FOR UPDATE OF n SKIP LOCKED`, models.NotificationPending, afterID,
+	).Scan(&n.ID, &n.SystemCode, &n.Kind, &n.Data, &n.Attempts, &to)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	sendErr := s.deliverNotification(sender, n, to)
+	if sendErr != nil {
+		status := models.NotificationPending
+		if n.Attempts+1 >= maxNotificationAttempts {
+			status = models.NotificationFailed
+		}
+		_, err = tx.Exec(ctx, `
+			UPDATE notifications
+			SET status = $1, attempts = attempts + 1, last_error = $2, updated_at = NOW()
+			WHERE id = $3`, status, sendErr.Error(), n.ID)
+	} else {
+		_, err = tx.Exec(ctx, `
+			UPDATE notifications
+			SET status = $1, attempts = attempts + 1, last_error = NULL, sent_at = NOW(), updated_at = NOW()
+			WHERE id = $2`, models.NotificationSent, n.ID)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, false, err
+	}
+	return n.ID, true, nil
+}
+
+// deliverNotification 按系统模板渲染并发送一条通知
+func (s *Service) deliverNotification(sender NotificationSender, n models.Notification, to string) error {
+	from, ok := s.config.ResendEmailFor(n.SystemCode)
+	if !ok {
+		return email.ErrEmailNotConfigured
+	}
+	var payload notificationPayload
+	if err := json.Unmarshal(n.Data, &payload); err != nil {
+		return err
+	}
+	data := email.NotificationData{
+		Email:      to,
+		SystemCode: n.SystemCode,
+		Points:     payload.Points,
+		Threshold:  payload.Threshold,
+		BucketType: payload.BucketType,
+	}
+	if payload.ExpiresAt != nil {
+		data.ExpiresAt = *payload.ExpiresAt
+	}
+	tmpl := s.config.NotificationFor(n.SystemCode).Templates[n.Kind]
+	subject, html, err := email.RenderNotification(n.Kind, tmpl.Subject, tmpl.HTML, data)
+	if err != nil {
+		return err
+	}
+	return sender.SendEmail(from.FromEmail, to, subject, html)
+}
@@ -0,0 +1,153 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"easyusersys/internal/config"
+	"easyusersys/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ChangePlanInput 订阅换档参数
+type ChangePlanInput struct {
+	SubscriptionID int64
+	PlanID         int64
+	ChangedBy      int64
+	PeriodEnd      *time.Time // Stripe 换档后的当前周期结束时间，为空表示不变
+}
+
+const planChangeColumns = `id, subscription_id, user_id, from_plan_id, to_plan_id, points_policy, points_granted, changed_by, created_at`
+
+// ChangeSubscriptionPlan 将生效中的订阅切换到新计划并记录换档历史
+// 系统换档策略为 immediate 时，升档立即以新积分桶补发新旧计划的积分差额（有效期到订阅结束），降档不收回积分；
+// 策略为 next_renewal 时，下次续费按新计划发放积分
+func (s *Service) ChangeSubscriptionPlan(ctx context.Context, in ChangePlanInput) (models.Subscription, models.PlanChange, error) {
+	if in.SubscriptionID == 0 || in.PlanID == 0 || in.ChangedBy == 0 {
+		return models.Subscription{}, models.PlanChange{}, ErrInvalidRequest
+	}
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return models.Subscription{}, models.PlanChange{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	var userID, fromPlanID int64
+	var status, systemCode string
+	err = tx.QueryRow(ctx, `
+		SELECT user_id, plan_id, status, system_code FROM subscriptions
+		WHERE id = $1 FOR UPDATE`, in.SubscriptionID).Scan(&userID, &fromPlanID, &status, &systemCode)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.Subscription{}, models.PlanChange{}, ErrNotFound
+	}
+	if err != nil {
+		return models.Subscription{}, models.PlanChange{}, err
+	}
+	if status != models.SubscriptionActive && status != models.SubscriptionPastDue {
+		return models.Subscription{}, models.PlanChange{}, ErrSubscriptionNotActive
+	}
+	if fromPlanID == in.PlanID {
+		return models.Subscription{}, models.PlanChange{}, ErrInvalidRequest
+	}
+	fromPlan, err := s.GetPlanByID(withTx(ctx, tx), fromPlanID)
+	if err != nil {
+		return models.Subscription{}, models.PlanChange{}, err
+	}
+	toPlan, err := s.GetPlanByID(withTx(ctx, tx), in.PlanID)
+	if err != nil {
+		return models.Subscription{}, models.PlanChange{}, err
+	}
+	if !toPlan.Active {
+		return models.Subscription{}, models.PlanChange{}, ErrInvalidRequest
+	}
+
+	var sub models.Subscription
+	err = tx.QueryRow(ctx, `
+		UPDATE subscriptions
+		SET plan_id = $1, ends_at = COALESCE($2, ends_at), updated_at = NOW()
+		WHERE id = $3
+		RETURNING id, user_id, plan_id, status, started_at, ends_at, stripe_subscription_id, cancel_at_period_end, created_at, updated_at`,
+		toPlan.ID, in.PeriodEnd, in.SubscriptionID,
+	).Scan(&sub.ID, &sub.UserID, &sub.PlanID, &sub.Status, &sub.StartedAt, &sub.EndsAt, &sub.StripeSubscriptionID, &sub.CancelAtPeriodEnd, &sub.CreatedAt, &sub.UpdatedAt)
+	if err != nil {
+		return models.Subscription{}, models.PlanChange{}, err
+	}
+
+	policy := s.config.PlanChangePolicyFor(systemCode).Points
+	change, err := scanPlanChange(tx.QueryRow(ctx, `
+		INSERT INTO plan_changes (subscription_id, user_id, system_code, from_plan_id, to_plan_id, points_policy, changed_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+planChangeColumns,
+		sub.ID, userID, systemCode, fromPlan.ID, toPlan.ID, policy, in.ChangedBy))
+	if err != nil {
+		return models.Subscription{}, models.PlanChange{}, err
+	}
+
+	if diff := PlanChangeGrant(policy, fromPlan, toPlan); diff > 0 {
+		var bucketID int64
+		err = tx.QueryRow(ctx, `
+			INSERT INTO balance_buckets (user_id, system_code, bucket_type, total_points, remaining_points, expires_at)
+			VALUES ($1, $2, $3, $4, $4, $5)
+			RETURNING id`, userID, systemCode, models.BucketSubscription, diff, sub.EndsAt).Scan(&bucketID)
+		if err != nil {
+			return models.Subscription{}, models.PlanChange{}, err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			userID, systemCode, bucketID, diff, "plan_change_grant", "plan_change", change.ID)
+		if err != nil {
+			return models.Subscription{}, models.PlanChange{}, err
+		}
+		if err := s.settleDebt(ctx, tx, bucketID); err != nil {
+			return models.Subscription{}, models.PlanChange{}, err
+		}
+		_, err = tx.Exec(ctx, `UPDATE plan_changes SET points_granted = $1 WHERE id = $2`, diff, change.ID)
+		if err != nil {
+			return models.Subscription{}, models.PlanChange{}, err
+		}
+		change.PointsGranted = diff
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return models.Subscription{}, models.PlanChange{}, err
+	}
+	return sub, change, nil
+}
+
+// PlanChangeGrant 换档时立即补发的积分：策略为 immediate 且升档时为新旧计划的积分差额，其余情况为 0
+func PlanChangeGrant(policy string, fromPlan, toPlan models.Plan) float64 {
+	if policy != config.PlanChangePointsImmediate || toPlan.GrantPoints <= fromPlan.GrantPoints {
+		return 0
+	}
+	return toPlan.GrantPoints - fromPlan.GrantPoints
+}
+
+// ListPlanChanges 列出订阅的换档历史，按时间倒序
+func (s *Service) ListPlanChanges(ctx context.Context, subscriptionID int64) ([]models.PlanChange, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT `+planChangeColumns+` FROM plan_changes
+		WHERE subscription_id = $1
+		ORDER BY id DESC`, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []models.PlanChange{}
+	for rows.Next() {
+		c, err := scanPlanChange(rows)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+func scanPlanChange(row pgx.Row) (models.PlanChange, error) {
+	var c models.PlanChange
+	err := row.Scan(&c.ID, &c.SubscriptionID, &c.UserID, &c.FromPlanID, &c.ToPlanID, &c.PointsPolicy, &c.PointsGranted, &c.ChangedBy, &c.CreatedAt)
+	return c, err
+}
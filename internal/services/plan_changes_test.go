@@ -0,0 +1,31 @@
+package services
+
+import (
+	"testing"
+
+	"easyusersys/internal/config"
+	"easyusersys/internal/models"
+)
+
+func TestPlanChangeGrant(t *testing.T) {
+	monthly := models.Plan{ID: 1, Name: "monthly", GrantPoints: 1000}
+	quarterly := models.Plan{ID: 2, Name: "quarterly", GrantPoints: 3200}
+	tests := []struct {
+		name     string
+		policy   string
+		from, to models.Plan
+		want     float64
+	}{
+		{name: "immediate upgrade grants difference", policy: config.PlanChangePointsImmediate, from: monthly, to: quarterly, want: 2200},
+		{name: "immediate downgrade grants nothing", policy: config.PlanChangePointsImmediate, from: quarterly, to: monthly, want: 0},
+		{name: "next renewal upgrade grants nothing", policy: config.PlanChangePointsNextRenewal, from: monthly, to: quarterly, want: 0},
+		{name: "same points grants nothing", policy: config.PlanChangePointsImmediate, from: monthly, to: models.Plan{ID: 3, GrantPoints: 1000}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PlanChangeGrant(tt.policy, tt.from, tt.to); got != tt.want {
+				t.Fatalf("PlanChangeGrant() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
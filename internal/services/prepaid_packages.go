@@ -0,0 +1,176 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"easyusersys/internal/config"
+	"easyusersys/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrPackageUnavailable 积分包已下架或不在销售时间内
+var ErrPackageUnavailable = errors.New("prepaid package is not available")
+
+const prepaidPackageColumns = `id, system_code, name, price_cents, points, bonus_points, expiry_days,
+	available_from, available_until, active, sort_order, created_at, updated_at`
+
+func scanPrepaidPackage(row pgx.Row) (models.PrepaidPackage, error) {
+	var p models.PrepaidPackage
+	err := row.Scan(&p.ID, &p.SystemCode, &p.Name, &p.PriceCents, &p.Points, &p.BonusPoints, &p.ExpiryDays,
+		&p.AvailableFrom, &p.AvailableUntil, &p.Active, &p.SortOrder, &p.CreatedAt, &p.UpdatedAt)
+	return p, err
+}
+
+func validatePrepaidPackage(p models.PrepaidPackage) error {
+	if p.SystemCode == "" || strings.TrimSpace(p.Name) == "" || p.PriceCents <= 0 || p.Points <= 0 || p.BonusPoints < 0 || p.ExpiryDays < 0 {
+		return ErrInvalidRequest
+	}
+	if p.AvailableFrom != nil && p.AvailableUntil != nil && !p.AvailableUntil.After(*p.AvailableFrom) {
+		return ErrInvalidRequest
+	}
+	return nil
+}
+
+// prepaidPackageAvailable 积分包在 now 时刻是否可以购买
+func prepaidPackageAvailable(p models.PrepaidPackage, now time.Time) bool {
+	if !p.Active {
+		return false
+	}
+	if p.AvailableFrom != nil && now.Before(*p.AvailableFrom) {
+		return false
+	}
+	return p.AvailableUntil == nil || now.Before(*p.AvailableUntil)
+}
+
+// CreatePrepaidPackage 创建积分包
+func (s *Service) CreatePrepaidPackage(ctx context.Context, p models.PrepaidPackage) (models.PrepaidPackage, error) {
+	p.Name = strings.TrimSpace(p.Name)
+	if err := validatePrepaidPackage(p); err != nil {
+		return models.PrepaidPackage{}, err
+	}
+	return scanPrepaidPackage(s.pool.QueryRow(ctx, `
+		INSERT INTO prepaid_packages (system_code, name, price_cents, points, bonus_points, expiry_days,
+			available_from, available_until, active, sort_order)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING `+prepaidPackageColumns,
+		p.SystemCode, p.Name, p.PriceCents, p.Points, p.BonusPoints, p.ExpiryDays,
+		p.AvailableFrom, p.AvailableUntil, p.Active, p.SortOrder))
+}
+
+// UpdatePrepaidPackage 更新积分包，已创建的订单保留下单时的价格和积分
+func (s *Service) UpdatePrepaidPackage(ctx context.Context, p models.PrepaidPackage) (models.PrepaidPackage, error) {
+	p.Name = strings.TrimSpace(p.Name)
+	if err := validatePrepaidPackage(p); err != nil {
+		return models.PrepaidPackage{}, err
+	}
+	updated, err := scanPrepaidPackage(s.pool.QueryRow(ctx, `
+		UPDATE prepaid_packages
+		SET name = $1, price_cents = $2, points = $3, bonus_points = $4, expiry_days = $5,
+			available_from = $6, available_until = $7, active = $8, sort_order = $9, updated_at = NOW()
+		WHERE id = $10 AND system_code = $11
+		RETURNING `+prepaidPackageColumns,
+		p.Name, p.PriceCents, p.Points, p.BonusPoints, p.ExpiryDays,
+		p.AvailableFrom, p.AvailableUntil, p.Active, p.SortOrder, p.ID, p.SystemCode))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.PrepaidPackage{}, ErrNotFound
+	}
+	return updated, err
+}
+
+// GetPrepaidPackage 根据 ID 获取积分包
+func (s *Service) GetPrepaidPackage(ctx context.Context, packageID int64) (models.PrepaidPackage, error) {
+	p, err := scanPrepaidPackage(s.db(ctx).QueryRow(ctx, `SELECT `+prepaidPackageColumns+` FROM prepaid_packages WHERE id = $1`, packageID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.PrepaidPackage{}, ErrNotFound
+	}
+	return p, err
+}
+
+// ListPrepaidPackages 列出系统内的积分包，availableOnly 为 true 时只返回当前可购买的
+func (s *Service) ListPrepaidPackages(ctx context.Context, systemCode string, availableOnly bool) ([]models.PrepaidPackage, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT `+prepaidPackageColumns+`
+		FROM prepaid_packages
+		WHERE system_code = $1
+		ORDER BY sort_order, price_cents, id`, systemCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	now := time.Now().UTC()
+	packages := []models.PrepaidPackage{}
+	for rows.Next() {
+		p, err := scanPrepaidPackage(rows)
+		if err != nil {
+			return nil, err
+		}
+		if availableOnly && !prepaidPackageAvailable(p, now) {
+			continue
+		}
+		packages = append(packages, p)
+	}
+	return packages, rows.Err()
+}
+
+// CreatePackageOrder 按积分包创建预充值订单，价格、积分（含赠送）和有效期在下单时确定
+func (s *Service) CreatePackageOrder(ctx context.Context, userID, packageID int64) (models.Order, models.PrepaidPackage, error) {
+	if userID == 0 || packageID == 0 {
+		return models.Order{}, models.PrepaidPackage{}, ErrInvalidRequest
+	}
+	systemCode, err := s.GetUserSystemCodeByID(ctx, userID)
+	if err != nil {
+		return models.Order{}, models.PrepaidPackage{}, err
+	}
+	p, err := s.GetPrepaidPackage(ctx, packageID)
+	if err != nil {
+		return models.Order{}, models.PrepaidPackage{}, err
+	}
+	// 其他系统的积分包视为不存在
+	if p.SystemCode != systemCode {
+		return models.Order{}, models.PrepaidPackage{}, ErrNotFound
+	}
+	if !prepaidPackageAvailable(p, time.Now().UTC()) {
+		return models.Order{}, models.PrepaidPackage{}, ErrPackageUnavailable
+	}
+	var expiryDays *int
+	if p.ExpiryDays > 0 {
+		expiryDays = &p.ExpiryDays
+	}
+	order, err := s.insertPrepaidOrder(ctx, userID, p.PriceCents, p.Points+p.BonusPoints, &p.ID, expiryDays)
+	return order, p, err
+}
+
+// CreateCustomPrepaidOrder 按自定义金额创建预充值订单，金额受系统配置的上下限约束
+func (s *Service) CreateCustomPrepaidOrder(ctx context.Context, userID int64, amountCents int) (models.Order, error) {
+	if userID == 0 || amountCents <= 0 {
+		return models.Order{}, ErrInvalidRequest
+	}
+	systemCode, err := s.GetUserSystemCodeByID(ctx, userID)
+	if err != nil {
+		return models.Order{}, err
+	}
+	custom := s.config.PrepaidCustomAmountFor(systemCode)
+	if err := validateCustomAmount(custom, amountCents); err != nil {
+		return models.Order{}, err
+	}
+	return s.insertPrepaidOrder(ctx, userID, amountCents, custom.Points(amountCents), nil, nil)
+}
+
+// validateCustomAmount 检查自定义金额是否允许以及是否在上下限内，自动充值的金额同样受此约束
+func validateCustomAmount(custom config.PrepaidCustomAmountConfig, amountCents int) error {
+	if custom.Disabled {
+		return fmt.Errorf("%w: custom amounts are disabled, choose a package", ErrInvalidRequest)
+	}
+	if custom.MinCents > 0 && amountCents < custom.MinCents {
+		return fmt.Errorf("%w: amount_cents must be at least %d", ErrInvalidRequest, custom.MinCents)
+	}
+	if custom.MaxCents > 0 && amountCents > custom.MaxCents {
+		return fmt.Errorf("%w: amount_cents must be at most %d", ErrInvalidRequest, custom.MaxCents)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"easyusersys/internal/config"
+	"easyusersys/internal/models"
+)
+
+func TestValidateCustomAmount(t *testing.T) {
+	bounded := config.PrepaidCustomAmountConfig{MinCents: 500, MaxCents: 10000}
+	tests := []struct {
+		name   string
+		custom config.PrepaidCustomAmountConfig
+		amount int
+		ok     bool
+	}{
+		{name: "no bounds", custom: config.PrepaidCustomAmountConfig{}, amount: 50, ok: true},
+		{name: "within bounds", custom: bounded, amount: 1000, ok: true},
+		{name: "at minimum", custom: bounded, amount: 500, ok: true},
+		{name: "at maximum", custom: bounded, amount: 10000, ok: true},
+		{name: "below minimum", custom: bounded, amount: 499, ok: false},
+		{name: "above maximum", custom: bounded, amount: 10001, ok: false},
+		{name: "custom amounts disabled", custom: config.PrepaidCustomAmountConfig{Disabled: true}, amount: 1000, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCustomAmount(tt.custom, tt.amount)
+			if tt.ok && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrInvalidRequest) {
+				t.Fatalf("expected ErrInvalidRequest, got %v", err)
+			}
+		})
+	}
+}
+
+func TestPrepaidPackageAvailable(t *testing.T) {
+	now := time.Date(2025, 6, 15, 12, 0, 0, 0, time.UTC)
+	before := now.Add(-time.Hour)
+	after := now.Add(time.Hour)
+	tests := []struct {
+		name string
+		pkg  models.PrepaidPackage
+		want bool
+	}{
+		{name: "active without window", pkg: models.PrepaidPackage{Active: true}, want: true},
+		{name: "inactive", pkg: models.PrepaidPackage{Active: false}, want: false},
+		{name: "inside window", pkg: models.PrepaidPackage{Active: true, AvailableFrom: &before, AvailableUntil: &after}, want: true},
+		{name: "not started", pkg: models.PrepaidPackage{Active: true, AvailableFrom: &after}, want: false},
+		{name: "starts now", pkg: models.PrepaidPackage{Active: true, AvailableFrom: &now}, want: true},
+		{name: "ended", pkg: models.PrepaidPackage{Active: true, AvailableUntil: &before}, want: false},
+		{name: "ends now", pkg: models.PrepaidPackage{Active: true, AvailableUntil: &now}, want: false},
+		{name: "inactive inside window", pkg: models.PrepaidPackage{Active: false, AvailableFrom: &before, AvailableUntil: &after}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := prepaidPackageAvailable(tt.pkg, now); got != tt.want {
+				t.Fatalf("prepaidPackageAvailable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePrepaidPackageWindow(t *testing.T) {
+	from := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	until := from.Add(24 * time.Hour)
+	p := models.PrepaidPackage{SystemCode: "demo", Name: "Starter", PriceCents: 1000, Points: 100, AvailableFrom: &from, AvailableUntil: &until}
+	if err := validatePrepaidPackage(p); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p.AvailableUntil = &from
+	if err := validatePrepaidPackage(p); !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("window ending at its start must be rejected, got %v", err)
+	}
+}
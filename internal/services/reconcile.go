@@ -0,0 +1,389 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"easyusersys/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// reconcileEpsilon 积分为浮点数，差额小于该值视为一致
+const reconcileEpsilon = 1e-6
+
+// reconcileSampleLimit 报告中每类问题最多列出的记录数
+const reconcileSampleLimit = 500
+
+// grantLinkWindow 发放流水与积分桶创建时间的最大间隔，超过时不自动关联
+const grantLinkWindow = time.Minute
+
+// 积分桶问题类型
+const (
+	BucketIssueLedgerMismatch = "ledger_mismatch" // 流水合计与剩余积分不一致
+	BucketIssueOutOfRange     = "out_of_range"    // 剩余积分超出 [0, total_points]，欠款桶大于 0
+	BucketIssueNoLedger       = "no_ledger"       // 没有任何流水的孤立积分桶
+)
+
+// 流水问题类型
+const (
+	LedgerIssueUnlinked     = "unlinked"      // 未关联积分桶（积分桶已删除或写入时遗漏）
+	LedgerIssueUserMismatch = "user_mismatch" // 关联的积分桶属于其他用户
+)
+
+// reconcileTables 带 user_id 和 system_code 的表，system_code 应与用户一致
+var reconcileTables = []string{"balance_buckets", "billing_ledger", "usage_records", "orders", "api_keys", "subscriptions"}
+
+// ReconcileOptions 对账参数，SystemCode 为空时检查全部系统
+type ReconcileOptions struct {
+	SystemCode string
+	Repair     bool
+}
+
+// BucketIssue 积分桶与流水不一致的记录
+type BucketIssue struct {
+	BucketID        int64    `json:"bucket_id"`
+	UserID          int64    `json:"user_id"`
+	SystemCode      string   `json:"system_code"`
+	BucketType      string   `json:"bucket_type"`
+	TotalPoints     float64  `json:"total_points"`
+	RemainingPoints float64  `json:"remaining_points"`
+	LedgerSum       float64  `json:"ledger_sum"`
+	LedgerRows      int      `json:"ledger_rows"`
+	Issues          []string `json:"issues"`
+}
+
+// LedgerIssue 有问题的流水记录
+type LedgerIssue struct {
+	LedgerID    int64   `json:"ledger_id"`
+	UserID      int64   `json:"user_id"`
+	SystemCode  string  `json:"system_code"`
+	BucketID    *int64  `json:"bucket_id"`
+	DeltaPoints float64 `json:"delta_points"`
+	Reason      string  `json:"reason"`
+	Issue       string  `json:"issue"`
+}
+
+// SystemCodeMismatch 某张表中 system_code 与所属用户不一致的记录
+type SystemCodeMismatch struct {
+	Table     string  `json:"table"`
+	Count     int     `json:"count"`
+	SampleIDs []int64 `json:"sample_ids"`
+}
+
+// ReconcileRepairs 修复结果
+type ReconcileRepairs struct {
+	SystemCodesFixed  int64   `json:"system_codes_fixed"`
+	LedgerRowsLinked  int64   `json:"ledger_rows_linked"`
+	BucketsAdjusted   int64   `json:"buckets_adjusted"`
+	AdjustedPointsNet float64 `json:"adjusted_points_net"`
+}
+
+// ReconcileReport 对账报告，列表最多包含 reconcileSampleLimit 条记录
+type ReconcileReport struct {
+	SystemCode           string               `json:"system_code,omitempty"`
+	CheckedAt            time.Time            `json:"checked_at"`
+	BucketIssues         []BucketIssue        `json:"bucket_issues"`
+	LedgerIssues         []LedgerIssue        `json:"ledger_issues"`
+	SystemCodeMismatches []SystemCodeMismatch `json:"system_code_mismatches"`
+	Repairs              *ReconcileRepairs    `json:"repairs,omitempty"`
+}
+
+// Clean 报告中没有发现问题
+func (r ReconcileReport) Clean() bool {
+	return len(r.BucketIssues) == 0 && len(r.LedgerIssues) == 0 && len(r.SystemCodeMismatches) == 0
+}
+
+// Reconcile 核对积分流水与积分桶，Repair 为 true 时在同一事务内修复后重新检查
+// 修复顺序：先按用户修正 system_code，再把遗漏 bucket_id 的发放流水关联回积分桶，
+// 最后以积分桶剩余积分为准写入 reconcile_adjustment 流水补齐差额；
+// 剩余积分超出范围的积分桶本身不可信，只报告不修复
+func (s *Service) Reconcile(ctx context.Context, opts ReconcileOptions) (ReconcileReport, error) {
+	var repairs *ReconcileRepairs
+	if opts.Repair {
+		r, err := s.repairReconciliation(ctx, opts.SystemCode)
+		if err != nil {
+			return ReconcileReport{}, err
+		}
+		repairs = &r
+	}
+
+	report := ReconcileReport{SystemCode: opts.SystemCode, CheckedAt: time.Now().UTC(), Repairs: repairs}
+	var err error
+	if report.BucketIssues, err = s.findBucketIssues(ctx, s.pool, opts.SystemCode, reconcileSampleLimit); err != nil {
+		return ReconcileReport{}, err
+	}
+	if report.LedgerIssues, err = s.findLedgerIssues(ctx, opts.SystemCode); err != nil {
+		return ReconcileReport{}, err
+	}
+	if report.SystemCodeMismatches, err = s.findSystemCodeMismatches(ctx, opts.SystemCode); err != nil {
+		return ReconcileReport{}, err
+	}
+	return report, nil
+}
+
+// findBucketIssues 查找流水合计与剩余积分不一致或剩余积分超出范围的积分桶，limit 为 0 表示不限制
+func (s *Service) findBucketIssues(ctx context.Context, q querier, systemCode string, limit int) ([]BucketIssue, error) {
+	rows, err := q.Query(ctx, `
+		SELECT b.id, b.user_id, b.system_code, b.bucket_type, b.total_points, b.remaining_points,
+			COALESCE(l.total, 0), COALESCE(l.count, 0)
+		FROM balance_buckets b
+		LEFT JOIN (
+			SELECT bucket_id, SUM(delta_points) AS total, COUNT(*) AS count
+			FROM billing_ledger WHERE bucket_id IS NOT NULL
+			GROUP BY bucket_id
+		) l ON l.bucket_id = b.id
+		WHERE ($1 = '' OR b.system_code = $1)
+			AND (ABS(b.remaining_points - COALESCE(l.total, 0)) > $2
+				OR (b.bucket_type <> $3 AND (b.remaining_points < -$2 OR b.remaining_points > b.total_points + $2))
+				OR (b.bucket_type = $3 AND b.remaining_points > $2))
+		ORDER BY b.id
+		LIMIT NULLIF($4::int, 0)`, systemCode, reconcileEpsilon, models.BucketDebt, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	issues := []BucketIssue{}
+	for rows.Next() {
+		var b BucketIssue
+		if err := rows.Scan(&b.BucketID, &b.UserID, &b.SystemCode, &b.BucketType, &b.TotalPoints, &b.RemainingPoints, &b.LedgerSum, &b.LedgerRows); err != nil {
+			return nil, err
+		}
+		b.Issues = classifyBucket(b)
+		issues = append(issues, b)
+	}
+	return issues, rows.Err()
+}
+
+// classifyBucket 按流水合计和剩余积分判断积分桶的问题类型，与 findBucketIssues 的查询条件一致
+func classifyBucket(b BucketIssue) []string {
+	var issues []string
+	if math.Abs(b.RemainingPoints-b.LedgerSum) > reconcileEpsilon {
+		issues = append(issues, BucketIssueLedgerMismatch)
+	}
+	if b.BucketType == models.BucketDebt {
+		if b.RemainingPoints > reconcileEpsilon {
+			issues = append(issues, BucketIssueOutOfRange)
+		}
+	} else if b.RemainingPoints < -reconcileEpsilon || b.RemainingPoints > b.TotalPoints+reconcileEpsilon {
+		issues = append(issues, BucketIssueOutOfRange)
+	}
+	if b.LedgerRows == 0 {
+		issues = append(issues, BucketIssueNoLedger)
+	}
+	return issues
+}
+
+// bucketAdjustment 返回修复时需要写入的 reconcile_adjustment 积分
+// 只有流水合计不一致且剩余积分在合理范围内时才以剩余积分为准，超出范围的积分桶需要人工处理
+func bucketAdjustment(b BucketIssue) (float64, bool) {
+	delta := b.RemainingPoints - b.LedgerSum
+	if math.Abs(delta) <= reconcileEpsilon {
+		return 0, false
+	}
+	for _, issue := range b.Issues {
+		if issue == BucketIssueOutOfRange {
+			return 0, false
+		}
+	}
+	return delta, true
+}
+
+func (s *Service) findLedgerIssues(ctx context.Context, systemCode string) ([]LedgerIssue, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT l.id, l.user_id, l.system_code, l.bucket_id, l.delta_points, l.reason,
+			CASE WHEN l.bucket_id IS NULL THEN $2 ELSE $3 END
+		FROM billing_ledger l
+		LEFT JOIN balance_buckets b ON b.id = l.bucket_id
+		WHERE ($1 = '' OR l.system_code = $1)
+			AND ((l.bucket_id IS NULL AND l.delta_points <> 0) OR b.user_id <> l.user_id)
+		ORDER BY l.id
+		LIMIT $4`, systemCode, LedgerIssueUnlinked, LedgerIssueUserMismatch, reconcileSampleLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	issues := []LedgerIssue{}
+	for rows.Next() {
+		var l LedgerIssue
+		if err := rows.Scan(&l.LedgerID, &l.UserID, &l.SystemCode, &l.BucketID, &l.DeltaPoints, &l.Reason, &l.Issue); err != nil {
+			return nil, err
+		}
+		issues = append(issues, l)
+	}
+	return issues, rows.Err()
+}
+
+// findSystemCodeMismatches 按用户当前的 system_code 检查，systemCode 过滤的是用户所属系统
+func (s *Service) findSystemCodeMismatches(ctx context.Context, systemCode string) ([]SystemCodeMismatch, error) {
+	mismatches := []SystemCodeMismatch{}
+	for _, table := range reconcileTables {
+		m := SystemCodeMismatch{Table: table}
+		err := s.pool.QueryRow(ctx, fmt.Sprintf(`
+			SELECT COUNT(*), COALESCE((ARRAY_AGG(t.id ORDER BY t.id))[1:%d], '{}')
+			FROM %s t JOIN users u ON u.id = t.user_id
+			WHERE t.system_code IS DISTINCT FROM u.system_code
+				AND ($1 = '' OR u.system_code = $1)`, reconcileSampleLimit, table), systemCode).Scan(&m.Count, &m.SampleIDs)
+		if err != nil {
+			return nil, err
+		}
+		if m.Count > 0 {
+			mismatches = append(mismatches, m)
+		}
+	}
+	return mismatches, nil
+}
+
+// repairReconciliation 在一个事务内修复可以自动修复的问题
+func (s *Service) repairReconciliation(ctx context.Context, systemCode string) (ReconcileRepairs, error) {
+	var repairs ReconcileRepairs
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return repairs, err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, table := range reconcileTables {
+		ct, err := tx.Exec(ctx, fmt.Sprintf(`
+			UPDATE %s t SET system_code = u.system_code
+			FROM users u
+			WHERE u.id = t.user_id AND t.system_code IS DISTINCT FROM u.system_code
+				AND ($1 = '' OR u.system_code = $1)`, table), systemCode)
+		if err != nil {
+			return repairs, err
+		}
+		repairs.SystemCodesFixed += ct.RowsAffected()
+	}
+
+	if repairs.LedgerRowsLinked, err = linkGrantLedgerRows(ctx, tx, systemCode); err != nil {
+		return repairs, err
+	}
+
+	issues, err := s.findBucketIssues(ctx, tx, systemCode, 0)
+	if err != nil {
+		return repairs, err
+	}
+	for _, b := range issues {
+		delta, ok := bucketAdjustment(b)
+		if !ok {
+			continue
+		}
+		note := fmt.Sprintf("reconcile: ledger sum %g, remaining %g", b.LedgerSum, b.RemainingPoints)
+		_, err := tx.Exec(ctx, `
+			INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id, note)
+			SELECT user_id, system_code, id, $2, $3, $4, id, $5 FROM balance_buckets WHERE id = $1`,
+			b.BucketID, delta, "reconcile_adjustment", "bucket", note)
+		if err != nil {
+			return repairs, err
+		}
+		repairs.BucketsAdjusted++
+		repairs.AdjustedPointsNet += delta
+	}
+	return repairs, tx.Commit(ctx)
+}
+
+// grantLedgerRow 遗漏 bucket_id 的发放流水
+type grantLedgerRow struct {
+	ID          int64
+	Reason      string
+	DeltaPoints float64
+	CreatedAt   time.Time
+}
+
+// grantBucketCandidate 可能对应发放流水的积分桶，Linked 表示已关联同类流水
+type grantBucketCandidate struct {
+	ID          int64
+	TotalPoints float64
+	CreatedAt   time.Time
+	Linked      bool
+}
+
+// grantBucketType 发放流水对应的积分桶类型，不支持自动关联的流水返回空
+func grantBucketType(reason string) string {
+	switch reason {
+	case "signup_bonus":
+		return models.BucketFree
+	case "subscription_grant":
+		return models.BucketSubscription
+	}
+	return ""
+}
+
+// matchGrantBucket 在同一用户、对应类型的积分桶中为发放流水选择关联的积分桶：
+// 总额等于发放积分、创建时间相差不超过 grantLinkWindow 且尚未关联同类流水，
+// 多个候选时取时间最接近的，再按 ID 取最早的
+func matchGrantBucket(l grantLedgerRow, candidates []grantBucketCandidate) (int64, bool) {
+	var best grantBucketCandidate
+	var bestGap time.Duration
+	found := false
+	for _, c := range candidates {
+		if c.Linked || math.Abs(c.TotalPoints-l.DeltaPoints) > reconcileEpsilon {
+			continue
+		}
+		gap := c.CreatedAt.Sub(l.CreatedAt).Abs()
+		if gap > grantLinkWindow {
+			continue
+		}
+		if !found || gap < bestGap || (gap == bestGap && c.ID < best.ID) {
+			best, bestGap, found = c, gap, true
+		}
+	}
+	return best.ID, found
+}
+
+// linkGrantLedgerRows 将遗漏 bucket_id 的注册赠送和订阅发放流水关联回对应的积分桶，匹配规则见 matchGrantBucket
+func linkGrantLedgerRows(ctx context.Context, tx pgx.Tx, systemCode string) (int64, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT id, user_id, reason, delta_points, created_at FROM billing_ledger
+		WHERE bucket_id IS NULL AND reason IN ('signup_bonus', 'subscription_grant')
+			AND ($1 = '' OR system_code = $1)
+		ORDER BY id`, systemCode)
+	if err != nil {
+		return 0, err
+	}
+	type pending struct {
+		userID int64
+		row    grantLedgerRow
+	}
+	var ledgerRows []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.row.ID, &p.userID, &p.row.Reason, &p.row.DeltaPoints, &p.row.CreatedAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ledgerRows = append(ledgerRows, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var linked int64
+	for _, p := range ledgerRows {
+		// 每次重新查询候选，本次修复中已关联的积分桶不会被再次选中
+		rows, err := tx.Query(ctx, `
+			SELECT b.id, b.total_points, b.created_at,
+				EXISTS (SELECT 1 FROM billing_ledger x WHERE x.bucket_id = b.id AND x.reason = $3)
+			FROM balance_buckets b
+			WHERE b.user_id = $1 AND b.bucket_type = $2`, p.userID, grantBucketType(p.row.Reason), p.row.Reason)
+		if err != nil {
+			return linked, err
+		}
+		candidates, err := pgx.CollectRows(rows, pgx.RowToStructByPos[grantBucketCandidate])
+		if err != nil {
+			return linked, err
+		}
+		bucketID, ok := matchGrantBucket(p.row, candidates)
+		if !ok {
+			continue
+		}
+		if _, err := tx.Exec(ctx, `UPDATE billing_ledger SET bucket_id = $1 WHERE id = $2`, bucketID, p.row.ID); err != nil {
+			return linked, err
+		}
+		linked++
+	}
+	return linked, nil
+}
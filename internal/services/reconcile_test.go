@@ -0,0 +1,183 @@
+package services
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"easyusersys/internal/models"
+)
+
+func TestClassifyBucket(t *testing.T) {
+	tests := []struct {
+		name   string
+		bucket BucketIssue
+		want   []string
+	}{
+		{
+			name:   "consistent",
+			bucket: BucketIssue{BucketType: models.BucketPrepaid, TotalPoints: 100, RemainingPoints: 40, LedgerSum: 40, LedgerRows: 3},
+		},
+		{
+			name:   "float noise is ignored",
+			bucket: BucketIssue{BucketType: models.BucketPrepaid, TotalPoints: 100, RemainingPoints: 40, LedgerSum: 40 + 1e-9, LedgerRows: 3},
+		},
+		{
+			name:   "ledger mismatch",
+			bucket: BucketIssue{BucketType: models.BucketPrepaid, TotalPoints: 100, RemainingPoints: 40, LedgerSum: 50, LedgerRows: 3},
+			want:   []string{BucketIssueLedgerMismatch},
+		},
+		{
+			name:   "missing grant ledger",
+			bucket: BucketIssue{BucketType: models.BucketFree, TotalPoints: 5, RemainingPoints: 5},
+			want:   []string{BucketIssueLedgerMismatch, BucketIssueNoLedger},
+		},
+		{
+			name:   "negative remaining",
+			bucket: BucketIssue{BucketType: models.BucketPrepaid, TotalPoints: 100, RemainingPoints: -1, LedgerSum: -1, LedgerRows: 2},
+			want:   []string{BucketIssueOutOfRange},
+		},
+		{
+			name:   "remaining above total",
+			bucket: BucketIssue{BucketType: models.BucketSubscription, TotalPoints: 100, RemainingPoints: 120, LedgerSum: 100, LedgerRows: 1},
+			want:   []string{BucketIssueLedgerMismatch, BucketIssueOutOfRange},
+		},
+		{
+			name:   "debt bucket may be negative",
+			bucket: BucketIssue{BucketType: models.BucketDebt, RemainingPoints: -30, LedgerSum: -30, LedgerRows: 2},
+		},
+		{
+			name:   "positive debt bucket",
+			bucket: BucketIssue{BucketType: models.BucketDebt, RemainingPoints: 5, LedgerSum: 5, LedgerRows: 2},
+			want:   []string{BucketIssueOutOfRange},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyBucket(tt.bucket); !slices.Equal(got, tt.want) {
+				t.Fatalf("classifyBucket() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketAdjustment(t *testing.T) {
+	tests := []struct {
+		name   string
+		bucket BucketIssue
+		want   float64
+		ok     bool
+	}{
+		{
+			name:   "missing grant is backfilled",
+			bucket: BucketIssue{BucketType: models.BucketFree, TotalPoints: 5, RemainingPoints: 5},
+			want:   5, ok: true,
+		},
+		{
+			name:   "ledger above remaining",
+			bucket: BucketIssue{BucketType: models.BucketPrepaid, TotalPoints: 100, RemainingPoints: 40, LedgerSum: 50, LedgerRows: 3},
+			want:   -10, ok: true,
+		},
+		{
+			name:   "consistent bucket",
+			bucket: BucketIssue{BucketType: models.BucketPrepaid, TotalPoints: 100, RemainingPoints: 40, LedgerSum: 40, LedgerRows: 3},
+		},
+		{
+			name:   "out of range remaining is not trusted",
+			bucket: BucketIssue{BucketType: models.BucketSubscription, TotalPoints: 100, RemainingPoints: 120, LedgerSum: 100, LedgerRows: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.bucket.Issues = classifyBucket(tt.bucket)
+			got, ok := bucketAdjustment(tt.bucket)
+			if ok != tt.ok || got != tt.want {
+				t.Fatalf("bucketAdjustment() = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestGrantBucketType(t *testing.T) {
+	if got := grantBucketType("signup_bonus"); got != models.BucketFree {
+		t.Fatalf("signup_bonus -> %q", got)
+	}
+	if got := grantBucketType("subscription_grant"); got != models.BucketSubscription {
+		t.Fatalf("subscription_grant -> %q", got)
+	}
+	if got := grantBucketType("prepaid_grant"); got != "" {
+		t.Fatalf("prepaid_grant must not be linked automatically, got %q", got)
+	}
+}
+
+func TestMatchGrantBucket(t *testing.T) {
+	granted := time.Date(2025, 1, 21, 10, 0, 0, 0, time.UTC)
+	row := grantLedgerRow{ID: 1, Reason: "subscription_grant", DeltaPoints: 100, CreatedAt: granted}
+	tests := []struct {
+		name       string
+		candidates []grantBucketCandidate
+		want       int64
+		ok         bool
+	}{
+		{name: "no candidates"},
+		{
+			name:       "same amount within window",
+			candidates: []grantBucketCandidate{{ID: 7, TotalPoints: 100, CreatedAt: granted.Add(2 * time.Second)}},
+			want:       7, ok: true,
+		},
+		{
+			name:       "bucket created before the ledger row",
+			candidates: []grantBucketCandidate{{ID: 7, TotalPoints: 100, CreatedAt: granted.Add(-30 * time.Second)}},
+			want:       7, ok: true,
+		},
+		{
+			name:       "different amount",
+			candidates: []grantBucketCandidate{{ID: 7, TotalPoints: 90, CreatedAt: granted}},
+		},
+		{
+			name:       "outside window",
+			candidates: []grantBucketCandidate{{ID: 7, TotalPoints: 100, CreatedAt: granted.Add(grantLinkWindow + time.Second)}},
+		},
+		{
+			name:       "at window edge",
+			candidates: []grantBucketCandidate{{ID: 7, TotalPoints: 100, CreatedAt: granted.Add(-grantLinkWindow)}},
+			want:       7, ok: true,
+		},
+		{
+			name:       "already linked",
+			candidates: []grantBucketCandidate{{ID: 7, TotalPoints: 100, CreatedAt: granted, Linked: true}},
+		},
+		{
+			name: "closest in time wins",
+			candidates: []grantBucketCandidate{
+				{ID: 7, TotalPoints: 100, CreatedAt: granted.Add(40 * time.Second)},
+				{ID: 9, TotalPoints: 100, CreatedAt: granted.Add(-5 * time.Second)},
+			},
+			want: 9, ok: true,
+		},
+		{
+			name: "tie goes to the lowest id",
+			candidates: []grantBucketCandidate{
+				{ID: 9, TotalPoints: 100, CreatedAt: granted.Add(5 * time.Second)},
+				{ID: 7, TotalPoints: 100, CreatedAt: granted.Add(-5 * time.Second)},
+			},
+			want: 7, ok: true,
+		},
+		{
+			name: "skips linked bucket for the next match",
+			candidates: []grantBucketCandidate{
+				{ID: 7, TotalPoints: 100, CreatedAt: granted, Linked: true},
+				{ID: 9, TotalPoints: 100, CreatedAt: granted.Add(20 * time.Second)},
+			},
+			want: 9, ok: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := matchGrantBucket(row, tt.candidates)
+			if ok != tt.ok || got != tt.want {
+				t.Fatalf("matchGrantBucket() = %d, %v, want %d, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
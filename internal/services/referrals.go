@@ -0,0 +1,336 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"time"
+
+	"easyusersys/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// 推荐被拒绝的原因
+const (
+	ReferralRejectSelf        = "self_referral"
+	ReferralRejectIPLimit     = "ip_limit"
+	ReferralRejectEmailDomain = "email_domain_limit"
+	ReferralRejectInactive    = "referrer_inactive"
+)
+
+// referralCodeAlphabet 推荐码字符集，去掉了容易混淆的 0/O/1/I
+const referralCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// SignupReferral 注册时携带的推荐信息
+type SignupReferral struct {
+	Code string // 推荐码，为空表示无推荐人
+	IP   string // 注册请求来源 IP
+}
+
+// ReferralSummary 用户的推荐统计
+type ReferralSummary struct {
+	ReferralCode string            `json:"referral_code"`
+	Total        int               `json:"total"`
+	Pending      int               `json:"pending"`
+	Rewarded     int               `json:"rewarded"`
+	Rejected     int               `json:"rejected"`
+	PointsEarned float64           `json:"points_earned"`
+	Referrals    []models.Referral `json:"referrals"`
+}
+
+const referralColumns = `id, system_code, referrer_id, referee_id, referral_code, signup_ip, email_domain,
+	status, reject_reason, order_id, referrer_points, referee_points, rewarded_at, created_at`
+
+func scanReferral(row pgx.Row) (models.Referral, error) {
+	var r models.Referral
+	err := row.Scan(&r.ID, &r.SystemCode, &r.ReferrerID, &r.RefereeID, &r.ReferralCode, &r.SignupIP, &r.EmailDomain,
+		&r.Status, &r.RejectReason, &r.OrderID, &r.ReferrerPoints, &r.RefereePoints, &r.RewardedAt, &r.CreatedAt)
+	return r, err
+}
+
+func generateReferralCode() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for i := range buf {
+		buf[i] = referralCodeAlphabet[int(buf[i])%len(referralCodeAlphabet)]
+	}
+	return string(buf), nil
+}
+
+// normalizeEmail 规范化邮箱用于识别自我推荐：小写并去掉 + 后缀
+func normalizeEmail(email string) (local, domain string) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email, ""
+	}
+	local, domain = email[:at], email[at+1:]
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+	return local, domain
+}
+
+// GetReferralCode 获取用户的推荐码，首次获取时生成
+func (s *Service) GetReferralCode(ctx context.Context, userID int64) (string, error) {
+	var code *string
+	err := s.pool.QueryRow(ctx, `SELECT referral_code FROM users WHERE id = $1`, userID).Scan(&code)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if code != nil {
+		return *code, nil
+	}
+	// 推荐码在同一 system_code 内唯一，冲突时重新生成
+	for attempt := 0; attempt < 5; attempt++ {
+		generated, err := generateReferralCode()
+		if err != nil {
+			return "", err
+		}
+		var stored string
+		err = s.pool.QueryRow(ctx, `
+			UPDATE users SET referral_code = COALESCE(referral_code, $1), updated_at = NOW()
+			WHERE id = $2
+			RETURNING referral_code`, generated, userID).Scan(&stored)
+		if err == nil {
+			return stored, nil
+		}
+		if !isUniqueViolation(err) {
+			return "", err
+		}
+	}
+	return "", errors.New("failed to generate unique referral code")
+}
+
+// recordReferral 记录新用户的推荐关系，推荐码无效时忽略
+// 触发防刷规则的推荐仍会记录，但状态为 rejected，不会发放奖励
+func (s *Service) recordReferral(ctx context.Context, referee models.User, ref SignupReferral) error {
+	code := strings.ToUpper(strings.TrimSpace(ref.Code))
+	if code == "" {
+		return nil
+	}
+	// 注册时在创建用户的事务内调用，使用保存点
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var referrerID int64
+	var referrerEmail, referrerStatus string
+	err = tx.QueryRow(ctx, `
+		SELECT id, email, status FROM users
+		WHERE system_code = $1 AND referral_code = $2
+		FOR UPDATE`, referee.SystemCode, code).Scan(&referrerID, &referrerEmail, &referrerStatus)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	refereeLocal, refereeDomain := normalizeEmail(referee.Email)
+	referrerLocal, referrerDomain := normalizeEmail(referrerEmail)
+	cfg, _ := s.config.ReferralFor(referee.SystemCode)
+
+	var rejectReason *string
+	reject := func(reason string) { rejectReason = &reason }
+	switch {
+	case referrerID == referee.ID || (refereeLocal == referrerLocal && refereeDomain == referrerDomain):
+		reject(ReferralRejectSelf)
+	case referrerStatus != models.UserStatusActive:
+		reject(ReferralRejectInactive)
+	}
+	if rejectReason == nil && cfg.MaxPerIP > 0 && ref.IP != "" {
+		var count int
+		err = tx.QueryRow(ctx, `
+			SELECT COUNT(*) FROM referrals
+			WHERE system_code = $1 AND signup_ip = $2 AND created_at > NOW() - INTERVAL '24 hours'`,
+			referee.SystemCode, ref.IP).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count >= cfg.MaxPerIP {
+			reject(ReferralRejectIPLimit)
+		}
+	}
+	if rejectReason == nil && cfg.MaxPerEmailDomain > 0 {
+		var count int
+		err = tx.QueryRow(ctx, `
+			SELECT COUNT(*) FROM referrals
+			WHERE referrer_id = $1 AND email_domain = $2 AND status <> $3`,
+			referrerID, refereeDomain, models.ReferralRejected).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count >= cfg.MaxPerEmailDomain {
+			reject(ReferralRejectEmailDomain)
+		}
+	}
+
+	status := models.ReferralPending
+	if rejectReason != nil {
+		status = models.ReferralRejected
+	}
+	var signupIP *string
+	if ref.IP != "" {
+		signupIP = &ref.IP
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO referrals (system_code, referrer_id, referee_id, referral_code, signup_ip, email_domain, status, reject_reason)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (referee_id) DO NOTHING`,
+		referee.SystemCode, referrerID, referee.ID, code, signupIP, refereeDomain, status, rejectReason)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// rewardReferral 被推荐人首个订单支付成功后向双方发放推荐奖励，需在 MarkOrderPaid 的事务中调用
+func (s *Service) rewardReferral(ctx context.Context, tx pgx.Tx, order models.Order) error {
+	referral, err := scanReferral(tx.QueryRow(ctx, `
+		SELECT `+referralColumns+` FROM referrals
+		WHERE referee_id = $1 AND status = $2
+		FOR UPDATE`, order.UserID, models.ReferralPending))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	cfg, _ := s.config.ReferralFor(referral.SystemCode)
+	var expiresAt *time.Time
+	if cfg.ExpiryDays > 0 {
+		t := time.Now().UTC().Add(time.Duration(cfg.ExpiryDays) * 24 * time.Hour)
+		expiresAt = &t
+	}
+
+	referrerPoints := 0.0
+	if cfg.ReferrerPoints > 0 {
+		var referrerStatus string
+		if err := tx.QueryRow(ctx, `SELECT status FROM users WHERE id = $1`, referral.ReferrerID).Scan(&referrerStatus); err != nil {
+			return err
+		}
+		// 推荐人已被禁用时不发放推荐人奖励
+		if referrerStatus == models.UserStatusActive {
+			if err := s.grantReferralPoints(ctx, tx, referral.ReferrerID, referral.ID, cfg.ReferrerPoints, expiresAt); err != nil {
+				return err
+			}
+			referrerPoints = cfg.ReferrerPoints
+		}
+	}
+	refereePoints := 0.0
+	if cfg.RefereePoints > 0 {
+		if err := s.grantReferralPoints(ctx, tx, referral.RefereeID, referral.ID, cfg.RefereePoints, expiresAt); err != nil {
+			return err
+		}
+		refereePoints = cfg.RefereePoints
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE referrals
+		SET status = $1, order_id = $2, referrer_points = $3, referee_points = $4, rewarded_at = NOW()
+		WHERE id = $5`, models.ReferralRewarded, order.ID, referrerPoints, refereePoints, referral.ID)
+	return err
+}
+
+// grantReferralPoints 发放推荐奖励积分（promo 积分桶）并优先偿还欠款
+func (s *Service) grantReferralPoints(ctx context.Context, tx pgx.Tx, userID, referralID int64, points float64, expiresAt *time.Time) error {
+	var bucketID int64
+	err := tx.QueryRow(ctx, `
+		INSERT INTO balance_buckets (user_id, system_code, bucket_type, total_points, remaining_points, expires_at)
+		SELECT id, system_code, $2, $3, $3, $4 FROM users WHERE id = $1
+		RETURNING id`, userID, models.BucketPromo, points, expiresAt).Scan(&bucketID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id)
+		SELECT id, system_code, $2, $3, $4, $5, $6 FROM users WHERE id = $1`,
+		userID, bucketID, points, "referral_reward", "referral", referralID)
+	if err != nil {
+		return err
+	}
+	return s.settleDebt(ctx, tx, bucketID)
+}
+
+// GetReferralSummary 查询用户作为推荐人的推荐码、推荐记录和累计奖励
+func (s *Service) GetReferralSummary(ctx context.Context, userID int64) (ReferralSummary, error) {
+	code, err := s.GetReferralCode(ctx, userID)
+	if err != nil {
+		return ReferralSummary{}, err
+	}
+	rows, err := s.pool.Query(ctx, `
+		SELECT `+referralColumns+` FROM referrals
+		WHERE referrer_id = $1
+		ORDER BY id DESC`, userID)
+	if err != nil {
+		return ReferralSummary{}, err
+	}
+	defer rows.Close()
+	summary := ReferralSummary{ReferralCode: code, Referrals: []models.Referral{}}
+	for rows.Next() {
+		r, err := scanReferral(rows)
+		if err != nil {
+			return ReferralSummary{}, err
+		}
+		summary.Total++
+		switch r.Status {
+		case models.ReferralPending:
+			summary.Pending++
+		case models.ReferralRewarded:
+			summary.Rewarded++
+			summary.PointsEarned += r.ReferrerPoints
+		case models.ReferralRejected:
+			summary.Rejected++
+		}
+		// 推荐人只能看到推荐状态，不返回被推荐人的注册 IP
+		r.SignupIP = nil
+		summary.Referrals = append(summary.Referrals, r)
+	}
+	return summary, rows.Err()
+}
+
+// ListSystemReferrals 管理员查询系统内的推荐记录，status 为空表示全部
+func (s *Service) ListSystemReferrals(ctx context.Context, systemCode, status string, page, pageSize int) ([]models.Referral, int64, error) {
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 {
+		pageSize = 20
+	}
+	var total int64
+	err := s.pool.QueryRow(ctx, `
+		SELECT COUNT(*) FROM referrals
+		WHERE ($1 = '' OR system_code = $1) AND ($2 = '' OR status = $2)`, systemCode, status).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := s.pool.Query(ctx, `
+		SELECT `+referralColumns+` FROM referrals
+		WHERE ($1 = '' OR system_code = $1) AND ($2 = '' OR status = $2)
+		ORDER BY id DESC
+		LIMIT $3 OFFSET $4`, systemCode, status, pageSize, (page-1)*pageSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	referrals := []models.Referral{}
+	for rows.Next() {
+		r, err := scanReferral(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		referrals = append(referrals, r)
+	}
+	return referrals, total, rows.Err()
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"context"
+	"errors"
+
+	"easyusersys/internal/config"
+	"easyusersys/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// OrderReversal 订单退款或拒付信息，金额均为 Stripe 侧的累计值
+type OrderReversal struct {
+	OrderID       int64
+	RefundedCents int    // 累计退款金额，小于订单已记录的值时忽略
+	DisputedCents int    // 争议金额，小于订单已记录的值时忽略
+	ChargedCents  int    // 实际扣款金额（含折扣），为 0 时使用订单金额
+	Note          string // 写入收回流水的备注
+}
+
+// GetOrderByPaymentIntentID 根据 Stripe PaymentIntent ID 获取订单
+func (s *Service) GetOrderByPaymentIntentID(ctx context.Context, paymentIntentID string) (models.Order, error) {
+	var order models.Order
+	err := s.db(ctx).QueryRow(ctx, `
+		SELECT id, user_id, order_type, status, amount_cents, points, subscription_id,
+			stripe_session_id, stripe_payment_intent_id, stripe_subscription_id, payment_provider, package_id, refunded_cents, disputed_cents, created_at, updated_at
+		FROM orders WHERE stripe_payment_intent_id = $1
+		ORDER BY id DESC LIMIT 1`, paymentIntentID,
+	).Scan(&order.ID, &order.UserID, &order.OrderType, &order.Status, &order.AmountCents, &order.Points, &order.SubscriptionID, &order.StripeSessionID, &order.StripePaymentIntentID, &order.StripeSubscriptionID, &order.PaymentProvider, &order.PackageID, &order.RefundedCents, &order.DisputedCents, &order.CreatedAt, &order.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.Order{}, ErrNotFound
+	}
+	return order, err
+}
+
+// RecordOrderRefund 记录订单退款，订单状态改为 refunded 并按退款比例收回该订单发放的积分
+func (s *Service) RecordOrderRefund(ctx context.Context, in OrderReversal) (models.Order, error) {
+	return s.reverseOrder(ctx, in, models.OrderStatusRefunded)
+}
+
+// RecordOrderDispute 记录订单拒付争议，订单状态改为 disputed 并按争议金额比例收回积分
+func (s *Service) RecordOrderDispute(ctx context.Context, in OrderReversal) (models.Order, error) {
+	return s.reverseOrder(ctx, in, models.OrderStatusDisputed)
+}
+
+// reverseOrder 按累计退款与争议金额计算应收回的积分，只处理尚未收回的差额，重复调用不会重复扣减
+// 优先从订单发放的积分桶扣除剩余积分，已消耗的部分按系统退款策略免除或记为欠款
+func (s *Service) reverseOrder(ctx context.Context, in OrderReversal, status string) (models.Order, error) {
+	if in.OrderID == 0 || in.RefundedCents < 0 || in.DisputedCents < 0 {
+		return models.Order{}, ErrInvalidRequest
+	}
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return models.Order{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	var order models.Order
+	var systemCode string
+	var clawedBack float64
+	err = tx.QueryRow(ctx, `
+		SELECT id, user_id, system_code, order_type, status, amount_cents, points, subscription_id,
+			refunded_cents, disputed_cents, clawback_points
+		FROM orders WHERE id = $1 FOR UPDATE`, in.OrderID,
+	).Scan(&order.ID, &order.UserID, &systemCode, &order.OrderType, &order.Status, &order.AmountCents, &order.Points, &order.SubscriptionID,
+		&order.RefundedCents, &order.DisputedCents, &clawedBack)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.Order{}, ErrNotFound
+	}
+	if err != nil {
+		return models.Order{}, err
+	}
+	if order.Status == models.OrderStatusPending || order.Status == models.OrderStatusFailed {
+		return models.Order{}, ErrInvalidRequest
+	}
+
+	charged := in.ChargedCents
+	if charged <= 0 {
+		charged = order.AmountCents
+	}
+	if charged <= 0 {
+		return models.Order{}, ErrInvalidRequest
+	}
+	refunded := max(order.RefundedCents, in.RefundedCents)
+	disputed := max(order.DisputedCents, in.DisputedCents)
+	if refunded > charged || disputed > charged {
+		return models.Order{}, ErrInvalidRequest
+	}
+	// 拒付中的订单收到退款时保持 disputed 状态
+	if status == models.OrderStatusRefunded && order.Status == models.OrderStatusDisputed {
+		status = models.OrderStatusDisputed
+	}
+
+	ratio := minFloat(1, float64(refunded+disputed)/float64(charged))
+	target := order.Points * ratio
+	if owed := target - clawedBack; owed > 0 {
+		if err := s.clawbackOrderPoints(ctx, tx, order, systemCode, owed, in.Note); err != nil {
+			return models.Order{}, err
+		}
+		clawedBack = target
+	}
+
+	err = tx.QueryRow(ctx, `
+		UPDATE orders
+		SET status = $1, refunded_cents = $2, disputed_cents = $3, clawback_points = $4, updated_at = NOW()
+		WHERE id = $5
+		RETURNING id, user_id, order_type, status, amount_cents, points, subscription_id,
+			stripe_session_id, stripe_payment_intent_id, stripe_subscription_id, payment_provider, package_id, refunded_cents, disputed_cents, created_at, updated_at`,
+		status, refunded, disputed, clawedBack, order.ID,
+	).Scan(&order.ID, &order.UserID, &order.OrderType, &order.Status, &order.AmountCents, &order.Points, &order.SubscriptionID, &order.StripeSessionID, &order.StripePaymentIntentID, &order.StripeSubscriptionID, &order.PaymentProvider, &order.PackageID, &order.RefundedCents, &order.DisputedCents, &order.CreatedAt, &order.UpdatedAt)
+	if err != nil {
+		return models.Order{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return models.Order{}, err
+	}
+	return order, nil
+}
+
+// clawbackOrderPoints 从订单发放的积分桶收回积分，不足部分根据退款策略处理
+func (s *Service) clawbackOrderPoints(ctx context.Context, tx pgx.Tx, order models.Order, systemCode string, points float64, note string) error {
+	bucketID, err := orderGrantBucket(ctx, tx, order)
+	if err != nil {
+		return err
+	}
+	shortfall := points
+	if bucketID != 0 {
+		var remaining float64
+		err = tx.QueryRow(ctx, `
+			SELECT remaining_points FROM balance_buckets
+			WHERE id = $1 FOR UPDATE`, bucketID).Scan(&remaining)
+		if err != nil {
+			return err
+		}
+		take := minFloat(remaining, points)
+		if take > 0 {
+			_, err = tx.Exec(ctx, `
+				UPDATE balance_buckets SET remaining_points = remaining_points - $1, updated_at = NOW()
+				WHERE id = $2`, take, bucketID)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, `
+				INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id, note)
+				SELECT id, system_code, $2, $3, $4, $5, $6, $7 FROM users WHERE id = $1`,
+				order.UserID, bucketID, -take, "refund_clawback", "order", order.ID, note)
+			if err != nil {
+				return err
+			}
+			shortfall -= take
+		}
+	}
+	if shortfall <= 0 || s.config.RefundPolicyFor(systemCode).SpentPoints != config.RefundSpentDebt {
+		return nil
+	}
+	// 已消耗的积分记为欠款，不受信用额度限制
+	debt, err := s.lockDebtBucket(ctx, tx, order.UserID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE balance_buckets SET remaining_points = remaining_points - $1, updated_at = NOW()
+		WHERE id = $2`, shortfall, debt.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id, note)
+		SELECT id, system_code, $2, $3, $4, $5, $6, $7 FROM users WHERE id = $1`,
+		order.UserID, debt.ID, -shortfall, "refund_debt", "order", order.ID, note)
+	return err
+}
+
+// orderGrantBucket 查找订单发放积分的桶：预充值订单为 prepaid_grant 流水对应的桶，
+// 订阅订单为该订阅首次发放的积分桶；找不到时返回 0
+func orderGrantBucket(ctx context.Context, tx pgx.Tx, order models.Order) (int64, error) {
+	var bucketID *int64
+	var err error
+	switch {
+	case order.OrderType == models.OrderTypePrepaid:
+		err = tx.QueryRow(ctx, `
+			SELECT bucket_id FROM billing_ledger
+			WHERE reason = 'prepaid_grant' AND reference_type = 'order' AND reference_id = $1
+			ORDER BY id LIMIT 1`, order.ID).Scan(&bucketID)
+	case order.OrderType == models.OrderTypeSubscription && order.SubscriptionID != nil:
+		err = tx.QueryRow(ctx, `
+			SELECT bucket_id FROM billing_ledger
+			WHERE reason = 'subscription_grant' AND reference_type = 'subscription' AND reference_id = $1
+			ORDER BY id LIMIT 1`, *order.SubscriptionID).Scan(&bucketID)
+	default:
+		return 0, nil
+	}
+	if errors.Is(err, pgx.ErrNoRows) || bucketID == nil {
+		return 0, nil
+	}
+	return *bucketID, err
+}
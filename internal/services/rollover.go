@@ -0,0 +1,136 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"easyusersys/internal/config"
+	"easyusersys/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// rolloverSubscriptionPoints 新周期开始时按计划的结转策略，将上个周期未用完的订阅积分转入 rollover 积分桶
+// 只从该订阅发放的 subscription 积分桶中转出（结转过的积分不会再次结转），未结转的部分仍随原积分桶过期
+func (s *Service) rolloverSubscriptionPoints(ctx context.Context, tx pgx.Tx, subscriptionID int64, grantPoints float64, now, periodEnd time.Time) error {
+	var planName string
+	err := tx.QueryRow(ctx, `
+		SELECT p.name FROM subscriptions sub JOIN plans p ON p.id = sub.plan_id
+		WHERE sub.id = $1`, subscriptionID).Scan(&planName)
+	if err != nil {
+		return err
+	}
+	policy := s.config.RolloverPolicyFor(planName)
+	if policy.Mode == config.RolloverNone {
+		return nil
+	}
+
+	// 只结转仍在宽限期内的积分桶，已过期较久的积分不会因续费而恢复
+	// 流水未关联积分桶的旧订阅积分桶（没有任何流水引用）按同一用户的 subscription 积分桶兜底匹配
+	rows, err := tx.Query(ctx, `
+		SELECT b.id, b.remaining_points FROM balance_buckets b
+		JOIN subscriptions sub ON sub.id = $2 AND sub.user_id = b.user_id
+		WHERE b.bucket_type = $1 AND b.remaining_points > 0
+			AND (b.expires_at IS NULL OR b.expires_at > $3)
+			AND (b.id IN (
+				SELECT bucket_id FROM billing_ledger
+				WHERE bucket_id IS NOT NULL AND (
+					(reason = 'subscription_grant' AND reference_type = 'subscription' AND reference_id = $2)
+					OR (reason = 'plan_change_grant' AND reference_type = 'plan_change'
+						AND reference_id IN (SELECT id FROM plan_changes WHERE subscription_id = $2))
+				)
+			) OR NOT EXISTS (SELECT 1 FROM billing_ledger bl WHERE bl.bucket_id = b.id))
+		ORDER BY b.id
+		FOR UPDATE OF b`, models.BucketSubscription, subscriptionID, now.Add(-s.config.SubscriptionExpiryGrace()))
+	if err != nil {
+		return err
+	}
+	var sources []rolloverSource
+	for rows.Next() {
+		var src rolloverSource
+		if err := rows.Scan(&src.id, &src.remaining); err != nil {
+			rows.Close()
+			return err
+		}
+		sources = append(sources, src)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	plan := planRollover(policy, sources, grantPoints, now, periodEnd)
+	if plan.amount <= 0 {
+		return nil
+	}
+
+	var rolloverID int64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO balance_buckets (user_id, system_code, bucket_type, total_points, remaining_points, expires_at)
+		SELECT user_id, system_code, $1, $2, $2, $3 FROM subscriptions WHERE id = $4
+		RETURNING id`,
+		models.BucketRollover, plan.amount, plan.expiresAt, subscriptionID).Scan(&rolloverID)
+	if err != nil {
+		return err
+	}
+
+	for _, take := range plan.takes {
+		_, err = tx.Exec(ctx, `
+			UPDATE balance_buckets SET remaining_points = remaining_points - $1, updated_at = NOW()
+			WHERE id = $2`, take.remaining, take.id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id)
+			SELECT user_id, system_code, $1, $2, $3, $4, id FROM subscriptions WHERE id = $5`,
+			take.id, -take.remaining, "rollover_out", "subscription", subscriptionID)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id)
+		SELECT user_id, system_code, $1, $2, $3, $4, id FROM subscriptions WHERE id = $5`,
+		rolloverID, plan.amount, "rollover_in", "subscription", subscriptionID)
+	return err
+}
+
+// rolloverSource 可结转的积分桶及其剩余积分
+type rolloverSource struct {
+	id        int64
+	remaining float64
+}
+
+// rolloverPlan 一次结转的积分、新积分桶的过期时间以及从每个积分桶转出的积分
+type rolloverPlan struct {
+	amount    float64
+	expiresAt time.Time
+	takes     []rolloverSource
+}
+
+// planRollover 按结转策略计算结转的积分，按积分桶顺序依次转出
+// rollover 积分桶默认随新周期结束过期，策略设置了 MaxAgeDays 时从结转时起算
+func planRollover(policy config.RolloverPolicy, sources []rolloverSource, grantPoints float64, now, periodEnd time.Time) rolloverPlan {
+	var remaining float64
+	for _, src := range sources {
+		remaining += src.remaining
+	}
+	plan := rolloverPlan{amount: policy.Amount(remaining, grantPoints), expiresAt: periodEnd}
+	if plan.amount <= 0 {
+		plan.amount = 0
+		return plan
+	}
+	if policy.MaxAgeDays > 0 {
+		plan.expiresAt = now.AddDate(0, 0, policy.MaxAgeDays)
+	}
+	left := plan.amount
+	for _, src := range sources {
+		if left <= 0 {
+			break
+		}
+		take := minFloat(src.remaining, left)
+		plan.takes = append(plan.takes, rolloverSource{id: src.id, remaining: take})
+		left -= take
+	}
+	return plan
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"easyusersys/internal/config"
+)
+
+func TestPlanRollover(t *testing.T) {
+	now := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	periodEnd := now.AddDate(0, 1, 0)
+	sources := []rolloverSource{{id: 1, remaining: 30}, {id: 2, remaining: 50}}
+	tests := []struct {
+		name       string
+		policy     config.RolloverPolicy
+		sources    []rolloverSource
+		wantAmount float64
+		wantTakes  []rolloverSource
+		wantExpiry time.Time
+	}{
+		{name: "none", policy: config.RolloverPolicy{Mode: config.RolloverNone}, sources: sources},
+		{name: "no sources", policy: config.RolloverPolicy{Mode: config.RolloverFull}},
+		{
+			name:       "full takes every bucket",
+			policy:     config.RolloverPolicy{Mode: config.RolloverFull},
+			sources:    sources,
+			wantAmount: 80,
+			wantTakes:  []rolloverSource{{id: 1, remaining: 30}, {id: 2, remaining: 50}},
+			wantExpiry: periodEnd,
+		},
+		{
+			name:       "cap points drains buckets in order",
+			policy:     config.RolloverPolicy{Mode: config.RolloverCapPoints, Value: 40},
+			sources:    sources,
+			wantAmount: 40,
+			wantTakes:  []rolloverSource{{id: 1, remaining: 30}, {id: 2, remaining: 10}},
+			wantExpiry: periodEnd,
+		},
+		{
+			name:       "cap percent of grant with max age",
+			policy:     config.RolloverPolicy{Mode: config.RolloverCapPercent, Value: 10, MaxAgeDays: 7},
+			sources:    sources,
+			wantAmount: 20,
+			wantTakes:  []rolloverSource{{id: 1, remaining: 20}},
+			wantExpiry: now.AddDate(0, 0, 7),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := planRollover(tt.policy, tt.sources, 200, now, periodEnd)
+			if got.amount != tt.wantAmount {
+				t.Fatalf("amount = %v, want %v", got.amount, tt.wantAmount)
+			}
+			if len(got.takes) != len(tt.wantTakes) {
+				t.Fatalf("takes = %+v, want %+v", got.takes, tt.wantTakes)
+			}
+			for i := range got.takes {
+				if got.takes[i] != tt.wantTakes[i] {
+					t.Fatalf("takes = %+v, want %+v", got.takes, tt.wantTakes)
+				}
+			}
+			if tt.wantAmount > 0 && !got.expiresAt.Equal(tt.wantExpiry) {
+				t.Fatalf("expiresAt = %v, want %v", got.expiresAt, tt.wantExpiry)
+			}
+		})
+	}
+}
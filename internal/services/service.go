@@ -35,6 +35,11 @@ var (
 	ErrEmailAlreadyExists    = errors.New("email already registered")
 	ErrEmailNotVerified      = errors.New("email not verified")
 	ErrUserDisabled          = errors.New("user account is disabled")
+	ErrReversalExceedsUsage  = errors.New("reversal exceeds reversible points")
+	ErrCouponInvalid         = errors.New("invalid or expired coupon")
+	ErrCouponExhausted       = errors.New("coupon redemption limit reached")
+	ErrTransferDisabled      = errors.New("point transfers are disabled")
+	ErrTransferLimitExceeded = errors.New("transfer limit exceeded")
 )
 
 type Service struct {
@@ -46,6 +51,37 @@ func New(pool *pgxpool.Pool, cfg config.Config) *Service {
 	return &Service{pool: pool, config: cfg}
 }
 
+// txContextKey 在 context 中保存外层事务，使多个服务方法共享同一个事务
+type txContextKey struct{}
+
+// querier 连接池和事务共有的查询方法
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// withTx 返回携带事务的 context，之后通过 begin/db 执行的操作都在该事务内
+func withTx(ctx context.Context, tx pgx.Tx) context.Context {
+	return context.WithValue(ctx, txContextKey{}, tx)
+}
+
+// begin 开启事务；context 已携带外层事务时创建保存点，提交只释放保存点，由外层事务统一提交
+func (s *Service) begin(ctx context.Context) (pgx.Tx, error) {
+	if tx, ok := ctx.Value(txContextKey{}).(pgx.Tx); ok {
+		return tx.Begin(ctx)
+	}
+	return s.pool.Begin(ctx)
+}
+
+// db 返回 context 中的外层事务，没有时返回连接池
+func (s *Service) db(ctx context.Context) querier {
+	if tx, ok := ctx.Value(txContextKey{}).(pgx.Tx); ok {
+		return tx
+	}
+	return s.pool
+}
+
 func (s *Service) EnsureDefaultPlans(ctx context.Context) error {
 	_, err := s.pool.Exec(ctx, `
 		INSERT INTO plans (name, period_days, price_cents, grant_points, active)
@@ -60,7 +96,9 @@ func (s *Service) EnsureDefaultPlans(ctx context.Context) error {
 	return err
 }
 
-func (s *Service) CreateUser(ctx context.Context, systemCode, email, password string) (models.User, error) {
+// CreateUser 创建用户，ref.Code 不为空时记录推荐关系
+// 用户、注册赠送积分和推荐关系在同一事务内写入
+func (s *Service) CreateUser(ctx context.Context, systemCode, email, password string, ref SignupReferral) (models.User, error) {
 	if systemCode == "" || email == "" || password == "" {
 		return models.User{}, ErrInvalidRequest
 	}
@@ -68,8 +106,14 @@ func (s *Service) CreateUser(ctx context.Context, systemCode, email, password st
 	if err != nil {
 		return models.User{}, err
 	}
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return models.User{}, err
+	}
+	defer tx.Rollback(ctx)
+
 	var user models.User
-	err = s.pool.QueryRow(ctx, `
+	err = tx.QueryRow(ctx, `
 		INSERT INTO users (system_code, email, password_hash, status, role)
 		VALUES ($1, $2, $3, $4, $5)
 		RETURNING id, system_code, email, password_hash, google_id, status, role, created_at, updated_at`,
@@ -81,25 +125,39 @@ func (s *Service) CreateUser(ctx context.Context, systemCode, email, password st
 		}
 		return models.User{}, err
 	}
-	if s.config.FreeSignupPoints > 0 {
-		expiresAt := time.Now().UTC().Add(s.config.FreeSignupExpiry())
-		_, err = s.pool.Exec(ctx, `
-			INSERT INTO balance_buckets (user_id, system_code, bucket_type, total_points, remaining_points, expires_at)
-			VALUES ($1, $2, $3, $4, $4, $5)`, user.ID, systemCode, models.BucketFree, s.config.FreeSignupPoints, expiresAt)
-		if err != nil {
-			return models.User{}, err
-		}
-		_, err = s.pool.Exec(ctx, `
-			INSERT INTO billing_ledger (user_id, system_code, delta_points, reason, reference_type)
-			VALUES ($1, $2, $3, $4, $5)`,
-			user.ID, systemCode, s.config.FreeSignupPoints, "signup_bonus", "user")
-		if err != nil {
-			return models.User{}, err
-		}
+	if err := s.grantSignupBonus(ctx, tx, user); err != nil {
+		return models.User{}, err
+	}
+	if err := s.recordReferral(withTx(ctx, tx), user, ref); err != nil {
+		return models.User{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return models.User{}, err
 	}
 	return user, nil
 }
 
+// grantSignupBonus 发放注册赠送的免费积分，流水关联到新建的积分桶
+func (s *Service) grantSignupBonus(ctx context.Context, tx pgx.Tx, user models.User) error {
+	if s.config.FreeSignupPoints <= 0 {
+		return nil
+	}
+	expiresAt := time.Now().UTC().Add(s.config.FreeSignupExpiry())
+	var bucketID int64
+	err := tx.QueryRow(ctx, `
+		INSERT INTO balance_buckets (user_id, system_code, bucket_type, total_points, remaining_points, expires_at)
+		VALUES ($1, $2, $3, $4, $4, $5)
+		RETURNING id`, user.ID, user.SystemCode, models.BucketFree, s.config.FreeSignupPoints, expiresAt).Scan(&bucketID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $1)`,
+		user.ID, user.SystemCode, bucketID, s.config.FreeSignupPoints, "signup_bonus", "user")
+	return err
+}
+
 func (s *Service) GetUserByID(ctx context.Context, id int64) (models.User, error) {
 	var user models.User
 	err := s.pool.QueryRow(ctx, `
@@ -146,42 +204,52 @@ func (s *Service) UpdateUserStatus(ctx context.Context, id int64, status string)
 	return nil
 }
 
-func (s *Service) CreateAPIKey(ctx context.Context, userID int64) (string, models.APIKey, error) {
+// CreateAPIKey 创建 API Key，limits 中为空的字段表示不限制
+func (s *Service) CreateAPIKey(ctx context.Context, userID int64, limits APIKeyLimits) (string, models.APIKey, error) {
 	if userID == 0 {
 		return "", models.APIKey{}, ErrInvalidRequest
 	}
+	if err := limits.validate(); err != nil {
+		return "", models.APIKey{}, err
+	}
 	raw, prefix, hash, err := generateKey()
 	if err != nil {
 		return "", models.APIKey{}, err
 	}
-	var apiKey models.APIKey
-	err = s.pool.QueryRow(ctx, `
-		INSERT INTO api_keys (user_id, system_code, key_hash, key_prefix, status)
-		SELECT id, system_code, $2, $3, $4 FROM users WHERE id = $1
-		RETURNING id, user_id, key_hash, key_prefix, status, created_at, revoked_at`,
+	apiKey, err := scanAPIKey(s.pool.QueryRow(ctx, `
+		INSERT INTO api_keys (user_id, system_code, key_hash, key_prefix, status,
+			daily_points_limit, monthly_points_limit, max_cost_per_request, expires_at, limit_window)
+		SELECT id, system_code, $2, $3, $4, $5, $6, $7, $8, $9 FROM users WHERE id = $1
+		RETURNING `+apiKeyColumns,
 		userID, hash, prefix, models.APIKeyStatusActive,
-	).Scan(&apiKey.ID, &apiKey.UserID, &apiKey.KeyHash, &apiKey.KeyPrefix, &apiKey.Status, &apiKey.CreatedAt, &apiKey.RevokedAt)
+		limits.DailyPointsLimit, limits.MonthlyPointsLimit, limits.MaxCostPerRequest, limits.ExpiresAt, limits.LimitWindow))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", models.APIKey{}, ErrNotFound
+	}
 	if err != nil {
 		return "", models.APIKey{}, err
 	}
 	return raw, apiKey, nil
 }
 
+// ListAPIKeys 列出用户的 API Key，并统计每个 Key 在当前限额窗口内的消耗
 func (s *Service) ListAPIKeys(ctx context.Context, userID int64) ([]models.APIKey, error) {
-	rows, err := s.pool.Query(ctx, `
-		SELECT id, user_id, key_hash, key_prefix, status, created_at, revoked_at
-		FROM api_keys WHERE user_id = $1
-		ORDER BY id DESC`, userID)
+	now := time.Now()
+	calendarDay, calendarMonth := apiKeyWindowStarts(models.APIKeyWindowCalendar, now)
+	rollingDay, rollingMonth := apiKeyWindowStarts(models.APIKeyWindowRolling, now)
+	rows, err := s.pool.Query(ctx, apiKeyListQuery, userID, models.APIKeyWindowRolling, calendarDay, calendarMonth, rollingDay, rollingMonth)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var keys []models.APIKey
 	for rows.Next() {
-		var item models.APIKey
-		if err := rows.Scan(&item.ID, &item.UserID, &item.KeyHash, &item.KeyPrefix, &item.Status, &item.CreatedAt, &item.RevokedAt); err != nil {
+		var daily, monthly float64
+		item, err := scanAPIKey(rows, &daily, &monthly)
+		if err != nil {
 			return nil, err
 		}
+		item.DailySpent, item.MonthlySpent = daily, monthly
 		keys = append(keys, item)
 	}
 	return keys, rows.Err()
@@ -221,7 +289,7 @@ func (s *Service) ListPlans(ctx context.Context) ([]models.Plan, error) {
 
 func (s *Service) GetPlanByID(ctx context.Context, planID int64) (models.Plan, error) {
 	var p models.Plan
-	err := s.pool.QueryRow(ctx, `
+	err := s.db(ctx).QueryRow(ctx, `
 		SELECT id, name, period_days, price_cents, grant_points, active
 		FROM plans WHERE id = $1`, planID).Scan(&p.ID, &p.Name, &p.PeriodDays, &p.PriceCents, &p.GrantPoints, &p.Active)
 	if errors.Is(err, pgx.ErrNoRows) {
@@ -236,14 +304,14 @@ func (s *Service) CreatePendingSubscription(ctx context.Context, userID, planID
 	err := s.pool.QueryRow(ctx, `
 		INSERT INTO subscriptions (user_id, system_code, plan_id, status, started_at, ends_at)
 		SELECT id, system_code, $2, $3, $4, $5 FROM users WHERE id = $1
-		RETURNING id, user_id, plan_id, status, started_at, ends_at, stripe_subscription_id, created_at, updated_at`,
+		RETURNING id, user_id, plan_id, status, started_at, ends_at, stripe_subscription_id, cancel_at_period_end, created_at, updated_at`,
 		userID, planID, models.SubscriptionPending, now, now.Add(time.Duration(periodDays)*24*time.Hour),
-	).Scan(&sub.ID, &sub.UserID, &sub.PlanID, &sub.Status, &sub.StartedAt, &sub.EndsAt, &sub.StripeSubscriptionID, &sub.CreatedAt, &sub.UpdatedAt)
+	).Scan(&sub.ID, &sub.UserID, &sub.PlanID, &sub.Status, &sub.StartedAt, &sub.EndsAt, &sub.StripeSubscriptionID, &sub.CancelAtPeriodEnd, &sub.CreatedAt, &sub.UpdatedAt)
 	return sub, err
 }
 
 func (s *Service) ActivateSubscription(ctx context.Context, subscriptionID int64, stripeSubscriptionID string, grantPoints float64, periodDays int) error {
-	tx, err := s.pool.Begin(ctx)
+	tx, err := s.begin(ctx)
 	if err != nil {
 		return err
 	}
@@ -261,6 +329,9 @@ func (s *Service) ActivateSubscription(ctx context.Context, subscriptionID int64
 	if ct.RowsAffected() == 0 {
 		return ErrNotFound
 	}
+	if err := s.rolloverSubscriptionPoints(ctx, tx, subscriptionID, grantPoints, now, endsAt); err != nil {
+		return err
+	}
 
 	var bucketID int64
 	err = tx.QueryRow(ctx, `
@@ -278,31 +349,48 @@ func (s *Service) ActivateSubscription(ctx context.Context, subscriptionID int64
 	if err != nil {
 		return err
 	}
+	if err := s.settleDebt(ctx, tx, bucketID); err != nil {
+		return err
+	}
 	return tx.Commit(ctx)
 }
 
-func (s *Service) CancelSubscription(ctx context.Context, userID int64) error {
-	ct, err := s.pool.Exec(ctx, `
-		UPDATE subscriptions
-		SET status = $1, updated_at = NOW()
-		WHERE user_id = $2 AND status = $3`, models.SubscriptionCanceled, userID, models.SubscriptionActive)
-	if err != nil {
-		return err
+// CancelSubscription 取消指定订阅
+// atPeriodEnd 为 true 时仅标记为到期取消，用户在 ends_at 之前仍可使用；否则立即取消，ends_at 提前到当前时间
+func (s *Service) CancelSubscription(ctx context.Context, subscriptionID int64, atPeriodEnd bool) (models.Subscription, error) {
+	var sub models.Subscription
+	var err error
+	if atPeriodEnd {
+		err = s.pool.QueryRow(ctx, `
+			UPDATE subscriptions
+			SET cancel_at_period_end = TRUE, updated_at = NOW()
+			WHERE id = $1 AND status IN ($2, $3)
+			RETURNING id, user_id, plan_id, status, started_at, ends_at, stripe_subscription_id, cancel_at_period_end, created_at, updated_at`,
+			subscriptionID, models.SubscriptionActive, models.SubscriptionPastDue,
+		).Scan(&sub.ID, &sub.UserID, &sub.PlanID, &sub.Status, &sub.StartedAt, &sub.EndsAt, &sub.StripeSubscriptionID, &sub.CancelAtPeriodEnd, &sub.CreatedAt, &sub.UpdatedAt)
+	} else {
+		err = s.pool.QueryRow(ctx, `
+			UPDATE subscriptions
+			SET status = $1, ends_at = LEAST(ends_at, NOW()), cancel_at_period_end = FALSE, updated_at = NOW()
+			WHERE id = $2 AND status IN ($3, $4)
+			RETURNING id, user_id, plan_id, status, started_at, ends_at, stripe_subscription_id, cancel_at_period_end, created_at, updated_at`,
+			models.SubscriptionCanceled, subscriptionID, models.SubscriptionActive, models.SubscriptionPastDue,
+		).Scan(&sub.ID, &sub.UserID, &sub.PlanID, &sub.Status, &sub.StartedAt, &sub.EndsAt, &sub.StripeSubscriptionID, &sub.CancelAtPeriodEnd, &sub.CreatedAt, &sub.UpdatedAt)
 	}
-	if ct.RowsAffected() == 0 {
-		return ErrSubscriptionNotActive
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.Subscription{}, ErrSubscriptionNotActive
 	}
-	return nil
+	return sub, err
 }
 
 func (s *Service) GetActiveSubscription(ctx context.Context, userID int64) (models.Subscription, error) {
 	var sub models.Subscription
 	err := s.pool.QueryRow(ctx, `
-		SELECT id, user_id, plan_id, status, started_at, ends_at, stripe_subscription_id, created_at, updated_at
+		SELECT id, user_id, plan_id, status, started_at, ends_at, stripe_subscription_id, cancel_at_period_end, created_at, updated_at
 		FROM subscriptions
 		WHERE user_id = $1 AND status = $2 AND ends_at > NOW()
 		ORDER BY id DESC LIMIT 1`, userID, models.SubscriptionActive,
-	).Scan(&sub.ID, &sub.UserID, &sub.PlanID, &sub.Status, &sub.StartedAt, &sub.EndsAt, &sub.StripeSubscriptionID, &sub.CreatedAt, &sub.UpdatedAt)
+	).Scan(&sub.ID, &sub.UserID, &sub.PlanID, &sub.Status, &sub.StartedAt, &sub.EndsAt, &sub.StripeSubscriptionID, &sub.CancelAtPeriodEnd, &sub.CreatedAt, &sub.UpdatedAt)
 	if errors.Is(err, pgx.ErrNoRows) {
 		return models.Subscription{}, ErrNotFound
 	}
@@ -311,10 +399,10 @@ func (s *Service) GetActiveSubscription(ctx context.Context, userID int64) (mode
 
 func (s *Service) GetSubscriptionByID(ctx context.Context, subscriptionID int64) (models.Subscription, error) {
 	var sub models.Subscription
-	err := s.pool.QueryRow(ctx, `
-		SELECT id, user_id, plan_id, status, started_at, ends_at, stripe_subscription_id, created_at, updated_at
+	err := s.db(ctx).QueryRow(ctx, `
+		SELECT id, user_id, plan_id, status, started_at, ends_at, stripe_subscription_id, cancel_at_period_end, created_at, updated_at
 		FROM subscriptions WHERE id = $1`, subscriptionID,
-	).Scan(&sub.ID, &sub.UserID, &sub.PlanID, &sub.Status, &sub.StartedAt, &sub.EndsAt, &sub.StripeSubscriptionID, &sub.CreatedAt, &sub.UpdatedAt)
+	).Scan(&sub.ID, &sub.UserID, &sub.PlanID, &sub.Status, &sub.StartedAt, &sub.EndsAt, &sub.StripeSubscriptionID, &sub.CancelAtPeriodEnd, &sub.CreatedAt, &sub.UpdatedAt)
 	if errors.Is(err, pgx.ErrNoRows) {
 		return models.Subscription{}, ErrNotFound
 	}
@@ -323,17 +411,18 @@ func (s *Service) GetSubscriptionByID(ctx context.Context, subscriptionID int64)
 
 func (s *Service) GetSubscriptionByStripeID(ctx context.Context, stripeSubscriptionID string) (models.Subscription, error) {
 	var sub models.Subscription
-	err := s.pool.QueryRow(ctx, `
-		SELECT id, user_id, plan_id, status, started_at, ends_at, stripe_subscription_id, created_at, updated_at
+	err := s.db(ctx).QueryRow(ctx, `
+		SELECT id, user_id, plan_id, status, started_at, ends_at, stripe_subscription_id, cancel_at_period_end, created_at, updated_at
 		FROM subscriptions WHERE stripe_subscription_id = $1`, stripeSubscriptionID,
-	).Scan(&sub.ID, &sub.UserID, &sub.PlanID, &sub.Status, &sub.StartedAt, &sub.EndsAt, &sub.StripeSubscriptionID, &sub.CreatedAt, &sub.UpdatedAt)
+	).Scan(&sub.ID, &sub.UserID, &sub.PlanID, &sub.Status, &sub.StartedAt, &sub.EndsAt, &sub.StripeSubscriptionID, &sub.CancelAtPeriodEnd, &sub.CreatedAt, &sub.UpdatedAt)
 	if errors.Is(err, pgx.ErrNoRows) {
 		return models.Subscription{}, ErrNotFound
 	}
 	return sub, err
 }
 
-func (s *Service) ReportUsage(ctx context.Context, userID int64, units int, requestID string) (models.UsageRecord, error) {
+// ReportUsage 上报用量并扣费，apiKey 为调用方使用的原始 API Key，非空时按该 Key 的限额检查
+func (s *Service) ReportUsage(ctx context.Context, userID int64, units int, requestID, apiKey string) (models.UsageRecord, error) {
 	if userID == 0 || units <= 0 || requestID == "" {
 		return models.UsageRecord{}, ErrInvalidRequest
 	}
@@ -344,37 +433,88 @@ func (s *Service) ReportUsage(ctx context.Context, userID int64, units int, requ
 	}
 	defer tx.Rollback(ctx)
 
-	var activeCount int
-	err = tx.QueryRow(ctx, `
-		SELECT COUNT(1)
-		FROM subscriptions
-		WHERE user_id = $1 AND status = $2 AND ends_at > NOW()`,
-		userID, models.SubscriptionActive,
-	).Scan(&activeCount)
+	drawOrder, allowed, err := s.usageBucketPolicy(ctx, tx, userID)
+	if err != nil {
+		return models.UsageRecord{}, err
+	}
+	// 先锁 API Key 再锁积分桶，与批量上报的加锁顺序一致
+	key, err := s.lockUsageAPIKey(ctx, tx, userID, apiKey)
 	if err != nil {
 		return models.UsageRecord{}, err
 	}
-	if activeCount == 0 {
-		return models.UsageRecord{}, ErrSubscriptionRequired
+	var keyID *int64
+	if key != nil {
+		keyID = &key.ID
 	}
 
 	usage := models.UsageRecord{}
 	err = tx.QueryRow(ctx, `
-		INSERT INTO usage_records (user_id, system_code, units, cost_points, request_id)
-		SELECT id, system_code, $2, $3, $4 FROM users WHERE id = $1
-		RETURNING id, user_id, units, cost_points, request_id, recorded_at`,
-		userID, units, costPoints, requestID).Scan(&usage.ID, &usage.UserID, &usage.Units, &usage.CostPoints, &usage.RequestID, &usage.RecordedAt)
+		INSERT INTO usage_records (user_id, system_code, units, cost_points, request_id, api_key_id)
+		SELECT id, system_code, $2, $3, $4, $5 FROM users WHERE id = $1
+		RETURNING id, user_id, units, cost_points, request_id, api_key_id, recorded_at`,
+		userID, units, costPoints, requestID, keyID).Scan(&usage.ID, &usage.UserID, &usage.Units, &usage.CostPoints, &usage.RequestID, &usage.APIKeyID, &usage.RecordedAt)
 	if err != nil {
 		if isUniqueViolation(err) {
 			return models.UsageRecord{}, ErrDuplicateRequest
 		}
 		return models.UsageRecord{}, err
 	}
+	if key != nil {
+		if err := s.checkAPIKeyLimits(ctx, tx, *key, usage.ID, costPoints); err != nil {
+			return models.UsageRecord{}, err
+		}
+	}
 
-	buckets, err := s.lockBuckets(ctx, tx, userID)
+	buckets, err := s.lockBuckets(ctx, tx, userID, drawOrder, allowed)
+	if err != nil {
+		return models.UsageRecord{}, err
+	}
+	before := availablePoints(buckets)
+	remaining, err := s.deductFromBuckets(ctx, tx, buckets, userID, usage.ID, costPoints)
 	if err != nil {
 		return models.UsageRecord{}, err
 	}
+	// 积分不足的部分在信用额度内记为欠款，否则返回 ErrInsufficientPoints
+	if err := s.chargeDebt(ctx, tx, userID, usage.ID, remaining); err != nil {
+		if errors.Is(err, ErrInsufficientPoints) {
+			// 扣费事务会回滚，自动充值单独写入
+			if qErr := s.queueAutoTopUp(ctx, s.pool, userID, autoTopUpBalance(before, costPoints-before)); qErr != nil {
+				return models.UsageRecord{}, qErr
+			}
+		}
+		return models.UsageRecord{}, err
+	}
+	after := availablePoints(buckets)
+	if err := s.queueLowBalanceNotification(ctx, tx, userID, before, after); err != nil {
+		return models.UsageRecord{}, err
+	}
+	if err := s.queueAutoTopUp(ctx, tx, userID, after); err != nil {
+		return models.UsageRecord{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return models.UsageRecord{}, err
+	}
+	return usage, nil
+}
+
+// hasActiveSubscription 检查用户在事务内是否存在有效订阅
+func (s *Service) hasActiveSubscription(ctx context.Context, tx pgx.Tx, userID int64) (bool, error) {
+	var activeCount int
+	err := tx.QueryRow(ctx, `
+		SELECT COUNT(1)
+		FROM subscriptions
+		WHERE user_id = $1 AND status = $2 AND ends_at > NOW()`,
+		userID, models.SubscriptionActive,
+	).Scan(&activeCount)
+	if err != nil {
+		return false, err
+	}
+	return activeCount > 0, nil
+}
+
+// deductFromBuckets 按顺序从已锁定的积分桶中扣减积分并写入流水
+// 会同步更新 buckets 中的剩余积分，返回未能扣减的积分数
+func (s *Service) deductFromBuckets(ctx context.Context, tx pgx.Tx, buckets []models.BalanceBucket, userID, usageID int64, costPoints float64) (float64, error) {
 	remaining := costPoints
 	for i := range buckets {
 		if remaining <= 0 {
@@ -387,47 +527,62 @@ func (s *Service) ReportUsage(ctx context.Context, userID int64, units int, requ
 		toDeduct := minFloat(available, remaining)
 		remaining -= toDeduct
 		newRemaining := available - toDeduct
-		_, err = tx.Exec(ctx, `
+		_, err := tx.Exec(ctx, `
 			UPDATE balance_buckets
 			SET remaining_points = $1, updated_at = NOW()
 			WHERE id = $2`, newRemaining, buckets[i].ID)
 		if err != nil {
-			return models.UsageRecord{}, err
+			return 0, err
 		}
 		_, err = tx.Exec(ctx, `
 			INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id)
 			SELECT id, system_code, $1, $2, $3, $4, $5 FROM users WHERE id = $6`,
-			buckets[i].ID, -toDeduct, "usage_deduction", "usage", usage.ID, userID)
+			buckets[i].ID, -toDeduct, "usage_deduction", "usage", usageID, userID)
 		if err != nil {
-			return models.UsageRecord{}, err
+			return 0, err
 		}
+		buckets[i].RemainingPoints = newRemaining
+	}
+	return remaining, nil
+}
+
+// usageBucketPolicy 根据用户所属系统的用量策略和订阅状态，返回扣减顺序和可扣减的桶类型
+// 可扣减的桶类型为 nil 时表示不限制；不允许扣费时返回 ErrSubscriptionRequired
+func (s *Service) usageBucketPolicy(ctx context.Context, tx pgx.Tx, userID int64) ([]string, []string, error) {
+	var systemCode string
+	err := tx.QueryRow(ctx, `SELECT system_code FROM users WHERE id = $1`, userID).Scan(&systemCode)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, ErrNotFound
 	}
-	if remaining > 0 {
-		return models.UsageRecord{}, ErrInsufficientPoints
+	if err != nil {
+		return nil, nil, err
 	}
-	if err := tx.Commit(ctx); err != nil {
-		return models.UsageRecord{}, err
+	hasSub, err := s.hasActiveSubscription(ctx, tx, userID)
+	if err != nil {
+		return nil, nil, err
 	}
-	return usage, nil
+	policy := s.config.UsagePolicyFor(systemCode)
+	allowed, ok := policy.SpendableBuckets(hasSub)
+	if !ok {
+		return nil, nil, ErrSubscriptionRequired
+	}
+	return policy.DrawOrder, allowed, nil
 }
 
-func (s *Service) lockBuckets(ctx context.Context, tx pgx.Tx, userID int64) ([]models.BalanceBucket, error) {
+// lockBuckets 按扣减顺序锁定用户的可用积分桶，allowed 为 nil 时不限制桶类型
+func (s *Service) lockBuckets(ctx context.Context, tx pgx.Tx, userID int64, drawOrder, allowed []string) ([]models.BalanceBucket, error) {
 	rows, err := tx.Query(ctx, `
 		SELECT id, user_id, bucket_type, total_points, remaining_points, expires_at, created_at, updated_at
 		FROM balance_buckets
 		WHERE user_id = $1
 			AND remaining_points > 0
 			AND (expires_at IS NULL OR expires_at > NOW())
+			AND ($3::text[] IS NULL OR bucket_type = ANY($3::text[]))
 		ORDER BY
-			CASE bucket_type
-				WHEN 'subscription' THEN 1
-				WHEN 'prepaid' THEN 2
-				WHEN 'free' THEN 3
-				ELSE 4
-			END,
+			COALESCE(array_position($2::text[], bucket_type), 2147483647),
 			expires_at NULLS LAST,
 			id
-		FOR UPDATE`, userID)
+		FOR UPDATE`, userID, drawOrder, allowed)
 	if err != nil {
 		return nil, err
 	}
@@ -445,7 +600,7 @@ func (s *Service) lockBuckets(ctx context.Context, tx pgx.Tx, userID int64) ([]m
 
 func (s *Service) ListUsage(ctx context.Context, userID int64, from, to time.Time) ([]models.UsageRecord, error) {
 	rows, err := s.pool.Query(ctx, `
-		SELECT id, user_id, units, cost_points, request_id, recorded_at
+		SELECT id, user_id, units, cost_points, request_id, api_key_id, recorded_at
 		FROM usage_records
 		WHERE user_id = $1 AND recorded_at >= $2 AND recorded_at <= $3
 		ORDER BY recorded_at DESC`, userID, from, to)
@@ -456,7 +611,7 @@ func (s *Service) ListUsage(ctx context.Context, userID int64, from, to time.Tim
 	var records []models.UsageRecord
 	for rows.Next() {
 		var r models.UsageRecord
-		if err := rows.Scan(&r.ID, &r.UserID, &r.Units, &r.CostPoints, &r.RequestID, &r.RecordedAt); err != nil {
+		if err := rows.Scan(&r.ID, &r.UserID, &r.Units, &r.CostPoints, &r.RequestID, &r.APIKeyID, &r.RecordedAt); err != nil {
 			return nil, err
 		}
 		records = append(records, r)
@@ -464,24 +619,21 @@ func (s *Service) ListUsage(ctx context.Context, userID int64, from, to time.Tim
 	return records, rows.Err()
 }
 
-func (s *Service) CreatePrepaidOrder(ctx context.Context, userID int64, amountCents int) (models.Order, error) {
-	if userID == 0 || amountCents <= 0 {
-		return models.Order{}, ErrInvalidRequest
-	}
-	points := float64(amountCents) / 10.0
+// insertPrepaidOrder 创建待支付的预充值订单，expiryDays 为空时到账积分使用全局有效期
+func (s *Service) insertPrepaidOrder(ctx context.Context, userID int64, amountCents int, points float64, packageID *int64, expiryDays *int) (models.Order, error) {
 	var order models.Order
-	err := s.pool.QueryRow(ctx, `
-		INSERT INTO orders (user_id, system_code, order_type, status, amount_cents, points)
-		SELECT id, system_code, $2, $3, $4, $5 FROM users WHERE id = $1
+	err := s.db(ctx).QueryRow(ctx, `
+		INSERT INTO orders (user_id, system_code, order_type, status, amount_cents, points, package_id, points_expiry_days)
+		SELECT id, system_code, $2, $3, $4, $5, $6, $7 FROM users WHERE id = $1
 		RETURNING id, user_id, order_type, status, amount_cents, points, subscription_id,
-			stripe_session_id, stripe_payment_intent_id, stripe_subscription_id, created_at, updated_at`,
-		userID, models.OrderTypePrepaid, models.OrderStatusPending, amountCents, points,
-	).Scan(&order.ID, &order.UserID, &order.OrderType, &order.Status, &order.AmountCents, &order.Points, &order.SubscriptionID, &order.StripeSessionID, &order.StripePaymentIntentID, &order.StripeSubscriptionID, &order.CreatedAt, &order.UpdatedAt)
+			stripe_session_id, stripe_payment_intent_id, stripe_subscription_id, payment_provider, package_id, refunded_cents, disputed_cents, created_at, updated_at`,
+		userID, models.OrderTypePrepaid, models.OrderStatusPending, amountCents, points, packageID, expiryDays,
+	).Scan(&order.ID, &order.UserID, &order.OrderType, &order.Status, &order.AmountCents, &order.Points, &order.SubscriptionID, &order.StripeSessionID, &order.StripePaymentIntentID, &order.StripeSubscriptionID, &order.PaymentProvider, &order.PackageID, &order.RefundedCents, &order.DisputedCents, &order.CreatedAt, &order.UpdatedAt)
 	return order, err
 }
 
 func (s *Service) MarkOrderPaid(ctx context.Context, orderID int64, stripeSessionID, stripePaymentIntentID, stripeSubscriptionID string) (models.Order, error) {
-	tx, err := s.pool.Begin(ctx)
+	tx, err := s.begin(ctx)
 	if err != nil {
 		return models.Order{}, err
 	}
@@ -491,17 +643,37 @@ func (s *Service) MarkOrderPaid(ctx context.Context, orderID int64, stripeSessio
 	err = tx.QueryRow(ctx, `
 		UPDATE orders
 		SET status = $1, stripe_session_id = $2, stripe_payment_intent_id = $3, stripe_subscription_id = $4, updated_at = NOW()
-		WHERE id = $5
+		WHERE id = $5 AND status = $6
 		RETURNING id, user_id, order_type, status, amount_cents, points, subscription_id,
-			stripe_session_id, stripe_payment_intent_id, stripe_subscription_id, created_at, updated_at`,
-		models.OrderStatusPaid, stripeSessionID, stripePaymentIntentID, stripeSubscriptionID, orderID,
-	).Scan(&order.ID, &order.UserID, &order.OrderType, &order.Status, &order.AmountCents, &order.Points, &order.SubscriptionID, &order.StripeSessionID, &order.StripePaymentIntentID, &order.StripeSubscriptionID, &order.CreatedAt, &order.UpdatedAt)
+			stripe_session_id, stripe_payment_intent_id, stripe_subscription_id, payment_provider, package_id, refunded_cents, disputed_cents, created_at, updated_at`,
+		models.OrderStatusPaid, stripeSessionID, stripePaymentIntentID, stripeSubscriptionID, orderID, models.OrderStatusPending,
+	).Scan(&order.ID, &order.UserID, &order.OrderType, &order.Status, &order.AmountCents, &order.Points, &order.SubscriptionID, &order.StripeSessionID, &order.StripePaymentIntentID, &order.StripeSubscriptionID, &order.PaymentProvider, &order.PackageID, &order.RefundedCents, &order.DisputedCents, &order.CreatedAt, &order.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// 订单已处理过（重复回调），直接返回现有订单，不再重复发放积分
+		existing, getErr := s.GetOrder(withTx(ctx, tx), orderID)
+		if getErr != nil {
+			return models.Order{}, getErr
+		}
+		if existing.Status == models.OrderStatusFailed {
+			return models.Order{}, ErrInvalidRequest
+		}
+		return existing, nil
+	}
 	if err != nil {
 		return models.Order{}, err
 	}
 
 	if order.OrderType == models.OrderTypePrepaid {
-		expiresAt := time.Now().UTC().Add(s.config.PrepaidExpiry())
+		// 积分包可以单独设置有效期，下单时已记录在订单上
+		expiry := s.config.PrepaidExpiry()
+		var expiryDays *int
+		if err := tx.QueryRow(ctx, `SELECT points_expiry_days FROM orders WHERE id = $1`, order.ID).Scan(&expiryDays); err != nil {
+			return models.Order{}, err
+		}
+		if expiryDays != nil {
+			expiry = time.Duration(*expiryDays) * 24 * time.Hour
+		}
+		expiresAt := time.Now().UTC().Add(expiry)
 		var bucketID int64
 		err = tx.QueryRow(ctx, `
 			INSERT INTO balance_buckets (user_id, system_code, bucket_type, total_points, remaining_points, expires_at)
@@ -517,6 +689,15 @@ func (s *Service) MarkOrderPaid(ctx context.Context, orderID int64, stripeSessio
 		if err != nil {
 			return models.Order{}, err
 		}
+		if err := s.settleDebt(ctx, tx, bucketID); err != nil {
+			return models.Order{}, err
+		}
+	}
+	if err := s.recordOrderCouponRedemption(ctx, tx, order.ID); err != nil {
+		return models.Order{}, err
+	}
+	if err := s.rewardReferral(ctx, tx, order); err != nil {
+		return models.Order{}, err
 	}
 	if err := tx.Commit(ctx); err != nil {
 		return models.Order{}, err
@@ -526,11 +707,11 @@ func (s *Service) MarkOrderPaid(ctx context.Context, orderID int64, stripeSessio
 
 func (s *Service) GetOrder(ctx context.Context, orderID int64) (models.Order, error) {
 	var order models.Order
-	err := s.pool.QueryRow(ctx, `
+	err := s.db(ctx).QueryRow(ctx, `
 		SELECT id, user_id, order_type, status, amount_cents, points, subscription_id,
-			stripe_session_id, stripe_payment_intent_id, stripe_subscription_id, created_at, updated_at
+			stripe_session_id, stripe_payment_intent_id, stripe_subscription_id, payment_provider, package_id, refunded_cents, disputed_cents, created_at, updated_at
 		FROM orders WHERE id = $1`, orderID,
-	).Scan(&order.ID, &order.UserID, &order.OrderType, &order.Status, &order.AmountCents, &order.Points, &order.SubscriptionID, &order.StripeSessionID, &order.StripePaymentIntentID, &order.StripeSubscriptionID, &order.CreatedAt, &order.UpdatedAt)
+	).Scan(&order.ID, &order.UserID, &order.OrderType, &order.Status, &order.AmountCents, &order.Points, &order.SubscriptionID, &order.StripeSessionID, &order.StripePaymentIntentID, &order.StripeSubscriptionID, &order.PaymentProvider, &order.PackageID, &order.RefundedCents, &order.DisputedCents, &order.CreatedAt, &order.UpdatedAt)
 	if errors.Is(err, pgx.ErrNoRows) {
 		return models.Order{}, ErrNotFound
 	}
@@ -595,18 +776,33 @@ func minFloat(a, b float64) float64 {
 	return b
 }
 
+// GrantSubscriptionPoints 发放订阅积分，积分桶和流水在同一事务内写入
 func (s *Service) GrantSubscriptionPoints(ctx context.Context, userID int64, points float64, expiresAt time.Time, subscriptionID int64) error {
-	_, err := s.pool.Exec(ctx, `
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var bucketID int64
+	err = tx.QueryRow(ctx, `
 		INSERT INTO balance_buckets (user_id, system_code, bucket_type, total_points, remaining_points, expires_at)
-		SELECT id, system_code, $2, $3, $3, $4 FROM users WHERE id = $1`, userID, models.BucketSubscription, points, expiresAt)
+		SELECT id, system_code, $2, $3, $3, $4 FROM users WHERE id = $1
+		RETURNING id`, userID, models.BucketSubscription, points, expiresAt).Scan(&bucketID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
 	if err != nil {
 		return err
 	}
-	_, err = s.pool.Exec(ctx, `
-		INSERT INTO billing_ledger (user_id, system_code, delta_points, reason, reference_type, reference_id)
-		SELECT id, system_code, $2, $3, $4, $5 FROM users WHERE id = $1`,
-		userID, points, "subscription_grant", "subscription", subscriptionID)
-	return err
+	_, err = tx.Exec(ctx, `
+		INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id)
+		SELECT id, system_code, $2, $3, $4, $5, $6 FROM users WHERE id = $1`,
+		userID, bucketID, points, "subscription_grant", "subscription", subscriptionID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
 }
 
 func (s *Service) UpdateSubscriptionFromStripe(ctx context.Context, subscriptionID int64, stripeSubscriptionID string, periodDays int, grantPoints float64) error {
@@ -644,27 +840,30 @@ func (s *Service) CreateSubscriptionOrder(ctx context.Context, userID int64, sub
 		INSERT INTO orders (user_id, system_code, order_type, status, amount_cents, points, subscription_id)
 		SELECT id, system_code, $2, $3, $4, $5, $6 FROM users WHERE id = $1
 		RETURNING id, user_id, order_type, status, amount_cents, points, subscription_id,
-			stripe_session_id, stripe_payment_intent_id, stripe_subscription_id, created_at, updated_at`,
+			stripe_session_id, stripe_payment_intent_id, stripe_subscription_id, payment_provider, package_id, refunded_cents, disputed_cents, created_at, updated_at`,
 		userID, models.OrderTypeSubscription, models.OrderStatusPending, amountCents, points, subscriptionID,
-	).Scan(&order.ID, &order.UserID, &order.OrderType, &order.Status, &order.AmountCents, &order.Points, &order.SubscriptionID, &order.StripeSessionID, &order.StripePaymentIntentID, &order.StripeSubscriptionID, &order.CreatedAt, &order.UpdatedAt)
+	).Scan(&order.ID, &order.UserID, &order.OrderType, &order.Status, &order.AmountCents, &order.Points, &order.SubscriptionID, &order.StripeSessionID, &order.StripePaymentIntentID, &order.StripeSubscriptionID, &order.PaymentProvider, &order.PackageID, &order.RefundedCents, &order.DisputedCents, &order.CreatedAt, &order.UpdatedAt)
 	return order, err
 }
 
 func (s *Service) GetOrderByStripeSessionID(ctx context.Context, sessionID string) (models.Order, error) {
 	var order models.Order
-	err := s.pool.QueryRow(ctx, `
+	err := s.db(ctx).QueryRow(ctx, `
 		SELECT id, user_id, order_type, status, amount_cents, points, subscription_id,
-			stripe_session_id, stripe_payment_intent_id, stripe_subscription_id, created_at, updated_at
+			stripe_session_id, stripe_payment_intent_id, stripe_subscription_id, payment_provider, package_id, refunded_cents, disputed_cents, created_at, updated_at
 		FROM orders WHERE stripe_session_id = $1`, sessionID,
-	).Scan(&order.ID, &order.UserID, &order.OrderType, &order.Status, &order.AmountCents, &order.Points, &order.SubscriptionID, &order.StripeSessionID, &order.StripePaymentIntentID, &order.StripeSubscriptionID, &order.CreatedAt, &order.UpdatedAt)
+	).Scan(&order.ID, &order.UserID, &order.OrderType, &order.Status, &order.AmountCents, &order.Points, &order.SubscriptionID, &order.StripeSessionID, &order.StripePaymentIntentID, &order.StripeSubscriptionID, &order.PaymentProvider, &order.PackageID, &order.RefundedCents, &order.DisputedCents, &order.CreatedAt, &order.UpdatedAt)
 	if errors.Is(err, pgx.ErrNoRows) {
 		return models.Order{}, ErrNotFound
 	}
 	return order, err
 }
 
-func (s *Service) LinkOrderSession(ctx context.Context, orderID int64, sessionID string) error {
-	ct, err := s.pool.Exec(ctx, `UPDATE orders SET stripe_session_id = $1, updated_at = NOW() WHERE id = $2`, sessionID, orderID)
+// LinkOrderSession 关联结账会话，provider 为空表示主支付平台
+func (s *Service) LinkOrderSession(ctx context.Context, orderID int64, sessionID, provider string) error {
+	ct, err := s.pool.Exec(ctx, `
+		UPDATE orders SET stripe_session_id = $1, payment_provider = NULLIF($2, ''), updated_at = NOW()
+		WHERE id = $3`, sessionID, provider, orderID)
 	if err != nil {
 		return err
 	}
@@ -674,6 +873,32 @@ func (s *Service) LinkOrderSession(ctx context.Context, orderID int64, sessionID
 	return nil
 }
 
+// ListPendingProviderOrders 列出指定支付平台上已创建结账、超过 minAge 仍未支付的订单（最近一天内），供状态轮询使用
+func (s *Service) ListPendingProviderOrders(ctx context.Context, provider string, minAge time.Duration, limit int) ([]models.Order, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT id, user_id, order_type, status, amount_cents, points, subscription_id,
+			stripe_session_id, stripe_payment_intent_id, stripe_subscription_id, payment_provider, package_id, refunded_cents, disputed_cents, created_at, updated_at
+		FROM orders
+		WHERE payment_provider = $1 AND status = $2 AND stripe_session_id IS NOT NULL
+			AND created_at < $3 AND created_at > $4
+		ORDER BY created_at
+		LIMIT $5`,
+		provider, models.OrderStatusPending, time.Now().UTC().Add(-minAge), time.Now().UTC().Add(-24*time.Hour), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var orders []models.Order
+	for rows.Next() {
+		var order models.Order
+		if err := rows.Scan(&order.ID, &order.UserID, &order.OrderType, &order.Status, &order.AmountCents, &order.Points, &order.SubscriptionID, &order.StripeSessionID, &order.StripePaymentIntentID, &order.StripeSubscriptionID, &order.PaymentProvider, &order.PackageID, &order.RefundedCents, &order.DisputedCents, &order.CreatedAt, &order.UpdatedAt); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
 func (s *Service) StringifyPoints(points float64) string {
 	return fmt.Sprintf("%.2f", points)
 }
@@ -845,7 +1070,7 @@ func (s *Service) ListUsersWithOptions(ctx context.Context, opts ListUsersOption
 // GetUserSubscriptions 获取用户的所有订阅记录
 func (s *Service) GetUserSubscriptions(ctx context.Context, userID int64) ([]models.Subscription, error) {
 	rows, err := s.pool.Query(ctx, `
-		SELECT id, user_id, plan_id, status, started_at, ends_at, stripe_subscription_id, created_at, updated_at
+		SELECT id, user_id, plan_id, status, started_at, ends_at, stripe_subscription_id, cancel_at_period_end, created_at, updated_at
 		FROM subscriptions
 		WHERE user_id = $1
 		ORDER BY id DESC`, userID)
@@ -857,7 +1082,7 @@ func (s *Service) GetUserSubscriptions(ctx context.Context, userID int64) ([]mod
 	var subs []models.Subscription
 	for rows.Next() {
 		var sub models.Subscription
-		if err := rows.Scan(&sub.ID, &sub.UserID, &sub.PlanID, &sub.Status, &sub.StartedAt, &sub.EndsAt, &sub.StripeSubscriptionID, &sub.CreatedAt, &sub.UpdatedAt); err != nil {
+		if err := rows.Scan(&sub.ID, &sub.UserID, &sub.PlanID, &sub.Status, &sub.StartedAt, &sub.EndsAt, &sub.StripeSubscriptionID, &sub.CancelAtPeriodEnd, &sub.CreatedAt, &sub.UpdatedAt); err != nil {
 			return nil, err
 		}
 		subs = append(subs, sub)
@@ -970,11 +1195,9 @@ func (s *Service) GetStats(ctx context.Context, from, to time.Time, systemCode s
 
 // GetAPIKeyByID 根据 ID 获取 API Key
 func (s *Service) GetAPIKeyByID(ctx context.Context, id int64) (models.APIKey, error) {
-	var apiKey models.APIKey
-	err := s.pool.QueryRow(ctx, `
-		SELECT id, user_id, key_hash, key_prefix, status, created_at, revoked_at
-		FROM api_keys WHERE id = $1`, id,
-	).Scan(&apiKey.ID, &apiKey.UserID, &apiKey.KeyHash, &apiKey.KeyPrefix, &apiKey.Status, &apiKey.CreatedAt, &apiKey.RevokedAt)
+	apiKey, err := scanAPIKey(s.pool.QueryRow(ctx, `
+		SELECT `+apiKeyColumns+`
+		FROM api_keys WHERE id = $1`, id))
 	if errors.Is(err, pgx.ErrNoRows) {
 		return models.APIKey{}, ErrNotFound
 	}
@@ -983,7 +1206,7 @@ func (s *Service) GetAPIKeyByID(ctx context.Context, id int64) (models.APIKey, e
 
 // GetOrCreateUserByGoogleID 通过 Google ID 获取或创建用户
 // 首次登录时会自动创建用户并赠送免费积分
-func (s *Service) GetOrCreateUserByGoogleID(ctx context.Context, systemCode, googleID, email string) (models.User, bool, error) {
+func (s *Service) GetOrCreateUserByGoogleID(ctx context.Context, systemCode, googleID, email string, ref SignupReferral) (models.User, bool, error) {
 	if systemCode == "" || googleID == "" || email == "" {
 		return models.User{}, false, ErrInvalidRequest
 	}
@@ -1022,9 +1245,15 @@ func (s *Service) GetOrCreateUserByGoogleID(ctx context.Context, systemCode, goo
 		return models.User{}, false, err
 	}
 
-	// 用户不存在，创建新用户
+	// 用户不存在，创建新用户，与注册赠送积分、推荐关系在同一事务内写入
 	// 注意：Google OAuth 用户没有密码，但 password_hash 是 NOT NULL，所以使用空字符串
-	err = s.pool.QueryRow(ctx, `
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return models.User{}, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, `
 		INSERT INTO users (system_code, email, password_hash, google_id, status, role)
 		VALUES ($1, $2, $3, $4, $5, $6)
 		RETURNING id, system_code, email, password_hash, google_id, status, role, created_at, updated_at`,
@@ -1035,21 +1264,14 @@ func (s *Service) GetOrCreateUserByGoogleID(ctx context.Context, systemCode, goo
 	}
 
 	// 赠送免费积分
-	if s.config.FreeSignupPoints > 0 {
-		expiresAt := time.Now().UTC().Add(s.config.FreeSignupExpiry())
-		_, err = s.pool.Exec(ctx, `
-			INSERT INTO balance_buckets (user_id, bucket_type, total_points, remaining_points, expires_at)
-			VALUES ($1, $2, $3, $3, $4)`, user.ID, models.BucketFree, s.config.FreeSignupPoints, expiresAt)
-		if err != nil {
-			return models.User{}, false, err
-		}
-		_, err = s.pool.Exec(ctx, `
-			INSERT INTO billing_ledger (user_id, delta_points, reason, reference_type)
-			VALUES ($1, $2, $3, $4)`,
-			user.ID, s.config.FreeSignupPoints, "signup_bonus", "user")
-		if err != nil {
-			return models.User{}, false, err
-		}
+	if err := s.grantSignupBonus(ctx, tx, user); err != nil {
+		return models.User{}, false, err
+	}
+	if err := s.recordReferral(withTx(ctx, tx), user, ref); err != nil {
+		return models.User{}, false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return models.User{}, false, err
 	}
 
 	return user, true, nil
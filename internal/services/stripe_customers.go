@@ -0,0 +1,38 @@
+package services
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// GetStripeCustomerID 获取用户已关联的 Stripe Customer ID，未关联时返回 ErrNotFound
+func (s *Service) GetStripeCustomerID(ctx context.Context, userID int64) (string, error) {
+	var customerID string
+	err := s.db(ctx).QueryRow(ctx, `
+		SELECT customer_id FROM stripe_customers WHERE user_id = $1`, userID).Scan(&customerID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return customerID, err
+}
+
+// SaveStripeCustomerID 关联用户与 Stripe Customer，用户已有关联时保留原值并返回已有的 Customer ID
+// Customer 已关联到其他用户时不做修改，用户也没有关联时返回 ErrNotFound
+func (s *Service) SaveStripeCustomerID(ctx context.Context, userID int64, customerID string) (string, error) {
+	if userID == 0 || customerID == "" {
+		return "", ErrInvalidRequest
+	}
+	var saved string
+	err := s.db(ctx).QueryRow(ctx, `
+		INSERT INTO stripe_customers (user_id, system_code, customer_id)
+		SELECT id, system_code, $2 FROM users WHERE id = $1
+		ON CONFLICT DO NOTHING
+		RETURNING customer_id`, userID, customerID).Scan(&saved)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// 用户已有关联、Customer 已被占用或用户不存在
+		return s.GetStripeCustomerID(ctx, userID)
+	}
+	return saved, err
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"context"
+	"errors"
+
+	"easyusersys/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const stripeEventColumns = `id, event_type, payload, status, attempts, last_error, processed_at, created_at, updated_at`
+
+// ProcessStripeEvent 记录并处理一个 Stripe 事件，同一事件 ID 只会成功处理一次
+// handle 收到的 context 携带事件事务，其中调用的服务方法与事件状态在同一事务中提交；
+// handle 返回错误时回滚其全部修改，事件标记为 failed 并记录错误，返回 false 表示本次未执行处理
+func (s *Service) ProcessStripeEvent(ctx context.Context, eventID, eventType string, payload []byte, handle func(ctx context.Context) error) (bool, error) {
+	if eventID == "" || eventType == "" {
+		return false, ErrInvalidRequest
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO stripe_events (id, event_type, payload, status)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO NOTHING`, eventID, eventType, payload, models.StripeEventPending)
+	if err != nil {
+		return false, err
+	}
+	// 并发投递的同一事件在这里排队，前一个提交后再检查状态
+	var status string
+	err = tx.QueryRow(ctx, `SELECT status FROM stripe_events WHERE id = $1 FOR UPDATE`, eventID).Scan(&status)
+	if err != nil {
+		return false, err
+	}
+	if status == models.StripeEventProcessed {
+		return false, tx.Commit(ctx)
+	}
+
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	if handleErr := handle(withTx(ctx, sp)); handleErr != nil {
+		if err := sp.Rollback(ctx); err != nil {
+			return false, err
+		}
+		_, err = tx.Exec(ctx, `
+			UPDATE stripe_events
+			SET status = $1, attempts = attempts + 1, last_error = $2, updated_at = NOW()
+			WHERE id = $3`, models.StripeEventFailed, handleErr.Error(), eventID)
+		if err != nil {
+			return false, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return false, err
+		}
+		return false, handleErr
+	}
+	if err := sp.Commit(ctx); err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE stripe_events
+		SET status = $1, attempts = attempts + 1, last_error = NULL, processed_at = NOW(), updated_at = NOW()
+		WHERE id = $2`, models.StripeEventProcessed, eventID)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetStripeEvent 获取已记录的 Stripe 事件
+func (s *Service) GetStripeEvent(ctx context.Context, eventID string) (models.StripeEvent, error) {
+	event, err := scanStripeEvent(s.pool.QueryRow(ctx, `
+		SELECT `+stripeEventColumns+` FROM stripe_events WHERE id = $1`, eventID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.StripeEvent{}, ErrNotFound
+	}
+	return event, err
+}
+
+// ListStripeEvents 分页列出 Stripe 事件，status 为空表示全部
+func (s *Service) ListStripeEvents(ctx context.Context, status string, page, pageSize int) ([]models.StripeEvent, int64, error) {
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 {
+		pageSize = 20
+	}
+	var total int64
+	err := s.pool.QueryRow(ctx, `
+		SELECT COUNT(*) FROM stripe_events WHERE ($1 = '' OR status = $1)`, status).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := s.pool.Query(ctx, `
+		SELECT `+stripeEventColumns+` FROM stripe_events
+		WHERE ($1 = '' OR status = $1)
+		ORDER BY created_at DESC
+		LIMIT $2 OFFSET $3`, status, pageSize, (page-1)*pageSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	events := []models.StripeEvent{}
+	for rows.Next() {
+		event, err := scanStripeEvent(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		events = append(events, event)
+	}
+	return events, total, rows.Err()
+}
+
+func scanStripeEvent(row pgx.Row) (models.StripeEvent, error) {
+	var e models.StripeEvent
+	var payload []byte
+	err := row.Scan(&e.ID, &e.EventType, &payload, &e.Status, &e.Attempts, &e.LastError, &e.ProcessedAt, &e.CreatedAt, &e.UpdatedAt)
+	e.Payload = payload
+	return e, err
+}
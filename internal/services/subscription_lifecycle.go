@@ -0,0 +1,168 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"easyusersys/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// StripeSubscriptionUpdate Stripe 订阅变更同步到本地的内容
+type StripeSubscriptionUpdate struct {
+	Status   string     // 本地订阅状态，为空表示不修改
+	PlanName string     // Stripe 价格对应的计划名称，为空表示不修改
+	EndedAt  *time.Time // 订阅终止时间，仅在取消或过期时使用
+	// CancelAtPeriodEnd Stripe 侧是否已设置到期取消（例如用户在 Stripe 页面取消），为空表示不修改
+	CancelAtPeriodEnd *bool
+}
+
+// SyncStripeSubscription 将 Stripe 订阅的状态和计划同步到本地订阅
+// 续费周期由 invoice.paid 通过 ActivateSubscription 延长，这里不会延后 ends_at，
+// 订阅进入 canceled/expired 时 ends_at 最多提前到 EndedAt，并将该订阅未支付的订单标记为失败
+func (s *Service) SyncStripeSubscription(ctx context.Context, stripeSubscriptionID string, update StripeSubscriptionUpdate) error {
+	if stripeSubscriptionID == "" {
+		return ErrInvalidRequest
+	}
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var subID, planID int64
+	var status string
+	err = tx.QueryRow(ctx, `
+		SELECT id, plan_id, status FROM subscriptions
+		WHERE stripe_subscription_id = $1
+		FOR UPDATE`, stripeSubscriptionID).Scan(&subID, &planID, &status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if update.PlanName != "" {
+		var newPlanID int64
+		err = tx.QueryRow(ctx, `SELECT id FROM plans WHERE name = $1`, update.PlanName).Scan(&newPlanID)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+		if newPlanID != 0 {
+			planID = newPlanID
+		}
+	}
+	if update.Status != "" {
+		status = update.Status
+	}
+	terminal := status == models.SubscriptionCanceled || status == models.SubscriptionExpired
+	var endedAt *time.Time
+	if terminal {
+		endedAt = update.EndedAt
+		if endedAt == nil {
+			now := time.Now().UTC()
+			endedAt = &now
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE subscriptions
+		SET status = $1, plan_id = $2, ends_at = LEAST(ends_at, COALESCE($3, ends_at)),
+			cancel_at_period_end = COALESCE($4, cancel_at_period_end), updated_at = NOW()
+		WHERE id = $5`, status, planID, endedAt, update.CancelAtPeriodEnd, subID)
+	if err != nil {
+		return err
+	}
+	if terminal {
+		if err := failPendingSubscriptionOrders(ctx, tx, subID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// MarkSubscriptionPaymentFailed 处理续费扣款失败：生效中的订阅转为 past_due，未支付的订单标记为失败
+func (s *Service) MarkSubscriptionPaymentFailed(ctx context.Context, stripeSubscriptionID string) error {
+	if stripeSubscriptionID == "" {
+		return ErrInvalidRequest
+	}
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var subID int64
+	err = tx.QueryRow(ctx, `
+		SELECT id FROM subscriptions
+		WHERE stripe_subscription_id = $1
+		FOR UPDATE`, stripeSubscriptionID).Scan(&subID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE subscriptions SET status = $1, updated_at = NOW()
+		WHERE id = $2 AND status = $3`, models.SubscriptionPastDue, subID, models.SubscriptionActive)
+	if err != nil {
+		return err
+	}
+	if err := failPendingSubscriptionOrders(ctx, tx, subID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// FailPendingOrder 将未支付的订单标记为失败（如 Checkout 会话过期）并释放预留的优惠码，订阅订单对应的待支付订阅同时标记为过期
+// 订单已不是 pending 状态时不做任何修改
+func (s *Service) FailPendingOrder(ctx context.Context, orderID int64) error {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var subscriptionID *int64
+	err = tx.QueryRow(ctx, `
+		UPDATE orders SET status = $1, updated_at = NOW()
+		WHERE id = $2 AND status = $3
+		RETURNING subscription_id`, models.OrderStatusFailed, orderID, models.OrderStatusPending).Scan(&subscriptionID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := releaseOrderCoupons(ctx, tx, []int64{orderID}); err != nil {
+		return err
+	}
+	if subscriptionID != nil {
+		_, err = tx.Exec(ctx, `
+			UPDATE subscriptions SET status = $1, updated_at = NOW()
+			WHERE id = $2 AND status = $3`, models.SubscriptionExpired, *subscriptionID, models.SubscriptionPending)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func failPendingSubscriptionOrders(ctx context.Context, tx pgx.Tx, subscriptionID int64) error {
+	rows, err := tx.Query(ctx, `
+		UPDATE orders SET status = $1, updated_at = NOW()
+		WHERE subscription_id = $2 AND status = $3
+		RETURNING id`, models.OrderStatusFailed, subscriptionID, models.OrderStatusPending)
+	if err != nil {
+		return err
+	}
+	orderIDs, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return err
+	}
+	return releaseOrderCoupons(ctx, tx, orderIDs)
+}
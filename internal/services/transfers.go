@@ -0,0 +1,294 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"easyusersys/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// defaultTransferBucketTypes 未配置时允许转出的积分桶类型
+var defaultTransferBucketTypes = []string{models.BucketPrepaid}
+
+// TransferInput 积分转赠参数，接收人通过 RecipientID 或 RecipientEmail 指定
+type TransferInput struct {
+	SenderID       int64
+	RecipientID    int64
+	RecipientEmail string
+	Points         float64
+	TransferKey    string // 幂等键，同一发送人重复提交返回已有转赠
+	Note           string
+}
+
+// TransferResult 积分转赠结果，接收人按转出的积分桶逐一获得新积分桶（保留原类型和过期时间）
+type TransferResult struct {
+	Transfer         models.PointTransfer   `json:"transfer"`
+	RecipientBuckets []models.BalanceBucket `json:"recipient_buckets"`
+}
+
+// GetTransferSettings 获取系统的积分转赠设置，未配置时返回默认设置
+func (s *Service) GetTransferSettings(ctx context.Context, systemCode string) (models.TransferSettings, error) {
+	return scanTransferSettings(s.pool.QueryRow(ctx, `
+		SELECT system_code, enabled, min_points, max_points_per_transfer, daily_limit_points, bucket_types, updated_at
+		FROM transfer_settings WHERE system_code = $1`, systemCode), systemCode)
+}
+
+// scanTransferSettings 读取转赠设置，没有记录时返回默认设置
+func scanTransferSettings(row pgx.Row, systemCode string) (models.TransferSettings, error) {
+	var ts models.TransferSettings
+	err := row.Scan(&ts.SystemCode, &ts.Enabled, &ts.MinPoints, &ts.MaxPointsPerTransfer, &ts.DailyLimitPoints, &ts.BucketTypes, &ts.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.TransferSettings{
+			SystemCode:  systemCode,
+			Enabled:     true,
+			BucketTypes: defaultTransferBucketTypes,
+		}, nil
+	}
+	return ts, err
+}
+
+// SetTransferSettings 更新系统的积分转赠设置
+func (s *Service) SetTransferSettings(ctx context.Context, ts models.TransferSettings) (models.TransferSettings, error) {
+	if ts.SystemCode == "" || ts.MinPoints < 0 || ts.MaxPointsPerTransfer < 0 || ts.DailyLimitPoints < 0 {
+		return models.TransferSettings{}, ErrInvalidRequest
+	}
+	if len(ts.BucketTypes) == 0 {
+		ts.BucketTypes = defaultTransferBucketTypes
+	}
+	for _, t := range ts.BucketTypes {
+		if !grantableBucketTypes[t] {
+			return models.TransferSettings{}, ErrInvalidRequest
+		}
+	}
+	return scanTransferSettings(s.pool.QueryRow(ctx, `
+		INSERT INTO transfer_settings (system_code, enabled, min_points, max_points_per_transfer, daily_limit_points, bucket_types)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (system_code) DO UPDATE SET
+			enabled = EXCLUDED.enabled,
+			min_points = EXCLUDED.min_points,
+			max_points_per_transfer = EXCLUDED.max_points_per_transfer,
+			daily_limit_points = EXCLUDED.daily_limit_points,
+			bucket_types = EXCLUDED.bucket_types,
+			updated_at = NOW()
+		RETURNING system_code, enabled, min_points, max_points_per_transfer, daily_limit_points, bucket_types, updated_at`,
+		ts.SystemCode, ts.Enabled, ts.MinPoints, ts.MaxPointsPerTransfer, ts.DailyLimitPoints, ts.BucketTypes), ts.SystemCode)
+}
+
+// TransferPoints 在同一系统的用户之间转赠积分
+// 发送人的积分桶按扣减顺序锁定并扣减，接收人按每个被扣减的积分桶获得同类型、同过期时间的新积分桶
+// 返回的 bool 表示是否为已存在的转赠（幂等重放）
+func (s *Service) TransferPoints(ctx context.Context, in TransferInput) (TransferResult, bool, error) {
+	if in.SenderID == 0 || (in.RecipientID == 0 && in.RecipientEmail == "") || in.Points <= 0 || in.TransferKey == "" {
+		return TransferResult{}, false, ErrInvalidRequest
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return TransferResult{}, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var systemCode string
+	err = tx.QueryRow(ctx, `SELECT system_code FROM users WHERE id = $1`, in.SenderID).Scan(&systemCode)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return TransferResult{}, false, ErrNotFound
+	}
+	if err != nil {
+		return TransferResult{}, false, err
+	}
+
+	existing, err := scanTransfer(tx.QueryRow(ctx, `
+		SELECT id, system_code, sender_id, recipient_id, points, transfer_key, note, created_at
+		FROM point_transfers WHERE sender_id = $1 AND transfer_key = $2`, in.SenderID, in.TransferKey))
+	if err == nil {
+		buckets, err := s.transferRecipientBuckets(ctx, tx, existing.ID)
+		if err != nil {
+			return TransferResult{}, false, err
+		}
+		return TransferResult{Transfer: existing, RecipientBuckets: buckets}, true, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return TransferResult{}, false, err
+	}
+
+	// 接收人必须与发送人属于同一系统且状态正常
+	var recipientID int64
+	var recipientStatus string
+	err = tx.QueryRow(ctx, `
+		SELECT id, status FROM users
+		WHERE system_code = $1 AND (id = $2 OR ($2 = 0 AND email = $3))`,
+		systemCode, in.RecipientID, strings.TrimSpace(in.RecipientEmail)).Scan(&recipientID, &recipientStatus)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return TransferResult{}, false, ErrNotFound
+	}
+	if err != nil {
+		return TransferResult{}, false, err
+	}
+	if recipientID == in.SenderID || recipientStatus != models.UserStatusActive {
+		return TransferResult{}, false, ErrInvalidRequest
+	}
+
+	settings, err := scanTransferSettings(tx.QueryRow(ctx, `
+		SELECT system_code, enabled, min_points, max_points_per_transfer, daily_limit_points, bucket_types, updated_at
+		FROM transfer_settings WHERE system_code = $1`, systemCode), systemCode)
+	if err != nil {
+		return TransferResult{}, false, err
+	}
+	if !settings.Enabled {
+		return TransferResult{}, false, ErrTransferDisabled
+	}
+	if in.Points < settings.MinPoints || (settings.MaxPointsPerTransfer > 0 && in.Points > settings.MaxPointsPerTransfer) {
+		return TransferResult{}, false, ErrTransferLimitExceeded
+	}
+
+	// 锁定发送人的可转出积分桶，同时串行化同一发送人的并发转赠
+	buckets, err := s.lockBuckets(ctx, tx, in.SenderID, s.config.UsagePolicyFor(systemCode).DrawOrder, settings.BucketTypes)
+	if err != nil {
+		return TransferResult{}, false, err
+	}
+	if settings.DailyLimitPoints > 0 {
+		var sent float64
+		err = tx.QueryRow(ctx, `
+			SELECT COALESCE(SUM(points), 0) FROM point_transfers
+			WHERE sender_id = $1 AND created_at > NOW() - INTERVAL '24 hours'`, in.SenderID).Scan(&sent)
+		if err != nil {
+			return TransferResult{}, false, err
+		}
+		if sent+in.Points > settings.DailyLimitPoints {
+			return TransferResult{}, false, ErrTransferLimitExceeded
+		}
+	}
+	if availablePoints(buckets) < in.Points {
+		return TransferResult{}, false, ErrInsufficientPoints
+	}
+
+	note, ledgerNote := transferNotes(in.Note)
+	transfer, err := scanTransfer(tx.QueryRow(ctx, `
+		INSERT INTO point_transfers (system_code, sender_id, recipient_id, points, transfer_key, note)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, system_code, sender_id, recipient_id, points, transfer_key, note, created_at`,
+		systemCode, in.SenderID, recipientID, in.Points, in.TransferKey, note))
+	if err != nil {
+		if isUniqueViolation(err) {
+			return TransferResult{}, false, ErrDuplicateRequest
+		}
+		return TransferResult{}, false, err
+	}
+
+	remaining := in.Points
+	var recipientBuckets []models.BalanceBucket
+	for _, b := range buckets {
+		if remaining <= 0 {
+			break
+		}
+		amount := minFloat(b.RemainingPoints, remaining)
+		remaining -= amount
+		_, err = tx.Exec(ctx, `
+			UPDATE balance_buckets SET remaining_points = remaining_points - $1, updated_at = NOW()
+			WHERE id = $2`, amount, b.ID)
+		if err != nil {
+			return TransferResult{}, false, err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id, note)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			in.SenderID, systemCode, b.ID, -amount, "transfer_out", "transfer", transfer.ID, ledgerNote)
+		if err != nil {
+			return TransferResult{}, false, err
+		}
+
+		var bucketID int64
+		err = tx.QueryRow(ctx, `
+			INSERT INTO balance_buckets (user_id, system_code, bucket_type, total_points, remaining_points, expires_at)
+			VALUES ($1, $2, $3, $4, $4, $5)
+			RETURNING id`, recipientID, systemCode, b.BucketType, amount, b.ExpiresAt).Scan(&bucketID)
+		if err != nil {
+			return TransferResult{}, false, err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id, note)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			recipientID, systemCode, bucketID, amount, "transfer_in", "transfer", transfer.ID, ledgerNote)
+		if err != nil {
+			return TransferResult{}, false, err
+		}
+		if err := s.settleDebt(ctx, tx, bucketID); err != nil {
+			return TransferResult{}, false, err
+		}
+		bucket, err := scanBucket(tx.QueryRow(ctx, `
+			SELECT id, user_id, bucket_type, total_points, remaining_points, expires_at, created_at, updated_at
+			FROM balance_buckets WHERE id = $1`, bucketID))
+		if err != nil {
+			return TransferResult{}, false, err
+		}
+		recipientBuckets = append(recipientBuckets, bucket)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return TransferResult{}, false, err
+	}
+	return TransferResult{Transfer: transfer, RecipientBuckets: recipientBuckets}, false, nil
+}
+
+// transferNotes 返回转赠记录和流水使用的备注
+// point_transfers.note 可为空，没有备注时写入 NULL；billing_ledger.note 不可为空，没有备注时写入空字符串
+func transferNotes(note string) (*string, string) {
+	note = strings.TrimSpace(note)
+	if note == "" {
+		return nil, ""
+	}
+	return &note, note
+}
+
+// transferRecipientBuckets 查询转赠中接收人获得的积分桶
+func (s *Service) transferRecipientBuckets(ctx context.Context, tx pgx.Tx, transferID int64) ([]models.BalanceBucket, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT b.id, b.user_id, b.bucket_type, b.total_points, b.remaining_points, b.expires_at, b.created_at, b.updated_at
+		FROM billing_ledger bl
+		JOIN balance_buckets b ON b.id = bl.bucket_id
+		WHERE bl.reference_type = 'transfer' AND bl.reference_id = $1 AND bl.reason = 'transfer_in'
+		ORDER BY b.id`, transferID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var buckets []models.BalanceBucket
+	for rows.Next() {
+		b, err := scanBucket(rows)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// ListTransfers 查询用户转出和收到的积分转赠记录
+func (s *Service) ListTransfers(ctx context.Context, userID int64) ([]models.PointTransfer, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT id, system_code, sender_id, recipient_id, points, transfer_key, note, created_at
+		FROM point_transfers
+		WHERE sender_id = $1 OR recipient_id = $1
+		ORDER BY id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var transfers []models.PointTransfer
+	for rows.Next() {
+		t, err := scanTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, t)
+	}
+	return transfers, rows.Err()
+}
+
+func scanTransfer(row pgx.Row) (models.PointTransfer, error) {
+	var t models.PointTransfer
+	err := row.Scan(&t.ID, &t.SystemCode, &t.SenderID, &t.RecipientID, &t.Points, &t.TransferKey, &t.Note, &t.CreatedAt)
+	return t, err
+}
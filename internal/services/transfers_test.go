@@ -0,0 +1,29 @@
+package services
+
+import "testing"
+
+func TestTransferNotes(t *testing.T) {
+	tests := []struct {
+		name       string
+		in         string
+		wantNote   *string
+		wantLedger string
+	}{
+		{name: "no note", in: "", wantLedger: ""},
+		{name: "blank note", in: "   ", wantLedger: ""},
+		{name: "note", in: " team budget ", wantNote: strPtr("team budget"), wantLedger: "team budget"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			note, ledger := transferNotes(tt.in)
+			if (note == nil) != (tt.wantNote == nil) || (note != nil && *note != *tt.wantNote) {
+				t.Fatalf("transfer note = %v, want %v", note, tt.wantNote)
+			}
+			if ledger != tt.wantLedger {
+				t.Fatalf("ledger note = %q, want %q", ledger, tt.wantLedger)
+			}
+		})
+	}
+}
+
+func strPtr(s string) *string { return &s }
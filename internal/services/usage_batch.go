@@ -0,0 +1,232 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"easyusersys/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// 批量用量上报中单条事件的处理结果
+const (
+	UsageResultCreated              = "created"
+	UsageResultDuplicate            = "duplicate"
+	UsageResultInsufficient         = "insufficient"
+	UsageResultSubscriptionRequired = "subscription_required"
+	UsageResultInvalid              = "invalid"
+	UsageResultInvalidAPIKey        = "invalid_api_key"
+	UsageResultAPIKeyLimit          = "api_key_limit_exceeded"
+	UsageResultError                = "error"
+)
+
+// UsageEvent 批量上报中的单条用量事件
+type UsageEvent struct {
+	UserID    int64  `json:"user_id"`
+	Units     int    `json:"units"`
+	RequestID string `json:"request_id"`
+	APIKey    string `json:"api_key,omitempty"` // 可选，调用方使用的原始 API Key，按其限额检查
+}
+
+// UsageEventResult 单条用量事件的处理结果，顺序与请求中的事件一致
+type UsageEventResult struct {
+	UserID    int64               `json:"user_id"`
+	RequestID string              `json:"request_id"`
+	Status    string              `json:"status"`
+	Usage     *models.UsageRecord `json:"usage,omitempty"`
+	Error     string              `json:"error,omitempty"`
+}
+
+// ReportUsageBatch 批量上报用量
+// 事件按用户分组，每个用户在独立事务中锁定积分桶并依次扣减；
+// 去重仍依赖 usage_records 的 UNIQUE(user_id, request_id)
+func (s *Service) ReportUsageBatch(ctx context.Context, events []UsageEvent) []UsageEventResult {
+	results := make([]UsageEventResult, len(events))
+	grouped := make(map[int64][]int)
+	for i, ev := range events {
+		results[i] = UsageEventResult{UserID: ev.UserID, RequestID: ev.RequestID}
+		if ev.UserID == 0 || ev.Units <= 0 || ev.RequestID == "" {
+			results[i].Status = UsageResultInvalid
+			results[i].Error = ErrInvalidRequest.Error()
+			continue
+		}
+		grouped[ev.UserID] = append(grouped[ev.UserID], i)
+	}
+
+	userIDs := make([]int64, 0, len(grouped))
+	for userID := range grouped {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Slice(userIDs, func(i, j int) bool { return userIDs[i] < userIDs[j] })
+
+	for _, userID := range userIDs {
+		indexes := grouped[userID]
+		if err := s.reportUserUsageBatch(ctx, userID, events, indexes, results); err != nil {
+			for _, idx := range indexes {
+				results[idx].Status = UsageResultError
+				results[idx].Error = err.Error()
+				results[idx].Usage = nil
+			}
+		}
+	}
+	return results
+}
+
+// reportUserUsageBatch 在单个事务内处理同一用户的所有用量事件
+func (s *Service) reportUserUsageBatch(ctx context.Context, userID int64, events []UsageEvent, indexes []int, results []UsageEventResult) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	drawOrder, allowed, err := s.usageBucketPolicy(ctx, tx, userID)
+	if errors.Is(err, ErrSubscriptionRequired) || errors.Is(err, ErrNotFound) {
+		status := UsageResultSubscriptionRequired
+		if errors.Is(err, ErrNotFound) {
+			status = UsageResultInvalid
+		}
+		for _, idx := range indexes {
+			results[idx].Status = status
+			results[idx].Error = err.Error()
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// 先锁定本批次用到的 API Key，再锁积分桶，与单条上报的加锁顺序一致
+	keys := make(map[string]*models.APIKey)
+	keyErrs := make(map[string]error)
+	for _, idx := range indexes {
+		raw := events[idx].APIKey
+		if raw == "" {
+			continue
+		}
+		if _, ok := keys[raw]; ok {
+			continue
+		}
+		if _, ok := keyErrs[raw]; ok {
+			continue
+		}
+		key, err := s.lockUsageAPIKey(ctx, tx, userID, raw)
+		if errors.Is(err, ErrAPIKeyInvalid) || errors.Is(err, ErrAPIKeyExpired) {
+			keyErrs[raw] = err
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		keys[raw] = key
+	}
+
+	buckets, err := s.lockBuckets(ctx, tx, userID, drawOrder, allowed)
+	if err != nil {
+		return err
+	}
+	before := availablePoints(buckets)
+	var maxShortfall float64 // 因积分不足失败的事件中最大的未满足积分
+
+	for _, idx := range indexes {
+		ev := events[idx]
+		costPoints := float64(ev.Units) * s.config.CostPerUnit
+		if err := keyErrs[ev.APIKey]; err != nil {
+			results[idx].Status = UsageResultInvalidAPIKey
+			results[idx].Error = err.Error()
+			continue
+		}
+		key := keys[ev.APIKey]
+		var keyID *int64
+		if key != nil {
+			keyID = &key.ID
+		}
+
+		// 每条事件使用保存点，余额不足或超出 API Key 限额时只回滚该事件
+		sp, err := tx.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		usage := models.UsageRecord{}
+		err = sp.QueryRow(ctx, `
+			INSERT INTO usage_records (user_id, system_code, units, cost_points, request_id, api_key_id)
+			SELECT id, system_code, $2, $3, $4, $5 FROM users WHERE id = $1
+			ON CONFLICT (user_id, request_id) DO NOTHING
+			RETURNING id, user_id, units, cost_points, request_id, api_key_id, recorded_at`,
+			userID, ev.Units, costPoints, ev.RequestID, keyID).Scan(&usage.ID, &usage.UserID, &usage.Units, &usage.CostPoints, &usage.RequestID, &usage.APIKeyID, &usage.RecordedAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			if err := sp.Rollback(ctx); err != nil {
+				return err
+			}
+			results[idx].Status = UsageResultDuplicate
+			results[idx].Error = ErrDuplicateRequest.Error()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if key != nil {
+			err := s.checkAPIKeyLimits(ctx, sp, *key, usage.ID, costPoints)
+			if errors.Is(err, ErrAPIKeyLimitExceeded) {
+				if err := sp.Rollback(ctx); err != nil {
+					return err
+				}
+				results[idx].Status = UsageResultAPIKeyLimit
+				results[idx].Error = err.Error()
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if shortfall := costPoints - availablePoints(buckets); shortfall > 0 {
+			headroom, err := s.debtHeadroom(ctx, sp, userID)
+			if err != nil {
+				return err
+			}
+			if shortfall > headroom {
+				if err := sp.Rollback(ctx); err != nil {
+					return err
+				}
+				maxShortfall = max(maxShortfall, shortfall)
+				results[idx].Status = UsageResultInsufficient
+				results[idx].Error = ErrInsufficientPoints.Error()
+				continue
+			}
+		}
+		remaining, err := s.deductFromBuckets(ctx, sp, buckets, userID, usage.ID, costPoints)
+		if err != nil {
+			return err
+		}
+		if err := s.chargeDebt(ctx, sp, userID, usage.ID, remaining); err != nil {
+			return err
+		}
+		if err := sp.Commit(ctx); err != nil {
+			return err
+		}
+		results[idx].Status = UsageResultCreated
+		results[idx].Usage = &usage
+	}
+	after := availablePoints(buckets)
+	if err := s.queueLowBalanceNotification(ctx, tx, userID, before, after); err != nil {
+		return err
+	}
+	if err := s.queueAutoTopUp(ctx, tx, userID, autoTopUpBalance(after, maxShortfall)); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// availablePoints 计算积分桶的剩余积分总和
+func availablePoints(buckets []models.BalanceBucket) float64 {
+	total := 0.0
+	for _, b := range buckets {
+		if b.RemainingPoints > 0 {
+			total += b.RemainingPoints
+		}
+	}
+	return total
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"context"
+	"errors"
+
+	"easyusersys/internal/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ReverseUsageInput 用量冲正参数
+type ReverseUsageInput struct {
+	UserID      int64
+	RequestID   string
+	ReversalKey string  // 幂等键，同一用量记录下重复提交返回已有冲正
+	Points      float64 // 为 0 时冲正全部剩余可退积分
+	Reason      string
+}
+
+// bucketRefund 某个积分桶上仍可退回的积分
+type bucketRefund struct {
+	BucketID   int64
+	BucketType string
+	Points     float64
+}
+
+// ReverseUsage 按 request_id 冲正用量，积分退回到扣费流水中记录的原积分桶
+// 透支部分退回欠款桶；欠款已被偿还的部分无法退回欠款桶，改为发放不过期的 promo 积分桶
+// 返回的 bool 表示是否为已存在的冲正（幂等重放）
+func (s *Service) ReverseUsage(ctx context.Context, in ReverseUsageInput) (models.UsageReversal, bool, error) {
+	if in.UserID == 0 || in.RequestID == "" || in.ReversalKey == "" || in.Points < 0 {
+		return models.UsageReversal{}, false, ErrInvalidRequest
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return models.UsageReversal{}, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var usageID int64
+	err = tx.QueryRow(ctx, `
+		SELECT id FROM usage_records
+		WHERE user_id = $1 AND request_id = $2
+		FOR UPDATE`, in.UserID, in.RequestID).Scan(&usageID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.UsageReversal{}, false, ErrNotFound
+	}
+	if err != nil {
+		return models.UsageReversal{}, false, err
+	}
+
+	var existing models.UsageReversal
+	err = tx.QueryRow(ctx, `
+		SELECT id, user_id, usage_record_id, reversal_key, points, reason, created_at
+		FROM usage_reversals
+		WHERE usage_record_id = $1 AND reversal_key = $2`, usageID, in.ReversalKey,
+	).Scan(&existing.ID, &existing.UserID, &existing.UsageRecordID, &existing.ReversalKey, &existing.Points, &existing.Reason, &existing.CreatedAt)
+	if err == nil {
+		return existing, true, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return models.UsageReversal{}, false, err
+	}
+
+	refunds, err := s.reversibleBuckets(ctx, tx, usageID)
+	if err != nil {
+		return models.UsageReversal{}, false, err
+	}
+	reversible := 0.0
+	for _, r := range refunds {
+		reversible += r.Points
+	}
+	points := in.Points
+	if points == 0 {
+		points = reversible
+	}
+	if points <= 0 || points > reversible {
+		return models.UsageReversal{}, false, ErrReversalExceedsUsage
+	}
+
+	var reversal models.UsageReversal
+	err = tx.QueryRow(ctx, `
+		INSERT INTO usage_reversals (user_id, system_code, usage_record_id, reversal_key, points, reason)
+		SELECT id, system_code, $2, $3, $4, $5 FROM users WHERE id = $1
+		RETURNING id, user_id, usage_record_id, reversal_key, points, reason, created_at`,
+		in.UserID, usageID, in.ReversalKey, points, in.Reason,
+	).Scan(&reversal.ID, &reversal.UserID, &reversal.UsageRecordID, &reversal.ReversalKey, &reversal.Points, &reversal.Reason, &reversal.CreatedAt)
+	if err != nil {
+		return models.UsageReversal{}, false, err
+	}
+
+	// 按扣费的逆序退回，先退回最后被扣减的积分桶
+	remaining := points
+	overflow := 0.0
+	for _, r := range refunds {
+		if remaining <= 0 {
+			break
+		}
+		restore := minFloat(r.Points, remaining)
+		remaining -= restore
+		if r.BucketType == models.BucketDebt {
+			var debtRemaining float64
+			if err := tx.QueryRow(ctx, `SELECT remaining_points FROM balance_buckets WHERE id = $1`, r.BucketID).Scan(&debtRemaining); err != nil {
+				return models.UsageReversal{}, false, err
+			}
+			var extra float64
+			restore, extra = splitDebtRestore(restore, debtRemaining)
+			overflow += extra
+		}
+		if restore <= 0 {
+			continue
+		}
+		if err := restoreUsageBucket(ctx, tx, in.UserID, r.BucketID, restore, reversal.ID); err != nil {
+			return models.UsageReversal{}, false, err
+		}
+	}
+	if overflow > 0 {
+		var bucketID int64
+		err = tx.QueryRow(ctx, `
+			INSERT INTO balance_buckets (user_id, system_code, bucket_type, total_points, remaining_points)
+			SELECT id, system_code, $2, $3, 0 FROM users WHERE id = $1
+			RETURNING id`, in.UserID, models.BucketPromo, overflow).Scan(&bucketID)
+		if err != nil {
+			return models.UsageReversal{}, false, err
+		}
+		if err := restoreUsageBucket(ctx, tx, in.UserID, bucketID, overflow, reversal.ID); err != nil {
+			return models.UsageReversal{}, false, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return models.UsageReversal{}, false, err
+	}
+	return reversal, false, nil
+}
+
+// restoreUsageBucket 将冲正积分退回积分桶并写入 usage_reversal 流水
+func restoreUsageBucket(ctx context.Context, tx pgx.Tx, userID, bucketID int64, points float64, reversalID int64) error {
+	_, err := tx.Exec(ctx, `
+		UPDATE balance_buckets
+		SET remaining_points = remaining_points + $1, updated_at = NOW()
+		WHERE id = $2`, points, bucketID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO billing_ledger (user_id, system_code, bucket_id, delta_points, reason, reference_type, reference_id)
+		SELECT id, system_code, $1, $2, $3, $4, $5 FROM users WHERE id = $6`,
+		bucketID, points, "usage_reversal", "usage_reversal", reversalID, userID)
+	return err
+}
+
+// splitDebtRestore 将透支部分的冲正积分拆分为退回欠款桶的积分和超出当前欠款的积分
+// debtRemaining 为欠款桶的剩余积分（负数），欠款桶退回后不能大于 0
+func splitDebtRestore(points, debtRemaining float64) (toDebt, overflow float64) {
+	toDebt = minFloat(points, max(-debtRemaining, 0))
+	return toDebt, points - toDebt
+}
+
+// reversibleBuckets 计算用量记录在各积分桶上扣减（含记为欠款的透支部分）且尚未退回的积分，按扣费逆序返回并锁定积分桶
+func (s *Service) reversibleBuckets(ctx context.Context, tx pgx.Tx, usageID int64) ([]bucketRefund, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT bl.bucket_id, b.bucket_type, -SUM(bl.delta_points)
+		FROM billing_ledger bl
+		JOIN balance_buckets b ON b.id = bl.bucket_id
+		WHERE bl.reference_type = 'usage' AND bl.reference_id = $1
+			AND bl.reason IN ('usage_deduction', 'credit_debt')
+		GROUP BY bl.bucket_id, b.bucket_type
+		ORDER BY MAX(bl.id) DESC`, usageID)
+	if err != nil {
+		return nil, err
+	}
+	deducted, err := pgx.CollectRows(rows, pgx.RowToStructByPos[bucketRefund])
+	if err != nil {
+		return nil, err
+	}
+	var reversed float64
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE(SUM(points), 0) FROM usage_reversals WHERE usage_record_id = $1`, usageID).Scan(&reversed)
+	if err != nil {
+		return nil, err
+	}
+	refunds := remainingRefunds(deducted, reversed)
+	var bucketIDs []int64
+	for _, r := range refunds {
+		bucketIDs = append(bucketIDs, r.BucketID)
+	}
+	if len(bucketIDs) > 0 {
+		if _, err := tx.Exec(ctx, `SELECT id FROM balance_buckets WHERE id = ANY($1) ORDER BY id FOR UPDATE`, bucketIDs); err != nil {
+			return nil, err
+		}
+	}
+	return refunds, nil
+}
+
+// remainingRefunds 从按扣费逆序排列的扣减中去掉已冲正的积分
+// 冲正总是按同样的顺序退回，已冲正的积分依次抵扣最后被扣减的积分桶
+func remainingRefunds(deducted []bucketRefund, reversed float64) []bucketRefund {
+	var refunds []bucketRefund
+	for _, d := range deducted {
+		used := minFloat(d.Points, max(reversed, 0))
+		reversed -= used
+		if d.Points-used > 0 {
+			d.Points -= used
+			refunds = append(refunds, d)
+		}
+	}
+	return refunds
+}
+
+// ListUsageReversals 查询某条用量记录的冲正历史
+func (s *Service) ListUsageReversals(ctx context.Context, userID int64, requestID string) ([]models.UsageReversal, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT ur.id, ur.user_id, ur.usage_record_id, ur.reversal_key, ur.points, ur.reason, ur.created_at
+		FROM usage_reversals ur
+		JOIN usage_records u ON u.id = ur.usage_record_id
+		WHERE u.user_id = $1 AND u.request_id = $2
+		ORDER BY ur.id`, userID, requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var reversals []models.UsageReversal
+	for rows.Next() {
+		var r models.UsageReversal
+		if err := rows.Scan(&r.ID, &r.UserID, &r.UsageRecordID, &r.ReversalKey, &r.Points, &r.Reason, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		reversals = append(reversals, r)
+	}
+	return reversals, rows.Err()
+}
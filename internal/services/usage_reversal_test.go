@@ -0,0 +1,66 @@
+package services
+
+import (
+	"slices"
+	"testing"
+
+	"easyusersys/internal/models"
+)
+
+func TestRemainingRefundsIncludesOverdraft(t *testing.T) {
+	// 用量先扣完 prepaid 积分桶（ID 3）的 40 积分，剩余 60 记为欠款（ID 9），按扣费逆序排列
+	deducted := []bucketRefund{
+		{BucketID: 9, BucketType: models.BucketDebt, Points: 60},
+		{BucketID: 3, BucketType: models.BucketPrepaid, Points: 40},
+	}
+	tests := []struct {
+		name     string
+		reversed float64
+		want     []bucketRefund
+	}{
+		{name: "nothing reversed", reversed: 0, want: deducted},
+		{
+			name:     "part of the overdraft reversed",
+			reversed: 25,
+			want: []bucketRefund{
+				{BucketID: 9, BucketType: models.BucketDebt, Points: 35},
+				{BucketID: 3, BucketType: models.BucketPrepaid, Points: 40},
+			},
+		},
+		{
+			name:     "overdraft fully reversed",
+			reversed: 70,
+			want:     []bucketRefund{{BucketID: 3, BucketType: models.BucketPrepaid, Points: 30}},
+		},
+		{name: "everything reversed", reversed: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := remainingRefunds(deducted, tt.reversed); !slices.Equal(got, tt.want) {
+				t.Fatalf("remainingRefunds() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitDebtRestore(t *testing.T) {
+	tests := []struct {
+		name          string
+		points        float64
+		debtRemaining float64
+		toDebt        float64
+		overflow      float64
+	}{
+		{name: "debt still outstanding", points: 30, debtRemaining: -60, toDebt: 30},
+		{name: "debt partly repaid", points: 30, debtRemaining: -10, toDebt: 10, overflow: 20},
+		{name: "debt fully repaid", points: 30, debtRemaining: 0, overflow: 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			toDebt, overflow := splitDebtRestore(tt.points, tt.debtRemaining)
+			if toDebt != tt.toDebt || overflow != tt.overflow {
+				t.Fatalf("splitDebtRestore() = %v, %v, want %v, %v", toDebt, overflow, tt.toDebt, tt.overflow)
+			}
+		})
+	}
+}
@@ -12,6 +12,8 @@ import (
 	"easyusersys/internal/config"
 	"easyusersys/internal/db"
 	httpapi "easyusersys/internal/http"
+	"easyusersys/internal/jobs"
+	"easyusersys/internal/payments"
 	"easyusersys/internal/services"
 	"github.com/joho/godotenv"
 )
@@ -36,11 +38,51 @@ func main() {
 	defer pool.Close()
 
 	svc := services.New(pool, cfg)
+
+	// 子命令：easyusersys reconcile [-system CODE] [-repair]
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		code := runReconcile(ctx, svc, os.Args[2:])
+		pool.Close()
+		os.Exit(code)
+	}
+
 	if err := svc.EnsureDefaultPlans(ctx); err != nil {
 		log.Fatalf("ensure plans failed: %v", err)
 	}
 
-	server := httpapi.NewServer(svc, cfg)
+	// 服务端与后台任务共用同一个支付平台实例（fake 模式的数据保存在内存中）
+	provider, err := payments.New(cfg)
+	if err != nil {
+		log.Fatalf("payment provider init failed: %v", err)
+	}
+	log.Printf("payment provider: %s", provider.Name())
+	alternatives, err := payments.NewAlternatives(cfg)
+	if err != nil {
+		log.Fatalf("payment provider init failed: %v", err)
+	}
+	for _, p := range alternatives {
+		log.Printf("additional payment provider: %s", p.Name())
+	}
+
+	server := httpapi.NewServer(svc, cfg, provider, alternatives...)
+
+	// 后台任务使用独立的 context，关闭时先停止任务再关闭连接池
+	jobsCtx, stopJobs := context.WithCancel(ctx)
+	jobsDone := make(chan struct{})
+	if cfg.SchedulerEnabled {
+		scheduler := jobs.NewScheduler(jobs.NewAdvisoryLockLeader(pool, cfg.SchedulerLockKey), 30*time.Second)
+		jobs.RegisterHousekeeping(scheduler, svc, cfg, provider)
+		if len(alternatives) > 0 {
+			jobs.RegisterPaymentPolling(scheduler, server.PollPendingPayments)
+		}
+		go func() {
+			defer close(jobsDone)
+			scheduler.Run(jobsCtx)
+		}()
+	} else {
+		close(jobsDone)
+	}
+
 	httpServer := &http.Server{
 		Addr:    cfg.ServerAddr,
 		Handler: server.Routes(),
@@ -62,4 +104,10 @@ func main() {
 	if err := httpServer.Shutdown(shutdownCtx); err != nil {
 		log.Printf("server shutdown error: %v", err)
 	}
+	stopJobs()
+	select {
+	case <-jobsDone:
+	case <-shutdownCtx.Done():
+		log.Printf("scheduler shutdown timed out")
+	}
 }
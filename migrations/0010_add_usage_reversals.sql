@@ -0,0 +1,19 @@
+-- 用量冲正记录表：按 request_id 退回已扣减的积分，支持部分冲正
+CREATE TABLE IF NOT EXISTS usage_reversals (
+	id BIGSERIAL PRIMARY KEY,
+	user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	system_code TEXT NOT NULL,
+	usage_record_id BIGINT NOT NULL REFERENCES usage_records(id) ON DELETE CASCADE,
+	reversal_key TEXT NOT NULL,
+	points DOUBLE PRECISION NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	UNIQUE(usage_record_id, reversal_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_usage_reversals_system_user ON usage_reversals(system_code, user_id);
+
+-- 加速按用量记录查找扣费流水
+CREATE INDEX IF NOT EXISTS idx_billing_ledger_reference ON billing_ledger(reference_type, reference_id);
+
+COMMENT ON TABLE usage_reversals IS '用量冲正记录（审计），reversal_key 用于幂等';
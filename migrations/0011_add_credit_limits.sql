@@ -0,0 +1,18 @@
+-- 信用额度（透支）：允许受信任账户余额为负，上限由 credit_limits 控制
+-- user_id 为空表示整个 system_code 的默认额度，否则为单个用户的额度
+CREATE TABLE IF NOT EXISTS credit_limits (
+	id BIGSERIAL PRIMARY KEY,
+	system_code TEXT NOT NULL,
+	user_id BIGINT REFERENCES users(id) ON DELETE CASCADE,
+	limit_points DOUBLE PRECISION NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_credit_limits_user ON credit_limits(user_id) WHERE user_id IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_credit_limits_system ON credit_limits(system_code) WHERE user_id IS NULL;
+
+-- 每个用户最多一个欠款桶（remaining_points 为负数）
+CREATE UNIQUE INDEX IF NOT EXISTS idx_balance_buckets_debt_user ON balance_buckets(user_id) WHERE bucket_type = 'debt';
+
+COMMENT ON TABLE credit_limits IS '信用额度：用户或系统级别的最大透支积分';
@@ -0,0 +1,4 @@
+-- 流水备注：记录管理员操作等场景下填写的原因说明
+ALTER TABLE billing_ledger ADD COLUMN IF NOT EXISTS note TEXT NOT NULL DEFAULT '';
+
+COMMENT ON COLUMN billing_ledger.note IS '备注，如管理员发放/调整积分时填写的原因';
@@ -0,0 +1,36 @@
+-- 优惠码：可兑换积分（promo 积分桶）或在 Checkout 中使用 Stripe 折扣
+CREATE TABLE IF NOT EXISTS coupons (
+	id BIGSERIAL PRIMARY KEY,
+	system_code TEXT NOT NULL,
+	code TEXT NOT NULL,
+	points DOUBLE PRECISION NOT NULL DEFAULT 0,
+	points_expiry_days INT NOT NULL DEFAULT 0,
+	stripe_coupon_id TEXT,
+	max_redemptions INT,
+	per_user_limit INT NOT NULL DEFAULT 1,
+	valid_from TIMESTAMPTZ,
+	valid_until TIMESTAMPTZ,
+	applies_to TEXT[] NOT NULL DEFAULT '{}',
+	active BOOLEAN NOT NULL DEFAULT TRUE,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	UNIQUE(system_code, code)
+);
+
+CREATE TABLE IF NOT EXISTS coupon_redemptions (
+	id BIGSERIAL PRIMARY KEY,
+	coupon_id BIGINT NOT NULL REFERENCES coupons(id) ON DELETE CASCADE,
+	user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	system_code TEXT NOT NULL,
+	bucket_id BIGINT REFERENCES balance_buckets(id) ON DELETE SET NULL,
+	order_id BIGINT REFERENCES orders(id) ON DELETE SET NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_coupon_redemptions_coupon_user ON coupon_redemptions(coupon_id, user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_coupon_redemptions_order ON coupon_redemptions(order_id) WHERE order_id IS NOT NULL;
+
+-- 订单关联的优惠码，支付成功后记入兑换记录
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS coupon_id BIGINT REFERENCES coupons(id) ON DELETE SET NULL;
+
+COMMENT ON COLUMN coupons.applies_to IS 'Checkout 折扣适用范围：计划名称或 prepaid，为空表示全部';
@@ -0,0 +1,25 @@
+-- 推荐计划：每个用户的推荐码，以及注册时记录的推荐关系
+ALTER TABLE users ADD COLUMN IF NOT EXISTS referral_code TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_system_referral_code ON users(system_code, referral_code) WHERE referral_code IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS referrals (
+	id BIGSERIAL PRIMARY KEY,
+	system_code TEXT NOT NULL,
+	referrer_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	referee_id BIGINT NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+	referral_code TEXT NOT NULL,
+	signup_ip TEXT,
+	email_domain TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	reject_reason TEXT,
+	order_id BIGINT REFERENCES orders(id) ON DELETE SET NULL,
+	referrer_points DOUBLE PRECISION NOT NULL DEFAULT 0,
+	referee_points DOUBLE PRECISION NOT NULL DEFAULT 0,
+	rewarded_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_referrals_referrer ON referrals(referrer_id);
+CREATE INDEX IF NOT EXISTS idx_referrals_system_ip ON referrals(system_code, signup_ip, created_at);
+
+COMMENT ON COLUMN referrals.status IS 'pending: 等待被推荐人首次付款; rewarded: 已发放奖励; rejected: 触发防刷规则';
@@ -0,0 +1,30 @@
+-- 用户之间的积分转赠
+CREATE TABLE IF NOT EXISTS point_transfers (
+	id BIGSERIAL PRIMARY KEY,
+	system_code TEXT NOT NULL,
+	sender_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	recipient_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	points DOUBLE PRECISION NOT NULL,
+	transfer_key TEXT NOT NULL,
+	note TEXT,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	UNIQUE(sender_id, transfer_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_point_transfers_sender_created ON point_transfers(sender_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_point_transfers_recipient ON point_transfers(recipient_id);
+
+-- 每个系统的转赠设置，没有记录时使用默认值（允许转赠 prepaid 积分，不限制额度）
+CREATE TABLE IF NOT EXISTS transfer_settings (
+	system_code TEXT PRIMARY KEY,
+	enabled BOOLEAN NOT NULL DEFAULT TRUE,
+	min_points DOUBLE PRECISION NOT NULL DEFAULT 0,
+	max_points_per_transfer DOUBLE PRECISION NOT NULL DEFAULT 0,
+	daily_limit_points DOUBLE PRECISION NOT NULL DEFAULT 0,
+	bucket_types TEXT[] NOT NULL DEFAULT '{prepaid}',
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+COMMENT ON COLUMN transfer_settings.max_points_per_transfer IS '单次转赠上限，0 表示不限制';
+COMMENT ON COLUMN transfer_settings.daily_limit_points IS '每个用户 24 小时内累计转出上限，0 表示不限制';
+COMMENT ON COLUMN transfer_settings.bucket_types IS '可转出的积分桶类型';
@@ -0,0 +1,6 @@
+-- 订单退款与拒付：记录累计退款/争议金额，以及已收回（含按策略免除）的积分
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS refunded_cents INT NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS disputed_cents INT NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS clawback_points DOUBLE PRECISION NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_orders_stripe_payment_intent_id ON orders(stripe_payment_intent_id);
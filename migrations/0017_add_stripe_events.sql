@@ -0,0 +1,14 @@
+-- Stripe Webhook 事件日志：按事件 ID 去重，保证每个事件只处理一次，失败事件可由管理员重放
+CREATE TABLE IF NOT EXISTS stripe_events (
+	id TEXT PRIMARY KEY,
+	event_type TEXT NOT NULL,
+	payload JSONB NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	attempts INT NOT NULL DEFAULT 0,
+	last_error TEXT,
+	processed_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_stripe_events_status_created ON stripe_events(status, created_at);
@@ -0,0 +1,2 @@
+-- 到期取消：用户取消后保留使用权直到 ends_at，Stripe 不再续费
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS cancel_at_period_end BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,7 @@
+-- 用户对应的 Stripe Customer，每次结账复用同一个 Customer，并用于打开 Billing Portal
+CREATE TABLE IF NOT EXISTS stripe_customers (
+	user_id BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+	system_code TEXT NOT NULL,
+	customer_id TEXT NOT NULL UNIQUE,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
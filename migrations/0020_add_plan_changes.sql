@@ -0,0 +1,15 @@
+-- 订阅换档记录
+CREATE TABLE IF NOT EXISTS plan_changes (
+	id BIGSERIAL PRIMARY KEY,
+	subscription_id BIGINT NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+	user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	system_code TEXT NOT NULL,
+	from_plan_id BIGINT NOT NULL REFERENCES plans(id),
+	to_plan_id BIGINT NOT NULL REFERENCES plans(id),
+	points_policy TEXT NOT NULL,
+	points_granted DOUBLE PRECISION NOT NULL DEFAULT 0,
+	changed_by BIGINT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_plan_changes_subscription ON plan_changes(subscription_id, created_at);
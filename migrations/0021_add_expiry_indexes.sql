@@ -0,0 +1,5 @@
+-- 后台过期任务使用的索引：只覆盖仍需处理的行
+CREATE INDEX IF NOT EXISTS idx_balance_buckets_expiring ON balance_buckets(expires_at)
+    WHERE remaining_points > 0 AND bucket_type <> 'debt';
+CREATE INDEX IF NOT EXISTS idx_subscriptions_open_ends_at ON subscriptions(ends_at)
+    WHERE status IN ('active', 'past_due');
@@ -0,0 +1,15 @@
+-- 免费积分周期刷新记录：每个用户每个周期最多发放一次
+CREATE TABLE IF NOT EXISTS free_refreshes (
+	id BIGSERIAL PRIMARY KEY,
+	system_code TEXT NOT NULL,
+	user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	period_start TIMESTAMPTZ NOT NULL,
+	bucket_id BIGINT REFERENCES balance_buckets(id),
+	points DOUBLE PRECISION NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	UNIQUE(user_id, period_start)
+);
+
+CREATE INDEX IF NOT EXISTS idx_free_refreshes_user_period ON free_refreshes(user_id, period_start DESC);
+
+COMMENT ON COLUMN free_refreshes.period_start IS '周期开始时间：自然月为当月 1 日（UTC），按天数刷新时为注册时间加整数个周期';
@@ -0,0 +1,34 @@
+-- 用户级通知设置，字段为空时使用系统配置（NOTIFICATION_CONFIGS）
+CREATE TABLE IF NOT EXISTS notification_settings (
+	user_id BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+	system_code TEXT NOT NULL,
+	enabled BOOLEAN NOT NULL DEFAULT TRUE,
+	low_balance_points DOUBLE PRECISION,
+	expiring_days INT,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+COMMENT ON COLUMN notification_settings.low_balance_points IS '余额低于该值时提醒，为空使用系统配置，0 表示不提醒';
+COMMENT ON COLUMN notification_settings.expiring_days IS '积分桶在该天数内过期时提醒，为空使用系统配置，0 表示不提醒';
+
+-- 待发送的邮件通知，dedup_key 保证同一事件只通知一次
+CREATE TABLE IF NOT EXISTS notifications (
+	id BIGSERIAL PRIMARY KEY,
+	system_code TEXT NOT NULL,
+	user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	kind TEXT NOT NULL,
+	dedup_key TEXT NOT NULL UNIQUE,
+	data JSONB NOT NULL DEFAULT '{}',
+	status TEXT NOT NULL DEFAULT 'pending',
+	attempts INT NOT NULL DEFAULT 0,
+	last_error TEXT,
+	sent_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_pending ON notifications(id) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_notifications_user_created ON notifications(user_id, created_at DESC);
+
+COMMENT ON COLUMN notifications.kind IS 'low_balance | expiring_points';
+COMMENT ON COLUMN notifications.dedup_key IS '低余额为 low_balance:{user_id}:{日期}，即将过期为 expiring_points:{bucket_id}';
@@ -0,0 +1,38 @@
+-- 自动充值设置：余额低于阈值时使用保存的支付方式扣款充值
+CREATE TABLE IF NOT EXISTS auto_topup_settings (
+	user_id BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+	system_code TEXT NOT NULL,
+	enabled BOOLEAN NOT NULL DEFAULT FALSE,
+	threshold_points DOUBLE PRECISION NOT NULL DEFAULT 0,
+	amount_cents INT NOT NULL DEFAULT 0,
+	payment_method_id TEXT,
+	consecutive_declines INT NOT NULL DEFAULT 0,
+	disabled_reason TEXT,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+COMMENT ON COLUMN auto_topup_settings.consecutive_declines IS '连续被拒付的次数，达到上限后自动关闭';
+COMMENT ON COLUMN auto_topup_settings.disabled_reason IS '被系统自动关闭的原因';
+
+-- 自动充值任务：扣费后余额低于阈值时写入，由后台任务异步扣款
+CREATE TABLE IF NOT EXISTS auto_topups (
+	id BIGSERIAL PRIMARY KEY,
+	system_code TEXT NOT NULL,
+	user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	amount_cents INT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	attempts INT NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	payment_intent_id TEXT,
+	order_id BIGINT REFERENCES orders(id),
+	last_error TEXT,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- 每个用户同时最多一个进行中的自动充值
+CREATE UNIQUE INDEX IF NOT EXISTS idx_auto_topups_user_open ON auto_topups(user_id) WHERE status IN ('pending', 'processing');
+CREATE INDEX IF NOT EXISTS idx_auto_topups_due ON auto_topups(next_attempt_at) WHERE status IN ('pending', 'processing');
+
+COMMENT ON COLUMN auto_topups.status IS 'pending | processing（已发起扣款，等待结果）| succeeded | failed';
@@ -0,0 +1,6 @@
+-- 订单使用的支付平台，NULL 表示主支付平台（PAYMENT_PROVIDER），退款与状态查询据此选择平台
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS payment_provider TEXT;
+
+-- 支付状态轮询任务使用的索引：只覆盖其他支付平台的待支付订单
+CREATE INDEX IF NOT EXISTS idx_orders_pending_provider ON orders(payment_provider, created_at)
+    WHERE status = 'pending' AND payment_provider IS NOT NULL;
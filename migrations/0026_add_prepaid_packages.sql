@@ -0,0 +1,25 @@
+-- 预充值积分包：管理员按系统配置价格、积分、赠送积分、有效期和上架时间
+CREATE TABLE IF NOT EXISTS prepaid_packages (
+	id BIGSERIAL PRIMARY KEY,
+	system_code TEXT NOT NULL,
+	name TEXT NOT NULL,
+	price_cents INT NOT NULL CHECK (price_cents > 0),
+	points DOUBLE PRECISION NOT NULL CHECK (points > 0),
+	bonus_points DOUBLE PRECISION NOT NULL DEFAULT 0 CHECK (bonus_points >= 0),
+	expiry_days INT NOT NULL DEFAULT 0,
+	available_from TIMESTAMPTZ,
+	available_until TIMESTAMPTZ,
+	active BOOLEAN NOT NULL DEFAULT TRUE,
+	sort_order INT NOT NULL DEFAULT 0,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_prepaid_packages_system ON prepaid_packages(system_code, sort_order);
+
+-- 订单购买的积分包，以及下单时确定的积分有效期（NULL 表示使用 PREPAID_EXPIRY_DAYS）
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS package_id BIGINT REFERENCES prepaid_packages(id) ON DELETE SET NULL;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS points_expiry_days INT;
+
+COMMENT ON COLUMN prepaid_packages.expiry_days IS '积分有效天数，0 表示使用 PREPAID_EXPIRY_DAYS';
+COMMENT ON COLUMN prepaid_packages.bonus_points IS '赠送积分，与 points 一起发放到同一个 prepaid 积分桶';
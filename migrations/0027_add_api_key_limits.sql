@@ -0,0 +1,13 @@
+-- API Key 限额：按天 / 按月的积分上限、单次请求最大消耗和过期时间，均为空表示不限制
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS daily_points_limit DOUBLE PRECISION;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS monthly_points_limit DOUBLE PRECISION;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS max_cost_per_request DOUBLE PRECISION;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS limit_window TEXT NOT NULL DEFAULT 'calendar';
+
+COMMENT ON COLUMN api_keys.limit_window IS '限额统计窗口：calendar 按 UTC 自然日 / 自然月，rolling 按最近 24 小时 / 30 天';
+
+-- 用量记录关联上报时使用的 API Key，用于统计每个 Key 的消耗
+ALTER TABLE usage_records ADD COLUMN IF NOT EXISTS api_key_id BIGINT REFERENCES api_keys(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_usage_records_api_key ON usage_records(api_key_id, recorded_at) WHERE api_key_id IS NOT NULL;
@@ -0,0 +1,3 @@
+-- 积分流水查询使用的索引：按用户 / 系统倒序游标分页
+CREATE INDEX IF NOT EXISTS idx_billing_ledger_user_id_desc ON billing_ledger(user_id, id DESC);
+CREATE INDEX IF NOT EXISTS idx_billing_ledger_system_id_desc ON billing_ledger(system_code, id DESC);
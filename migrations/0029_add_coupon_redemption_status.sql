@@ -0,0 +1,4 @@
+-- 优惠码兑换状态：Checkout 创建时预留（pending），订单支付成功后转为 redeemed，会话过期或失败时删除预留
+ALTER TABLE coupon_redemptions ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'redeemed';
+
+COMMENT ON COLUMN coupon_redemptions.status IS 'pending: Checkout 预留，占用兑换次数; redeemed: 已兑换';
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"easyusersys/internal/services"
+)
+
+// runReconcile 执行 reconcile 子命令，将对账报告以 JSON 输出到标准输出
+// 返回进程退出码：0 表示没有问题，1 表示报告中仍有问题，2 表示参数或执行错误
+func runReconcile(ctx context.Context, svc *services.Service, args []string) int {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	systemCode := fs.String("system", "", "只检查指定 system_code，默认检查全部系统")
+	repair := fs.Bool("repair", false, "修复可自动修复的问题后重新检查")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	report, err := svc.Reconcile(ctx, services.ReconcileOptions{SystemCode: *systemCode, Repair: *repair})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reconcile failed: %v\n", err)
+		return 2
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		fmt.Fprintf(os.Stderr, "encode report failed: %v\n", err)
+		return 2
+	}
+	if !report.Clean() {
+		return 1
+	}
+	return 0
+}